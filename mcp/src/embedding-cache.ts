@@ -0,0 +1,163 @@
+import { createHash } from 'crypto';
+
+export interface EmbeddingCache {
+    get(key: string): number[] | undefined;
+    set(key: string, embedding: number[]): void;
+    close?(): void;
+}
+
+// Bump when the key layout or stored vector format changes, so old entries stop matching.
+export const EMBEDDING_CACHE_VERSION = 2;
+
+// Keys cover everything that changes the vector, so switching model or dimension never
+// serves a vector computed under the previous configuration.
+export const embeddingCacheKey = (provider: string, model: string, text: string, dimension?: number): string =>
+    createHash('sha256')
+        .update(`v${EMBEDDING_CACHE_VERSION}\0${provider}\0${model}\0${dimension ?? ''}\0${text}`)
+        .digest('hex');
+
+// Identifies the embedding configuration a disk cache was filled under.
+export const embeddingCacheConfig = (provider: string, model: string, dimension?: number): string =>
+    `v${EMBEDDING_CACHE_VERSION}:${provider}:${model}:${dimension ?? 'default'}`;
+
+// In-memory cache that evicts the least recently used entry once `maxEntries` is reached.
+export class LruEmbeddingCache implements EmbeddingCache {
+    private entries = new Map<string, number[]>();
+
+    constructor(private maxEntries: number) {}
+
+    get(key: string): number[] | undefined {
+        const embedding = this.entries.get(key);
+        if (embedding) {
+            this.entries.delete(key);
+            this.entries.set(key, embedding);
+        }
+        return embedding;
+    }
+
+    set(key: string, embedding: number[]) {
+        this.entries.delete(key);
+        this.entries.set(key, embedding);
+        if (this.entries.size > this.maxEntries) {
+            const oldest = this.entries.keys().next().value;
+            if (oldest !== undefined) {
+                this.entries.delete(oldest);
+            }
+        }
+    }
+}
+
+type CacheStatement = {
+    get: (...params: unknown[]) => unknown;
+    run: (...params: unknown[]) => unknown;
+};
+
+type CacheDatabase = {
+    exec: (sql: string) => unknown;
+    prepare: (sql: string) => CacheStatement;
+    close: () => void;
+};
+
+type CacheDatabaseCtor = new (path: string) => CacheDatabase;
+
+export type SqliteEmbeddingCacheOptions = {
+    // Entries kept on disk; the oldest by created_at are pruned beyond it (0 keeps all).
+    maxEntries?: number;
+    // Age after which an entry is no longer served and is pruned (0 never expires).
+    maxAgeMs?: number;
+    now?: () => number;
+};
+
+// Disk-backed cache in a small SQLite file, so cached vectors survive restarts.
+// Vectors are stored as float32 blobs, the precision sqlite-vec queries use anyway.
+// When `config` differs from the one the file was filled under, its entries are dropped
+// and `invalidated` is set. Read and write failures (a locked or full disk, say) are
+// logged and treated as misses, so the cache never fails a query.
+export class SqliteEmbeddingCache implements EmbeddingCache {
+    private db: CacheDatabase;
+    private selectStatement: CacheStatement;
+    private upsertStatement: CacheStatement;
+    private expireStatement: CacheStatement;
+    private trimStatement: CacheStatement;
+    private maxEntries: number;
+    private maxAgeMs: number;
+    private now: () => number;
+    readonly invalidated: boolean = false;
+
+    constructor(Database: CacheDatabaseCtor, cachePath: string, config?: string, options: SqliteEmbeddingCacheOptions = {}) {
+        this.maxEntries = options.maxEntries ?? 0;
+        this.maxAgeMs = options.maxAgeMs ?? 0;
+        this.now = options.now ?? Date.now;
+        this.db = new Database(cachePath);
+        this.db.exec(`
+            CREATE TABLE IF NOT EXISTS embeddings (
+                cache_key TEXT PRIMARY KEY,
+                embedding BLOB NOT NULL,
+                created_at INTEGER NOT NULL
+            );
+            CREATE INDEX IF NOT EXISTS embeddings_created_at ON embeddings (created_at);
+            CREATE TABLE IF NOT EXISTS cache_meta (
+                key TEXT PRIMARY KEY,
+                value TEXT NOT NULL
+            )
+        `);
+        if (config !== undefined) {
+            const stored = this.db.prepare(`SELECT value FROM cache_meta WHERE key = 'config'`).get() as { value: string } | undefined;
+            if (stored?.value !== config) {
+                this.invalidated = stored !== undefined;
+                this.db.exec('DELETE FROM embeddings');
+                this.db.prepare(`INSERT OR REPLACE INTO cache_meta (key, value) VALUES ('config', ?)`).run(config);
+            }
+        }
+        this.selectStatement = this.db.prepare('SELECT embedding FROM embeddings WHERE cache_key = ? AND created_at >= ?');
+        this.upsertStatement = this.db.prepare(
+            'INSERT OR REPLACE INTO embeddings (cache_key, embedding, created_at) VALUES (?, ?, ?)'
+        );
+        this.expireStatement = this.db.prepare('DELETE FROM embeddings WHERE created_at < ?');
+        this.trimStatement = this.db.prepare(
+            'DELETE FROM embeddings WHERE cache_key IN (SELECT cache_key FROM embeddings ORDER BY created_at DESC LIMIT -1 OFFSET ?)'
+        );
+        this.prune();
+    }
+
+    // Entries created before this are expired; 0 when nothing expires.
+    private expiredBefore(): number {
+        return this.maxAgeMs > 0 ? this.now() - this.maxAgeMs : 0;
+    }
+
+    private prune() {
+        if (this.maxAgeMs > 0) {
+            this.expireStatement.run(this.expiredBefore());
+        }
+        if (this.maxEntries > 0) {
+            this.trimStatement.run(this.maxEntries);
+        }
+    }
+
+    get(key: string): number[] | undefined {
+        try {
+            const row = this.selectStatement.get(key, this.expiredBefore()) as { embedding: Buffer } | undefined;
+            if (!row) {
+                return undefined;
+            }
+            const { buffer, byteOffset, byteLength } = row.embedding;
+            return Array.from(new Float32Array(buffer.slice(byteOffset, byteOffset + byteLength)));
+        } catch (error) {
+            console.warn(`Warning: embedding cache read failed, treating it as a miss: ${error instanceof Error ? error.message : String(error)}`);
+            return undefined;
+        }
+    }
+
+    set(key: string, embedding: number[]) {
+        try {
+            this.upsertStatement.run(key, Buffer.from(new Float32Array(embedding).buffer), this.now());
+            this.prune();
+        } catch (error) {
+            console.warn(`Warning: embedding cache write failed; the embedding was not cached: ${error instanceof Error ? error.message : String(error)}`);
+        }
+    }
+
+    close() {
+        this.db.close();
+    }
+}
@@ -1,15 +1,15 @@
 #!/usr/bin/env node
 // src/index.ts
-import 'dotenv/config'; // Load .env file
+import * as dotenv from 'dotenv';
 import { McpServer } from "@modelcontextprotocol/sdk/server/mcp.js";
 import { ListToolsRequestSchema, CallToolRequestSchema } from "@modelcontextprotocol/sdk/types.js";
 import { AzureOpenAI } from "openai";
 import { StdioServerTransport } from "@modelcontextprotocol/sdk/server/stdio.js";
 import { StreamableHTTPServerTransport } from "@modelcontextprotocol/sdk/server/streamableHttp.js";
 import { SSEServerTransport } from "@modelcontextprotocol/sdk/server/sse.js";
-import express, { Request, Response } from "express";
+import express, { NextFunction, Request, Response } from "express";
 import { z } from "zod";
-import { randomUUID } from 'crypto';
+import { randomUUID, timingSafeEqual } from 'crypto';
 
 import * as sqliteVec from "sqlite-vec";
 import Database from "better-sqlite3";
@@ -19,25 +19,256 @@ import { QdrantClient } from '@qdrant/js-client-rest';
 import path from 'path';
 import { fileURLToPath } from 'url';
 import fs from 'fs'; // Import fs for checking file existence
-import { createQueryHandlers, createSqliteDbProvider, createQdrantProvider } from './server.js';
+import { parseArgs } from 'util';
+import { AsyncLocalStorage } from 'async_hooks';
+import {
+    createCachedLoader,
+    checkProductHealth,
+    HEALTH_DETAIL_MAX_AGE_MS,
+    createConnectionLimiter,
+    createKeyedSemaphore,
+    createTokenLedger,
+    createEmbeddingClients,
+    estimateTokens,
+    createQueryHandlers,
+    createSqliteDbProvider,
+    createQdrantProvider,
+    DEFAULT_MAX_QUERY_CHARS,
+    DEFAULT_RECENCY_HALF_LIFE_DAYS,
+    DEFAULT_RESULT_TEMPLATE,
+    DEFAULT_MIN_QUERY_LENGTH,
+    DEFAULT_MAX_CHUNK_IDS,
+    DEFAULT_MAX_EXCLUDE_CHUNK_IDS,
+    DEFAULT_MAX_VERSIONS,
+    DEFAULT_LIST_PRODUCTS_LIMIT,
+    DEFAULT_DB_BUSY_TIMEOUT_MS,
+    DEFAULT_DB_BUSY_RETRIES,
+    DEFAULT_DB_OPEN_RETRIES,
+    DEFAULT_EMBEDDING_MAX_RETRIES,
+    DEFAULT_EMBEDDING_RETRY_BASE_DELAY_MS,
+    DEFAULT_VALIDATION_QUERY,
+    DEFAULT_EXPORT_PAGE_SIZE,
+    MAX_EXPORT_PAGE_SIZE,
+    MAX_METADATA_BOOST,
+    MIN_METADATA_BOOST,
+    DEFAULT_FTS_TABLE,
+    DEFAULT_SPARSE_COLUMN,
+    DEFAULT_SPARSE_WEIGHT,
+    DEFAULT_SPARSE_MAX_SCAN_ROWS,
+    DEFAULT_MAX_EMBEDDING_DIMENSION,
+    DEFAULT_EMBEDDING_MAX_TOKENS,
+    KNOWN_MODEL_DIMENSIONS,
+    COHERE_INPUT_TYPES,
+    formatStartupBanner,
+    httpStatusForResponse,
+    toolError,
+    maskApiKey,
+    MAX_CANDIDATE_MULTIPLIER,
+    DEFAULT_AUTO_DETECT_MAX_PRODUCTS,
+    DEFAULT_AUTO_DETECT_MIN_SIMILARITY,
+    PRODUCTS_MANIFEST_FILE,
+    normalizeAzureEndpoint,
+    parseModelDimensions,
+    parseProductManifest,
+    parseDatabaseUris,
+    parseQueryMessages,
+    parseRedactPatterns,
+    parseCompositeWeights,
+    parseQueryPreprocess,
+    parseResultTemplate,
+    parseSparseVector,
+    parseVecColumns,
+    preprocessQuery,
+    resolveConfigValue,
+    retryWithBackoff,
+    isTransientEmbeddingError,
+    createLogger,
+    LOG_LEVELS,
+    truncateForEmbedding,
+    withConcurrencyLimit,
+    HOST_BYTE_ORDER,
+    ByteOrder,
+    CohereInputType,
+    VectorQuantization,
+    DefaultVersionStrategy,
+    KeywordSearch,
+    LogFormat,
+    LogLevel,
+    ProductManifestEntry,
+    ProductHealth,
+    QueryCollection,
+    QueryLengthMode,
+    QueryTrimMode,
+    ResultTemplate,
+    SparseVector,
+    TruncateStrategy,
+    QueryPreprocessStep,
+    QueryMessages,
+    EmbeddingSource,
+    CompositeWeights,
+    ConfigSource,
+    ToolCallExtra,
+    VecColumn,
+} from './server.js';
+import { metrics } from './metrics.js';
+import { EmbeddingCache, embeddingCacheConfig, embeddingCacheKey, LruEmbeddingCache, SqliteEmbeddingCache } from './embedding-cache.js';
 
 // --- Configuration & Environment Check ---
 
 const __filename = fileURLToPath(import.meta.url);
 const __dirname = path.dirname(__filename);
 
+// Command-line flags override environment variables, which override values from
+// the .env file (dotenv never replaces variables that are already set).
+const usage = `Usage: doc-query [options]
+
+Options:
+  --provider <name>    Embedding provider (overrides EMBEDDING_PROVIDER)
+  --port <port>        HTTP/SSE port (overrides PORT)
+  --transport <type>   Transport type: stdio, sse, or http (overrides TRANSPORT_TYPE)
+  --db-dir <path>      Directory containing SQLite databases (overrides SQLITE_DB_DIR)
+  --env-file <path>    Load environment variables from this file instead of ./.env (overrides ENV_FILE)
+  -h, --help           Show this help message`;
+
+let flags: { provider?: string; port?: string; transport?: string; 'db-dir'?: string; 'env-file'?: string; help?: boolean };
+try {
+    flags = parseArgs({
+        options: {
+            provider: { type: 'string' },
+            port: { type: 'string' },
+            transport: { type: 'string' },
+            'db-dir': { type: 'string' },
+            'env-file': { type: 'string' },
+            help: { type: 'boolean', short: 'h' },
+        },
+    }).values;
+} catch (error) {
+    console.error(`Error: ${error instanceof Error ? error.message : String(error)}\n\n${usage}`);
+    process.exit(1);
+}
+
+if (flags.help) {
+    console.error(usage);
+    process.exit(0);
+}
+
+// Variables exported before the .env file is loaded, used to report where settings came from.
+const shellEnvNames = new Set(Object.keys(process.env));
+
+// Load the .env file. An explicitly configured file must exist; the default ./.env is optional.
+const envFile = flags['env-file'] || process.env.ENV_FILE;
+if (envFile) {
+    if (!fs.existsSync(envFile)) {
+        console.error(`Error: env file ${envFile} does not exist.`);
+        process.exit(1);
+    }
+    dotenv.config({ path: envFile });
+} else {
+    dotenv.config();
+}
+
+// DEBUG_CONFIG=true logs every setting and where it came from (see configSetting and logEnvSettings).
+const debugConfig = process.env.DEBUG_CONFIG === 'true';
+
+// Names of the environment variables read while the configuration loads. Recorded only
+// with DEBUG_CONFIG, which swaps process.env for a proxy that notes each read.
+const readEnvNames = new Set<string>();
+if (debugConfig) {
+    process.env = new Proxy(process.env, {
+        get(target, name) {
+            if (typeof name === 'string') {
+                readEnvNames.add(name);
+            }
+            return Reflect.get(target, name);
+        },
+    });
+}
+
+// Format of the startup summary line: `text` key=value pairs or a `json` object
+const logFormat = (process.env.LOG_FORMAT || 'text') as LogFormat;
+if (logFormat !== 'text' && logFormat !== 'json') {
+    console.error(`Error: LOG_FORMAT '${logFormat}' must be 'text' or 'json'.`);
+    process.exit(1);
+}
+
+// Per-query database details log at debug; errors and the query summary stay visible at info.
+const logLevel = (process.env.LOG_LEVEL || 'info') as LogLevel;
+if (!LOG_LEVELS.includes(logLevel)) {
+    console.error(`Error: LOG_LEVEL '${logLevel}' must be one of ${LOG_LEVELS.join(', ')}.`);
+    process.exit(1);
+}
+const logger = createLogger(logLevel);
+
+// With DEBUG_CONFIG=true, each flag-backed setting logs its effective value and source as
+// it is read, and logEnvSettings lists every other variable the configuration read.
+const configOrigin = (source: ConfigSource, flag?: string): string =>
+    source === 'flag' ? `flag --${flag}` : source === 'env' ? 'environment' : source === 'file' ? `env file ${envFile || '.env'}` : 'default';
+const flagSettingNames = new Set<string>();
+const configSetting = (flag: string, flagValue: string | undefined, envName: string, defaultValue?: string): string | undefined => {
+    const { value, source } = resolveConfigValue(flagValue, envName, process.env, shellEnvNames, defaultValue);
+    if (debugConfig) {
+        flagSettingNames.add(envName);
+        console.error(`[config] ${envName}=${value ?? '(unset)'} (from ${configOrigin(source, flag)})`);
+    }
+    return value;
+};
+if (debugConfig) {
+    const fromFile = Object.keys(process.env).filter((name) => !shellEnvNames.has(name)).sort();
+    console.error(`[config] Variables loaded from env file ${envFile || '.env'}: ${fromFile.length > 0 ? fromFile.join(', ') : '(none)'}`);
+}
+
+// Logs each variable the configuration read that configSetting did not already log. Unset
+// ones use their default, which the startup banner shows; secrets are masked.
+function logEnvSettings() {
+    for (const name of Array.from(readEnvNames).sort()) {
+        if (flagSettingNames.has(name) || name === 'DEBUG_CONFIG') {
+            continue;
+        }
+        const { value, source } = resolveConfigValue(undefined, name, process.env, shellEnvNames);
+        const shown = /KEY|TOKEN|SECRET|PASSWORD/.test(name) ? maskApiKey(value) : value;
+        console.error(`[config] ${name}=${shown ?? '(unset)'} (from ${configOrigin(source)})`);
+    }
+}
+
 // Provider configuration
 // Note: Anthropic does not provide an embeddings API, only text generation
-// Supported providers: 'openai', 'azure', 'gemini'
-const embeddingProvider = process.env.EMBEDDING_PROVIDER || 'openai';
+// Supported providers: 'openai', 'azure', 'gemini', 'voyage', 'cohere', 'ollama'
+const embeddingProvider = configSetting('provider', flags.provider, 'EMBEDDING_PROVIDER', 'openai')!;
+
+// Optional secondary provider used when the primary provider fails. It uses the
+// same provider-specific keys as when configured as the primary provider.
+const fallbackProvider = process.env.FALLBACK_PROVIDER;
+// Providers that query_documentation callers may pick per query, for corpora indexed with
+// different models. The primary provider is always allowed.
+const queryProviders = Array.from(new Set([
+    embeddingProvider,
+    ...(process.env.QUERY_PROVIDERS || '').split(',').map((provider) => provider.trim()).filter(Boolean),
+]));
+// Expected vector dimension; when unset, the dimension of the first primary embedding is used.
+const embeddingDimension = process.env.EMBEDDING_DIMENSION ? parseInt(process.env.EMBEDDING_DIMENSION, 10) : undefined;
 
 // OpenAI configuration
 const openAIApiKey = process.env.OPENAI_API_KEY;
 const openAIModel = process.env.OPENAI_MODEL || 'text-embedding-3-large';
+// Output size requested from text-embedding-3 models, to match databases built with shortened
+// vectors (0 keeps the model's native dimension)
+const openAIDimensions = Number(process.env.OPENAI_DIMENSIONS || '0');
+if (!Number.isInteger(openAIDimensions) || openAIDimensions < 0) {
+    console.error(`Error: OPENAI_DIMENSIONS must be a non-negative integer, got '${process.env.OPENAI_DIMENSIONS}'.`);
+    process.exit(1);
+}
 
 // Azure OpenAI configuration
 const azureApiKey = process.env.AZURE_OPENAI_KEY;
-const azureEndpoint = process.env.AZURE_OPENAI_ENDPOINT;
+let azureEndpoint = process.env.AZURE_OPENAI_ENDPOINT;
+if (azureEndpoint && (queryProviders.includes('azure') || fallbackProvider === 'azure')) {
+    try {
+        azureEndpoint = normalizeAzureEndpoint(azureEndpoint);
+    } catch (error) {
+        console.error(`Error: ${error instanceof Error ? error.message : String(error)}`);
+        process.exit(1);
+    }
+}
 const azureApiVersion = process.env.AZURE_OPENAI_API_VERSION || '2024-10-21';
 const azureDeploymentName = process.env.AZURE_OPENAI_DEPLOYMENT_NAME || 'text-embedding-3-large';
 
@@ -45,12 +276,338 @@ const azureDeploymentName = process.env.AZURE_OPENAI_DEPLOYMENT_NAME || 'text-em
 const geminiApiKey = process.env.GEMINI_API_KEY;
 const geminiModel = process.env.GEMINI_MODEL || 'gemini-embedding-001';
 
-const dbDir = process.env.SQLITE_DB_DIR || __dirname; // Default to current dir if not set
+// Voyage AI configuration
+const voyageApiKey = process.env.VOYAGE_API_KEY;
+const voyageModel = process.env.VOYAGE_MODEL || 'voyage-3';
+
+// Cohere configuration. Embed v3 models embed queries and documents differently, so the
+// input type must match how the database side was embedded: search_query for queries.
+const cohereApiKey = process.env.COHERE_API_KEY;
+const cohereModel = process.env.COHERE_MODEL || 'embed-english-v3.0';
+const cohereInputType = (process.env.COHERE_INPUT_TYPE || 'search_query') as CohereInputType;
+if (!COHERE_INPUT_TYPES.includes(cohereInputType)) {
+    console.error(`Error: COHERE_INPUT_TYPE '${cohereInputType}' must be one of ${COHERE_INPUT_TYPES.join(', ')}.`);
+    process.exit(1);
+}
+
+// Ollama configuration, for air-gapped deployments embedding with a local server
+const ollamaBaseUrl = (process.env.OLLAMA_BASE_URL || 'http://localhost:11434').replace(/\/+$/, '');
+const ollamaModel = process.env.OLLAMA_MODEL || 'nomic-embed-text';
+
+// What to do with input over the model's token limit: `error` leaves it to the provider to
+// reject; `head`, `tail` and `middle` choose which part is kept before embedding
+const truncateStrategy = (process.env.TRUNCATE_STRATEGY || 'error') as TruncateStrategy;
+if (!['error', 'head', 'tail', 'middle'].includes(truncateStrategy)) {
+    console.error(`Error: TRUNCATE_STRATEGY '${truncateStrategy}' must be one of: error, head, tail, middle.`);
+    process.exit(1);
+}
+// Known output dimension per model, used to validate databases at startup without an embedding call
+let modelDimensions: Record<string, number> = KNOWN_MODEL_DIMENSIONS;
+try {
+    modelDimensions = { ...KNOWN_MODEL_DIMENSIONS, ...parseModelDimensions(process.env.MODEL_DIMENSIONS) };
+} catch (error) {
+    console.error(`Error: ${error instanceof Error ? error.message : String(error)}`);
+    process.exit(1);
+}
+
+// Token limit of the configured model; defaults to the limit of each provider's default model
+const embeddingMaxTokens = process.env.EMBEDDING_MAX_TOKENS ? Number(process.env.EMBEDDING_MAX_TOKENS) : undefined;
+if (embeddingMaxTokens !== undefined && (!Number.isInteger(embeddingMaxTokens) || embeddingMaxTokens <= 0)) {
+    console.error(`Error: EMBEDDING_MAX_TOKENS must be a positive integer, got '${process.env.EMBEDDING_MAX_TOKENS}'.`);
+    process.exit(1);
+}
+
+const dbDir = configSetting('db-dir', flags['db-dir'], 'SQLITE_DB_DIR', __dirname)!; // Default to current dir if not set
 const vectorDbType = (process.env.VECTOR_DB_TYPE || 'sqlite').toLowerCase();
 
+// Byte order of the float32 vectors stored in SQLite. sqlite-vec reads them in host order,
+// so databases in the other order are refused rather than queried
+const vectorByteOrder = (process.env.VECTOR_BYTE_ORDER || 'little') as ByteOrder;
+if (!['little', 'big'].includes(vectorByteOrder)) {
+    console.error(`Error: VECTOR_BYTE_ORDER '${vectorByteOrder}' must be 'little' or 'big'.`);
+    process.exit(1);
+}
+if (vectorByteOrder !== HOST_BYTE_ORDER) {
+    console.warn(`Warning: VECTOR_BYTE_ORDER=${vectorByteOrder} does not match this ${HOST_BYTE_ORDER}-endian host; float32 databases without a matching byte_order in vec_items_info will be refused.`);
+}
+
+// Quantization of the vectors stored in SQLite; int8 databases get int8 query vectors
+const vectorQuantization = (process.env.VECTOR_QUANTIZATION || 'none') as VectorQuantization;
+if (!['none', 'int8'].includes(vectorQuantization)) {
+    console.error(`Error: VECTOR_QUANTIZATION '${vectorQuantization}' must be 'none' or 'int8'.`);
+    process.exit(1);
+}
+
+let vecColumns: VecColumn[] = [];
+try {
+    vecColumns = parseVecColumns(process.env.VEC_COLUMNS);
+} catch (error) {
+    console.error(`Error: ${error instanceof Error ? error.message : String(error)}`);
+    process.exit(1);
+}
+
+// Query normalization applied before embedding; should mirror what was done at index time
+let queryPreprocessSteps: QueryPreprocessStep[] = [];
+try {
+    queryPreprocessSteps = parseQueryPreprocess(process.env.QUERY_PREPROCESS);
+} catch (error) {
+    console.error(`Error: ${error instanceof Error ? error.message : String(error)}`);
+    process.exit(1);
+}
+
+// Custom plain-text layout for each result; a literal "\n" in the value is read as a newline
+const unescapeNewlines = (value: string): string => value.replace(/\\n/g, '\n');
+let resultTemplate: ResultTemplate | undefined;
+if (process.env.RESULT_TEMPLATE || process.env.RESULT_SEPARATOR) {
+    try {
+        resultTemplate = parseResultTemplate(
+            unescapeNewlines(process.env.RESULT_TEMPLATE || DEFAULT_RESULT_TEMPLATE),
+            unescapeNewlines(process.env.RESULT_SEPARATOR ?? '\n')
+        );
+    } catch (error) {
+        console.error(`Error: ${error instanceof Error ? error.message : String(error)}`);
+        process.exit(1);
+    }
+}
+
+// Replacement user-facing strings (e.g. translations); NO_RESULTS_MESSAGE overrides the file's noResults
+let messages: QueryMessages = {};
+if (process.env.MESSAGES_FILE) {
+    try {
+        messages = parseQueryMessages(fs.readFileSync(process.env.MESSAGES_FILE, 'utf8'));
+    } catch (error) {
+        console.error(`Error: unable to load MESSAGES_FILE ${process.env.MESSAGES_FILE}: ${error instanceof Error ? error.message : String(error)}`);
+        process.exit(1);
+    }
+}
+if (process.env.NO_RESULTS_MESSAGE) {
+    messages.noResults = unescapeNewlines(process.env.NO_RESULTS_MESSAGE);
+}
+
+// Regular expressions whose matches in returned chunk content are replaced with [REDACTED]
+let redactPatterns: RegExp[] = [];
+try {
+    redactPatterns = parseRedactPatterns(process.env.REDACT_PATTERNS);
+} catch (error) {
+    console.error(`Error: ${error instanceof Error ? error.message : String(error)}`);
+    process.exit(1);
+}
+
+// Signal weights for query_documentation's composite ranking; recency reads RECENCY_COLUMN
+let compositeWeights: CompositeWeights;
+try {
+    compositeWeights = parseCompositeWeights(process.env.COMPOSITE_WEIGHTS);
+} catch (error) {
+    console.error(`Error: ${error instanceof Error ? error.message : String(error)}`);
+    process.exit(1);
+}
+const recencyColumn = process.env.RECENCY_COLUMN || undefined;
+if (recencyColumn && !/^[A-Za-z_][A-Za-z0-9_]*$/.test(recencyColumn)) {
+    console.error(`Error: RECENCY_COLUMN '${recencyColumn}' must be a valid column name.`);
+    process.exit(1);
+}
+if (compositeWeights.recency > 0 && !recencyColumn) {
+    console.error('Error: COMPOSITE_WEIGHTS gives recency a weight, but RECENCY_COLUMN is not set.');
+    process.exit(1);
+}
+const recencyHalfLifeDays = Number(process.env.RECENCY_HALF_LIFE_DAYS || String(DEFAULT_RECENCY_HALF_LIFE_DAYS));
+if (!(recencyHalfLifeDays > 0)) {
+    console.error(`Error: RECENCY_HALF_LIFE_DAYS must be a positive number, got '${process.env.RECENCY_HALF_LIFE_DAYS}'.`);
+    process.exit(1);
+}
+
 const qdrantUrl = process.env.QDRANT_URL || 'http://localhost:6333';
 const qdrantApiKey = process.env.QDRANT_API_KEY;
 
+// Reads a count or millisecond setting, exiting on anything but a non-negative integer;
+// where 0 is allowed it disables the limit.
+const nonNegativeIntegerSetting = (name: string, defaultValue: number): number => {
+    const value = Number(process.env[name] || String(defaultValue));
+    if (!Number.isInteger(value) || value < 0) {
+        console.error(`Error: ${name} must be a non-negative integer, got '${process.env[name]}'.`);
+        process.exit(1);
+    }
+    return value;
+};
+
+// Query text limits
+const maxQueryChars = nonNegativeIntegerSetting('MAX_QUERY_CHARS', DEFAULT_MAX_QUERY_CHARS);
+const queryLengthMode: QueryLengthMode = process.env.QUERY_LENGTH_MODE === 'truncate' ? 'truncate' : 'reject';
+const minQueryLength = parseInt(process.env.MIN_QUERY_LENGTH || String(DEFAULT_MIN_QUERY_LENGTH), 10);
+// Leading/trailing whitespace is trimmed by default; `collapse` also squeezes internal runs
+const queryTrimMode: QueryTrimMode = process.env.TRIM_QUERY === 'collapse' || process.env.TRIM_QUERY === 'none'
+    ? process.env.TRIM_QUERY
+    : 'edges';
+
+// Time budget for query_all_products fan-out (0 waits for every product)
+const deadlineMs = parseInt(process.env.DEADLINE_MS || '0', 10);
+
+// Interface the HTTP/SSE server binds to; unset binds all interfaces
+const listenHost = process.env.LISTEN_HOST || '';
+
+// Endpoint paths for the HTTP and SSE transports, e.g. to run several instances behind one host
+const endpointPath = (name: string, defaultPath: string): string => {
+    const value = process.env[name] || defaultPath;
+    if (!value.startsWith('/')) {
+        console.error(`Error: ${name} '${value}' must start with '/'.`);
+        process.exit(1);
+    }
+    return value.length > 1 ? value.replace(/\/+$/, '') : value;
+};
+const httpPath = endpointPath('HTTP_PATH', '/mcp');
+const ssePath = endpointPath('SSE_PATH', '/sse');
+const sseMessagesPath = endpointPath('SSE_MESSAGES_PATH', '/messages');
+
+// Answer HTTP transport POSTs with JSON bodies whose status reflects tool errors (400, 404, 429, 503)
+const httpErrorStatus = process.env.HTTP_ERROR_STATUS === 'true';
+
+// Per-database cap on concurrent vector searches (0 disables the limit)
+const maxConcurrentPerProduct = nonNegativeIntegerSetting('MAX_CONCURRENT_PER_PRODUCT', 0);
+const concurrencyWaitMs = nonNegativeIntegerSetting('CONCURRENCY_WAIT_MS', 5000);
+
+// Global cap on outbound embedding requests, so inbound bursts queue instead of hitting provider rate limits
+const maxConcurrentEmbeddings = parseInt(process.env.MAX_CONCURRENT_EMBEDDINGS || '0', 10);
+const embeddingWaitMs = parseInt(process.env.EMBEDDING_WAIT_MS || '30000', 10);
+
+// Retries of embedding requests that hit a rate limit, server error or timeout, backing off
+// exponentially from EMBEDDING_RETRY_BASE_DELAY milliseconds
+const embeddingMaxRetries = Number(process.env.EMBEDDING_MAX_RETRIES || String(DEFAULT_EMBEDDING_MAX_RETRIES));
+if (!Number.isInteger(embeddingMaxRetries) || embeddingMaxRetries < 0) {
+    console.error(`Error: EMBEDDING_MAX_RETRIES must be a non-negative integer, got '${process.env.EMBEDDING_MAX_RETRIES}'.`);
+    process.exit(1);
+}
+const embeddingRetryBaseDelayMs = Number(process.env.EMBEDDING_RETRY_BASE_DELAY || String(DEFAULT_EMBEDDING_RETRY_BASE_DELAY_MS));
+if (!Number.isInteger(embeddingRetryBaseDelayMs) || embeddingRetryBaseDelayMs < 0) {
+    console.error(`Error: EMBEDDING_RETRY_BASE_DELAY must be a non-negative integer, got '${process.env.EMBEDDING_RETRY_BASE_DELAY}'.`);
+    process.exit(1);
+}
+
+// Deadline for the embedding requests of one tool call (0 leaves it to the client's cancellation)
+const requestTimeoutMs = Number(process.env.REQUEST_TIMEOUT_MS || '0');
+if (!Number.isInteger(requestTimeoutMs) || requestTimeoutMs < 0) {
+    console.error(`Error: REQUEST_TIMEOUT_MS must be a non-negative integer, got '${process.env.REQUEST_TIMEOUT_MS}'.`);
+    process.exit(1);
+}
+
+// Cap on embedding tokens one MCP session may spend on provider calls (0 disables the cap)
+const maxTokensPerSession = Number(process.env.MAX_TOKENS_PER_SESSION || '0');
+if (!Number.isInteger(maxTokensPerSession) || maxTokensPerSession < 0) {
+    console.error(`Error: MAX_TOKENS_PER_SESSION must be a non-negative integer, got '${process.env.MAX_TOKENS_PER_SESSION}'.`);
+    process.exit(1);
+}
+
+// FTS5 table used by query_documentation's keyword mode
+const ftsTable = process.env.FTS_TABLE || DEFAULT_FTS_TABLE;
+if (!/^[A-Za-z_][A-Za-z0-9_]*$/.test(ftsTable)) {
+    console.error(`Error: FTS_TABLE '${ftsTable}' must be a valid SQL identifier.`);
+    process.exit(1);
+}
+
+// Sparse (SPLADE) search: enabled by SPARSE_ENCODER_URL, a service that turns query text
+// into a sparse vector. Results are fused with dense results using SPARSE_WEIGHT.
+const sparseEncoderUrl = process.env.SPARSE_ENCODER_URL;
+const sparseColumn = process.env.SPARSE_COLUMN || DEFAULT_SPARSE_COLUMN;
+if (!/^[A-Za-z_][A-Za-z0-9_]*$/.test(sparseColumn)) {
+    console.error(`Error: SPARSE_COLUMN '${sparseColumn}' must be a valid SQL identifier.`);
+    process.exit(1);
+}
+// Rows one sparse search scores (0 scores every row matching the filters)
+const sparseMaxScanRows = nonNegativeIntegerSetting('SPARSE_MAX_SCAN_ROWS', DEFAULT_SPARSE_MAX_SCAN_ROWS);
+const sparseWeight = Number(process.env.SPARSE_WEIGHT || DEFAULT_SPARSE_WEIGHT);
+if (!Number.isFinite(sparseWeight) || sparseWeight < 0 || sparseWeight > 1) {
+    console.error(`Error: SPARSE_WEIGHT must be a number between 0 and 1.`);
+    process.exit(1);
+}
+// Deadline for one sparse encoder request (0 leaves it to the tool call's signal)
+const sparseEncoderTimeoutMs = Number(process.env.SPARSE_ENCODER_TIMEOUT_MS || '10000');
+if (!Number.isInteger(sparseEncoderTimeoutMs) || sparseEncoderTimeoutMs < 0) {
+    console.error(`Error: SPARSE_ENCODER_TIMEOUT_MS must be a non-negative integer, got '${process.env.SPARSE_ENCODER_TIMEOUT_MS}'.`);
+    process.exit(1);
+}
+
+// Default similarity floor for route_query; products whose best match is below it are not offered
+const routeMinSimilarity = Number(process.env.ROUTE_MIN_SIMILARITY || '0');
+if (!Number.isFinite(routeMinSimilarity) || routeMinSimilarity < 0 || routeMinSimilarity > 1) {
+    console.error(`Error: ROUTE_MIN_SIMILARITY must be a number between 0 and 1.`);
+    process.exit(1);
+}
+
+// With AUTO_DETECT_PRODUCT=true, query_documentation without productName or dbName searches the
+// single product whose best match clears AUTO_DETECT_MIN_SIMILARITY, probing at most
+// AUTO_DETECT_MAX_PRODUCTS products.
+const autoDetectProduct = process.env.AUTO_DETECT_PRODUCT === 'true';
+const autoDetectMinSimilarity = Number(process.env.AUTO_DETECT_MIN_SIMILARITY || String(DEFAULT_AUTO_DETECT_MIN_SIMILARITY));
+if (!Number.isFinite(autoDetectMinSimilarity) || autoDetectMinSimilarity < 0 || autoDetectMinSimilarity > 1) {
+    console.error(`Error: AUTO_DETECT_MIN_SIMILARITY must be a number between 0 and 1.`);
+    process.exit(1);
+}
+const autoDetectMaxProducts = parseInt(process.env.AUTO_DETECT_MAX_PRODUCTS || String(DEFAULT_AUTO_DETECT_MAX_PRODUCTS), 10);
+if (!Number.isInteger(autoDetectMaxProducts) || autoDetectMaxProducts < 1) {
+    console.error(`Error: AUTO_DETECT_MAX_PRODUCTS must be a positive integer.`);
+    process.exit(1);
+}
+
+// Versions searched when a request names none: 'all' (default) or 'latest' (the highest version in each database)
+const defaultVersionStrategy = (process.env.DEFAULT_VERSION_STRATEGY || 'all') as DefaultVersionStrategy;
+if (!['all', 'latest'].includes(defaultVersionStrategy)) {
+    console.error(`Error: DEFAULT_VERSION_STRATEGY '${defaultVersionStrategy}' must be 'all' or 'latest'.`);
+    process.exit(1);
+}
+
+// Log a warning with a hashed query and timing breakdown for query_documentation calls slower than this (0 disables)
+const slowQueryThresholdMs = Number(process.env.SLOW_QUERY_THRESHOLD || '0');
+if (!Number.isInteger(slowQueryThresholdMs) || slowQueryThresholdMs < 0) {
+    console.error(`Error: SLOW_QUERY_THRESHOLD must be a non-negative number of milliseconds.`);
+    process.exit(1);
+}
+
+// Echo the effective query parameters in query_documentation responses
+const includeQueryEcho = process.env.INCLUDE_QUERY_ECHO === 'true';
+
+// embed_text exposes raw vectors and spends provider quota, so it is registered only on request
+const enableEmbedText = process.env.ENABLE_EMBED_TEXT === 'true';
+
+// text_similarity embeds two texts per call, spending provider quota like embed_text
+const enableTextSimilarity = process.env.ENABLE_TEXT_SIMILARITY === 'true';
+
+// validate_database and calibrate_threshold spend provider quota, reveal file paths or
+// rewrite per-product settings, so they are for operators only
+const enableAdminTools = process.env.ENABLE_ADMIN_TOOLS === 'true';
+// export_documents can dump a whole corpus, so it needs its own opt-in on top of the admin tools
+const enableExportDocuments = process.env.ENABLE_EXPORT_DOCUMENTS === 'true';
+if (enableExportDocuments && !enableAdminTools) {
+    console.warn('Warning: ENABLE_EXPORT_DOCUMENTS has no effect without ENABLE_ADMIN_TOOLS=true.');
+}
+
+// Upper bound on IDs accepted by a single get_chunks_by_ids call
+const maxChunkIds = nonNegativeIntegerSetting('MAX_CHUNK_IDS', DEFAULT_MAX_CHUNK_IDS);
+
+// Upper bound on excludeChunkIds accepted by a single query_documentation call
+const maxExcludeChunkIds = parseInt(process.env.MAX_EXCLUDE_CHUNK_IDS || String(DEFAULT_MAX_EXCLUDE_CHUNK_IDS), 10);
+
+// Upper bound on versions searched by a single query_documentation call (0 disables the limit)
+const maxVersions = nonNegativeIntegerSetting('MAX_VERSIONS', DEFAULT_MAX_VERSIONS);
+
+// Upper bound on products returned by list_products (0 lists every product)
+const listProductsLimit = nonNegativeIntegerSetting('LIST_PRODUCTS_LIMIT', DEFAULT_LIST_PRODUCTS_LIMIT);
+
+// Largest query embedding accepted before it reaches SQLite (0 disables the check)
+const maxEmbeddingDimension = nonNegativeIntegerSetting('MAX_EMBEDDING_DIMENSION', DEFAULT_MAX_EMBEDDING_DIMENSION);
+
+// Seconds between rescans of the database directory (0 reads the directory on every request)
+const dbRescanInterval = Number(process.env.DB_RESCAN_INTERVAL || '0');
+if (!Number.isInteger(dbRescanInterval) || dbRescanInterval < 0) {
+    console.error(`Error: DB_RESCAN_INTERVAL '${process.env.DB_RESCAN_INTERVAL}' must be a non-negative number of seconds.`);
+    process.exit(1);
+}
+
+// Seconds between checks that drop cached metadata of changed database files (0 disables them)
+const dbHealthcheckInterval = Number(process.env.DB_HEALTHCHECK_INTERVAL || '0');
+if (!Number.isInteger(dbHealthcheckInterval) || dbHealthcheckInterval < 0) {
+    console.error(`Error: DB_HEALTHCHECK_INTERVAL '${process.env.DB_HEALTHCHECK_INTERVAL}' must be a non-negative number of seconds.`);
+    process.exit(1);
+}
+
 const normalizeQdrantConfig = (rawUrl: string): { url: string; port?: number } => {
     try {
         const parsed = new URL(rawUrl);
@@ -70,9 +627,36 @@ if (vectorDbType === 'sqlite' && !fs.existsSync(dbDir)) {
     process.exit(1);
 }
 
-const strictMode = process.env.STRICT_MODE === 'true';
-if (strictMode) {
-    switch (embeddingProvider) {
+// Curated product list; without one, products are discovered by scanning SQLITE_DB_DIR
+const productsManifestPath = process.env.PRODUCTS_MANIFEST || path.join(dbDir, PRODUCTS_MANIFEST_FILE);
+let productsManifest: ProductManifestEntry[] | undefined;
+if (vectorDbType === 'sqlite' && fs.existsSync(productsManifestPath)) {
+    try {
+        productsManifest = parseProductManifest(fs.readFileSync(productsManifestPath, 'utf8'));
+        console.error(`Loaded ${productsManifest.length} products from ${productsManifestPath}.`);
+    } catch (error) {
+        console.error(`Error: ${productsManifestPath}: ${error instanceof Error ? error.message : String(error)}`);
+        process.exit(1);
+    }
+} else if (process.env.PRODUCTS_MANIFEST) {
+    console.error(`Error: PRODUCTS_MANIFEST (${productsManifestPath}) does not exist.`);
+    process.exit(1);
+}
+
+// Per-product SQLite URIs, for VFS and connection options a plain file path cannot carry
+let databaseUris: Record<string, string> | undefined;
+if (vectorDbType === 'sqlite' && process.env.SQLITE_DB_URIS) {
+    try {
+        databaseUris = parseDatabaseUris(process.env.SQLITE_DB_URIS);
+        console.error(`Using SQLite URIs for products: ${Object.keys(databaseUris).join(', ')}.`);
+    } catch (error) {
+        console.error(`Error: ${error instanceof Error ? error.message : String(error)}`);
+        process.exit(1);
+    }
+}
+
+function validateProviderCredentials(provider: string) {
+    switch (provider) {
         case 'openai':
             if (!openAIApiKey) {
                 console.error("Error: OPENAI_API_KEY environment variable is not set.");
@@ -91,79 +675,541 @@ if (strictMode) {
                 process.exit(1);
             }
             break;
+        case 'voyage':
+            if (!voyageApiKey) {
+                console.error("Error: VOYAGE_API_KEY environment variable is not set.");
+                process.exit(1);
+            }
+            break;
+        case 'cohere':
+            if (!cohereApiKey) {
+                console.error("Error: COHERE_API_KEY environment variable is not set.");
+                process.exit(1);
+            }
+            break;
+        // Strict mode does not fall back to localhost, so a missing setting is not mistaken
+        // for a server that happens to be unreachable.
+        case 'ollama':
+            if (!process.env.OLLAMA_BASE_URL) {
+                console.error("Error: OLLAMA_BASE_URL environment variable is not set.");
+                process.exit(1);
+            }
+            break;
         default:
-            console.error(`Error: Unknown embedding provider '${embeddingProvider}'. Supported providers: openai, azure, gemini`);
+            console.error(`Error: Unknown embedding provider '${provider}'. Supported providers: openai, azure, gemini, voyage, cohere, ollama`);
             console.error("Note: Anthropic does not provide an embeddings API, only text generation models.");
             process.exit(1);
     }
+}
+
+// Settings each provider needs at query time, keyed by environment variable name.
+function missingProviderSettings(provider: string): string[] | undefined {
+    const required: Record<string, Record<string, string | undefined>> = {
+        openai: { OPENAI_API_KEY: openAIApiKey },
+        azure: { AZURE_OPENAI_KEY: azureApiKey, AZURE_OPENAI_ENDPOINT: azureEndpoint },
+        gemini: { GEMINI_API_KEY: geminiApiKey },
+        voyage: { VOYAGE_API_KEY: voyageApiKey },
+        cohere: { COHERE_API_KEY: cohereApiKey },
+        // OLLAMA_BASE_URL defaults to the local server.
+        ollama: {},
+    };
+    const settings = required[provider];
+    if (!settings) {
+        return undefined;
+    }
+    return Object.keys(settings).filter((name) => !settings[name]);
+}
+
+const strictMode = process.env.STRICT_MODE === 'true';
+const probeProviderOnStart = process.env.PROBE_PROVIDER_ON_START === 'true';
+const skipDimensionProbe = process.env.SKIP_DIMENSION_PROBE === 'true';
+const unknownQueryProviders = queryProviders.filter((provider) => provider !== embeddingProvider && missingProviderSettings(provider) === undefined);
+if (unknownQueryProviders.length > 0) {
+    console.error(`Error: QUERY_PROVIDERS has unknown provider(s) ${unknownQueryProviders.join(', ')}. Supported providers: openai, azure, gemini, voyage, cohere, ollama`);
+    process.exit(1);
+}
+const configuredProviders = Array.from(new Set(fallbackProvider ? [...queryProviders, fallbackProvider] : queryProviders));
+if (strictMode) {
+    for (const provider of configuredProviders) {
+        validateProviderCredentials(provider);
+    }
 
     if (vectorDbType !== 'sqlite' && vectorDbType !== 'qdrant') {
         console.error(`Error: Unknown VECTOR_DB_TYPE '${vectorDbType}'. Supported: sqlite, qdrant`);
         process.exit(1);
     }
+} else {
+    // Without strict mode these only fail on the first query, so surface them at startup.
+    for (const provider of configuredProviders) {
+        const missing = missingProviderSettings(provider);
+        if (missing === undefined) {
+            console.warn(`Warning: unknown embedding provider '${provider}'. Supported providers: openai, azure, gemini, voyage, cohere, ollama`);
+        } else if (missing.length > 0) {
+            console.warn(`Warning: embedding provider '${provider}' is missing ${missing.join(', ')}. Queries will fail until set (use STRICT_MODE=true to fail at startup).`);
+        }
+    }
 }
 
-async function createEmbeddings(text: string): Promise<number[]> {
-    try {
+// Closing aborts requests still in flight, so shutdown is not held up by a slow provider.
+const {
+    clients: embeddingClients,
+    signal: embeddingSignal,
+    close: closeEmbeddingClients,
+} = createEmbeddingClients<{ openai: OpenAI; azure: AzureOpenAI; gemini: GoogleGenerativeAI }>();
 
-        switch (embeddingProvider) {
-            case 'openai': {
-                const openai = new OpenAI({
-                    apiKey: openAIApiKey,
-                });
-                const response = await openai.embeddings.create({
-                    model: openAIModel,
-                    input: text,
-                });
-                if (!response.data?.[0]?.embedding) {
-                    throw new Error("Failed to get embedding from OpenAI response.");
-                }
-                return response.data[0].embedding;
+// Embedding tokens used by the tool call in progress and the session it belongs to.
+// Calls outside a tool call, such as the startup probe, are only counted in metrics.
+type ToolCallUsage = { sessionId: string; embeddingTokens: number };
+const toolCallUsage = new AsyncLocalStorage<ToolCallUsage>();
+const tokenLedger = createTokenLedger(maxTokensPerSession);
+// stdio serves a single client without a session ID.
+const STDIO_SESSION_ID = 'stdio';
+
+// Uses the provider's reported token count, or an estimate from the input lengths.
+function recordEmbeddingTokens(provider: string, texts: string[], reportedTokens?: number) {
+    const tokens = reportedTokens ?? texts.reduce((sum, text) => sum + estimateTokens(text), 0);
+    metrics.incCounter(
+        'doc2vec_embedding_tokens_total',
+        'Embedding input tokens, as reported by the provider or estimated from input length',
+        { provider, model: providerModel(provider) },
+        tokens
+    );
+    const usage = toolCallUsage.getStore();
+    if (usage) {
+        usage.embeddingTokens += tokens;
+        tokenLedger.charge(usage.sessionId, tokens);
+    }
+}
+
+// Checks that a provider returned one vector per input, in input order.
+function expectEmbeddings(embeddings: (number[] | undefined)[] | undefined, count: number, source: string): number[][] {
+    if (!embeddings || embeddings.length !== count || embeddings.some((embedding) => !embedding?.length)) {
+        throw new Error(`Failed to get embedding from ${source} response.`);
+    }
+    return embeddings as number[][];
+}
+
+// Embeds `texts` in one request where the API takes a list (OpenAI, Azure, Voyage, Cohere),
+// or one request per text otherwise. `callSignal` aborts the requests along with the tool
+// call that needs them.
+async function createProviderEmbeddings(provider: string, texts: string[], callSignal?: AbortSignal): Promise<number[][]> {
+    const signal = callSignal ? AbortSignal.any([embeddingSignal, callSignal]) : embeddingSignal;
+    signal.throwIfAborted();
+    switch (provider) {
+        case 'openai': {
+            // Retries are left to createRetriedEmbeddings, so EMBEDDING_MAX_RETRIES is the only limit.
+            const openai = embeddingClients.openai ??= new OpenAI({
+                apiKey: openAIApiKey,
+                maxRetries: 0,
+            });
+            const response = await openai.embeddings.create({
+                model: openAIModel,
+                input: texts,
+                ...(openAIDimensions > 0 && { dimensions: openAIDimensions }),
+            }, { signal });
+            const embeddings = expectEmbeddings([...(response.data ?? [])].sort((a, b) => a.index - b.index).map((item) => item.embedding), texts.length, 'OpenAI');
+            recordEmbeddingTokens(provider, texts, response.usage?.prompt_tokens);
+            // A model without the dimensions parameter would otherwise reach MATCH at full size.
+            if (openAIDimensions > 0 && embeddings[0].length !== openAIDimensions) {
+                throw new Error(`OpenAI returned a ${embeddings[0].length}-dimensional embedding, but OPENAI_DIMENSIONS is ${openAIDimensions}. Check that ${openAIModel} supports the dimensions parameter.`);
             }
+            return embeddings;
+        }
 
-            case 'azure': {
-                const azure = new AzureOpenAI({
-                    apiKey: azureApiKey,
-                    endpoint: azureEndpoint,
-                    deployment: azureDeploymentName,
-                    apiVersion: azureApiVersion,
-                });
+        case 'azure': {
+            const azure = embeddingClients.azure ??= new AzureOpenAI({
+                apiKey: azureApiKey,
+                endpoint: azureEndpoint,
+                deployment: azureDeploymentName,
+                apiVersion: azureApiVersion,
+                maxRetries: 0,
+            });
 
-                const response = await azure.embeddings.create({
-                    model: azureDeploymentName, // Use deployment name for Azure
-                    input: text,
-                });
-                if (!response.data?.[0]?.embedding) {
-                    throw new Error("Failed to get embedding from Azure OpenAI response.");
-                }
-                return response.data[0].embedding;
+            const response = await azure.embeddings.create({
+                model: azureDeploymentName, // Use deployment name for Azure
+                input: texts,
+            }, { signal });
+            const embeddings = expectEmbeddings([...(response.data ?? [])].sort((a, b) => a.index - b.index).map((item) => item.embedding), texts.length, 'Azure OpenAI');
+            recordEmbeddingTokens(provider, texts, response.usage?.prompt_tokens);
+            return embeddings;
+        }
+
+        case 'gemini': {
+            const genAI = embeddingClients.gemini ??= new GoogleGenerativeAI(geminiApiKey!);
+            const model = genAI.getGenerativeModel({ model: geminiModel });
+            const results = await Promise.all(texts.map((text) => model.embedContent(text, { signal })));
+            const embeddings = expectEmbeddings(results.map((result) => result.embedding?.values), texts.length, 'Gemini');
+            // Gemini does not report usage for embeddings.
+            recordEmbeddingTokens(provider, texts);
+            return embeddings;
+        }
+
+        case 'voyage': {
+            const response = await fetch('https://api.voyageai.com/v1/embeddings', {
+                signal,
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'Authorization': `Bearer ${voyageApiKey}`,
+                },
+                body: JSON.stringify({
+                    model: voyageModel,
+                    input: texts,
+                    input_type: 'query',
+                }),
+            });
+            if (!response.ok) {
+                throw new Error(`Voyage API returned ${response.status}: ${await response.text()}`);
             }
+            const body = await response.json() as { data?: { embedding?: number[]; index?: number }[]; usage?: { total_tokens?: number } };
+            const embeddings = expectEmbeddings([...(body.data ?? [])].sort((a, b) => (a.index ?? 0) - (b.index ?? 0)).map((item) => item.embedding), texts.length, 'Voyage');
+            recordEmbeddingTokens(provider, texts, body.usage?.total_tokens);
+            return embeddings;
+        }
 
-            case 'gemini': {
-                const genAI = new GoogleGenerativeAI(geminiApiKey!);
-                const model = genAI.getGenerativeModel({ model: geminiModel });
-                const result = await model.embedContent(text);
-                if (!result.embedding?.values) {
-                    throw new Error("Failed to get embedding from Gemini response.");
-                }
-                return result.embedding.values;
+        case 'cohere': {
+            const response = await fetch('https://api.cohere.com/v2/embed', {
+                signal,
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'Authorization': `Bearer ${cohereApiKey}`,
+                },
+                body: JSON.stringify({
+                    model: cohereModel,
+                    texts,
+                    input_type: cohereInputType,
+                    embedding_types: ['float'],
+                }),
+            });
+            if (!response.ok) {
+                throw new Error(`Cohere API returned ${response.status}: ${await response.text()}`);
             }
-            default:
-                throw new Error(`Unsupported embedding provider: ${embeddingProvider}. Supported providers: openai, azure, gemini`);
+            const body = await response.json() as { embeddings?: { float?: number[][] }; meta?: { billed_units?: { input_tokens?: number } } };
+            const embeddings = expectEmbeddings(body.embeddings?.float, texts.length, 'Cohere');
+            recordEmbeddingTokens(provider, texts, body.meta?.billed_units?.input_tokens);
+            return embeddings;
+        }
+
+        case 'ollama': {
+            const embeddings = await Promise.all(texts.map(async (text) => {
+                const response = await fetch(`${ollamaBaseUrl}/api/embeddings`, {
+                    signal,
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({
+                        model: ollamaModel,
+                        prompt: text,
+                    }),
+                });
+                if (!response.ok) {
+                    throw new Error(`Ollama API returned ${response.status}: ${await response.text()}`);
+                }
+                const body = await response.json() as { embedding?: number[] };
+                if (!body.embedding?.length) {
+                    throw new Error(`Failed to get embedding from Ollama response. Check that ${ollamaModel} is pulled and is an embedding model.`);
+                }
+                return body.embedding;
+            }));
+            // The embeddings endpoint does not report usage.
+            recordEmbeddingTokens(provider, texts);
+            return embeddings;
         }
+        default:
+            throw new Error(`Unsupported embedding provider: ${provider}. Supported providers: openai, azure, gemini, voyage, cohere, ollama`);
+    }
+}
 
+// Dimension the provider is asked to produce, when it is not the model's native one.
+function requestedDimension(provider: string): number | undefined {
+    return provider === 'openai' && openAIDimensions > 0 ? openAIDimensions : undefined;
+}
+
+function providerModel(provider: string): string {
+    switch (provider) {
+        case 'openai':
+            return openAIModel;
+        case 'azure':
+            return azureDeploymentName;
+        case 'gemini':
+            return geminiModel;
+        case 'voyage':
+            return voyageModel;
+        case 'cohere':
+            return cohereModel;
+        case 'ollama':
+            return ollamaModel;
+        default:
+            return 'unknown';
+    }
+}
+
+// Records the latency of one provider request and the output dimension per provider and model.
+async function createInstrumentedEmbeddings(provider: string, texts: string[], signal?: AbortSignal): Promise<number[][]> {
+    const labels = { provider, model: providerModel(provider) };
+    const startTime = Date.now();
+    try {
+        const embeddings = await createProviderEmbeddings(provider, texts, signal);
+        metrics.setGauge('doc2vec_embedding_dimension', 'Dimension of the most recent embedding', labels, embeddings[0].length);
+        return embeddings;
+    } finally {
+        metrics.observe('doc2vec_embedding_duration_ms', 'Embedding request latency in milliseconds', labels, Date.now() - startTime);
+    }
+}
+
+const embeddingLimiter = maxConcurrentEmbeddings > 0 ? createKeyedSemaphore(maxConcurrentEmbeddings, embeddingWaitMs) : undefined;
+
+// Waits for a MAX_CONCURRENT_EMBEDDINGS slot (when set) before calling the provider.
+async function createLimitedEmbeddings(provider: string, texts: string[], signal?: AbortSignal): Promise<number[][]> {
+    if (!embeddingLimiter) {
+        return createInstrumentedEmbeddings(provider, texts, signal);
+    }
+    const queuedAt = Date.now();
+    return embeddingLimiter.run('Embedding provider', () => {
+        metrics.observe('doc2vec_embedding_queue_wait_ms', 'Time embedding requests waited for a free slot in milliseconds', {}, Date.now() - queuedAt);
+        return createInstrumentedEmbeddings(provider, texts, signal);
+    });
+}
+
+// Retries transient provider failures around the slot, so a request backing off does not
+// hold a MAX_CONCURRENT_EMBEDDINGS slot while it waits. Counts as one error only if every
+// attempt fails.
+async function createRetriedEmbeddings(provider: string, texts: string[], signal?: AbortSignal): Promise<number[][]> {
+    const labels = { provider, model: providerModel(provider) };
+    try {
+        return await retryWithBackoff(() => createLimitedEmbeddings(provider, texts, signal), {
+            maxRetries: embeddingMaxRetries,
+            baseDelayMs: embeddingRetryBaseDelayMs,
+            isRetryable: isTransientEmbeddingError,
+            signal: signal ? AbortSignal.any([embeddingSignal, signal]) : embeddingSignal,
+            onRetry: (error, attempt, delayMs) => {
+                metrics.incCounter('doc2vec_embedding_retries_total', 'Embedding requests retried after a transient provider error', labels);
+                logger.warn(`Warning: ${provider} embedding request failed (${error instanceof Error ? error.message : String(error)}); retrying in ${delayMs}ms (attempt ${attempt} of ${embeddingMaxRetries}).`);
+            },
+        });
+    } catch (error) {
+        metrics.incCounter('doc2vec_embedding_errors_total', 'Embedding requests that failed', labels);
+        throw error;
+    }
+}
+
+// Dimension the databases were indexed with, as far as configuration tells: fallback vectors
+// must match it, and the fallback is refused when it is unknown.
+const expectedEmbeddingDimension = embeddingDimension ?? requestedDimension(embeddingProvider) ?? modelDimensions[providerModel(embeddingProvider)];
+if (fallbackProvider && expectedEmbeddingDimension === undefined) {
+    console.warn(`Warning: FALLBACK_PROVIDER '${fallbackProvider}' is disabled: the dimension of ${providerModel(embeddingProvider)} is unknown. Set EMBEDDING_DIMENSION or MODEL_DIMENSIONS to enable it.`);
+}
+
+// Expects a JSON reply holding a term -> weight map or `{ indices, values }`, either at the
+// top level or under `vector`. `callSignal` is the tool call's, as for dense embeddings.
+async function createSparseEmbedding(text: string, callSignal?: AbortSignal): Promise<SparseVector> {
+    const timeout = sparseEncoderTimeoutMs > 0 ? AbortSignal.timeout(sparseEncoderTimeoutMs) : undefined;
+    const signal = AbortSignal.any([embeddingSignal, ...(callSignal ? [callSignal] : []), ...(timeout ? [timeout] : [])]);
+    let response: Response;
+    try {
+        response = await fetch(sparseEncoderUrl!, {
+            signal,
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ text }),
+        });
+    } catch (error) {
+        if (timeout?.aborted) {
+            throw new Error(`Sparse encoder did not respond within ${sparseEncoderTimeoutMs}ms (SPARSE_ENCODER_TIMEOUT_MS).`);
+        }
+        throw error;
+    }
+    if (!response.ok) {
+        throw new Error(`Sparse encoder returned ${response.status}: ${await response.text()}`);
+    }
+    const body = await response.json() as { vector?: unknown };
+    const vector = parseSparseVector(body.vector ?? body);
+    if (!vector) {
+        throw new Error('Sparse encoder returned an unrecognized vector format.');
+    }
+    return vector;
+}
+
+// Query embedding cache: on disk when EMBEDDING_CACHE_PATH is set (survives restarts),
+// otherwise in memory when EMBEDDING_CACHE_SIZE > 0.
+const embeddingCachePath = process.env.EMBEDDING_CACHE_PATH;
+const embeddingCacheSize = parseInt(process.env.EMBEDDING_CACHE_SIZE || '0', 10);
+// Bounds on the disk cache, which otherwise grows with every distinct query
+const embeddingCacheMaxEntries = Number(process.env.EMBEDDING_CACHE_MAX_ENTRIES || '100000');
+if (!Number.isInteger(embeddingCacheMaxEntries) || embeddingCacheMaxEntries < 0) {
+    console.error(`Error: EMBEDDING_CACHE_MAX_ENTRIES must be a non-negative integer, got '${process.env.EMBEDDING_CACHE_MAX_ENTRIES}'.`);
+    process.exit(1);
+}
+const embeddingCacheMaxAgeMs = Number(process.env.EMBEDDING_CACHE_MAX_AGE_MS || '0');
+if (!Number.isInteger(embeddingCacheMaxAgeMs) || embeddingCacheMaxAgeMs < 0) {
+    console.error(`Error: EMBEDDING_CACHE_MAX_AGE_MS must be a non-negative integer, got '${process.env.EMBEDDING_CACHE_MAX_AGE_MS}'.`);
+    process.exit(1);
+}
+let embeddingCache: EmbeddingCache | undefined;
+if (embeddingCachePath) {
+    try {
+        const diskCache = new SqliteEmbeddingCache(
+            Database,
+            path.resolve(embeddingCachePath),
+            embeddingCacheConfig(embeddingProvider, providerModel(embeddingProvider), embeddingDimension ?? requestedDimension(embeddingProvider)),
+            { maxEntries: embeddingCacheMaxEntries, maxAgeMs: embeddingCacheMaxAgeMs }
+        );
+        if (diskCache.invalidated) {
+            console.error(`Embedding provider, model or dimension changed; cleared the embedding cache at ${path.resolve(embeddingCachePath)}`);
+        }
+        embeddingCache = diskCache;
+        console.error(`Using disk embedding cache at ${path.resolve(embeddingCachePath)}`);
+    } catch (error) {
+        console.error(`Error: could not open EMBEDDING_CACHE_PATH '${embeddingCachePath}': ${error instanceof Error ? error.message : String(error)}`);
+        process.exit(1);
+    }
+} else if (embeddingCacheSize > 0) {
+    embeddingCache = new LruEmbeddingCache(embeddingCacheSize);
+}
+
+function truncateInput(provider: string, text: string): string {
+    const maxTokens = embeddingMaxTokens ?? DEFAULT_EMBEDDING_MAX_TOKENS[provider] ?? 0;
+    const result = truncateForEmbedding(text, maxTokens, truncateStrategy);
+    if (result.truncated) {
+        console.warn(`Warning: input of ${text.length} characters exceeds the estimated ${maxTokens}-token limit of '${provider}'; kept the ${truncateStrategy} (${result.text.length} characters).`);
+    }
+    return result.text;
+}
+
+// Provider and model behind each vector createEmbeddings returned, reported with
+// query_documentation results. Weakly held, so vectors are not kept alive by it.
+const embeddingSources = new WeakMap<number[], EmbeddingSource>();
+
+function fromProvider(embedding: number[], provider: string): number[] {
+    embeddingSources.set(embedding, { provider, model: providerModel(provider) });
+    return embedding;
+}
+
+function writeEmbeddingCache(cacheKey: string | undefined, embedding: number[]) {
+    if (!embeddingCache || !cacheKey) {
+        return;
+    }
+    try {
+        embeddingCache.set(cacheKey, embedding);
+    } catch (cacheError) {
+        console.warn('Warning: failed to write embedding cache:', cacheError);
+    }
+}
+
+// `provider` selects one of QUERY_PROVIDERS; the fallback provider only backs up the primary,
+// since its vectors would not match a corpus indexed with another selected provider.
+// `signal` is the tool call's, so provider requests stop when the call is cancelled or times out.
+// Texts missing from the cache are embedded in one provider request where the API allows it,
+// and a fallback serves all of them, so vectors of one batch never mix models they were not
+// cached under.
+async function createEmbeddingsBatch(texts: string[], provider: string = embeddingProvider, signal?: AbortSignal): Promise<number[][]> {
+    const inputs = queryPreprocessSteps.length > 0 ? texts.map((text) => preprocessQuery(text, queryPreprocessSteps)) : texts;
+    const primary = provider === embeddingProvider;
+    const truncated = inputs.map((input) => truncateInput(provider, input));
+
+    // Fallback vectors are never cached; they come from a different model.
+    const cacheKeys = truncated.map((text) => embeddingCache
+        ? embeddingCacheKey(provider, providerModel(provider), text, (primary ? embeddingDimension : undefined) ?? requestedDimension(provider))
+        : undefined);
+    const embeddings: (number[] | undefined)[] = cacheKeys.map((cacheKey) => {
+        if (!embeddingCache || !cacheKey) {
+            return undefined;
+        }
+        const cached = embeddingCache.get(cacheKey);
+        metrics.incCounter(
+            cached ? 'doc2vec_embedding_cache_hits_total' : 'doc2vec_embedding_cache_misses_total',
+            cached ? 'Query embeddings served from the embedding cache.' : 'Query embeddings not found in the embedding cache.'
+        );
+        return cached && fromProvider(cached, provider);
+    });
+    const missing = embeddings.flatMap((embedding, index) => (embedding ? [] : [index]));
+    if (missing.length === 0) {
+        return embeddings as number[][];
+    }
+
+    // Cached embeddings are free, so only provider calls count against the budget.
+    const usage = toolCallUsage.getStore();
+    if (usage) {
+        tokenLedger.assertWithinBudget(usage.sessionId);
+    }
+
+    const fill = (fresh: number[][], source: string) => {
+        missing.forEach((index, position) => {
+            embeddings[index] = fromProvider(fresh[position], source);
+        });
+        return embeddings as number[][];
+    };
+
+    if (!primary) {
+        const fresh = await createRetriedEmbeddings(provider, missing.map((index) => truncated[index]), signal);
+        missing.forEach((index, position) => writeEmbeddingCache(cacheKeys[index], fresh[position]));
+        return fill(fresh, provider);
+    }
+
+    try {
+        const fresh = await createRetriedEmbeddings(embeddingProvider, missing.map((index) => truncated[index]), signal);
+        missing.forEach((index, position) => writeEmbeddingCache(cacheKeys[index], fresh[position]));
+        if (fallbackProvider) {
+            console.error(`Embedding served by provider '${embeddingProvider}'.`);
+        }
+        return fill(fresh, embeddingProvider);
     } catch (error) {
         console.error(`Error creating ${embeddingProvider} embeddings:`, error);
-        throw new Error(`Failed to create embeddings with ${embeddingProvider}: ${error instanceof Error ? error.message : String(error)}`);
+        const primaryError = new Error(`Failed to create embeddings with ${embeddingProvider}: ${error instanceof Error ? error.message : String(error)}`);
+        // A cancelled or timed-out call has nobody waiting for the fallback's answer.
+        if (!fallbackProvider || signal?.aborted || expectedEmbeddingDimension === undefined) {
+            throw primaryError;
+        }
+
+        console.error(`Falling back to embedding provider '${fallbackProvider}'...`);
+        let fresh: number[][];
+        try {
+            fresh = await createRetriedEmbeddings(fallbackProvider, missing.map((index) => truncateInput(fallbackProvider, inputs[index])), signal);
+        } catch (fallbackError) {
+            console.error(`Error creating ${fallbackProvider} embeddings:`, fallbackError);
+            throw primaryError;
+        }
+
+        const mismatched = fresh.find((embedding) => embedding.length !== expectedEmbeddingDimension);
+        if (mismatched) {
+            console.warn(`Warning: fallback provider '${fallbackProvider}' returned ${mismatched.length}-dimensional vectors, expected ${expectedEmbeddingDimension}. Skipping fallback.`);
+            throw primaryError;
+        }
+
+        console.error(`Embedding served by fallback provider '${fallbackProvider}'.`);
+        return fill(fresh, fallbackProvider);
     }
 }
 
+async function createEmbeddings(text: string, provider: string = embeddingProvider, signal?: AbortSignal): Promise<number[]> {
+    const [embedding] = await createEmbeddingsBatch([text], provider, signal);
+    return embedding;
+}
+
 const sqliteProvider = createSqliteDbProvider({
     dbDir,
     sqliteVec,
     Database,
     fs,
     path,
+    vecColumns,
+    fuzzyVersionFallback: process.env.VERSION_FUZZY_FALLBACK === 'true',
+    caseInsensitiveFilters: process.env.CASE_INSENSITIVE_FILTERS === 'true',
+    databaseUris,
+    busyTimeoutMs: parseInt(process.env.DB_BUSY_TIMEOUT || String(DEFAULT_DB_BUSY_TIMEOUT_MS), 10),
+    busyRetries: parseInt(process.env.DB_BUSY_RETRIES || String(DEFAULT_DB_BUSY_RETRIES), 10),
+    openRetries: parseInt(process.env.DB_OPEN_RETRIES || String(DEFAULT_DB_OPEN_RETRIES), 10),
+    logger,
+    integrityCheck: process.env.DB_INTEGRITY_CHECK === 'true',
+    quarantineCorrupt: process.env.QUARANTINE_CORRUPT_DBS === 'true',
+    ftsTable,
+    sparseColumn,
+    sparseMaxScanRows,
+    productsManifest,
+    productsManifestPath,
+    vectorByteOrder,
+    vectorQuantization,
+    maxEmbeddingDimension,
 });
 
 const qdrantConfig = normalizeQdrantConfig(qdrantUrl);
@@ -177,11 +1223,82 @@ const qdrantProvider = createQdrantProvider({
 
 const activeProvider = vectorDbType === 'qdrant' ? qdrantProvider : sqliteProvider;
 
-const { queryDocumentationToolHandler, queryCodeToolHandler, getChunksToolHandler } = createQueryHandlers({
+// Every search reaching the vector database is counted, for /metrics and /health/detail.
+const countedQueryCollection: QueryCollection = (...args) => {
+    metrics.incCounter('doc2vec_queries_total', 'Searches run against the vector database.', { mode: 'vector' });
+    return activeProvider.queryCollection(...args);
+};
+const countedKeywordSearch: KeywordSearch = (...args) => {
+    metrics.incCounter('doc2vec_queries_total', 'Searches run against the vector database.', { mode: 'keyword' });
+    return sqliteProvider.keywordSearch(...args);
+};
+
+const {
+    queryDocumentationToolHandler,
+    queryCodeToolHandler,
+    queryAllProductsToolHandler,
+    compareProductsToolHandler,
+    listProductsToolHandler,
+    routeQueryToolHandler,
+    embedTextToolHandler,
+    textSimilarityToolHandler,
+    refineQueryToolHandler,
+    calibrateThresholdToolHandler,
+    validateDatabaseToolHandler,
+    exportDocumentsToolHandler,
+    getChunksToolHandler,
+    getChunksByIdsToolHandler,
+} = createQueryHandlers({
     createEmbeddings,
+    createEmbeddingsBatch,
     resolveDbPath: activeProvider.resolveDbPath,
-    queryCollection: activeProvider.queryCollection,
+    queryCollection: maxConcurrentPerProduct > 0
+        ? withConcurrencyLimit(countedQueryCollection, maxConcurrentPerProduct, concurrencyWaitMs)
+        : countedQueryCollection,
     getChunksForDocument: activeProvider.getChunksForDocument,
+    getChunksByIds: activeProvider.getChunksByIds,
+    listProducts: vectorDbType === 'sqlite' ? sqliteProvider.listDatabaseNames : undefined,
+    getProductInfo: vectorDbType === 'sqlite' ? sqliteProvider.getProductInfo : undefined,
+    getLatestVersion: vectorDbType === 'sqlite' ? sqliteProvider.getLatestVersion : undefined,
+    testConnection: vectorDbType === 'sqlite' ? sqliteProvider.testConnection : undefined,
+    inspectDatabase: vectorDbType === 'sqlite' ? sqliteProvider.inspectDatabase : undefined,
+    exportChunks: vectorDbType === 'sqlite' ? sqliteProvider.exportChunks : undefined,
+    getStoredDimension: vectorDbType === 'sqlite' ? sqliteProvider.getStoredDimension : undefined,
+    getColumns: vectorDbType === 'sqlite' ? sqliteProvider.getColumns : undefined,
+    describeEmbedding: (embedding) => embeddingSources.get(embedding),
+    getDistanceThreshold: vectorDbType === 'sqlite' ? sqliteProvider.getDistanceThreshold : undefined,
+    saveDistanceCalibration: vectorDbType === 'sqlite' ? sqliteProvider.saveDistanceCalibration : undefined,
+    keywordSearch: vectorDbType === 'sqlite' ? countedKeywordSearch : undefined,
+    createSparseEmbedding: sparseEncoderUrl ? createSparseEmbedding : undefined,
+    sparseSearch: sparseEncoderUrl && vectorDbType === 'sqlite' ? sqliteProvider.sparseSearch : undefined,
+    options: {
+        maxQueryChars,
+        queryLengthMode,
+        queryTrimMode,
+        minQueryLength,
+        deadlineMs,
+        maxChunkIds,
+        maxExcludeChunkIds,
+        maxVersions,
+        listProductsLimit,
+        includeQueryEcho,
+        resultTemplate,
+        messages,
+        sparseWeight,
+        routeMinSimilarity,
+        slowQueryThresholdMs,
+        defaultVersionStrategy,
+        queryProviders,
+        redactPatterns,
+        compositeWeights,
+        requestTimeoutMs,
+        recencyColumn,
+        recencyHalfLifeDays,
+        autoDetectProduct,
+        autoDetectMinSimilarity,
+        autoDetectMaxProducts,
+        embeddingDimension: expectedEmbeddingDimension,
+    },
 });
 
 // --- MCP Server Setup ---
@@ -194,54 +1311,682 @@ const server = new McpServer({
     capabilities: {},
 });
 
-// --- Define the MCP Tool ---
-server.tool(
-    "query_documentation",
-    "Query documentation stored in a sqlite-vec database using vector search.",
-    {
-        queryText: z.string().min(1).describe("The natural language query to search for."),
-        productName: z.string().min(1).optional().describe("The name of the product documentation database to search within (e.g., 'my-product'). Corresponds to the DB filename without .db."),
-        dbName: z.string().min(1).optional().describe("The database filename to query directly (e.g., 'my-product.db' or 'my-product')."),
-        version: z.string().optional().describe("The specific version of the product documentation (e.g., '1.2.0'). Optional."),
-        urlPathPrefix: z.string().min(1).optional().describe("Full URL prefix to filter documentation results (e.g., 'https://docs.example.com/guide/')."),
-        limit: z.number().int().positive().optional().default(4).describe("Maximum number of results to return. Defaults to 4."),
-    },
-    queryDocumentationToolHandler
-);
-
-server.tool(
-    "query_code",
-    "Query code stored in a sqlite-vec database using vector search.",
-    {
-        queryText: z.string().min(1).describe("The natural language query to search for."),
-        productName: z.string().min(1).optional().describe("Filter results by product name stored in the DB (e.g., 'istio')."),
-        repo: z.string().min(1).optional().describe("Filter results by repo name stored in the DB (e.g., 'owner/repo')."),
-        dbName: z.string().min(1).describe("The database filename to query directly (e.g., 'repo.db' or 'repo')."),
-        branch: z.string().min(1).optional().describe("Branch name to filter code results (e.g., 'main')."),
-        filePathPrefix: z.string().min(1).optional().describe("Full file path prefix to filter code results (e.g., 'https://github.com/org/repo/blob/main/src/')."),
-        extensions: z.array(z.string().min(1)).optional().describe("File extensions to include (e.g., ['.go', '.rs'])."),
-        limit: z.number().int().positive().optional().default(4).describe("Maximum number of results to return. Defaults to 4."),
-    },
-    queryCodeToolHandler
-);
-
-server.tool(
-    "get_chunks",
-    "Retrieve specific chunks from a document by file path.",
-    {
-        productName: z.string().min(1).optional().describe("The name of the product documentation database to search within (e.g., 'my-product'). Corresponds to the DB filename without .db."),
-        dbName: z.string().min(1).optional().describe("The database filename to query directly (e.g., 'my-product.db' or 'my-product')."),
-        filePath: z.string().min(1).describe("The file path (url) of the document to retrieve chunks from."),
-        startIndex: z.number().int().nonnegative().optional().describe("Start index of the chunk range to retrieve (0-based). If not provided, returns all chunks from the beginning."),
-        endIndex: z.number().int().nonnegative().optional().describe("End index of the chunk range to retrieve (0-based, inclusive). If not provided, returns all chunks to the end."),
-        version: z.string().optional().describe("The specific version of the product documentation (e.g., '1.2.0'). Optional."),
-    },
-    getChunksToolHandler
-);
+// --- Define the MCP Tools ---
+// Optional namespace for tool names when several servers sit behind one MCP gateway.
+const rawToolPrefix = process.env.TOOL_PREFIX || '';
+if (rawToolPrefix && !/^[A-Za-z][A-Za-z0-9_-]*$/.test(rawToolPrefix)) {
+    console.error(`Error: TOOL_PREFIX '${rawToolPrefix}' must start with a letter and contain only letters, digits, '_' or '-'.`);
+    process.exit(1);
+}
+const toolPrefix = rawToolPrefix && !rawToolPrefix.endsWith('_') ? `${rawToolPrefix}_` : rawToolPrefix;
+
+const toolName = (name: string): string => `${toolPrefix}${name}`;
+
+// Shape of query_documentation's structured content, so clients can validate results
+// instead of parsing text. Extra fields (chunk_id, rowid, ...) are allowed through.
+const structuredResultSchema = z.object({
+    content: z.string(),
+    distance: z.number().describe("Vector distance (lower is closer), or the BM25 score when score_type is 'bm25'."),
+    score: z.number().describe("Higher-is-better relevance: 1 / (1 + distance), or the BM25 score in keyword mode."),
+    score_type: z.enum(['bm25']).optional(),
+    url: z.string().optional(),
+    section: z.string().optional(),
+    breadcrumb: z.string().optional().describe("Heading path of the chunk, e.g. 'Networking > Services > ClusterIP', when the database stores headings."),
+    product: z.string().optional(),
+    version: z.string().optional(),
+    chunk_id: z.string().optional(),
+    chunk_index: z.number().optional(),
+    total_chunks: z.number().optional(),
+    composite_score: z.number().optional().describe("Blended relevance from 0 to 1, present with ranking 'composite'."),
+    composite: z.object({
+        vector: z.number(),
+        keyword: z.number(),
+        recency: z.number(),
+    }).optional().describe("The 0 to 1 signals blended into composite_score, present with explain."),
+}).passthrough();
+
+// Validation errors come back as text without structured content; they are flagged as
+// errors so the SDK does not reject them for missing the declared output.
+const queryDocumentationWithOutput = async (args: Parameters<typeof queryDocumentationToolHandler>[0], extra?: ToolCallExtra) => {
+    const response = await queryDocumentationToolHandler(args, extra);
+    return 'structuredContent' in response ? response : { ...response, isError: true };
+};
+
+// Runs a tool call with its own usage record and reports, in the result's _meta, the
+// embedding tokens it used and the session's running total.
+function metered<A, R extends object>(handler: (args: A, extra?: ToolCallExtra) => Promise<R>) {
+    return (args: A, extra: ToolCallExtra & { sessionId?: string }) => {
+        const usage: ToolCallUsage = { sessionId: extra.sessionId ?? STDIO_SESSION_ID, embeddingTokens: 0 };
+        return toolCallUsage.run(usage, async () => {
+            const result = await handler(args, extra);
+            return {
+                ...result,
+                _meta: {
+                    ...(result as { _meta?: Record<string, unknown> })._meta,
+                    usage: {
+                        embeddingTokens: usage.embeddingTokens,
+                        sessionEmbeddingTokens: tokenLedger.used(usage.sessionId),
+                        ...(maxTokensPerSession > 0 && { sessionTokenBudget: maxTokensPerSession }),
+                    },
+                },
+            };
+        });
+    };
+}
+
+function registerTools(target: McpServer) {
+    target.registerTool(
+        toolName("query_documentation"),
+        {
+            description: "Query documentation stored in a sqlite-vec database using vector search.",
+            outputSchema: {
+                results: z.array(structuredResultSchema),
+                autoSelectedProduct: z.object({
+                    product: z.string(),
+                    similarity: z.number(),
+                }).optional().describe("Product chosen by automatic product detection, present when productName and dbName were omitted."),
+                context: z.string().optional().describe("Prompt-ready block of cited snippets, present when contextTokenBudget is set."),
+                totalCandidates: z.number().int().optional().describe("Matches that passed every filter before limit was applied, present when includeTotalCandidates is set."),
+                totalCandidatesCapped: z.boolean().optional().describe("True when the candidate fetch was full, so totalCandidates is a lower bound."),
+                embedding: z.object({
+                    provider: z.string(),
+                    model: z.string(),
+                }).optional().describe("Embedding provider and model that produced the query vector; absent in keyword mode."),
+            },
+            inputSchema: {
+                queryText: z.string().min(1).describe("The natural language query to search for."),
+                productName: z.string().min(1).optional().describe(`The name of the product documentation database to search within (e.g., 'my-product'). Corresponds to the DB filename without .db. A comma-separated list (e.g., 'kubernetes,istio') searches each product and merges the results.${autoDetectProduct ? ' Omit it, and dbName, to search the product that best matches the query.' : ''}`),
+                dbName: z.string().min(1).optional().describe("The database filename to query directly (e.g., 'my-product.db' or 'my-product')."),
+                version: z.string().optional().describe("The specific version of the product documentation (e.g., '1.2.0'). Optional."),
+                versions: z.array(z.string().min(1)).optional().describe(`Search each of these versions (e.g., ['1.29', '1.30']) and group the results by version, to compare how documentation changed across releases. Up to limit results per version. At most ${maxVersions} per call; cannot be combined with version.`),
+                urlPathPrefix: z.string().min(1).optional().describe("Full URL prefix to filter documentation results (e.g., 'https://docs.example.com/guide/')."),
+                limit: z.number().int().positive().optional().default(4).describe("Maximum number of results to return. Defaults to 4."),
+                uniqueUrls: z.boolean().optional().describe("Return only the best-matching chunk per distinct URL. Defaults to false."),
+                snippetSentences: z.number().int().positive().optional().describe("Return only this many sentences per result, centered on the sentence that best matches the query. Defaults to the whole chunk."),
+                mode: z.enum(['vector', 'keyword', 'sparse']).optional().default('vector').describe("'vector' for embedding search, 'keyword' for BM25 full-text search that skips embedding (requires an FTS5 index), or 'sparse' to fuse embedding search with learned sparse (SPLADE) scores (requires SPARSE_ENCODER_URL). Defaults to 'vector'."),
+                minDistance: z.number().nonnegative().optional().describe("Drop results whose distance is below this value, e.g. to skip near-duplicates and explore adjacent topics. Combine with maxDistance to select a distance band; must not exceed maxDistance. Not applied in keyword mode."),
+                maxDistance: z.number().nonnegative().optional().describe("Drop results whose distance is above this value. Defaults to the product's calibrated threshold, if any."),
+                contentFormat: z.enum(['raw', 'text', 'markdown']).optional().default('raw').describe("How to render stored content: 'raw' as stored, 'text' with HTML and Markdown syntax stripped, or 'markdown' with HTML stripped. Defaults to 'raw'."),
+                timing: z.boolean().optional().describe("Append a timing breakdown (embedding, db open, query, format) to the response. Defaults to false."),
+                boostExactTitleMatch: z.boolean().optional().describe("Move results whose title or content contains the exact query text to the top. Defaults to false."),
+                candidateMultiplier: z.number().min(1).max(MAX_CANDIDATE_MULTIPLIER).optional().describe(`Fetch limit x this many candidates before post-processing trims to limit, for better recall with uniqueUrls, urlPathPrefix or boostExactTitleMatch. 1 to ${MAX_CANDIDATE_MULTIPLIER}; defaults to 1.`),
+                excludeChunkIds: z.array(z.string().min(1)).optional().describe(`Chunk IDs to leave out of the results, e.g. chunks already in context. At most ${maxExcludeChunkIds} per call.`),
+                includeMatchOffset: z.boolean().optional().describe("Include the character offset of the first query term in each result's content (match_offset in JSON output), so clients can scroll to or excerpt the match. Most useful with mode 'keyword' or 'sparse'. Defaults to false."),
+                boosts: z.record(z.string(), z.number()).optional().describe(`Soft preferences as column=value -> multiplier, e.g. {"doc_type=reference": 1.5}. Matching results have their score multiplied and are re-ranked; nothing is filtered out. Multipliers from ${MIN_METADATA_BOOST} to ${MAX_METADATA_BOOST}.`),
+                includeTotalCandidates: z.boolean().optional().describe(`Report how many matches passed every filter before limit was applied, so agents can tell whether more results exist. Fetches up to limit x ${MAX_CANDIDATE_MULTIPLIER} candidates; when that fetch is full the count is a lower bound. Defaults to false.`),
+                contextTokenBudget: z.number().int().positive().optional().describe("Return one prompt-ready context block of [n]-cited snippets, packed best first within this many (estimated) tokens, instead of the result list. JSON output keeps the results and adds a context field."),
+                ...(queryProviders.length > 1 && {
+                    provider: z.enum(queryProviders as [string, ...string[]]).optional().describe(`Embedding provider to embed the query with, matching the provider the product was indexed with. Defaults to '${embeddingProvider}'.`),
+                }),
+                ranking: z.enum(['distance', 'composite']).optional().default('distance').describe(`'distance' orders results by vector distance; 'composite' re-ranks an over-fetched candidate set by a blend of vector similarity, query-term matches and recency (weights vector ${compositeWeights.vector}, keyword ${compositeWeights.keyword}, recency ${compositeWeights.recency}). Cannot be combined with mode 'keyword', boosts or boostExactTitleMatch. Defaults to 'distance'.`),
+                explain: z.boolean().optional().describe("With ranking 'composite', also return the vector, keyword and recency signals behind each composite_score. Defaults to false."),
+                includeRowid: z.boolean().optional().describe("Include each result's SQLite rowid in JSON output, for joining results with external metadata stores. Defaults to false."),
+                format: z.enum(['plain', 'markdown', 'json']).optional().default('plain').describe("Output format: 'plain' text, 'markdown' with [n] citations, or 'json'. Defaults to 'plain'."),
+            },
+        },
+        metered(queryDocumentationWithOutput)
+    );
+
+    target.tool(
+        toolName("query_code"),
+        "Query code stored in a sqlite-vec database using vector search.",
+        {
+            queryText: z.string().min(1).describe("The natural language query to search for."),
+            productName: z.string().min(1).optional().describe("Filter results by product name stored in the DB (e.g., 'istio')."),
+            repo: z.string().min(1).optional().describe("Filter results by repo name stored in the DB (e.g., 'owner/repo')."),
+            dbName: z.string().min(1).describe("The database filename to query directly (e.g., 'repo.db' or 'repo')."),
+            branch: z.string().min(1).optional().describe("Branch name to filter code results (e.g., 'main')."),
+            filePathPrefix: z.string().min(1).optional().describe("Full file path prefix to filter code results (e.g., 'https://github.com/org/repo/blob/main/src/')."),
+            extensions: z.array(z.string().min(1)).optional().describe("File extensions to include (e.g., ['.go', '.rs'])."),
+            limit: z.number().int().positive().optional().default(4).describe("Maximum number of results to return. Defaults to 4."),
+        },
+        metered(queryCodeToolHandler)
+    );
+
+    target.tool(
+        toolName("query_all_products"),
+        "Query documentation across every available product database and merge the results by distance.",
+        {
+            queryText: z.string().min(1).describe("The natural language query to search for."),
+            version: z.string().optional().describe("The specific version of the product documentation (e.g., '1.2.0'). Optional."),
+            limit: z.number().int().positive().optional().default(4).describe("Maximum number of results to return. Defaults to 4."),
+            deadlineMs: z.number().int().nonnegative().optional().describe("Time budget in milliseconds; products that do not finish in time are reported as timed out. Defaults to DEADLINE_MS."),
+        },
+        metered(queryAllProductsToolHandler)
+    );
+
+    target.tool(
+        toolName("compare_products"),
+        "Compare how well two products' documentation covers a query by their best-matching distances.",
+        {
+            queryText: z.string().min(1).describe("The natural language query to search for."),
+            productA: z.string().min(1).describe("The first product to compare (e.g., 'kubernetes')."),
+            productB: z.string().min(1).describe("The second product to compare (e.g., 'istio')."),
+            version: z.string().optional().describe("The specific version of the product documentation (e.g., '1.2.0'). Optional."),
+        },
+        metered(compareProductsToolHandler)
+    );
+
+    target.tool(
+        toolName("list_products"),
+        "List the product documentation databases available to query.",
+        {
+            validate: z.boolean().optional().describe("Open each listed database and report whether it is queryable. Slower on large deployments. Defaults to false."),
+            limit: z.number().int().positive().optional().describe("Maximum number of products to list. Defaults to, and is capped by, LIST_PRODUCTS_LIMIT."),
+        },
+        metered(listProductsToolHandler)
+    );
+
+    target.tool(
+        toolName("route_query"),
+        "Rank which products most likely contain the answer to a query, for routing questions when the product is unknown.",
+        {
+            queryText: z.string().min(1).describe("The natural language query to route."),
+            version: z.string().optional().describe("The specific version of the product documentation (e.g., '1.2.0'). Optional."),
+            limit: z.number().int().positive().optional().default(3).describe("Maximum number of products to return. Defaults to 3."),
+            products: z.array(z.string().min(1)).optional().describe("Candidate products to rank (e.g., ['kubernetes', 'istio']). Defaults to every available product."),
+            minSimilarity: z.number().min(0).max(1).optional().describe(`Leave out products whose best match has a similarity (1 / (1 + distance)) below this value. Defaults to ${routeMinSimilarity}.`),
+        },
+        metered(routeQueryToolHandler)
+    );
+
+    if (enableEmbedText) {
+        target.tool(
+            toolName("embed_text"),
+            "Return the embedding vector and its dimension for the given text, using the server's configured embedding provider and model.",
+            {
+                text: z.string().min(1).describe("The text to embed."),
+            },
+            metered(embedTextToolHandler)
+        );
+    }
+
+    if (enableTextSimilarity) {
+        target.tool(
+            toolName("text_similarity"),
+            "Embed two texts with the server's configured embedding model and return their cosine similarity, for checking how the model relates texts or building evaluation harnesses.",
+            {
+                textA: z.string().min(1).describe("The first text to compare."),
+                textB: z.string().min(1).describe("The second text to compare."),
+            },
+            metered(textSimilarityToolHandler)
+        );
+    }
+
+    target.tool(
+        toolName("refine_query"),
+        "Refine a previous documentation query with feedback (e.g., 'more about networking') and re-run the search, skipping results already seen.",
+        {
+            previousQuery: z.string().min(1).describe("The query that produced the previous results."),
+            feedback: z.string().min(1).describe("What to focus on next (e.g., 'more about networking')."),
+            productName: z.string().min(1).optional().describe("The name of the product documentation database to search within (e.g., 'my-product'). Corresponds to the DB filename without .db."),
+            dbName: z.string().min(1).optional().describe("The database filename to query directly (e.g., 'my-product.db' or 'my-product')."),
+            version: z.string().optional().describe("The specific version of the product documentation (e.g., '1.2.0'). Optional."),
+            limit: z.number().int().positive().optional().default(4).describe("Maximum number of results to return. Defaults to 4."),
+            previousChunkIds: z.array(z.string().min(1)).optional().describe("Chunk IDs from the previous results to leave out of the refined results."),
+        },
+        metered(refineQueryToolHandler)
+    );
+
+    if (enableAdminTools) {
+        target.tool(
+            toolName("validate_database"),
+            "Check a product database end to end (file, sqlite-vec, vector dimension, rows, columns and a sample query) and report each check's result.",
+            {
+                productName: z.string().min(1).optional().describe("The name of the product documentation database to validate (e.g., 'my-product')."),
+                dbName: z.string().min(1).optional().describe("The database filename to validate directly (e.g., 'my-product.db' or 'my-product')."),
+                sampleQuery: z.string().min(1).optional().describe(`Query used for the embedding dimension and sample query checks. Defaults to '${DEFAULT_VALIDATION_QUERY}'.`),
+                format: z.enum(['plain', 'json']).optional().default('plain').describe("Output format: 'plain' text or 'json'. Defaults to 'plain'."),
+            },
+            metered(validateDatabaseToolHandler)
+        );
+
+        target.tool(
+            toolName("calibrate_threshold"),
+            "Recompute a product's default maxDistance from a set of probe queries that should have relevant matches.",
+            {
+                productName: z.string().min(1).optional().describe("The name of the product documentation database to calibrate (e.g., 'my-product')."),
+                dbName: z.string().min(1).optional().describe("The database filename to calibrate directly (e.g., 'my-product.db' or 'my-product'). Must be a file in the database directory, not a path."),
+                probeQueries: z.array(z.string().min(1)).min(1).describe("Representative queries that the product's documentation is expected to answer."),
+                topK: z.number().int().positive().optional().default(3).describe("Number of results per probe treated as relevant. Defaults to 3."),
+                percentile: z.number().gt(0).max(1).optional().default(0.9).describe("Percentile of the observed distances used as the threshold. Defaults to 0.9."),
+            },
+            metered(calibrateThresholdToolHandler)
+        );
+    }
+
+    if (enableAdminTools && enableExportDocuments) {
+        target.tool(
+            toolName("export_documents"),
+            "Export a page of a product's chunks in stable rowid order (content, url and metadata, without vectors), for re-indexing with another embedding model or backup. Pass nextCursor back as cursor until it is absent. Requires the ADMIN_TOKEN bearer token.",
+            {
+                productName: z.string().min(1).optional().describe("The name of the product documentation database to export (e.g., 'my-product')."),
+                dbName: z.string().min(1).optional().describe("The database filename to export directly (e.g., 'my-product.db' or 'my-product')."),
+                cursor: z.number().int().nonnegative().optional().default(0).describe("Return chunks after this rowid: the nextCursor of the previous page. Defaults to 0, the first page."),
+                limit: z.number().int().positive().max(MAX_EXPORT_PAGE_SIZE).optional().default(DEFAULT_EXPORT_PAGE_SIZE).describe(`Chunks per page, at most ${MAX_EXPORT_PAGE_SIZE}. Defaults to ${DEFAULT_EXPORT_PAGE_SIZE}.`),
+            },
+            metered(requireAdminToken(exportDocumentsToolHandler))
+        );
+    }
+
+    target.tool(
+        toolName("get_chunks"),
+        "Retrieve specific chunks from a document by file path.",
+        {
+            productName: z.string().min(1).optional().describe("The name of the product documentation database to search within (e.g., 'my-product'). Corresponds to the DB filename without .db."),
+            dbName: z.string().min(1).optional().describe("The database filename to query directly (e.g., 'my-product.db' or 'my-product')."),
+            filePath: z.string().min(1).describe("The file path (url) of the document to retrieve chunks from."),
+            startIndex: z.number().int().nonnegative().optional().describe("Start index of the chunk range to retrieve (0-based). If not provided, returns all chunks from the beginning."),
+            endIndex: z.number().int().nonnegative().optional().describe("End index of the chunk range to retrieve (0-based, inclusive). If not provided, returns all chunks to the end."),
+            version: z.string().optional().describe("The specific version of the product documentation (e.g., '1.2.0'). Optional."),
+        },
+        metered(getChunksToolHandler)
+    );
+
+    target.tool(
+        toolName("get_chunks_by_ids"),
+        "Retrieve several chunks by their chunk IDs in one call, returned in request order.",
+        {
+            productName: z.string().min(1).optional().describe("The name of the product documentation database to search within (e.g., 'my-product'). Corresponds to the DB filename without .db."),
+            dbName: z.string().min(1).optional().describe("The database filename to query directly (e.g., 'my-product.db' or 'my-product')."),
+            chunkIds: z.array(z.string().min(1)).min(1).describe(`Chunk IDs to retrieve. At most ${maxChunkIds} per call.`),
+            version: z.string().optional().describe("The specific version of the product documentation (e.g., '1.2.0'). Optional."),
+        },
+        metered(getChunksByIdsToolHandler)
+    );
+}
+
+registerTools(server);
+
+// --- Admin Endpoints ---
+// Admin endpoints are only served on the HTTP/SSE transports and are disabled unless ADMIN_TOKEN is set.
+const adminToken = process.env.ADMIN_TOKEN;
+
+if (enableExportDocuments && enableAdminTools && !adminToken) {
+    console.warn('Warning: export_documents needs ADMIN_TOKEN; every call will be refused until it is set.');
+}
+
+function hasAdminAuthorization(authorization: string | string[] | undefined): boolean {
+    if (!adminToken || typeof authorization !== 'string') {
+        return false;
+    }
+    const provided = Buffer.from(authorization);
+    const expected = Buffer.from(`Bearer ${adminToken}`);
+    return provided.length === expected.length && timingSafeEqual(provided, expected);
+}
+
+function requireAdmin(req: Request, res: Response, next: NextFunction) {
+    if (!adminToken) {
+        res.status(404).send('Not Found');
+        return;
+    }
+
+    if (!hasAdminAuthorization(req.headers.authorization)) {
+        res.status(401).json({ error: 'Unauthorized' });
+        return;
+    }
+    next();
+}
+
+// Tool-level counterpart of requireAdmin: the call's HTTP request must carry the same bearer
+// token. stdio calls have no request headers, so they are always refused.
+function requireAdminToken<A, R extends object>(handler: (args: A, extra?: ToolCallExtra) => Promise<R>) {
+    return async (args: A, extra?: ToolCallExtra & { requestInfo?: { headers: Record<string, string | string[] | undefined> } }) => {
+        if (!hasAdminAuthorization(extra?.requestInfo?.headers.authorization)) {
+            return toolError('Unauthorized: this tool requires Authorization: Bearer <ADMIN_TOKEN> on the HTTP or SSE transport.', 'unauthorized');
+        }
+        return handler(args, extra);
+    };
+}
+
+// --- Connection Limit ---
+// Caps open streams and session-creating requests on the HTTP/SSE transports, so a flood of
+// clients cannot exhaust the server. Messages on an existing session, health, metrics and
+// admin endpoints are not counted.
+const maxConnections = Number(process.env.MAX_CONNECTIONS || '0');
+if (!Number.isInteger(maxConnections) || maxConnections < 0) {
+    console.error(`Error: MAX_CONNECTIONS '${process.env.MAX_CONNECTIONS}' must be a non-negative integer.`);
+    process.exit(1);
+}
+const limitConnections = createConnectionLimiter({
+    maxConnections,
+    onChange: (open) => metrics.setGauge('doc2vec_open_connections', 'MCP streams and session-creating requests currently open on the HTTP/SSE transports', {}, open),
+    onReject: () => metrics.incCounter('doc2vec_connections_rejected_total', 'MCP requests rejected because MAX_CONNECTIONS were open'),
+});
+
+// --- HTTP Error Status ---
+const responseStatuses = new WeakMap<StreamableHTTPServerTransport, Map<string | number, number>>();
+
+// Records the HTTP status each outgoing JSON-RPC response maps to, keyed by request id.
+function trackResponseStatuses(transport: StreamableHTTPServerTransport) {
+    const statuses = new Map<string | number, number>();
+    responseStatuses.set(transport, statuses);
+    const send = transport.send.bind(transport);
+    transport.send = async (message, options) => {
+        const id = (message as { id?: string | number }).id;
+        const status = httpStatusForResponse(message);
+        if (id !== undefined && status !== undefined) {
+            statuses.set(id, status);
+        }
+        return send(message, options);
+    };
+}
+
+// Swaps the transport's 200 for the recorded status of the first failing response in
+// the request (a batch can carry several). The JSON-RPC body is left untouched.
+function applyResponseStatus(transport: StreamableHTTPServerTransport, req: Request, res: Response) {
+    const statuses = responseStatuses.get(transport);
+    const ids = (Array.isArray(req.body) ? req.body : [req.body])
+        .map((message) => message?.id)
+        .filter((id): id is string | number => id !== undefined && id !== null);
+    if (!statuses || ids.length === 0) {
+        return;
+    }
+    const writeHead = res.writeHead;
+    res.writeHead = function (this: Response, statusCode: number, ...rest: unknown[]) {
+        const override = ids.map((id) => statuses.get(id)).find((status) => status !== undefined);
+        ids.forEach((id) => statuses.delete(id));
+        return Reflect.apply(writeHead, this, [statusCode === 200 && override ? override : statusCode, ...rest]);
+    } as Response['writeHead'];
+}
+
+// --- Health Detail ---
+const startedAt = Date.now();
+
+// Product checks open every database, so they are refreshed at most every
+// HEALTH_DETAIL_MAX_AGE_MS however often dashboards poll.
+const productHealth = createCachedLoader(async (): Promise<ProductHealth[]> => {
+    if (vectorDbType !== 'sqlite') {
+        return [];
+    }
+    const names = sqliteProvider.listDatabaseNames();
+    return checkProductHealth(
+        listProductsLimit > 0 ? names.slice(0, listProductsLimit) : names,
+        (product) => sqliteProvider.resolveDbPath(undefined, product).dbPath,
+        sqliteProvider.testConnection,
+        (dbPath) => path.basename(dbPath)
+    );
+}, HEALTH_DETAIL_MAX_AGE_MS);
+
+// Structured health for dashboards: provider settings, uptime, searches served and,
+// for SQLite, whether each product database (up to LIST_PRODUCTS_LIMIT) can be opened.
+async function healthDetail(): Promise<{ statusCode: number; body: Record<string, unknown> }> {
+    const products = await productHealth();
+
+    const unavailable = products.filter((entry) => entry.status === 'unavailable').length;
+    const status = products.length > 0 && unavailable === products.length
+        ? 'unhealthy'
+        : unavailable > 0 ? 'degraded' : 'healthy';
+    return {
+        statusCode: status === 'unhealthy' ? 503 : 200,
+        body: {
+            status,
+            uptimeSeconds: Math.round((Date.now() - startedAt) / 1000),
+            embeddingProvider,
+            embeddingModel: providerModel(embeddingProvider),
+            fallbackProvider: fallbackProvider || null,
+            vectorDbType,
+            queriesServed: (metrics.getValue('doc2vec_queries_total', { mode: 'vector' }) ?? 0)
+                + (metrics.getValue('doc2vec_queries_total', { mode: 'keyword' }) ?? 0),
+            products,
+        },
+    };
+}
+
+// --- Startup Validation ---
+// An empty SQLITE_DB_DIR, or one holding only broken databases, is usually a deployment
+// mistake (wrong volume or path); strict mode refuses to serve in that state.
+async function validateQueryableDatabases() {
+    if (vectorDbType !== 'sqlite') {
+        return;
+    }
+
+    const products = sqliteProvider.listDatabaseNames();
+    const checks = await Promise.all(products.map(async (product) => {
+        try {
+            await sqliteProvider.testConnection(sqliteProvider.resolveDbPath(undefined, product).dbPath);
+            return true;
+        } catch (error) {
+            console.warn(`Warning: product '${product}' is not queryable: ${error instanceof Error ? error.message : String(error)}`);
+            return false;
+        }
+    }));
+    if (checks.some((ok) => ok)) {
+        return;
+    }
+
+    const reason = products.length === 0
+        ? `no product databases found in ${productsManifest ? productsManifestPath : dbDir}`
+        : `none of the ${products.length} product databases in ${dbDir} can be queried`;
+    if (strictMode) {
+        console.error(`Error: ${reason}.`);
+        process.exit(1);
+    }
+    console.warn(`Warning: ${reason}. Queries will fail until databases are added (use STRICT_MODE=true to fail at startup).`);
+}
+
+// Keeps the product list used by list_products and routing in step with .db files
+// added or removed while serving.
+function startDatabaseRescan() {
+    if (vectorDbType !== 'sqlite' || dbRescanInterval === 0) {
+        return;
+    }
+
+    sqliteProvider.rescanDatabases();
+    setInterval(() => {
+        try {
+            const { added, removed } = sqliteProvider.rescanDatabases();
+            if (added.length > 0 || removed.length > 0) {
+                console.error(`Database rescan: added [${added.join(', ')}], removed [${removed.join(', ')}].`);
+            }
+        } catch (error) {
+            console.warn(`Warning: unable to rescan ${dbDir}:`, error);
+        }
+    }, dbRescanInterval * 1000).unref();
+}
+
+// Queries already notice a changed file, but this also releases the metadata of idle
+// databases that were replaced or deleted, and logs each one.
+function startDatabaseHealthCheck() {
+    if (vectorDbType !== 'sqlite' || dbHealthcheckInterval === 0) {
+        return;
+    }
+
+    setInterval(() => {
+        for (const dbPath of sqliteProvider.checkDatabaseFiles()) {
+            console.error(`Database health check: ${dbPath} changed on disk; dropped its cached metadata.`);
+        }
+    }, dbHealthcheckInterval * 1000).unref();
+}
+
+// Embeds a fixed string with the primary provider, bypassing the embedding cache, so invalid
+// keys or a wrong endpoint show up at startup rather than on the first user query.
+// Returns the probed dimension, or undefined when the probe is off or failed.
+async function probeEmbeddingProvider(): Promise<number | undefined> {
+    if (!probeProviderOnStart) {
+        return undefined;
+    }
+
+    const model = providerModel(embeddingProvider);
+    const expectedDimension = embeddingDimension ?? requestedDimension(embeddingProvider) ?? modelDimensions[model];
+    const startTime = Date.now();
+    let failure: string;
+    try {
+        const [embedding] = await createRetriedEmbeddings(embeddingProvider, ['doc2vec provider probe']);
+        const latencyMs = Date.now() - startTime;
+        if (expectedDimension === undefined || embedding.length === expectedDimension) {
+            console.error(`Embedding provider probe: ${embeddingProvider} (${model}) returned ${embedding.length} dimensions in ${latencyMs}ms.`);
+            return embedding.length;
+        }
+        failure = `returned ${embedding.length} dimensions, expected ${expectedDimension}`;
+    } catch (error) {
+        failure = `failed after ${Date.now() - startTime}ms: ${error instanceof Error ? error.message : String(error)}`;
+    }
+
+    if (strictMode) {
+        console.error(`Error: embedding provider probe for ${embeddingProvider} (${model}) ${failure}.`);
+        process.exit(1);
+    }
+    console.warn(`Warning: embedding provider probe for ${embeddingProvider} (${model}) ${failure}. Queries may fail (use STRICT_MODE=true to fail at startup).`);
+    return undefined;
+}
+
+// Compares the query embedding dimension against each SQLite database, catching a
+// model/database mismatch before the first user query. The dimension is configured, known
+// for the model, or measured by embedding a probe string with the configured model.
+async function validateEmbeddingDimensions(probedDimension?: number) {
+    if (vectorDbType !== 'sqlite') {
+        return;
+    }
+
+    // A configured or known dimension avoids the live probe, so the check also works offline.
+    const model = providerModel(embeddingProvider);
+    let probeDimension = embeddingDimension ?? requestedDimension(embeddingProvider) ?? modelDimensions[model] ?? probedDimension;
+    let dimensionSource = embeddingDimension !== undefined
+        ? 'EMBEDDING_DIMENSION'
+        : requestedDimension(embeddingProvider) !== undefined
+            ? 'OPENAI_DIMENSIONS'
+            : modelDimensions[model] !== undefined ? `known dimension of ${model}` : 'startup probe';
+    if (probeDimension === undefined && skipDimensionProbe) {
+        console.warn(`Warning: the dimension of ${model} is unknown and SKIP_DIMENSION_PROBE is set, skipping dimension validation. Set EMBEDDING_DIMENSION or MODEL_DIMENSIONS to check it offline.`);
+        return;
+    }
+    if (probeDimension === undefined) {
+        try {
+            probeDimension = (await createEmbeddings('doc2vec dimension probe')).length;
+            dimensionSource = 'startup probe';
+        } catch (error) {
+            console.warn(`Warning: could not embed startup probe, skipping dimension validation: ${error instanceof Error ? error.message : String(error)}`);
+            return;
+        }
+    }
+
+    // With QUERY_PROVIDERS, a product may be indexed with any of the selectable providers, so
+    // it is compatible when its dimension matches one of them. Those have no probe; a product
+    // matching none is left unchecked while any of their dimensions is unknown.
+    const providerDimensions = [{ provider: embeddingProvider, dimension: probeDimension, source: dimensionSource }];
+    const unknownProviders: string[] = [];
+    for (const provider of queryProviders.filter((candidate) => candidate !== embeddingProvider)) {
+        const providerDimension = requestedDimension(provider) ?? modelDimensions[providerModel(provider)];
+        if (providerDimension === undefined) {
+            unknownProviders.push(provider);
+            continue;
+        }
+        providerDimensions.push({
+            provider,
+            dimension: providerDimension,
+            source: requestedDimension(provider) !== undefined ? 'OPENAI_DIMENSIONS' : `known dimension of ${providerModel(provider)}`,
+        });
+    }
+    if (unknownProviders.length > 0) {
+        console.warn(`Warning: the dimension of query provider(s) ${unknownProviders.join(', ')} is unknown; add their models to MODEL_DIMENSIONS to check the products indexed with them.`);
+    }
+    const describedDimensions = providerDimensions.map(({ provider, dimension, source }) => `${provider}: ${dimension} from ${source}`).join('; ');
+
+    const incompatible: string[] = [];
+    console.error(`Embedding dimension compatibility (${describedDimensions}):`);
+    for (const product of sqliteProvider.listDatabaseNames()) {
+        const { dbPath } = sqliteProvider.resolveDbPath(undefined, product);
+        let storedDimension: number | undefined;
+        try {
+            storedDimension = await sqliteProvider.getStoredDimension(dbPath);
+        } catch (error) {
+            console.warn(`  ${product}: unable to read dimension (${error instanceof Error ? error.message : String(error)})`);
+            continue;
+        }
+
+        const matching = providerDimensions.filter(({ dimension }) => dimension === storedDimension).map(({ provider }) => provider);
+        if (storedDimension === undefined) {
+            console.error(`  ${product}: unknown`);
+        } else if (matching.length > 0) {
+            console.error(`  ${product}: ${storedDimension} OK (${matching.join(', ')})`);
+        } else if (unknownProviders.length > 0) {
+            console.error(`  ${product}: ${storedDimension} UNCHECKED (dimension of ${unknownProviders.join(', ')} unknown)`);
+        } else {
+            console.error(`  ${product}: ${storedDimension} MISMATCH`);
+            incompatible.push(product);
+        }
+    }
+
+    if (incompatible.length > 0) {
+        if (strictMode) {
+            console.error(`Error: no configured query provider (${describedDimensions}) matches the dimension of databases: ${incompatible.join(', ')}`);
+            process.exit(1);
+        }
+        console.warn(`Warning: no configured query provider (${describedDimensions}) matches the dimension of databases: ${incompatible.join(', ')}. Queries against them will fail.`);
+    }
+}
 
 // --- Transport Setup ---
+const transportSetting = configSetting('transport', flags.transport, 'TRANSPORT_TYPE', 'http')!;
+const portSetting = configSetting('port', flags.port, 'PORT', '3001')!;
+
+// One grep-able line with the effective configuration; secrets are masked.
+function logStartupBanner() {
+    let productCount: number | undefined;
+    if (vectorDbType === 'sqlite') {
+        try {
+            productCount = sqliteProvider.listDatabaseNames().length;
+        } catch (error) {
+            console.warn(`Warning: unable to list products in ${dbDir}:`, error);
+        }
+    }
+    const httpTransport = transportSetting !== 'stdio';
+    console.error(formatStartupBanner({
+        server: serverName,
+        version: serverVersion,
+        transport: transportSetting,
+        listenHost: httpTransport ? listenHost || '0.0.0.0' : undefined,
+        port: httpTransport ? Number(portSetting) : undefined,
+        path: transportSetting === 'http' ? httpPath : transportSetting === 'sse' ? ssePath : undefined,
+        httpErrorStatus: transportSetting === 'http' ? httpErrorStatus : undefined,
+        embeddingProvider,
+        embeddingModel: providerModel(embeddingProvider),
+        embeddingDimension,
+        fallbackProvider,
+        fallbackModel: fallbackProvider ? providerModel(fallbackProvider) : undefined,
+        openaiApiKey: maskApiKey(openAIApiKey),
+        azureApiKey: maskApiKey(azureApiKey),
+        azureEndpoint,
+        geminiApiKey: maskApiKey(geminiApiKey),
+        voyageApiKey: maskApiKey(voyageApiKey),
+        cohereApiKey: maskApiKey(cohereApiKey),
+        ollamaBaseUrl: configuredProviders.includes('ollama') ? ollamaBaseUrl : undefined,
+        vectorDb: vectorDbType,
+        dbDir: vectorDbType === 'sqlite' ? dbDir : undefined,
+        productsManifest: productsManifest ? productsManifestPath : undefined,
+        products: productCount,
+        dbRescanInterval: vectorDbType === 'sqlite' && dbRescanInterval > 0 ? dbRescanInterval : undefined,
+        dbHealthcheckInterval: vectorDbType === 'sqlite' && dbHealthcheckInterval > 0 ? dbHealthcheckInterval : undefined,
+        qdrantUrl: vectorDbType === 'qdrant' ? qdrantUrl : undefined,
+        qdrantApiKey: vectorDbType === 'qdrant' ? maskApiKey(qdrantApiKey) : undefined,
+        embeddingCache: embeddingCachePath ? 'disk' : embeddingCacheSize > 0 ? 'memory' : undefined,
+        sparseSearch: !!sparseEncoderUrl,
+        adminEndpoints: !!adminToken,
+        maxConnections: httpTransport && maxConnections > 0 ? maxConnections : undefined,
+        maxTokensPerSession: maxTokensPerSession > 0 ? maxTokensPerSession : undefined,
+        requestTimeoutMs: requestTimeoutMs > 0 ? requestTimeoutMs : undefined,
+        redactPatterns: redactPatterns.length > 0 ? redactPatterns.length : undefined,
+        strictMode,
+        autoDetectProduct: autoDetectProduct || undefined,
+        logLevel,
+        probeProvider: probeProviderOnStart,
+        skipDimensionProbe: skipDimensionProbe || undefined,
+        toolPrefix: toolPrefix || undefined,
+    }, logFormat));
+}
+
 async function main() {
-    const transport_type = process.env.TRANSPORT_TYPE || 'http';
+    await validateQueryableDatabases();
+    await validateEmbeddingDimensions(await probeEmbeddingProvider());
+    startDatabaseRescan();
+    startDatabaseHealthCheck();
+    if (debugConfig) {
+        logEnvSettings();
+    }
+    logStartupBanner();
+
+    const transport_type = transportSetting;
     let webserver: any = null; // Store server reference for proper shutdown
     
     // Common graceful shutdown handler
@@ -271,8 +2016,10 @@ async function main() {
                     });
                 }
 
-                // Clean up transports
+                // Abort embedding requests first so open tool calls finish, then clean up transports
+                closeEmbeddingClients();
                 await transportCleanup();
+                embeddingCache?.close?.();
 
                 clearTimeout(forceExitTimeout);
                 console.error('Graceful shutdown complete');
@@ -311,18 +2058,20 @@ async function main() {
         // Storage for SSE transports by session ID
         const sseTransports: {[sessionId: string]: SSEServerTransport} = {};
 
-        app.get("/sse", async (_: Request, res: Response) => {
+        app.get(ssePath, limitConnections(), async (_: Request, res: Response) => {
             console.error('Received SSE connection request');
-            const transport = new SSEServerTransport('/messages', res);
+            const transport = new SSEServerTransport(sseMessagesPath, res);
             sseTransports[transport.sessionId] = transport;
             res.on("close", () => {
                 console.error(`SSE connection closed for session ${transport.sessionId}`);
                 delete sseTransports[transport.sessionId];
+                tokenLedger.forget(transport.sessionId);
             });
             await server.connect(transport);
         });
 
-        app.post("/messages", async (req: Request, res: Response) => {
+        // Messages belong to an SSE stream that already holds a connection slot.
+        app.post(sseMessagesPath, async (req: Request, res: Response) => {
             console.error('Received SSE message POST request');
             const sessionId = req.query.sessionId as string;
             const transport = sseTransports[sessionId];
@@ -338,11 +2087,25 @@ async function main() {
             res.status(200).send("OK");
         });
 
-        const PORT = process.env.PORT || 3001;
-        webserver = app.listen(PORT, () => {
-            console.error(`MCP server is running on port ${PORT} with SSE transport`);
-            console.error(`Connect to: http://localhost:${PORT}/sse`);
+        app.get("/health/detail", requireAdmin, async (_: Request, res: Response) => {
+            const { statusCode, body } = await healthDetail();
+            res.status(statusCode).json(body);
         });
+
+        app.get("/metrics", (_: Request, res: Response) => {
+            res.status(200).type('text/plain; version=0.0.4').send(metrics.render());
+        });
+
+        app.get("/admin/connections", requireAdmin, (_: Request, res: Response) => {
+            res.status(200).json({ connections: vectorDbType === 'sqlite' ? sqliteProvider.getDatabaseStats() : [] });
+        });
+
+        const PORT = portSetting;
+        const onSseListening = () => {
+            console.error(`MCP server is running on ${listenHost || 'all interfaces'}, port ${PORT} with SSE transport`);
+            console.error(`Connect to: http://${listenHost || 'localhost'}:${PORT}${ssePath}`);
+        };
+        webserver = listenHost ? app.listen(Number(PORT), listenHost, onSseListening) : app.listen(PORT, onSseListening);
         
         webserver.keepAliveTimeout = 3000;
         
@@ -379,8 +2142,13 @@ async function main() {
         const transports: Map<string, StreamableHTTPServerTransport> = new Map<string, StreamableHTTPServerTransport>();
         const servers: Map<string, McpServer> = new Map<string, McpServer>();
         
-        // Handle POST requests for MCP initialization and method calls
-        app.post('/mcp', async (req: Request, res: Response) => {
+        // Handle POST requests for MCP initialization and method calls. Only requests that
+        // would open a new session count against MAX_CONNECTIONS.
+        const hasKnownSession = (req: { headers: Record<string, string | string[] | undefined> }) => {
+            const sessionId = req.headers['mcp-session-id'];
+            return typeof sessionId === 'string' && transports.has(sessionId);
+        };
+        app.post(httpPath, limitConnections(hasKnownSession), async (req: Request, res: Response) => {
             console.error('Received MCP POST request');
             try {
                 // Check for existing session ID
@@ -402,52 +2170,13 @@ async function main() {
                     });
 
                     // Add tools to this server instance using shared handlers
-                    sessionServer.tool(
-                        "query_documentation",
-                        "Query documentation stored in a sqlite-vec database using vector search.",
-                        {
-                            queryText: z.string().min(1).describe("The natural language query to search for."),
-                            productName: z.string().min(1).optional().describe("The name of the product documentation database to search within (e.g., 'my-product'). Corresponds to the DB filename without .db."),
-                            dbName: z.string().min(1).optional().describe("The database filename to query directly (e.g., 'my-product.db' or 'my-product')."),
-                            version: z.string().optional().describe("The specific version of the product documentation (e.g., '1.2.0'). Optional."),
-                            urlPathPrefix: z.string().min(1).optional().describe("Full URL prefix to filter documentation results (e.g., 'https://docs.example.com/guide/')."),
-                            limit: z.number().int().positive().optional().default(4).describe("Maximum number of results to return. Defaults to 4."),
-                        },
-                        queryDocumentationToolHandler
-                    );
-
-                    sessionServer.tool(
-                        "query_code",
-                        "Query code stored in a sqlite-vec database using vector search.",
-                        {
-                            queryText: z.string().min(1).describe("The natural language query to search for."),
-                            productName: z.string().min(1).optional().describe("Filter results by product name stored in the DB (e.g., 'istio')."),
-                            repo: z.string().min(1).optional().describe("Filter results by repo name stored in the DB (e.g., 'owner/repo')."),
-                            dbName: z.string().min(1).describe("The database filename to query directly (e.g., 'repo.db' or 'repo')."),
-                            branch: z.string().min(1).optional().describe("Branch name to filter code results (e.g., 'main')."),
-                            filePathPrefix: z.string().min(1).optional().describe("Full file path prefix to filter code results (e.g., 'https://github.com/org/repo/blob/main/src/')."),
-                            extensions: z.array(z.string().min(1)).optional().describe("File extensions to include (e.g., ['.go', '.rs'])."),
-                            limit: z.number().int().positive().optional().default(4).describe("Maximum number of results to return. Defaults to 4."),
-                        },
-                        queryCodeToolHandler
-                    );
-                    
-                    sessionServer.tool(
-                        "get_chunks",
-                        "Retrieve specific chunks from a document by file path.",
-                        {
-                            productName: z.string().min(1).optional().describe("The name of the product documentation database to search within (e.g., 'my-product'). Corresponds to the DB filename without .db."),
-                            dbName: z.string().min(1).optional().describe("The database filename to query directly (e.g., 'my-product.db' or 'my-product')."),
-                            filePath: z.string().min(1).describe("The file path (url) of the document to retrieve chunks from."),
-                            startIndex: z.number().int().nonnegative().optional().describe("Start index of the chunk range to retrieve (0-based). If not provided, returns all chunks from the beginning."),
-                            endIndex: z.number().int().nonnegative().optional().describe("End index of the chunk range to retrieve (0-based, inclusive). If not provided, returns all chunks to the end."),
-                            version: z.string().optional().describe("The specific version of the product documentation (e.g., '1.2.0'). Optional."),
-                        },
-                        getChunksToolHandler
-                    );
+                    registerTools(sessionServer);
 
                     transport = new StreamableHTTPServerTransport({
                         sessionIdGenerator: () => randomUUID(),
+                        // Status codes need the whole response before headers go out, so
+                        // answer with a JSON body instead of an SSE stream.
+                        enableJsonResponse: httpErrorStatus,
                         onsessioninitialized: (sessionId: string) => {
                             // Store the transport and server by session ID when session is initialized
                             console.error(`Session initialized with ID: ${sessionId}`);
@@ -464,11 +2193,17 @@ async function main() {
                             transports.delete(sid);
                             servers.delete(sid);
                         }
+                        if (sid) {
+                            tokenLedger.forget(sid);
+                        }
                     };
 
                     // Connect the transport to the session-specific MCP s
                     // erver BEFORE handling the request
                     await sessionServer.connect(transport);
+                    if (httpErrorStatus) {
+                        trackResponseStatuses(transport);
+                    }
 
                     await transport.handleRequest(req, res);
                     return; // Already handled
@@ -486,6 +2221,9 @@ async function main() {
                 }
 
                 // Handle the request with existing transport
+                if (httpErrorStatus) {
+                    applyResponseStatus(transport, req, res);
+                }
                 await transport.handleRequest(req, res);
             } catch (error) {
                 console.error('Error handling MCP request:', error);
@@ -503,7 +2241,7 @@ async function main() {
         });
 
         // Handle GET requests for SSE streams
-        app.get('/mcp', async (req: Request, res: Response) => {
+        app.get(httpPath, limitConnections(), async (req: Request, res: Response) => {
             console.error('Received MCP GET request');
             const sessionId = req.headers['mcp-session-id'] as string | undefined;
             if (!sessionId || !transports.has(sessionId)) {
@@ -531,7 +2269,7 @@ async function main() {
         });
 
         // Handle DELETE requests for session termination
-        app.delete('/mcp', async (req: Request, res: Response) => {
+        app.delete(httpPath, async (req: Request, res: Response) => {
             const sessionId = req.headers['mcp-session-id'] as string | undefined;
             if (!sessionId || !transports.has(sessionId)) {
                 res.status(400).json({
@@ -568,12 +2306,26 @@ async function main() {
         app.get("/health", (_: Request, res: Response) => {
             res.status(200).send("OK");
         });
-        
-        const PORT = process.env.PORT || 3001;
-        webserver = app.listen(PORT, () => {
-            console.error(`MCP server is running on port ${PORT} with HTTP transport`);
-            console.error(`Connect to: http://localhost:${PORT}/mcp`);
+
+        app.get("/health/detail", requireAdmin, async (_: Request, res: Response) => {
+            const { statusCode, body } = await healthDetail();
+            res.status(statusCode).json(body);
+        });
+
+        app.get("/metrics", (_: Request, res: Response) => {
+            res.status(200).type('text/plain; version=0.0.4').send(metrics.render());
         });
+
+        app.get("/admin/connections", requireAdmin, (_: Request, res: Response) => {
+            res.status(200).json({ connections: vectorDbType === 'sqlite' ? sqliteProvider.getDatabaseStats() : [] });
+        });
+        
+        const PORT = portSetting;
+        const onHttpListening = () => {
+            console.error(`MCP server is running on ${listenHost || 'all interfaces'}, port ${PORT} with HTTP transport`);
+            console.error(`Connect to: http://${listenHost || 'localhost'}:${PORT}${httpPath}`);
+        };
+        webserver = listenHost ? app.listen(Number(PORT), listenHost, onHttpListening) : app.listen(PORT, onHttpListening);
         
         webserver.keepAliveTimeout = 3000;
         
@@ -0,0 +1,109 @@
+export type MetricLabels = Record<string, string>;
+
+type MetricType = 'counter' | 'gauge' | 'histogram';
+
+type HistogramValue = {
+    buckets: number[];
+    sum: number;
+    count: number;
+};
+
+type MetricFamily = {
+    type: MetricType;
+    help: string;
+    values: Map<string, { labels: MetricLabels; value: number | HistogramValue }>;
+};
+
+export const DEFAULT_LATENCY_BUCKETS_MS = [10, 50, 100, 250, 500, 1000, 2500, 5000, 10000];
+
+const labelKey = (labels: MetricLabels): string =>
+    Object.keys(labels).sort().map((key) => `${key}=${labels[key]}`).join(',');
+
+const escapeLabelValue = (value: string): string =>
+    value.replace(/\\/g, '\\\\').replace(/\n/g, '\\n').replace(/"/g, '\\"');
+
+const formatLabels = (labels: MetricLabels, extra?: MetricLabels): string => {
+    const all = { ...labels, ...extra };
+    const keys = Object.keys(all);
+    if (keys.length === 0) {
+        return '';
+    }
+    return `{${keys.map((key) => `${key}="${escapeLabelValue(all[key])}"`).join(',')}}`;
+};
+
+// Minimal in-process registry rendered in the Prometheus text exposition format.
+export class MetricsRegistry {
+    private families = new Map<string, MetricFamily>();
+
+    constructor(private latencyBuckets: number[] = DEFAULT_LATENCY_BUCKETS_MS) {}
+
+    private family(name: string, type: MetricType, help: string): MetricFamily {
+        let family = this.families.get(name);
+        if (!family) {
+            family = { type, help, values: new Map() };
+            this.families.set(name, family);
+        }
+        return family;
+    }
+
+    incCounter(name: string, help: string, labels: MetricLabels = {}, value: number = 1) {
+        const family = this.family(name, 'counter', help);
+        const key = labelKey(labels);
+        const current = family.values.get(key);
+        family.values.set(key, { labels, value: ((current?.value as number | undefined) ?? 0) + value });
+    }
+
+    setGauge(name: string, help: string, labels: MetricLabels = {}, value: number) {
+        const family = this.family(name, 'gauge', help);
+        family.values.set(labelKey(labels), { labels, value });
+    }
+
+    observe(name: string, help: string, labels: MetricLabels = {}, value: number) {
+        const family = this.family(name, 'histogram', help);
+        const key = labelKey(labels);
+        let entry = family.values.get(key);
+        if (!entry) {
+            entry = { labels, value: { buckets: this.latencyBuckets.map(() => 0), sum: 0, count: 0 } };
+            family.values.set(key, entry);
+        }
+        const histogram = entry.value as HistogramValue;
+        this.latencyBuckets.forEach((bound, index) => {
+            if (value <= bound) {
+                histogram.buckets[index] += 1;
+            }
+        });
+        histogram.sum += value;
+        histogram.count += 1;
+    }
+
+    getValue(name: string, labels: MetricLabels = {}): number | undefined {
+        const entry = this.families.get(name)?.values.get(labelKey(labels));
+        if (!entry) {
+            return undefined;
+        }
+        return typeof entry.value === 'number' ? entry.value : entry.value.count;
+    }
+
+    render(): string {
+        const lines: string[] = [];
+        for (const [name, family] of this.families) {
+            lines.push(`# HELP ${name} ${family.help}`);
+            lines.push(`# TYPE ${name} ${family.type}`);
+            for (const { labels, value } of family.values.values()) {
+                if (typeof value === 'number') {
+                    lines.push(`${name}${formatLabels(labels)} ${value}`);
+                    continue;
+                }
+                this.latencyBuckets.forEach((bound, index) => {
+                    lines.push(`${name}_bucket${formatLabels(labels, { le: String(bound) })} ${value.buckets[index]}`);
+                });
+                lines.push(`${name}_bucket${formatLabels(labels, { le: '+Inf' })} ${value.count}`);
+                lines.push(`${name}_sum${formatLabels(labels)} ${value.sum}`);
+                lines.push(`${name}_count${formatLabels(labels)} ${value.count}`);
+            }
+        }
+        return `${lines.join('\n')}\n`;
+    }
+}
+
+export const metrics = new MetricsRegistry();
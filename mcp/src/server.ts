@@ -1,13 +1,20 @@
+import { AsyncLocalStorage } from 'async_hooks';
+import { createHash } from 'crypto';
+
 export interface QueryResult {
     chunk_id: string;
     distance?: number;
     content: string;
     url?: string;
     section?: string;
-    heading_hierarchy?: string;
+    // JSON array text in SQLite, an array in Qdrant payloads.
+    heading_hierarchy?: string | string[];
     chunk_index?: number;
     total_chunks?: number;
     embedding?: Float32Array | number[];
+    matched_version?: string;
+    provenance_hash?: string;
+    rowid?: number | bigint;
     [key: string]: unknown;
 }
 
@@ -18,15 +25,25 @@ export type QueryFilter = {
     repo?: string;
     urlPrefix?: string;
     extensions?: string[];
+    excludeChunkIds?: string[];
 };
 
 export type ResolveDbPath = (dbName?: string, productName?: string, version?: string, repo?: string) => { dbPath: string; dbLabel: string };
 
+export type QueryTimings = {
+    embeddingMs?: number;
+    dbOpenMs?: number;
+    queryMs?: number;
+    formatMs?: number;
+};
+
+// Providers fill in `timings` (when given) with the parts of the search they can measure.
 export type QueryCollection = (
     queryEmbedding: number[],
     dbPath: string,
     filter: QueryFilter,
-    topK?: number
+    topK?: number,
+    timings?: QueryTimings
 ) => Promise<QueryResult[]>;
 
 export type GetChunksForDocument = (
@@ -38,6 +55,333 @@ export type GetChunksForDocument = (
     version?: string
 ) => Promise<QueryResult[]>;
 
+export type KeywordSearch = (
+    queryText: string,
+    dbPath: string,
+    filter: QueryFilter,
+    topK?: number
+) => Promise<QueryResult[]>;
+
+// Learned sparse (e.g. SPLADE) vector: term or vocabulary index -> weight.
+export type SparseVector = Record<string, number>;
+
+// Rows come back with `distance` set to 1 - score / best score, so they can be fused
+// with dense distances.
+export type SparseSearch = (
+    sparseQuery: SparseVector,
+    dbPath: string,
+    filter: QueryFilter,
+    topK?: number
+) => Promise<QueryResult[]>;
+
+export type GetChunksByIds = (
+    productName: string | undefined,
+    dbName: string | undefined,
+    chunkIds: string[],
+    version?: string
+) => Promise<QueryResult[]>;
+
+export type DistanceCalibration = {
+    threshold: number;
+    percentile: number;
+    probeCount: number;
+    calibratedAt: string;
+};
+
+export type TestConnection = (dbPath: string) => Promise<void>;
+
+// What validate_database learned about a database file; failures are recorded, not thrown.
+export type DatabaseInspection = {
+    exists: boolean;
+    openError?: string;
+    vecVersion?: string;
+    vecError?: string;
+    dimension?: number;
+    rowCount?: number;
+    columns: string[];
+};
+
+export type InspectDatabase = (dbPath: string) => Promise<DatabaseInspection>;
+
+// Provider and model that produced a query vector, for attributing results to a model.
+export type EmbeddingSource = {
+    provider: string;
+    model: string;
+};
+
+// Looks up which provider and model produced an embedding returned by createEmbeddings.
+export type DescribeEmbedding = (embedding: number[]) => EmbeddingSource | undefined;
+
+// Vector dimension declared by a database's vec_items table, or undefined when unknown.
+export type GetStoredDimension = (dbPath: string) => Promise<number | undefined>;
+
+// Columns of a database's vec_items table, as PRAGMA table_info lists them.
+export type GetColumns = (dbPath: string) => Promise<string[]>;
+
+// One page of a database's chunks in rowid order, with the row count for progress.
+// hasMore is set when rows past the last one returned remain.
+export type ExportedChunks = {
+    rows: QueryResult[];
+    total: number;
+    hasMore: boolean;
+};
+
+// Returns chunks whose rowid is above afterRowid; 0 starts from the beginning.
+export type ExportChunks = (dbPath: string, afterRowid: number, limit: number) => Promise<ExportedChunks>;
+
+export type DatabaseCheckStatus = 'pass' | 'fail' | 'skip';
+
+export type DatabaseCheck = {
+    name: string;
+    status: DatabaseCheckStatus;
+    detail: string;
+};
+
+// One product listed in a products.json manifest; `db` is relative to the database directory.
+export type ProductManifestEntry = {
+    name: string;
+    db: string;
+    defaultVersion?: string;
+    displayName?: string;
+};
+
+export type GetProductInfo = (product: string) => ProductManifestEntry | undefined;
+
+// Highest version stored in a database, or undefined when it has no versions.
+export type GetLatestVersion = (dbPath: string) => Promise<string | undefined>;
+
+// What to search when a request names no version: every version, or only the newest.
+export type DefaultVersionStrategy = 'all' | 'latest';
+
+export type GetDistanceThreshold = (dbPath: string) => number | undefined;
+
+export type SaveDistanceCalibration = (dbPath: string, calibration: DistanceCalibration) => void;
+
+export type QueryLengthMode = 'reject' | 'truncate';
+
+export type QueryTrimMode = 'none' | 'edges' | 'collapse';
+
+export type TruncateStrategy = 'error' | 'head' | 'tail' | 'middle';
+
+export type ByteOrder = 'little' | 'big';
+
+// How stored vectors are encoded: float32, or scalar-quantized to one signed byte per dimension.
+export type VectorQuantization = 'none' | 'int8';
+
+export type QueryHandlerOptions = {
+    maxQueryChars?: number;
+    queryLengthMode?: QueryLengthMode;
+    queryTrimMode?: QueryTrimMode;
+    minQueryLength?: number;
+    deadlineMs?: number;
+    maxChunkIds?: number;
+    maxExcludeChunkIds?: number;
+    maxVersions?: number;
+    listProductsLimit?: number;
+    includeQueryEcho?: boolean;
+    resultTemplate?: ResultTemplate;
+    messages?: QueryMessages;
+    sparseWeight?: number;
+    routeMinSimilarity?: number;
+    slowQueryThresholdMs?: number;
+    defaultVersionStrategy?: DefaultVersionStrategy;
+    // Embedding providers query_documentation may select per query; empty disables selection.
+    queryProviders?: string[];
+    // Matches in returned chunk content are replaced with REDACTED_PLACEHOLDER.
+    redactPatterns?: RegExp[];
+    compositeWeights?: CompositeWeights;
+    // Deadline for the embedding requests of one tool call; 0 leaves them to the client.
+    requestTimeoutMs?: number;
+    // vec_items column holding each chunk's last-modified time, for the recency signal.
+    recencyColumn?: string;
+    recencyHalfLifeDays?: number;
+    // With productName and dbName omitted, query_documentation routes the query to one product.
+    autoDetectProduct?: boolean;
+    autoDetectMinSimilarity?: number;
+    autoDetectMaxProducts?: number;
+    // Dimension of the primary provider's embeddings when configuration already says it, so
+    // validate_database can check a database's dimension without calling the provider.
+    embeddingDimension?: number;
+};
+
+export const DEFAULT_MAX_QUERY_CHARS = 8000;
+export const DEFAULT_MIN_QUERY_LENGTH = 2;
+export const DEFAULT_MAX_CHUNK_IDS = 50;
+export const DEFAULT_MAX_EXCLUDE_CHUNK_IDS = 100;
+export const DEFAULT_MAX_VERSIONS = 5;
+export const DEFAULT_LIST_PRODUCTS_LIMIT = 200;
+export const MAX_CANDIDATE_MULTIPLIER = 10;
+export const DEFAULT_AUTO_DETECT_MIN_SIMILARITY = 0.5;
+export const DEFAULT_AUTO_DETECT_MAX_PRODUCTS = 20;
+export const LATEST_VERSION_CACHE_MS = 60_000;
+export const MIN_METADATA_BOOST = 0.1;
+export const MAX_METADATA_BOOST = 10;
+// vec_items columns every search and retrieval path reads.
+export const REQUIRED_VEC_ITEMS_COLUMNS = ['chunk_id', 'content', 'url'];
+export const DEFAULT_VALIDATION_QUERY = 'getting started';
+export const DEFAULT_EXPORT_PAGE_SIZE = 100;
+export const MAX_EXPORT_PAGE_SIZE = 1000;
+export const MAX_PRODUCT_SUGGESTION_DISTANCE = 3;
+export const DEFAULT_COMPOSITE_WEIGHTS: CompositeWeights = { vector: 0.8, keyword: 0.2, recency: 0 };
+export const DEFAULT_RECENCY_HALF_LIFE_DAYS = 180;
+
+// Input token limits of each provider's default embedding models.
+export const DEFAULT_EMBEDDING_MAX_TOKENS: Record<string, number> = {
+    openai: 8191,
+    azure: 8191,
+    gemini: 2048,
+    voyage: 32000,
+    cohere: 512,
+    ollama: 2048,
+};
+
+// Output dimensions of well-known embedding models, so the startup compatibility check
+// can run without an embedding call. Extended or overridden by MODEL_DIMENSIONS.
+export const KNOWN_MODEL_DIMENSIONS: Record<string, number> = {
+    'text-embedding-3-large': 3072,
+    'text-embedding-3-small': 1536,
+    'text-embedding-ada-002': 1536,
+    'gemini-embedding-001': 3072,
+    'text-embedding-004': 768,
+    'voyage-3': 1024,
+    'voyage-3-large': 1024,
+    'voyage-3-lite': 512,
+    'voyage-code-2': 1536,
+    'voyage-code-3': 1024,
+    'embed-english-v3.0': 1024,
+    'embed-multilingual-v3.0': 1024,
+    'embed-english-light-v3.0': 384,
+    'embed-multilingual-light-v3.0': 384,
+    'nomic-embed-text': 768,
+    'mxbai-embed-large': 1024,
+    'all-minilm': 384,
+};
+
+// Cohere input types; doc2vec embeds queries, so search_query is the usual choice.
+export const COHERE_INPUT_TYPES = ['search_query', 'search_document', 'classification', 'clustering'] as const;
+export type CohereInputType = typeof COHERE_INPUT_TYPES[number];
+
+// Parses MODEL_DIMENSIONS entries such as "my-deployment:3072,custom-model:768".
+export function parseModelDimensions(raw?: string): Record<string, number> {
+    const dimensions: Record<string, number> = {};
+    if (!raw || raw.trim().length === 0) {
+        return dimensions;
+    }
+    for (const entry of raw.split(',').map((part) => part.trim()).filter((part) => part.length > 0)) {
+        const separator = entry.lastIndexOf(':');
+        const model = entry.slice(0, separator).trim();
+        const dimension = Number(entry.slice(separator + 1).trim());
+        if (separator <= 0 || model.length === 0 || !Number.isInteger(dimension) || dimension <= 0) {
+            throw new Error(`Invalid MODEL_DIMENSIONS entry '${entry}'. Expected model:dimension, e.g. text-embedding-3-large:3072.`);
+        }
+        dimensions[model] = dimension;
+    }
+    return dimensions;
+}
+
+// Without a tokenizer, tokens are estimated from characters. Three characters per token
+// undercounts typical English (about four), so truncated text stays under the limit.
+const ESTIMATED_CHARS_PER_TOKEN = 3;
+
+export const estimateTokens = (text: string): number => Math.ceil(text.length / ESTIMATED_CHARS_PER_TOKEN);
+export const DEFAULT_DB_BUSY_TIMEOUT_MS = 5000;
+export const DEFAULT_DB_BUSY_RETRIES = 3;
+export const DEFAULT_DB_OPEN_RETRIES = 2;
+export const DEFAULT_EMBEDDING_MAX_RETRIES = 2;
+export const DEFAULT_EMBEDDING_RETRY_BASE_DELAY_MS = 500;
+export const DEFAULT_FTS_TABLE = 'vec_items_fts';
+export const DEFAULT_MAX_EMBEDDING_DIMENSION = 16384;
+export const DEFAULT_SPARSE_COLUMN = 'sparse_embedding';
+export const DEFAULT_SPARSE_WEIGHT = 0.3;
+export const DEFAULT_SPARSE_MAX_SCAN_ROWS = 20000;
+export const PRODUCTS_MANIFEST_FILE = 'products.json';
+
+const RETRY_BASE_DELAY_MS = 50;
+
+export type ScoreType = 'distance' | 'bm25';
+
+export type SearchMode = 'vector' | 'keyword' | 'sparse';
+
+export type RankingMode = 'distance' | 'composite';
+
+// Weights of the signals blended into a composite score.
+export type CompositeWeights = { vector: number; keyword: number; recency: number };
+
+// The [0, 1] signals a composite score was blended from, reported with `explain`.
+export type CompositeComponents = { vector: number; keyword: number; recency: number };
+
+export type DocumentationResult = {
+    chunk_id?: string;
+    distance: number;
+    score_type?: ScoreType;
+    content: string;
+    url?: string;
+    section?: string;
+    // Heading path of the chunk, e.g. "Networking > Services > ClusterIP".
+    breadcrumb?: string;
+    chunk_index?: number;
+    total_chunks?: number;
+    product?: string;
+    matched_version?: string;
+    // Set when a query spans several versions, naming the version the result was searched in.
+    version?: string;
+    provenance_hash?: string;
+    rowid?: number;
+    match_offset?: number;
+    composite_score?: number;
+    composite?: CompositeComponents;
+};
+
+export type ResultFormat = 'plain' | 'markdown' | 'json';
+
+// Typed form of a query_documentation result, returned as MCP structured content.
+export type StructuredResult = DocumentationResult & {
+    score: number;
+    product?: string;
+    version?: string;
+};
+
+export type ContentFormat = 'raw' | 'text' | 'markdown';
+
+// Filled in (when given) with how many candidates passed every filter before `limit` was
+// applied. `capped` means the candidate fetch was full, so more matches may exist.
+export type CandidateCount = {
+    total: number;
+    capped: boolean;
+};
+
+export type QueryDocumentationOptions = {
+    uniqueUrls?: boolean;
+    snippetSentences?: number;
+    contentFormat?: ContentFormat;
+    minDistance?: number;
+    maxDistance?: number;
+    mode?: SearchMode;
+    timings?: QueryTimings;
+    includeRowid?: boolean;
+    excludeChunkIds?: string[];
+    boostExactTitleMatch?: boolean;
+    candidateMultiplier?: number;
+    includeMatchOffset?: boolean;
+    metadataBoosts?: MetadataBoost[];
+    candidateCount?: CandidateCount;
+    // Precomputed embedding, so a query fanned out across products is embedded once.
+    queryEmbedding?: number[];
+    // Embedding provider picked per query; its dimension is checked against the database.
+    provider?: string;
+    // Filled with the provider and model that embedded the query, when known.
+    embeddingSource?: Partial<EmbeddingSource>;
+    ranking?: RankingMode;
+    explain?: boolean;
+};
+
+export type QueryPreprocessStep = 'lowercase' | 'collapse_whitespace' | 'strip_code_fences';
+
+export type VecColumn = {
+    column: string;
+    weight: number;
+};
+
 type SqliteVecModule = {
     load: (db: any) => void;
 };
@@ -51,15 +395,27 @@ type SqliteDatabase = {
     close: () => void;
 };
 
-type SqliteDatabaseCtor = new (path: string) => SqliteDatabase;
+type SqliteDatabaseOptions = {
+    readonly?: boolean;
+    fileMustExist?: boolean;
+    timeout?: number;
+};
+
+type SqliteDatabaseCtor = new (path: string, options?: SqliteDatabaseOptions) => SqliteDatabase;
 
 type FsModule = {
     existsSync: (path: string) => boolean;
+    readdirSync?: (path: string) => string[];
+    readFileSync?: (path: string, encoding: 'utf8') => string;
+    writeFileSync?: (path: string, data: string) => void;
+    renameSync?: (oldPath: string, newPath: string) => void;
+    statSync?: (path: string) => { ino: number; size: number; mtimeMs: number };
 };
 
 type PathModule = {
     isAbsolute: (path: string) => boolean;
     join: (...parts: string[]) => string;
+    basename: (path: string) => string;
 };
 
 type QdrantClientLike = {
@@ -97,6 +453,22 @@ export function filterResultsByUrl(
     });
 }
 
+// Removes BLOB-valued columns (raw embeddings and the like) from a row read with SELECT *,
+// so a nonstandard schema cannot leak binary data into content, url or other text fields.
+// A BLOB content column is replaced with an empty string, which result filters then skip.
+export function dropBlobColumns<T extends Record<string, unknown>>(row: T): T {
+    const columns = row as Record<string, unknown>;
+    for (const [column, value] of Object.entries(columns)) {
+        if (ArrayBuffer.isView(value) || value instanceof ArrayBuffer) {
+            delete columns[column];
+            if (column === 'content') {
+                columns.content = '';
+            }
+        }
+    }
+    return row;
+}
+
 export function filterResultsWithContent(results: QueryResult[]): QueryResult[] {
     return results.filter((row) => {
         if (typeof row.content !== 'string') {
@@ -106,331 +478,4047 @@ export function filterResultsWithContent(results: QueryResult[]): QueryResult[]
     });
 }
 
-export function createQueryHandlers(deps: {
-    createEmbeddings: (text: string) => Promise<number[]>;
-    resolveDbPath: ResolveDbPath;
-    queryCollection: QueryCollection;
-    getChunksForDocument: GetChunksForDocument;
-}) {
-    const { createEmbeddings, resolveDbPath, queryCollection, getChunksForDocument } = deps;
+export function trimQueryText(queryText: string, mode: QueryTrimMode): string {
+    if (mode === 'none') {
+        return queryText;
+    }
+    const trimmed = queryText.trim();
+    return mode === 'collapse' ? trimmed.replace(/\s+/g, ' ') : trimmed;
+}
 
-    async function queryDocumentation(
-        queryText: string,
-        productName: string | undefined,
-        dbName: string | undefined,
-        version: string | undefined,
-        urlPathPrefix: string | undefined,
-        limit: number = 4
-    ): Promise<{
-        distance: number;
-        content: string;
-        url?: string;
-        section?: string;
-        chunk_index?: number;
-        total_chunks?: number;
-    }[]> {
-        const queryEmbedding = await createEmbeddings(queryText);
-        const { dbPath } = resolveDbPath(dbName, productName, version);
-        const hasPostFilters = !!urlPathPrefix;
-        const fetchLimit = hasPostFilters ? limit * 3 : limit;
-        const results = await queryCollection(
-            queryEmbedding,
-            dbPath,
-            { product_name: productName, version: version, urlPrefix: urlPathPrefix },
-            fetchLimit
-        );
-        const filteredResults = filterResultsWithContent(filterResultsByUrl(results, urlPathPrefix));
-        return filteredResults.slice(0, limit).map((qr: QueryResult) => ({
-            distance: typeof qr.distance === 'number' ? qr.distance : 0,
-            content: qr.content,
-            ...(qr.url && { url: qr.url }),
-            ...(qr.section && { section: qr.section }),
-            ...(typeof qr.chunk_index === 'number' && { chunk_index: qr.chunk_index }),
-            ...(typeof qr.total_chunks === 'number' && { total_chunks: qr.total_chunks }),
-        }));
+// Cuts text that is estimated to exceed `maxTokens`: 'head' keeps the beginning, 'tail'
+// the end, and 'middle' both ends around a dropped middle. 'error' leaves the text for the
+// provider to reject, as without truncation.
+export function truncateForEmbedding(
+    text: string,
+    maxTokens: number,
+    strategy: TruncateStrategy
+): { text: string; truncated: boolean } {
+    const maxChars = maxTokens * ESTIMATED_CHARS_PER_TOKEN;
+    if (strategy === 'error' || maxTokens <= 0 || text.length <= maxChars) {
+        return { text, truncated: false };
+    }
+    if (strategy === 'head') {
+        return { text: text.slice(0, maxChars), truncated: true };
     }
+    if (strategy === 'tail') {
+        return { text: text.slice(text.length - maxChars), truncated: true };
+    }
+    const headChars = Math.ceil(maxChars / 2);
+    return { text: `${text.slice(0, headChars)}\n${text.slice(text.length - (maxChars - headChars - 1))}`, truncated: true };
+}
 
-    async function queryCode(
-        queryText: string,
-        productName: string | undefined,
-        repo: string | undefined,
-        dbName: string | undefined,
-        branch: string | undefined,
-        filePathPrefix: string | undefined,
-        extensions: string[] | undefined,
-        limit: number = 4
-    ): Promise<{
-        results: {
-            distance: number;
-            content: string;
-            url?: string;
-            section?: string;
-            chunk_index?: number;
-            total_chunks?: number;
-        }[];
-        rawCount: number;
-        emptyContentCount: number;
-    }> {
-        const queryEmbedding = await createEmbeddings(queryText);
-        const { dbPath } = resolveDbPath(dbName, productName, undefined, repo);
-        const hasPostFilters = !!filePathPrefix || (extensions && extensions.length > 0);
-        const fetchLimit = hasPostFilters ? limit * 3 : limit;
-        const results = await queryCollection(
-            queryEmbedding,
-            dbPath,
-            { product_name: productName, repo, branch, urlPrefix: filePathPrefix, extensions },
-            fetchLimit
-        );
-        const filteredResults = filterResultsWithContent(filterResultsByUrl(results, filePathPrefix, extensions));
-        const mappedResults = filteredResults.slice(0, limit).map((qr: QueryResult) => ({
-            distance: typeof qr.distance === 'number' ? qr.distance : 0,
-            content: qr.content,
-            ...(qr.url && { url: qr.url }),
-            ...(qr.section && { section: qr.section }),
-            ...(typeof qr.chunk_index === 'number' && { chunk_index: qr.chunk_index }),
-            ...(typeof qr.total_chunks === 'number' && { total_chunks: qr.total_chunks }),
-        }));
-        const emptyContentCount = results.filter((row) => typeof row.content !== 'string' || row.content.trim().length === 0).length;
-        return { results: mappedResults, rawCount: results.length, emptyContentCount };
+export function enforceQueryLength(
+    queryText: string,
+    maxChars: number,
+    mode: QueryLengthMode,
+    minChars: number = 0,
+    trimMode: QueryTrimMode = 'none'
+): { queryText: string; truncated?: boolean; error?: string } {
+    queryText = trimQueryText(queryText, trimMode);
+    const trimmedLength = queryText.trim().length;
+    if (trimmedLength < minChars || trimmedLength === 0) {
+        return {
+            queryText,
+            error: `Query text is too short (${trimmedLength} non-whitespace characters, minimum is ${Math.max(minChars, 1)}). Provide a more descriptive query.`,
+        };
     }
 
-    const queryDocumentationToolHandler = async ({
+    if (maxChars <= 0 || queryText.length <= maxChars) {
+        return { queryText };
+    }
+
+    if (mode === 'truncate') {
+        console.error(`Query text truncated from ${queryText.length} to ${maxChars} characters.`);
+        return { queryText: queryText.slice(0, maxChars), truncated: true };
+    }
+
+    return {
         queryText,
-        productName,
-        dbName,
-        version,
-        urlPathPrefix,
-        limit,
-    }: {
-        queryText: string;
-        productName?: string;
-        dbName?: string;
-        version?: string;
-        urlPathPrefix?: string;
-        limit: number;
-    }) => {
-        if (!productName && !dbName) {
-            return {
-                content: [{ type: 'text' as const, text: 'Provide either productName or dbName for query_documentation.' }],
-            };
-        }
+        error: `Query text is too long (${queryText.length} characters, maximum is ${maxChars}). Shorten the query and try again.`,
+    };
+}
 
-        console.error(`Received query: text="${queryText}", product="${productName || 'n/a'}", dbName="${dbName || 'n/a'}", version="${version || 'any'}", limit=${limit}`);
+export const BREADCRUMB_SEPARATOR = ' > ';
+const HEADING_LEVEL_COLUMNS = ['h1', 'h2', 'h3', 'h4', 'h5', 'h6'];
 
+// Builds a breadcrumb from the heading columns a row carries: the indexer's heading_hierarchy
+// (a JSON array in SQLite, an array in Qdrant) or per-level h1..h6 columns. Searches read
+// vec_items with SELECT *, so databases without these columns simply yield no breadcrumb.
+export function resultBreadcrumb(row: QueryResult): string | undefined {
+    let headings: unknown = row.heading_hierarchy;
+    if (typeof headings === 'string' && headings.trim().startsWith('[')) {
         try {
-            const results = await queryDocumentation(queryText, productName, dbName, version, urlPathPrefix, limit);
+            headings = JSON.parse(headings);
+        } catch {
+            // Not JSON after all; used as written.
+        }
+    }
+    const parts = (Array.isArray(headings) ? headings : headings !== undefined ? [headings] : HEADING_LEVEL_COLUMNS.map((column) => row[column]))
+        .filter((heading): heading is string => typeof heading === 'string' && heading.trim() !== '')
+        .map((heading) => heading.trim());
+    return parts.length > 0 ? parts.join(BREADCRUMB_SEPARATOR) : undefined;
+}
 
-            if (results.length === 0) {
-                return {
-                    content: [{
-                        type: 'text' as const,
-                        text: `No relevant documentation found for "${queryText}" in ${productName ? `product "${productName}"` : `db "${dbName}"`} ${version ? `(version ${version})` : ''}.`,
-                    }],
-                };
-            }
+export function toDocumentationResult(qr: QueryResult): DocumentationResult {
+    const breadcrumb = resultBreadcrumb(qr);
+    return {
+        ...(qr.chunk_id && { chunk_id: qr.chunk_id }),
+        distance: typeof qr.distance === 'number' ? qr.distance : 0,
+        ...(qr.score_type === 'bm25' && { score_type: 'bm25' as const }),
+        content: qr.content,
+        ...(qr.url && { url: qr.url }),
+        ...(qr.section && { section: qr.section }),
+        ...(breadcrumb && { breadcrumb }),
+        ...(typeof qr.chunk_index === 'number' && { chunk_index: qr.chunk_index }),
+        ...(typeof qr.total_chunks === 'number' && { total_chunks: qr.total_chunks }),
+        ...(qr.matched_version && { matched_version: qr.matched_version }),
+        ...(qr.provenance_hash && { provenance_hash: qr.provenance_hash }),
+    };
+}
 
-            const formattedResults = results.map((r, index) =>
-                [
-                    `Result ${index + 1}:`,
-                    `  Content: ${r.content}`,
-                    `  Distance: ${r.distance.toFixed(4)}`,
-                    r.url ? `  URL: ${r.url}` : null,
-                    typeof r.chunk_index === 'number' && typeof r.total_chunks === 'number' && r.total_chunks > 0
-                        ? `  Chunk: ${r.chunk_index + 1} of ${r.total_chunks}`
-                        : null,
-                    '---',
-                ].filter((line) => line !== null).join('\n')
-            ).join('\n');
+// Stable identity for a result across tool calls: product (or database) plus chunk ID,
+// falling back to the content when a chunk has no ID.
+export function computeProvenanceHash(scope: string, chunkId: string | undefined, content: string): string {
+    const identity = chunkId ? `${scope}:${chunkId}` : `${scope}:content:${content}`;
+    return createHash('sha256').update(identity).digest('hex').slice(0, 16);
+}
 
-            const responseText = `Found ${results.length} relevant documentation snippets for "${queryText}" in ${productName ? `product "${productName}"` : `db "${dbName}"`} ${version ? `(version ${version})` : ''}:\n\n${formattedResults}`;
-            console.error(`Handler finished processing. Payload size (approx): ${responseText.length} chars. Returning response object...`);
+// The SQLite rowid of a result, read from `rowid` or an integer `id` column when present.
+export function resultRowid(row: QueryResult): number | undefined {
+    const value = row.rowid ?? row.id;
+    if (typeof value === 'bigint') {
+        return Number(value);
+    }
+    return typeof value === 'number' && Number.isInteger(value) ? value : undefined;
+}
 
-            return {
-                content: [{ type: 'text' as const, text: responseText }],
-            };
-        } catch (error: any) {
-            console.error("Error processing 'query_documentation' tool:", error);
-            return {
-                content: [{ type: 'text' as const, text: `Error querying documentation: ${error.message}` }],
-            };
-        }
-    };
+const withProvenanceHash = (row: QueryResult, scope: string): QueryResult => {
+    row.provenance_hash = computeProvenanceHash(
+        typeof row.product_name === 'string' && row.product_name ? row.product_name : scope,
+        row.chunk_id,
+        row.content
+    );
+    return row;
+};
 
-    const queryCodeToolHandler = async ({
-        queryText,
-        productName,
-        repo,
-        dbName,
-        branch,
-        filePathPrefix,
-        extensions,
-        limit,
-    }: {
-        queryText: string;
-        productName?: string;
-        repo?: string;
-        dbName?: string;
-        branch?: string;
-        filePathPrefix?: string;
-        extensions?: string[];
-        limit: number;
-    }) => {
-        if (!dbName) {
-            return {
-                content: [{ type: 'text' as const, text: 'Provide dbName for query_code.' }],
-            };
+// Prepends the effective query parameters to a response; JSON responses get a `query` key.
+export function withQueryEcho(responseText: string, echo: Record<string, unknown>, format: ResultFormat = 'plain'): string {
+    if (format === 'json') {
+        try {
+            return JSON.stringify({ query: echo, ...JSON.parse(responseText) }, null, 2);
+        } catch {
+            return JSON.stringify({ query: echo, message: responseText }, null, 2);
         }
+    }
+    return `Effective query: ${JSON.stringify(echo)}\n\n${responseText}`;
+}
 
-        console.error(`Received code query: text="${queryText}", product="${productName || 'n/a'}", repo="${repo || 'n/a'}", dbName="${dbName}", branch="${branch || 'any'}", limit=${limit}`);
+// Feedback goes first so it carries weight in the embedding, followed by the original
+// query for context.
+export function buildRefinedQuery(previousQuery: string, feedback: string): string {
+    return [feedback.trim(), previousQuery.trim()].filter((part) => part.length > 0).join('. ');
+}
 
+export function withTimings(responseText: string, timings: QueryTimings, format: ResultFormat = 'plain'): string {
+    if (format === 'json') {
         try {
-            const { results, rawCount, emptyContentCount } = await queryCode(
-                queryText,
-                productName,
-                repo,
-                dbName,
-                branch,
-                filePathPrefix,
-                extensions,
-                limit
-            );
+            return JSON.stringify({ ...JSON.parse(responseText), timing: timings }, null, 2);
+        } catch {
+            return JSON.stringify({ message: responseText, timing: timings }, null, 2);
+        }
+    }
+    const parts = [
+        ['embedding', timings.embeddingMs],
+        ['db open', timings.dbOpenMs],
+        ['query', timings.queryMs],
+        ['format', timings.formatMs],
+    ].filter(([, ms]) => typeof ms === 'number').map(([label, ms]) => `${label} ${ms}ms`);
+    return `${responseText}\n\nTiming: ${parts.join(', ')}`;
+}
 
-            const target = repo
+// Warning for a query_documentation call slower than SLOW_QUERY_THRESHOLD. Only a short
+// hash of the query text is logged, so slow-query logs do not leak what users searched for.
+export function formatSlowQueryLog(queryText: string, target: string, totalMs: number, thresholdMs: number, timings: QueryTimings, errorKind?: ToolErrorKind): string {
+    const queryHash = createHash('sha256').update(queryText).digest('hex').slice(0, 12);
+    const parts = [
+        ['embedding', timings.embeddingMs],
+        ['db_open', timings.dbOpenMs],
+        ['query', timings.queryMs],
+        ['format', timings.formatMs],
+    ].filter(([, ms]) => typeof ms === 'number').map(([label, ms]) => `${label}=${ms}ms`);
+    if (errorKind) {
+        parts.push(`error=${errorKind}`);
+    }
+    return `Warning: slow query (${totalMs}ms, threshold ${thresholdMs}ms): query_hash=${queryHash} target=${target}${parts.length > 0 ? ` ${parts.join(' ')}` : ''}`;
+}
+
+// Packs results, best first, into one prompt-ready block of `[n]`-cited snippets within
+// `tokenBudget` estimated tokens. A snippet that does not fit is skipped so smaller,
+// lower-ranked ones can still use the remaining budget.
+export function buildContextBlock(results: DocumentationResult[], tokenBudget: number): { context: string; included: number } {
+    const snippets: string[] = [];
+    const sources: string[] = [];
+    let used = 0;
+    for (const result of results) {
+        const citation = snippets.length + 1;
+        const label = [result.product, result.section].filter(Boolean).join(' — ');
+        const snippet = `[${citation}]${label ? ` ${label}` : ''}\n${result.content.trim()}`;
+        const source = result.url ? `[${citation}]: ${result.url}` : undefined;
+        const cost = estimateTokens(snippet) + (source ? estimateTokens(source) : 0);
+        if (used + cost > tokenBudget) {
+            continue;
+        }
+        used += cost;
+        snippets.push(snippet);
+        if (source) {
+            sources.push(source);
+        }
+    }
+    const context = sources.length > 0 ? `${snippets.join('\n\n')}\n\nSources:\n${sources.join('\n')}` : snippets.join('\n\n');
+    return { context, included: snippets.length };
+}
+
+type ExactMatchFields = { content: string; section?: unknown; heading_hierarchy?: unknown };
+
+// Whether the section, heading or content contains the exact query string (case-insensitive).
+export function isExactMatch(result: ExactMatchFields, queryText: string): boolean {
+    const needle = queryText.trim().toLowerCase();
+    return !!needle && [result.section, result.heading_hierarchy, result.content]
+        .some((field) => typeof field === 'string' && field.toLowerCase().includes(needle));
+}
+
+// Stable re-rank that moves exact matches (see isExactMatch) ahead of the rest, keeping
+// distance order within each group.
+export function boostExactMatches<T extends ExactMatchFields>(results: T[], queryText: string): T[] {
+    const exact = results.filter((result) => isExactMatch(result, queryText));
+    return exact.length === 0 ? results : [...exact, ...results.filter((result) => !isExactMatch(result, queryText))];
+}
+
+export type ConfigSource = 'flag' | 'env' | 'file' | 'default';
+
+// Resolves a setting with the precedence flag > environment variable > env file > default.
+// `shellEnvNames` holds the variables set before the env file was loaded, which tells
+// an exported variable apart from one that came from the file.
+export function resolveConfigValue(
+    flagValue: string | undefined,
+    envName: string,
+    env: Record<string, string | undefined>,
+    shellEnvNames: Set<string>,
+    defaultValue?: string
+): { value: string | undefined; source: ConfigSource } {
+    if (flagValue) {
+        return { value: flagValue, source: 'flag' };
+    }
+    const envValue = env[envName];
+    if (envValue) {
+        return { value: envValue, source: shellEnvNames.has(envName) ? 'env' : 'file' };
+    }
+    return { value: defaultValue, source: 'default' };
+}
+
+// Keeps only the last four characters of a secret, enough to tell keys apart in logs.
+export function maskApiKey(key: string | undefined): string | undefined {
+    if (!key) {
+        return undefined;
+    }
+    return key.length > 8 ? `****${key.slice(-4)}` : '****';
+}
+
+export type LogFormat = 'text' | 'json';
+
+export type LogLevel = 'debug' | 'info' | 'warn' | 'error';
+
+export const LOG_LEVELS: LogLevel[] = ['debug', 'info', 'warn', 'error'];
+
+// Leveled logging to stderr, which stays free while stdout carries the stdio transport.
+// Messages below `level` are dropped.
+export function createLogger(level: LogLevel = 'info') {
+    const enabled = (messageLevel: LogLevel): boolean => LOG_LEVELS.indexOf(messageLevel) >= LOG_LEVELS.indexOf(level);
+    return {
+        debug: (...args: unknown[]) => {
+            if (enabled('debug')) {
+                console.error(...args);
+            }
+        },
+        info: (...args: unknown[]) => {
+            if (enabled('info')) {
+                console.error(...args);
+            }
+        },
+        warn: (...args: unknown[]) => {
+            if (enabled('warn')) {
+                console.warn(...args);
+            }
+        },
+        error: (...args: unknown[]) => console.error(...args),
+    };
+}
+
+export type ServerLogger = ReturnType<typeof createLogger>;
+
+// Renders the startup summary as one line: a JSON object, or space-separated key=value pairs.
+// Unset settings are left out.
+export function formatStartupBanner(config: Record<string, string | number | boolean | undefined>, format: LogFormat): string {
+    const entries = Object.entries(config).filter(([, value]) => value !== undefined && value !== '');
+    if (format === 'json') {
+        return JSON.stringify({ event: 'startup', ...Object.fromEntries(entries) });
+    }
+    return `Startup config: ${entries.map(([key, value]) => `${key}=${/\s/.test(String(value)) ? JSON.stringify(value) : value}`).join(' ')}`;
+}
+
+// Splits a comma-separated productName (e.g. "kubernetes,istio") into distinct names.
+export function parseProductNames(raw: string): { products: string[]; error?: string } {
+    const products = Array.from(new Set(raw.split(',').map((name) => name.trim())));
+    const invalid = products.filter((name) => name.length === 0 || name === '.' || name === '..' || /[\\/]/.test(name));
+    if (invalid.length > 0) {
+        return {
+            products: [],
+            error: `Invalid product name(s) in "${raw}". Use a comma-separated list of product names, e.g. "kubernetes,istio".`,
+        };
+    }
+    return { products };
+}
+
+// Parses a products.json manifest: { "products": [{ "name", "db", "defaultVersion", "displayName" }] }.
+// `db` defaults to "<name>.db". Malformed entries are rejected so a bad manifest fails at startup.
+export function parseProductManifest(raw: string): ProductManifestEntry[] {
+    let parsed: unknown;
+    try {
+        parsed = JSON.parse(raw);
+    } catch (error) {
+        throw new Error(`products manifest is not valid JSON: ${error instanceof Error ? error.message : String(error)}`);
+    }
+    const products = (parsed as { products?: unknown } | null)?.products;
+    if (!Array.isArray(products)) {
+        throw new Error('products manifest must be an object with a "products" array.');
+    }
+
+    const seen = new Set<string>();
+    return products.map((entry, index) => {
+        const { name, db, defaultVersion, displayName } = (entry ?? {}) as Record<string, unknown>;
+        if (typeof name !== 'string' || parseProductNames(name).error || name.includes(',')) {
+            throw new Error(`products manifest entry ${index} has an invalid "name".`);
+        }
+        if (seen.has(name)) {
+            throw new Error(`products manifest lists "${name}" more than once.`);
+        }
+        seen.add(name);
+        for (const [field, value] of Object.entries({ db, defaultVersion, displayName })) {
+            if (value !== undefined && (typeof value !== 'string' || value.trim().length === 0)) {
+                throw new Error(`products manifest entry "${name}" has an invalid "${field}".`);
+            }
+        }
+        const dbFile = (db as string | undefined) ?? `${name}.db`;
+        return {
+            name,
+            db: dbFile.endsWith('.db') ? dbFile : `${dbFile}.db`,
+            ...(defaultVersion !== undefined ? { defaultVersion: defaultVersion as string } : {}),
+            ...(displayName !== undefined ? { displayName: displayName as string } : {}),
+        };
+    });
+}
+
+// URI parameters SQLite understands on a `file:` database URI.
+const SQLITE_URI_PARAMS = ['vfs', 'mode', 'cache', 'psow', 'nolock', 'immutable'];
+
+// Parses SQLITE_DB_URIS: a JSON object mapping product names to SQLite `file:` URIs, e.g.
+// {"kubernetes": "file:/mnt/docs/k8s.db?vfs=unix-dotfile"}. Databases are opened read-only,
+// so `mode` may only be `ro`; unknown parameters are rejected so typos fail at startup.
+export function parseDatabaseUris(raw: string): Record<string, string> {
+    let parsed: unknown;
+    try {
+        parsed = JSON.parse(raw);
+    } catch (error) {
+        throw new Error(`SQLITE_DB_URIS is not valid JSON: ${error instanceof Error ? error.message : String(error)}`);
+    }
+    if (!parsed || typeof parsed !== 'object' || Array.isArray(parsed)) {
+        throw new Error('SQLITE_DB_URIS must be a JSON object mapping product names to file: URIs.');
+    }
+    const uris: Record<string, string> = {};
+    for (const [product, uri] of Object.entries(parsed)) {
+        if (parseProductNames(product).error || product.includes(',')) {
+            throw new Error(`SQLITE_DB_URIS has an invalid product name "${product}".`);
+        }
+        if (typeof uri !== 'string' || !uri.startsWith('file:') || sqliteFilePath(uri).length === 0) {
+            throw new Error(`SQLITE_DB_URIS entry "${product}" must be a SQLite file: URI, e.g. file:/data/${product}.db?cache=shared.`);
+        }
+        const query = uri.includes('?') ? uri.slice(uri.indexOf('?') + 1).split('#')[0] : '';
+        for (const [param, value] of new URLSearchParams(query)) {
+            if (!SQLITE_URI_PARAMS.includes(param)) {
+                throw new Error(`SQLITE_DB_URIS entry "${product}" has an unknown parameter "${param}". Supported: ${SQLITE_URI_PARAMS.join(', ')}.`);
+            }
+            if (param === 'mode' && value !== 'ro') {
+                throw new Error(`SQLITE_DB_URIS entry "${product}" has mode=${value}; databases are opened read-only, so only mode=ro is allowed.`);
+            }
+            if (param === 'cache' && value !== 'shared' && value !== 'private') {
+                throw new Error(`SQLITE_DB_URIS entry "${product}" has an invalid cache "${value}" (expected shared or private).`);
+            }
+        }
+        uris[product] = uri;
+    }
+    return uris;
+}
+
+// Filesystem path of a database given either as a path or as a SQLite `file:` URI, for
+// existence checks and sidecar files.
+export function sqliteFilePath(dbPath: string): string {
+    if (!dbPath.startsWith('file:')) {
+        return dbPath;
+    }
+    let file = dbPath.slice('file:'.length).split(/[?#]/)[0];
+    if (file.startsWith('//')) {
+        // file://host/path: only an empty or "localhost" authority is valid in SQLite.
+        file = file.slice(file.indexOf('/', 2) === -1 ? file.length : file.indexOf('/', 2));
+    }
+    return decodeURIComponent(file);
+}
+
+type ResultTemplateNode = string | { field: string } | { section: string; children: ResultTemplateNode[] };
+
+export type ResultTemplate = { nodes: ResultTemplateNode[]; separator: string };
+
+const RESULT_TEMPLATE_FIELDS = ['index', 'content', 'distance', 'score_label', 'url', 'section', 'breadcrumb', 'product', 'chunk', 'chunk_id', 'match_offset', 'composite'];
+
+// Mirrors the original hardcoded plain layout; `{{#field}}...{{/field}}` renders only when the field is set.
+export const DEFAULT_RESULT_TEMPLATE = 'Result {{index}}:\n{{#product}}  Product: {{product}}\n{{/product}}{{#breadcrumb}}  Breadcrumb: {{breadcrumb}}\n{{/breadcrumb}}  Content: {{content}}\n  {{score_label}}: {{distance}}\n{{#url}}  URL: {{url}}\n{{/url}}{{#chunk}}  Chunk: {{chunk}}\n{{/chunk}}{{#composite}}  Composite: {{composite}}\n{{/composite}}---';
+
+// Parses a RESULT_TEMPLATE such as "[{{index}}] {{section}}\n{{content}}". Unknown fields,
+// unbalanced sections and stray braces are rejected so mistakes surface at startup.
+export function parseResultTemplate(raw: string, separator: string = '\n'): ResultTemplate {
+    const root: ResultTemplateNode[] = [];
+    const stack: Array<{ section: string; children: ResultTemplateNode[] }> = [];
+    const current = () => (stack.length > 0 ? stack[stack.length - 1].children : root);
+    const tagPattern = /\{\{\s*([#/]?)([A-Za-z_]+)\s*\}\}/g;
+    let lastIndex = 0;
+    let match: RegExpExecArray | null;
+    const pushText = (text: string) => {
+        if (text.includes('{{') || text.includes('}}')) {
+            throw new Error(`Invalid RESULT_TEMPLATE: malformed tag near "${text.trim().slice(0, 20)}".`);
+        }
+        if (text) {
+            current().push(text);
+        }
+    };
+    while ((match = tagPattern.exec(raw)) !== null) {
+        pushText(raw.slice(lastIndex, match.index));
+        lastIndex = tagPattern.lastIndex;
+        const [, marker, name] = match;
+        if (!RESULT_TEMPLATE_FIELDS.includes(name)) {
+            throw new Error(`Invalid RESULT_TEMPLATE: unknown field "${name}". Supported fields: ${RESULT_TEMPLATE_FIELDS.join(', ')}.`);
+        }
+        if (marker === '#') {
+            const section = { section: name, children: [] as ResultTemplateNode[] };
+            current().push(section);
+            stack.push(section);
+        } else if (marker === '/') {
+            if (stack.pop()?.section !== name) {
+                throw new Error(`Invalid RESULT_TEMPLATE: unexpected closing tag "{{/${name}}}".`);
+            }
+        } else {
+            current().push({ field: name });
+        }
+    }
+    pushText(raw.slice(lastIndex));
+    if (stack.length > 0) {
+        throw new Error(`Invalid RESULT_TEMPLATE: section "{{#${stack[stack.length - 1].section}}}" is not closed.`);
+    }
+    return { nodes: root, separator };
+}
+
+const DEFAULT_PARSED_RESULT_TEMPLATE = parseResultTemplate(DEFAULT_RESULT_TEMPLATE);
+
+// User-facing strings that deployments can replace, e.g. to serve non-English agents.
+// Unset messages keep the built-in English wording.
+export type QueryMessages = {
+    noResults?: string;
+    resultsHeader?: string;
+    contextHeader?: string;
+    distanceLabel?: string;
+    bm25Label?: string;
+};
+
+export const QUERY_MESSAGE_KEYS: (keyof QueryMessages)[] = ['noResults', 'resultsHeader', 'contextHeader', 'distanceLabel', 'bm25Label'];
+
+// Parses a MESSAGES_FILE: a JSON object mapping message keys to templates.
+export function parseQueryMessages(raw: string): QueryMessages {
+    let parsed: unknown;
+    try {
+        parsed = JSON.parse(raw);
+    } catch (error) {
+        throw new Error(`messages file is not valid JSON: ${error instanceof Error ? error.message : String(error)}`);
+    }
+    if (!parsed || typeof parsed !== 'object' || Array.isArray(parsed)) {
+        throw new Error('messages file must be a JSON object of message templates.');
+    }
+    const messages: QueryMessages = {};
+    for (const [key, value] of Object.entries(parsed)) {
+        if (!QUERY_MESSAGE_KEYS.includes(key as keyof QueryMessages)) {
+            throw new Error(`messages file has an unknown key "${key}". Supported keys: ${QUERY_MESSAGE_KEYS.join(', ')}.`);
+        }
+        if (typeof value !== 'string') {
+            throw new Error(`messages file key "${key}" must be a string.`);
+        }
+        messages[key as keyof QueryMessages] = value;
+    }
+    return messages;
+}
+
+// Replaces `{name}` placeholders with `values`; unknown placeholders are left as written.
+export function formatMessage(template: string, values: Record<string, string | number>): string {
+    return template.replace(/\{(\w+)\}/g, (placeholder, name: string) =>
+        Object.prototype.hasOwnProperty.call(values, name) ? String(values[name]) : placeholder
+    );
+}
+
+const scoreLabel = (r: DocumentationResult, messages: QueryMessages): string =>
+    r.score_type === 'bm25' ? messages.bm25Label ?? 'BM25 score' : messages.distanceLabel ?? 'Distance';
+
+const resultTemplateValues = (r: DocumentationResult, index: number, messages: QueryMessages): Record<string, string | undefined> => ({
+    index: String(index + 1),
+    content: r.content,
+    distance: r.distance.toFixed(4),
+    score_label: scoreLabel(r, messages),
+    url: r.url,
+    section: r.section,
+    breadcrumb: r.breadcrumb,
+    product: r.product,
+    chunk: typeof r.chunk_index === 'number' && typeof r.total_chunks === 'number' && r.total_chunks > 0
+        ? `${r.chunk_index + 1} of ${r.total_chunks}`
+        : undefined,
+    chunk_id: r.chunk_id,
+    match_offset: r.match_offset === undefined ? undefined : String(r.match_offset),
+    composite: r.composite && r.composite_score !== undefined
+        ? `${r.composite_score.toFixed(4)} (vector ${r.composite.vector.toFixed(4)}, keyword ${r.composite.keyword.toFixed(4)}, recency ${r.composite.recency.toFixed(4)})`
+        : undefined,
+});
+
+const renderResultTemplateNodes = (nodes: ResultTemplateNode[], values: Record<string, string | undefined>): string =>
+    nodes.map((node) => {
+        if (typeof node === 'string') {
+            return node;
+        }
+        if ('field' in node) {
+            return values[node.field] ?? '';
+        }
+        return values[node.section] ? renderResultTemplateNodes(node.children, values) : '';
+    }).join('');
+
+export function formatQueryResults(
+    results: DocumentationResult[],
+    format: ResultFormat = 'plain',
+    template: ResultTemplate = DEFAULT_PARSED_RESULT_TEMPLATE,
+    messages: QueryMessages = {}
+): string {
+    if (format === 'json') {
+        return JSON.stringify({ results }, null, 2);
+    }
+
+    if (format === 'markdown') {
+        const snippets = results.map((r, index) => {
+            const quoted = r.content.split('\n').map((line) => `> ${line}`).join('\n');
+            const heading = `**[${index + 1}]**${r.product ? ` ${r.product}` : ''}${r.breadcrumb ?? r.section ? ` — ${r.breadcrumb ?? r.section}` : ''} (${r.score_type === 'bm25' ? messages.bm25Label ?? 'BM25 score' : messages.distanceLabel ?? 'distance'} ${r.distance.toFixed(4)})`;
+            return `${heading}\n\n${quoted}`;
+        });
+        const citations = results
+            .map((r, index) => (r.url ? `[${index + 1}]: ${r.url}` : null))
+            .filter((line) => line !== null);
+        return citations.length > 0
+            ? `${snippets.join('\n\n')}\n\n${citations.join('\n')}`
+            : snippets.join('\n\n');
+    }
+
+    return results
+        .map((r, index) => renderResultTemplateNodes(template.nodes, resultTemplateValues(r, index, messages)))
+        .join(template.separator);
+}
+
+const HTML_ENTITIES: Record<string, string> = {
+    '&amp;': '&',
+    '&lt;': '<',
+    '&gt;': '>',
+    '&quot;': '"',
+    '&#39;': "'",
+    '&nbsp;': ' ',
+};
+
+const stripHtml = (content: string): string =>
+    content
+        .replace(/<(script|style)[^>]*>[\s\S]*?<\/\1>/gi, '')
+        .replace(/<br\s*\/?>/gi, '\n')
+        .replace(/<\/(p|div|li|h[1-6]|tr|pre)>/gi, '\n')
+        .replace(/<[^>]+>/g, '')
+        .replace(/&(amp|lt|gt|quot|#39|nbsp);/g, (entity) => HTML_ENTITIES[entity]);
+
+const collapseBlankLines = (content: string): string =>
+    content
+        .split('\n')
+        .map((line) => line.trimEnd())
+        .join('\n')
+        .replace(/\n{3,}/g, '\n\n')
+        .trim();
+
+// 'markdown' strips embedded HTML and tidies whitespace; 'text' additionally removes
+// Markdown syntax (headings, emphasis, links, code fences). 'raw' returns content as stored.
+export function transformContent(content: string, contentFormat: ContentFormat = 'raw'): string {
+    if (contentFormat === 'raw') {
+        return content;
+    }
+
+    const markdown = collapseBlankLines(stripHtml(content));
+    if (contentFormat === 'markdown') {
+        return markdown;
+    }
+
+    return collapseBlankLines(
+        markdown
+            .replace(/^```[^\n]*$/gm, '')
+            .replace(/!\[([^\]]*)\]\([^)]*\)/g, '$1')
+            .replace(/\[([^\]]+)\]\([^)]*\)/g, '$1')
+            .replace(/^\s{0,3}#{1,6}\s+/gm, '')
+            .replace(/^\s{0,3}>\s?/gm, '')
+            .replace(/(\*\*|__)(.+?)\1/g, '$2')
+            .replace(/(\*|_)(\S(?:.*?\S)?)\1/g, '$2')
+            .replace(/`([^`]+)`/g, '$1')
+    );
+}
+
+const tokenize = (text: string): string[] => text.toLowerCase().match(/[\p{L}\p{N}_]+/gu) ?? [];
+
+// Maps a distance onto (0, 1], 1 being an exact match. Works for any distance metric
+// since it only relies on distances being non-negative and lower-is-better.
+export function distanceToSimilarity(distance: number): number {
+    return 1 / (1 + Math.max(distance, 0));
+}
+
+// Cosine of the angle between two vectors, from -1 to 1; 0 when either is all zeros.
+export function cosineSimilarity(a: number[], b: number[]): number {
+    if (a.length !== b.length) {
+        throw new Error(`Cannot compare a ${a.length}-dimensional embedding with a ${b.length}-dimensional one.`);
+    }
+    let dot = 0;
+    let normA = 0;
+    let normB = 0;
+    for (let index = 0; index < a.length; index++) {
+        dot += a[index] * b[index];
+        normA += a[index] * a[index];
+        normB += b[index] * b[index];
+    }
+    return normA === 0 || normB === 0 ? 0 : dot / Math.sqrt(normA * normB);
+}
+
+// A soft preference for results whose `column` equals `value`, e.g. doc_type=reference.
+export type MetadataBoost = {
+    column: string;
+    value: string;
+    multiplier: number;
+};
+
+// Parses `{ "doc_type=reference": 1.5 }` into boosts, rejecting malformed keys and
+// multipliers outside MIN_METADATA_BOOST..MAX_METADATA_BOOST.
+export function parseMetadataBoosts(boosts: Record<string, number>): MetadataBoost[] {
+    return Object.entries(boosts).map(([key, multiplier]) => {
+        const separator = key.indexOf('=');
+        const column = separator === -1 ? '' : key.slice(0, separator).trim();
+        if (!/^[A-Za-z_][A-Za-z0-9_]*$/.test(column)) {
+            throw invalidRequestError(`Invalid boost "${key}": expected column=value.`);
+        }
+        if (!(multiplier >= MIN_METADATA_BOOST && multiplier <= MAX_METADATA_BOOST)) {
+            throw invalidRequestError(`Boost multiplier for "${key}" must be between ${MIN_METADATA_BOOST} and ${MAX_METADATA_BOOST}.`);
+        }
+        return { column, value: key.slice(separator + 1).trim(), multiplier };
+    });
+}
+
+// A result's relevanceScore multiplied by each boost it matches.
+export function boostedScore(result: QueryResult, boosts: MetadataBoost[]): number {
+    return boosts.reduce(
+        (current, boost) => (String(result[boost.column] ?? '') === boost.value ? current * boost.multiplier : current),
+        relevanceScore(result)
+    );
+}
+
+// Re-orders results by their boostedScore. Nothing is dropped and the reported distances
+// are left unchanged.
+export function applyMetadataBoosts<T extends QueryResult>(results: T[], boosts: MetadataBoost[]): T[] {
+    return results
+        .map((result, index) => ({ result, index, score: boostedScore(result, boosts) }))
+        .sort((a, b) => b.score - a.score || a.index - b.index)
+        .map(({ result }) => result);
+}
+
+const COMPOSITE_SIGNALS: Array<keyof CompositeWeights> = ['vector', 'keyword', 'recency'];
+
+// Parses COMPOSITE_WEIGHTS such as "vector:0.7,keyword:0.2,recency:0.1". Signals that
+// are not listed get weight 0.
+export function parseCompositeWeights(raw?: string): CompositeWeights {
+    if (!raw || raw.trim().length === 0) {
+        return DEFAULT_COMPOSITE_WEIGHTS;
+    }
+
+    const weights: CompositeWeights = { vector: 0, keyword: 0, recency: 0 };
+    for (const entry of raw.split(',').map((part) => part.trim()).filter((part) => part.length > 0)) {
+        const [signal, weightText] = entry.split(':').map((part) => part.trim());
+        const weight = Number(weightText);
+        if (!COMPOSITE_SIGNALS.includes(signal as keyof CompositeWeights)) {
+            throw new Error(`Invalid signal '${signal}' in COMPOSITE_WEIGHTS. Expected one of: ${COMPOSITE_SIGNALS.join(', ')}.`);
+        }
+        if (weightText === undefined || weightText === '' || !Number.isFinite(weight) || weight < 0) {
+            throw new Error(`Invalid weight '${weightText ?? ''}' for signal '${signal}' in COMPOSITE_WEIGHTS.`);
+        }
+        weights[signal as keyof CompositeWeights] = weight;
+    }
+    if (COMPOSITE_SIGNALS.every((signal) => weights[signal] === 0)) {
+        throw new Error('COMPOSITE_WEIGHTS must give at least one signal a positive weight.');
+    }
+    return weights;
+}
+
+// Halves every `halfLifeDays`: 1 for a chunk modified now, 0 when the time is missing or
+// unreadable. Numbers are epoch seconds, or milliseconds when too large to be seconds.
+export function recencyScore(value: unknown, halfLifeDays: number, now: number = Date.now()): number {
+    const time = typeof value === 'number'
+        ? (value < 1e11 ? value * 1000 : value)
+        : typeof value === 'string' && value.trim() ? Date.parse(value) : NaN;
+    if (!Number.isFinite(time) || halfLifeDays <= 0) {
+        return 0;
+    }
+    const ageDays = Math.max(now - time, 0) / 86_400_000;
+    return Math.pow(0.5, ageDays / halfLifeDays);
+}
+
+// Re-orders results by a weighted blend of vector similarity, the share of query terms
+// found in the chunk, and recency, normalized to 0..1. Ties keep their distance order.
+export function rankByCompositeScore<T extends QueryResult>(
+    results: T[],
+    queryText: string,
+    weights: CompositeWeights,
+    recency: { column?: string; halfLifeDays: number; now?: number }
+): Array<T & { composite_score: number; composite: CompositeComponents }> {
+    const queryTerms = new Set(tokenize(queryText));
+    const totalWeight = weights.vector + weights.keyword + weights.recency || 1;
+    return results
+        .map((result, index) => {
+            const fields = [result.section, result.heading_hierarchy, result.content].flat().filter((field) => typeof field === 'string');
+            const chunkTerms = new Set(tokenize(fields.join(' ')));
+            const composite: CompositeComponents = {
+                vector: distanceToSimilarity(result.distance ?? 0),
+                keyword: queryTerms.size > 0 ? Array.from(queryTerms).filter((term) => chunkTerms.has(term)).length / queryTerms.size : 0,
+                recency: recency.column ? recencyScore(result[recency.column], recency.halfLifeDays, recency.now) : 0,
+            };
+            const score = (weights.vector * composite.vector + weights.keyword * composite.keyword + weights.recency * composite.recency) / totalWeight;
+            return { result: { ...result, composite_score: score, composite }, index };
+        })
+        .sort((a, b) => b.result.composite_score - a.result.composite_score || a.index - b.index)
+        .map(({ result }) => result);
+}
+
+// Adds a higher-is-better `score` (the BM25 score, or the similarity of the distance) and
+// fills in the product and version each result was searched in.
+export function toStructuredResults(
+    results: DocumentationResult[],
+    productName: string | undefined,
+    version: string | undefined
+): StructuredResult[] {
+    return results.map((result) => {
+        const product = result.product ?? productName;
+        const resultVersion = result.version ?? result.matched_version ?? version;
+        return {
+            ...result,
+            score: result.score_type === 'bm25' ? result.distance : distanceToSimilarity(result.distance),
+            ...(product && { product }),
+            ...(resultVersion && { version: resultVersion }),
+        };
+    });
+}
+
+// Character offset of the first word in `content` that is also a query term, matched
+// case-insensitively on whole words like the FTS tokenizer; undefined when none occurs.
+export function findMatchOffset(content: string, queryText: string): number | undefined {
+    const queryTerms = new Set(tokenize(queryText));
+    for (const match of content.matchAll(/[\p{L}\p{N}_]+/gu)) {
+        if (queryTerms.has(match[0].toLowerCase())) {
+            return match.index;
+        }
+    }
+    return undefined;
+}
+
+// Quotes each query term and ORs them so free text cannot trip FTS5 query syntax.
+export function buildFtsMatchExpression(queryText: string): string {
+    return Array.from(new Set(tokenize(queryText))).map((term) => `"${term}"`).join(' OR ');
+}
+
+// Returns a window of `sentenceCount` sentences centered on the sentence sharing the
+// most terms with the query. Term overlap is used instead of embeddings to avoid cost.
+export function extractSnippet(content: string, queryText: string, sentenceCount: number): string {
+    const sentences = content
+        .split(/(?<=[.!?])\s+|\n+/)
+        .map((sentence) => sentence.trim())
+        .filter((sentence) => sentence.length > 0);
+    if (sentenceCount <= 0 || sentences.length <= sentenceCount) {
+        return content;
+    }
+
+    const queryTerms = new Set(tokenize(queryText));
+    let bestIndex = 0;
+    let bestScore = -1;
+    sentences.forEach((sentence, index) => {
+        const score = tokenize(sentence).filter((term) => queryTerms.has(term)).length;
+        if (score > bestScore) {
+            bestScore = score;
+            bestIndex = index;
+        }
+    });
+
+    const start = Math.min(
+        Math.max(0, bestIndex - Math.floor((sentenceCount - 1) / 2)),
+        sentences.length - sentenceCount
+    );
+    return sentences.slice(start, start + sentenceCount).join(' ');
+}
+
+export function collapseByUrl(results: QueryResult[]): QueryResult[] {
+    const seenUrls = new Set<string>();
+    return results.filter((row) => {
+        if (typeof row.url !== 'string' || row.url.length === 0) {
+            return true;
+        }
+        if (seenUrls.has(row.url)) {
+            return false;
+        }
+        seenUrls.add(row.url);
+        return true;
+    });
+}
+
+export type DatabaseStats = {
+    dbPath: string;
+    firstOpenedAt: string;
+    lastUsedAt: string;
+    queryCount: number;
+    dimension?: number;
+    distanceMetric?: string;
+};
+
+export type SqliteBindValue = string | number | bigint | ArrayBufferView | null;
+
+// better-sqlite3 only binds numbers, strings, bigints, buffers, and null; anything
+// else is converted here or rejected with an error naming the offending parameter.
+export function toSqliteBindValue(name: string, value: unknown): SqliteBindValue {
+    if (value === undefined || value === null) {
+        return null;
+    }
+    if (typeof value === 'string' || typeof value === 'bigint') {
+        return value;
+    }
+    if (typeof value === 'number') {
+        if (!Number.isFinite(value)) {
+            throw new Error(`Cannot bind non-finite number for parameter "${name}".`);
+        }
+        return value;
+    }
+    if (typeof value === 'boolean') {
+        return value ? 1 : 0;
+    }
+    if (ArrayBuffer.isView(value)) {
+        return value;
+    }
+    if (Array.isArray(value) && value.every((item) => typeof item === 'number')) {
+        return new Float32Array(value);
+    }
+    throw new Error(`Unsupported parameter type for "${name}": ${Array.isArray(value) ? 'array' : typeof value}.`);
+}
+
+export function normalizeBindParams(params: Record<string, unknown>): Record<string, SqliteBindValue> {
+    return Object.fromEntries(
+        Object.entries(params).map(([name, value]) => [name, toSqliteBindValue(name, value)])
+    );
+}
+
+export function parseVectorDimension(tableSql: string | undefined, column: string = 'embedding'): number | undefined {
+    if (!tableSql) {
+        return undefined;
+    }
+    const match = new RegExp(`\\b${column}\\s+(?:float|int8|bit)\\[(\\d+)\\]`, 'i').exec(tableSql);
+    return match ? Number(match[1]) : undefined;
+}
+
+const normalizeVersion = (version: string): string => version.trim().replace(/^v/i, '');
+
+// The stored value a client-supplied filter value refers to, ignoring case: an exact match
+// wins, otherwise the first stored value equal to it when both are lowercased.
+export function matchStoredValue(value: string, stored: unknown[]): string | undefined {
+    const values = stored.filter((candidate): candidate is string => typeof candidate === 'string');
+    if (values.includes(value)) {
+        return value;
+    }
+    const folded = value.toLowerCase();
+    return values.find((candidate) => candidate.toLowerCase() === folded);
+}
+
+// Matches versions that are equal after stripping a leading "v", or that share the
+// requested major.minor prefix (e.g. "1.29" matches "1.29.0" and "v1.29").
+export function fuzzyVersionMatches(requested: string, candidate: string): boolean {
+    const normalizedRequested = normalizeVersion(requested);
+    const normalizedCandidate = normalizeVersion(candidate);
+    if (normalizedRequested === normalizedCandidate) {
+        return true;
+    }
+
+    const [major, minor] = normalizedRequested.split('.');
+    const prefix = minor !== undefined ? `${major}.${minor}` : major;
+    return normalizedCandidate === prefix || normalizedCandidate.startsWith(`${prefix}.`);
+}
+
+// Levenshtein distance: the number of single-character insertions, deletions and
+// substitutions that turn `a` into `b`.
+export function editDistance(a: string, b: string): number {
+    let previous = Array.from({ length: b.length + 1 }, (_, index) => index);
+    for (let i = 1; i <= a.length; i++) {
+        const current = [i];
+        for (let j = 1; j <= b.length; j++) {
+            current[j] = Math.min(previous[j] + 1, current[j - 1] + 1, previous[j - 1] + (a[i - 1] === b[j - 1] ? 0 : 1));
+        }
+        previous = current;
+    }
+    return previous[b.length];
+}
+
+// Closest product to a name that was not found, compared case-insensitively. Only
+// near misses are suggested: at most MAX_PRODUCT_SUGGESTION_DISTANCE edits, and fewer
+// than half the name's length so short names do not match unrelated products. A name
+// that does exist (its database may be missing for another reason) gets no suggestion.
+export function suggestProductName(name: string, products: string[]): string | undefined {
+    const wanted = name.trim().toLowerCase();
+    const maxDistance = Math.min(MAX_PRODUCT_SUGGESTION_DISTANCE, Math.floor(wanted.length / 2));
+    let best: { product: string; distance: number } | undefined;
+    for (const product of products) {
+        const distance = editDistance(wanted, product.toLowerCase());
+        if (distance === 0) {
+            return undefined;
+        }
+        if (distance <= maxDistance && (!best || distance < best.distance)) {
+            best = { product, distance };
+        }
+    }
+    return best?.product;
+}
+
+// Semver-style ordering: numeric segments compare as numbers (so "1.30" > "1.9"), a
+// missing segment counts as 0, and a pre-release ("1.30.0-rc.1") sorts before its release.
+export function compareVersions(a: string, b: string): number {
+    const [coreA, preA] = splitPrerelease(normalizeVersion(a));
+    const [coreB, preB] = splitPrerelease(normalizeVersion(b));
+    const partsA = coreA.split('.');
+    const partsB = coreB.split('.');
+    for (let index = 0; index < Math.max(partsA.length, partsB.length); index++) {
+        const partA = partsA[index] ?? '0';
+        const partB = partsB[index] ?? '0';
+        const numeric = /^\d+$/.test(partA) && /^\d+$/.test(partB);
+        const order = numeric ? Number(partA) - Number(partB) : compareStrings(partA, partB);
+        if (order !== 0) {
+            return Math.sign(order);
+        }
+    }
+    if (preA === preB) {
+        return 0;
+    }
+    if (preA === undefined || preB === undefined) {
+        return preA === undefined ? 1 : -1;
+    }
+    return compareStrings(preA, preB);
+}
+
+const splitPrerelease = (version: string): [string, string | undefined] => {
+    const index = version.indexOf('-');
+    return index === -1 ? [version, undefined] : [version.slice(0, index), version.slice(index + 1)];
+};
+
+export function pickLatestVersion(versions: unknown[]): string | undefined {
+    return versions
+        .filter((version): version is string => typeof version === 'string' && version.trim() !== '')
+        .reduce<string | undefined>((latest, version) => (latest === undefined || compareVersions(version, latest) > 0 ? version : latest), undefined);
+}
+
+export const HOST_BYTE_ORDER: ByteOrder = new Uint8Array(new Uint16Array([1]).buffer)[0] === 1 ? 'little' : 'big';
+
+// Scalar int8 quantization with sqlite-vec's 'unit' scheme, as vec_quantize_int8(v, 'unit')
+// computes it: [-1, 1] is split into 255 steps, which suits normalized embeddings.
+export function quantizeInt8(embedding: number[]): Int8Array {
+    const step = 2 / 255;
+    return Int8Array.from(embedding, (value) => Math.max(-128, Math.min(127, Math.trunc((value + 1) / step - 128))));
+}
+
+// Converts a query embedding to the vector bound to `MATCH`, rejecting vectors that are
+// empty or larger than any sane model would produce. It must use the quantization of the
+// stored vectors; float32 is always in host order, since that is how sqlite-vec reads
+// both the query and the stored blobs.
+export function toEmbeddingVector(
+    embedding: number[],
+    maxDimension: number = DEFAULT_MAX_EMBEDDING_DIMENSION,
+    quantization: VectorQuantization = 'none'
+): Float32Array | Int8Array {
+    if (embedding.length === 0) {
+        throw new Error('Query embedding is empty. Check the embedding provider configuration.');
+    }
+    if (maxDimension > 0 && embedding.length > maxDimension) {
+        throw new Error(`Query embedding has ${embedding.length} dimensions, above MAX_EMBEDDING_DIMENSION (${maxDimension}). Check the embedding model configuration.`);
+    }
+    if (quantization === 'int8') {
+        return quantizeInt8(embedding);
+    }
+    return new Float32Array(embedding);
+}
+
+const TRANSIENT_OPEN_ERROR_CODES = new Set(['SQLITE_CANTOPEN', 'EIO', 'ESTALE', 'EAGAIN', 'EBUSY', 'ETIMEDOUT']);
+
+// Open failures worth retrying on networked filesystems (EFS/NFS). Callers must rule
+// out a missing file first, since SQLite also reports that as SQLITE_CANTOPEN. Lock
+// contention (SQLITE_BUSY) is left to the busy retries of queryCollection, so it is
+// not retried twice over.
+export function isTransientOpenError(error: unknown): boolean {
+    const code = (error as { code?: unknown })?.code;
+    return typeof code === 'string' && (code.startsWith('SQLITE_IOERR') || TRANSIENT_OPEN_ERROR_CODES.has(code));
+}
+
+export function isSqliteBusyError(error: unknown): boolean {
+    const code = (error as { code?: unknown })?.code;
+    if (code === 'SQLITE_BUSY' || code === 'SQLITE_LOCKED') {
+        return true;
+    }
+    const message = error instanceof Error ? error.message : String(error);
+    return /database is (locked|busy)/i.test(message);
+}
+
+// SQLite reports a truncated or overwritten file as NOTADB and damaged pages as CORRUPT.
+export function isSqliteCorruptError(error: unknown): boolean {
+    const code = (error as { code?: unknown })?.code;
+    if (typeof code === 'string' && (code.startsWith('SQLITE_CORRUPT') || code === 'SQLITE_NOTADB')) {
+        return true;
+    }
+    const message = error instanceof Error ? error.message : String(error);
+    return /database disk image is malformed|file is not a database/i.test(message);
+}
+
+// Prefix of the error returned for a corrupt database, and the suffix quarantined files get.
+export const DB_CORRUPT = 'DB_CORRUPT';
+export const CORRUPT_DB_SUFFIX = '.corrupt';
+
+const FILTER_COLUMNS = ['product_name', 'version', 'branch', 'repo'] as const;
+
+// Drops metadata filters whose column does not exist in vec_items, returning the names
+// of the dropped filters. An empty column list (unknown schema) leaves the filter as is.
+export function applicableFilter(filter: QueryFilter, columns: string[]): { filter: QueryFilter; dropped: string[] } {
+    if (columns.length === 0) {
+        return { filter, dropped: [] };
+    }
+    const available = new Set(columns);
+    const applicable: QueryFilter = { ...filter };
+    const dropped: string[] = [];
+    for (const column of FILTER_COLUMNS) {
+        if (applicable[column] && !available.has(column)) {
+            delete applicable[column];
+            dropped.push(column);
+        }
+    }
+    if (applicable.excludeChunkIds?.length && !available.has('chunk_id')) {
+        delete applicable.excludeChunkIds;
+        dropped.push('chunk_id');
+    }
+    return { filter: applicable, dropped };
+}
+
+export function parseDistanceMetric(tableSql: string | undefined): string | undefined {
+    if (!tableSql) {
+        return undefined;
+    }
+    const match = /distance_metric\s*=\s*(\w+)/i.exec(tableSql);
+    // sqlite-vec defaults to L2 distance when no metric is declared.
+    return match ? match[1].toLowerCase() : 'l2';
+}
+
+// Accepts a bare host (https:// is assumed) and strips trailing slashes so the
+// SDK does not build URLs like "https://x.openai.azure.com//openai/deployments".
+export function normalizeAzureEndpoint(raw: string): string {
+    const trimmed = raw.trim();
+    const withScheme = /^[a-z][a-z0-9+.-]*:\/\//i.test(trimmed) ? trimmed : `https://${trimmed}`;
+    let parsed: URL;
+    try {
+        parsed = new URL(withScheme);
+    } catch {
+        throw new Error(`Invalid AZURE_OPENAI_ENDPOINT '${raw}': not a valid URL.`);
+    }
+    if (parsed.protocol !== 'https:' && parsed.protocol !== 'http:') {
+        throw new Error(`Invalid AZURE_OPENAI_ENDPOINT '${raw}': expected an http(s) URL.`);
+    }
+    if (!parsed.hostname || parsed.search || parsed.hash) {
+        throw new Error(`Invalid AZURE_OPENAI_ENDPOINT '${raw}': expected a URL like https://<resource>.openai.azure.com.`);
+    }
+    return `${parsed.protocol}//${parsed.host}${parsed.pathname}`.replace(/\/+$/, '');
+}
+
+export function parseVecColumns(raw?: string): VecColumn[] {
+    if (!raw || raw.trim().length === 0) {
+        return [];
+    }
+
+    return raw.split(',')
+        .map((entry) => entry.trim())
+        .filter((entry) => entry.length > 0)
+        .map((entry) => {
+            const [column, weightText] = entry.split(':').map((part) => part.trim());
+            const weight = weightText === undefined || weightText === '' ? 1 : Number(weightText);
+            if (!/^[A-Za-z_][A-Za-z0-9_]*$/.test(column)) {
+                throw new Error(`Invalid vector column name '${column}' in VEC_COLUMNS.`);
+            }
+            // These hold text, not vectors, and are stripped from results as required metadata.
+            if (REQUIRED_VEC_ITEMS_COLUMNS.includes(column)) {
+                throw new Error(`'${column}' in VEC_COLUMNS is a text column, not a vector column.`);
+            }
+            if (!Number.isFinite(weight) || weight < 0) {
+                throw new Error(`Invalid weight '${weightText}' for vector column '${column}' in VEC_COLUMNS.`);
+            }
+            return { column, weight };
+        });
+}
+
+const QUERY_PREPROCESS_STEPS: QueryPreprocessStep[] = ['lowercase', 'collapse_whitespace', 'strip_code_fences'];
+
+export function parseQueryPreprocess(raw?: string): QueryPreprocessStep[] {
+    if (!raw || raw.trim().length === 0) {
+        return [];
+    }
+
+    return raw.split(',')
+        .map((entry) => entry.trim().toLowerCase())
+        .filter((entry) => entry.length > 0)
+        .map((entry) => {
+            if (!QUERY_PREPROCESS_STEPS.includes(entry as QueryPreprocessStep)) {
+                throw new Error(`Invalid step '${entry}' in QUERY_PREPROCESS. Expected one of: ${QUERY_PREPROCESS_STEPS.join(', ')}.`);
+            }
+            return entry as QueryPreprocessStep;
+        });
+}
+
+// Applies the configured steps in a fixed order so the result does not depend on how
+// QUERY_PREPROCESS lists them: code fences are removed before whitespace is collapsed.
+export function preprocessQuery(text: string, steps: QueryPreprocessStep[]): string {
+    let result = text;
+    if (steps.includes('strip_code_fences')) {
+        result = result.replace(/^\s*(```|~~~)[^\n]*$/gm, '');
+    }
+    if (steps.includes('lowercase')) {
+        result = result.toLowerCase();
+    }
+    if (steps.includes('collapse_whitespace')) {
+        result = result.replace(/\s+/g, ' ').trim();
+    }
+    return result;
+}
+
+export const REDACTED_PLACEHOLDER = '[REDACTED]';
+
+// Parses REDACT_PATTERNS: a JSON array of regular expressions, each either a bare
+// pattern or "/pattern/flags". Every pattern is applied globally.
+export function parseRedactPatterns(raw?: string): RegExp[] {
+    if (!raw || raw.trim().length === 0) {
+        return [];
+    }
+
+    let parsed: unknown;
+    try {
+        parsed = JSON.parse(raw);
+    } catch (error) {
+        throw new Error(`REDACT_PATTERNS is not valid JSON: ${error instanceof Error ? error.message : String(error)}`);
+    }
+    if (!Array.isArray(parsed)) {
+        throw new Error('REDACT_PATTERNS must be a JSON array of regular expressions.');
+    }
+    return parsed.map((entry) => {
+        if (typeof entry !== 'string' || entry.length === 0) {
+            throw new Error(`Invalid entry ${JSON.stringify(entry)} in REDACT_PATTERNS: expected a non-empty string.`);
+        }
+        const literal = /^\/(.+)\/([a-z]*)$/s.exec(entry);
+        const [source, flags] = literal ? [literal[1], literal[2]] : [entry, ''];
+        let pattern: RegExp;
+        try {
+            pattern = new RegExp(source, flags.includes('g') ? flags : `${flags}g`);
+        } catch (error) {
+            throw new Error(`Invalid pattern '${entry}' in REDACT_PATTERNS: ${error instanceof Error ? error.message : String(error)}`);
+        }
+        // A pattern that matches nothing would insert a placeholder between every character.
+        if (new RegExp(pattern.source, pattern.flags.replace('g', '')).test('')) {
+            throw new Error(`Invalid pattern '${entry}' in REDACT_PATTERNS: it matches the empty string.`);
+        }
+        return pattern;
+    });
+}
+
+export function redactContent(content: string, patterns: RegExp[]): string {
+    return patterns.reduce((current, pattern) => current.replace(pattern, REDACTED_PLACEHOLDER), content);
+}
+
+// Nearest-rank percentile of the distances observed for a probe set.
+export function computeDistanceThreshold(distances: number[], percentile: number): number | undefined {
+    const sorted = distances.filter((distance) => Number.isFinite(distance)).sort((a, b) => a - b);
+    if (sorted.length === 0) {
+        return undefined;
+    }
+    const rank = Math.ceil(Math.min(Math.max(percentile, 0), 1) * sorted.length);
+    return sorted[Math.min(Math.max(rank - 1, 0), sorted.length - 1)];
+}
+
+export function calibrationSidecarPath(dbPath: string): string {
+    return `${sqliteFilePath(dbPath).replace(/\.db$/, '')}.calibration.json`;
+}
+
+// Minimal request and response shapes the connection limit needs, so it can be exercised
+// without Express.
+export type ConnectionRequest = { headers: Record<string, string | string[] | undefined> };
+export type ConnectionResponse = {
+    status(code: number): ConnectionResponse;
+    set(field: string, value: string): ConnectionResponse;
+    json(body: unknown): unknown;
+    once(event: 'close', listener: () => void): unknown;
+};
+
+// Caps the streams and new sessions open on the HTTP/SSE transports. Each request that passes
+// holds a slot until its response closes, so an SSE stream holds one for its lifetime.
+// Requests matching `exempt`, such as messages posted to an existing session, take no slot:
+// their session already holds one, and counting them too would reject traffic on live sessions.
+export function createConnectionLimiter(options: {
+    maxConnections: number;
+    onChange?: (open: number) => void;
+    onReject?: () => void;
+}) {
+    let open = 0;
+    const change = (delta: number) => {
+        open += delta;
+        options.onChange?.(open);
+    };
+
+    return (exempt?: (req: ConnectionRequest) => boolean) =>
+        (req: ConnectionRequest, res: ConnectionResponse, next: () => void) => {
+            if (exempt?.(req)) {
+                next();
+                return;
+            }
+            if (options.maxConnections > 0 && open >= options.maxConnections) {
+                options.onReject?.();
+                res.status(503).set('Retry-After', '1').json({ error: `Server is at capacity (${options.maxConnections} open connections). Try again shortly.` });
+                return;
+            }
+            change(1);
+            res.once('close', () => change(-1));
+            next();
+        };
+}
+
+// Bounds concurrent work per key. Callers over the limit wait up to `maxWaitMs`
+// for a free slot (0 rejects immediately) and then fail with a busy error.
+export function createKeyedSemaphore(maxConcurrent: number, maxWaitMs: number) {
+    const active = new Map<string, number>();
+    const waiters = new Map<string, Array<() => void>>();
+
+    const acquire = (key: string): Promise<void> => new Promise((resolve, reject) => {
+        const count = active.get(key) ?? 0;
+        if (count < maxConcurrent) {
+            active.set(key, count + 1);
+            resolve();
+            return;
+        }
+
+        if (maxWaitMs <= 0) {
+            reject(busyError(`${key} is busy (${maxConcurrent} concurrent queries). Try again shortly.`));
+            return;
+        }
+
+        const queue = waiters.get(key) ?? [];
+        waiters.set(key, queue);
+        const timer = setTimeout(() => {
+            queue.splice(queue.indexOf(grant), 1);
+            reject(busyError(`${key} is busy (waited ${maxWaitMs}ms for one of ${maxConcurrent} slots). Try again shortly.`));
+        }, maxWaitMs);
+        const grant = () => {
+            clearTimeout(timer);
+            resolve();
+        };
+        queue.push(grant);
+    });
+
+    const release = (key: string) => {
+        const queue = waiters.get(key);
+        const next = queue?.shift();
+        if (next) {
+            // Hand the slot straight to the next waiter; the active count is unchanged.
+            next();
+            return;
+        }
+        waiters.delete(key);
+        const count = (active.get(key) ?? 1) - 1;
+        if (count <= 0) {
+            active.delete(key);
+        } else {
+            active.set(key, count);
+        }
+    };
+
+    return {
+        run: async <T>(key: string, task: () => Promise<T>): Promise<T> => {
+            await acquire(key);
+            try {
+                return await task();
+            } finally {
+                release(key);
+            }
+        },
+    };
+}
+
+const TRANSIENT_NETWORK_ERROR_CODES = new Set(['ECONNRESET', 'ECONNREFUSED', 'ETIMEDOUT', 'EAI_AGAIN', 'UND_ERR_CONNECT_TIMEOUT', 'UND_ERR_SOCKET']);
+
+// Rate limits, server errors, dropped connections and provider-side timeouts are worth
+// retrying; auth and validation errors (other 4xx) and cancellations are not. The SDKs
+// set `status`; Voyage, Cohere and Ollama are called with fetch and report it as "returned <status>".
+export function isTransientEmbeddingError(error: unknown): boolean {
+    const { status, code, name, cause } = (error ?? {}) as { status?: unknown; code?: unknown; name?: unknown; cause?: unknown };
+    if (name === 'AbortError' || name === 'APIUserAbortError') {
+        return false;
+    }
+    const message = error instanceof Error ? error.message : String(error);
+    const reported = typeof status === 'number' ? status : Number(/\breturned (\d{3})\b/.exec(message)?.[1]);
+    if (Number.isInteger(reported)) {
+        return reported === 408 || reported === 429 || reported >= 500;
+    }
+    if (name === 'APIConnectionError' || name === 'APIConnectionTimeoutError') {
+        return true;
+    }
+    const causeCode = (cause as { code?: unknown } | undefined)?.code;
+    return [code, causeCode].some((value) => typeof value === 'string' && TRANSIENT_NETWORK_ERROR_CODES.has(value))
+        || /fetch failed|socket hang up/i.test(message);
+}
+
+// Runs `task`, retrying errors `isRetryable` accepts up to `maxRetries` times. Attempt n
+// waits between half and all of baseDelayMs * 2^n, so clients that failed together do not
+// retry together. An aborted `signal` ends the wait and stops further attempts.
+export async function retryWithBackoff<T>(
+    task: () => Promise<T>,
+    options: {
+        maxRetries: number;
+        baseDelayMs: number;
+        isRetryable: (error: unknown) => boolean;
+        signal?: AbortSignal;
+        onRetry?: (error: unknown, attempt: number, delayMs: number) => void;
+        random?: () => number;
+    }
+): Promise<T> {
+    const random = options.random ?? Math.random;
+    for (let attempt = 0; ; attempt++) {
+        try {
+            return await task();
+        } catch (error) {
+            if (attempt >= options.maxRetries || options.signal?.aborted || !options.isRetryable(error)) {
+                throw error;
+            }
+            const ceiling = options.baseDelayMs * 2 ** attempt;
+            const delayMs = Math.round(ceiling / 2 + random() * (ceiling / 2));
+            options.onRetry?.(error, attempt + 1, delayMs);
+            await new Promise<void>((resolve, reject) => {
+                const signal = options.signal;
+                const onAbort = () => {
+                    clearTimeout(timer);
+                    reject(signal!.reason);
+                };
+                const timer = setTimeout(() => {
+                    signal?.removeEventListener('abort', onAbort);
+                    resolve();
+                }, delayMs);
+                signal?.addEventListener('abort', onAbort, { once: true });
+            });
+        }
+    }
+}
+
+export const HEALTH_DETAIL_MAX_AGE_MS = 30_000;
+
+export type ProductHealth = { product: string; status: 'ok' | 'unavailable'; error?: string };
+
+// Opens each product database once. Errors name the file, never its absolute path, since
+// health output often ends up on dashboards.
+export async function checkProductHealth(
+    products: string[],
+    resolveDbPath: (product: string) => string,
+    testConnection: (dbPath: string) => Promise<void>,
+    basename: (dbPath: string) => string
+): Promise<ProductHealth[]> {
+    const results: ProductHealth[] = [];
+    for (const product of products) {
+        let dbPath: string | undefined;
+        try {
+            dbPath = resolveDbPath(product);
+            await testConnection(dbPath);
+            results.push({ product, status: 'ok' });
+        } catch (error) {
+            const message = error instanceof Error ? error.message : String(error);
+            results.push({ product, status: 'unavailable', error: dbPath ? message.split(dbPath).join(basename(dbPath)) : message });
+        }
+    }
+    return results;
+}
+
+// Keeps the last value of an expensive load for `maxAgeMs`. Concurrent callers of a stale
+// value share one load, so a burst of requests costs a single load.
+export function createCachedLoader<T>(load: () => Promise<T>, maxAgeMs: number, now: () => number = Date.now) {
+    let cached: { value: T; loadedAt: number } | undefined;
+    let pending: Promise<T> | undefined;
+    return (): Promise<T> => {
+        if (cached && now() - cached.loadedAt < maxAgeMs) {
+            return Promise.resolve(cached.value);
+        }
+        pending ??= load()
+            .then((value) => {
+                cached = { value, loadedAt: now() };
+                return value;
+            })
+            .finally(() => {
+                pending = undefined;
+            });
+        return pending;
+    };
+}
+
+// Provider clients created on first use and reused, so their HTTP connections are pooled.
+// None of the SDKs expose a close method; close() aborts the requests still in flight on
+// `signal` instead and drops the clients. Later calls to close() do nothing.
+export function createEmbeddingClients<T extends object>() {
+    const clients: Partial<T> = {};
+    const abort = new AbortController();
+    return {
+        clients,
+        signal: abort.signal,
+        close(): void {
+            if (abort.signal.aborted) {
+                return;
+            }
+            abort.abort(new Error('Embedding clients closed during shutdown.'));
+            for (const name of Object.keys(clients)) {
+                delete clients[name as keyof T];
+            }
+        },
+    };
+}
+
+// Embedding tokens used per MCP session. With a positive budget, a session that has used
+// it up is refused further provider calls until it reconnects.
+export function createTokenLedger(maxTokensPerSession: number) {
+    const used = new Map<string, number>();
+
+    return {
+        charge: (sessionId: string, tokens: number) => {
+            used.set(sessionId, (used.get(sessionId) ?? 0) + tokens);
+        },
+        used: (sessionId: string): number => used.get(sessionId) ?? 0,
+        assertWithinBudget: (sessionId: string) => {
+            const sessionTokens = used.get(sessionId) ?? 0;
+            if (maxTokensPerSession > 0 && sessionTokens >= maxTokensPerSession) {
+                throw new Error(`Embedding token budget exceeded for this session (${sessionTokens} of ${maxTokensPerSession} tokens used). Start a new session to continue.`);
+            }
+        },
+        forget: (sessionId: string) => {
+            used.delete(sessionId);
+        },
+    };
+}
+
+export function withConcurrencyLimit(queryCollection: QueryCollection, maxConcurrent: number, maxWaitMs: number): QueryCollection {
+    const semaphore = createKeyedSemaphore(maxConcurrent, maxWaitMs);
+    return (queryEmbedding, dbPath, filter, topK, timings) =>
+        semaphore.run(dbPath, () => queryCollection(queryEmbedding, dbPath, filter, topK, timings));
+}
+
+// Why a tool call failed. Handlers return it in the result's _meta alongside isError, so
+// the HTTP transport can choose a status without parsing the message.
+export type ToolErrorKind = 'invalid_request' | 'unauthorized' | 'not_found' | 'rate_limited' | 'unavailable' | 'internal';
+
+const TOOL_ERROR_STATUS: Record<ToolErrorKind, number> = {
+    invalid_request: 400,
+    unauthorized: 401,
+    not_found: 404,
+    rate_limited: 429,
+    unavailable: 503,
+    internal: 500,
+};
+
+// Exceptions reaching a handler's catch block are classified by their code, then by the
+// messages of the layers below. Order matters: a provider 429 wrapped in "Failed to
+// create embeddings" is a rate limit, not an outage.
+const TOOL_ERROR_KIND_PATTERNS: Array<[RegExp, ToolErrorKind]> = [
+    [/Unknown product|Database file not found/, 'not_found'],
+    [/\b429\b|rate limit|too many requests|token budget exceeded/i, 'rate_limited'],
+    [/Failed to create embeddings|Sparse encoder returned|ECONNREFUSED|ETIMEDOUT|ENOTFOUND|fetch failed|closed during shutdown/, 'unavailable'],
+];
+
+// Errors the SDK itself returns as tool results when the arguments fail the input schema.
+const SDK_INVALID_PARAMS_PATTERN = /^(MCP error -32602|Input validation error)/;
+
+// An error for a request that can never succeed as sent, e.g. an unknown boost column.
+export function invalidRequestError(message: string): Error {
+    return Object.assign(new Error(message), { code: 'INVALID_REQUEST' });
+}
+
+// An error for contention that clears by itself: a busy database or no free query slot.
+export function busyError(message: string): Error {
+    return Object.assign(new Error(message), { code: 'BUSY' });
+}
+
+export function toolErrorKind(error: unknown): ToolErrorKind {
+    const code = (error as { code?: unknown })?.code;
+    if (code === 'INVALID_REQUEST') {
+        return 'invalid_request';
+    }
+    if (code === 'BUSY' || isSqliteBusyError(error)) {
+        return 'rate_limited';
+    }
+    const message = error instanceof Error ? error.message : String(error);
+    return TOOL_ERROR_KIND_PATTERNS.find(([pattern]) => pattern.test(message))?.[1] ?? 'internal';
+}
+
+export function toolError(text: string, kind: ToolErrorKind) {
+    return {
+        content: [{ type: 'text' as const, text }],
+        isError: true,
+        _meta: { errorKind: kind },
+    };
+}
+
+// HTTP status for a JSON-RPC response sent over the streamable HTTP transport, so
+// gateways can tell bad requests from outages without parsing the body. Undefined
+// means the response is a success and keeps the transport's 200.
+export function httpStatusForResponse(message: unknown): number | undefined {
+    if (!message || typeof message !== 'object') {
+        return undefined;
+    }
+    const { error, result } = message as {
+        error?: { code?: number };
+        result?: { isError?: boolean; content?: Array<{ type?: string; text?: string }>; _meta?: { errorKind?: string } };
+    };
+    if (error) {
+        switch (error.code) {
+            case -32700:
+            case -32600:
+            case -32602:
+                return 400;
+            case -32601:
+                return 404;
+            default:
+                return 500;
+        }
+    }
+    if (!result?.isError) {
+        return undefined;
+    }
+    const kind = result._meta?.errorKind;
+    if (kind && Object.prototype.hasOwnProperty.call(TOOL_ERROR_STATUS, kind)) {
+        return TOOL_ERROR_STATUS[kind as ToolErrorKind];
+    }
+    const text = result.content?.find((part) => part.type === 'text')?.text;
+    return typeof text === 'string' && SDK_INVALID_PARAMS_PATTERN.test(text) ? 400 : 500;
+}
+
+// Accepts a term -> weight map or the `{ indices, values }` form used by Qdrant and most
+// SPLADE servers, either as an object or as a JSON string (how SQLite stores it).
+export function parseSparseVector(raw: unknown): SparseVector | undefined {
+    let value = raw;
+    if (typeof value === 'string') {
+        try {
+            value = JSON.parse(value);
+        } catch {
+            return undefined;
+        }
+    }
+    if (!value || typeof value !== 'object' || Array.isArray(value)) {
+        return undefined;
+    }
+    const { indices, values } = value as { indices?: unknown; values?: unknown };
+    if (Array.isArray(indices) && Array.isArray(values)) {
+        if (indices.length !== values.length) {
+            return undefined;
+        }
+        const vector: SparseVector = {};
+        indices.forEach((index, position) => {
+            const weight = values[position];
+            if (typeof weight === 'number' && Number.isFinite(weight)) {
+                vector[String(index)] = weight;
+            }
+        });
+        return vector;
+    }
+    const vector: SparseVector = {};
+    for (const [term, weight] of Object.entries(value as Record<string, unknown>)) {
+        if (typeof weight !== 'number' || !Number.isFinite(weight)) {
+            return undefined;
+        }
+        vector[term] = weight;
+    }
+    return vector;
+}
+
+export function sparseDotProduct(a: SparseVector, b: SparseVector): number {
+    const [smaller, larger] = Object.keys(a).length <= Object.keys(b).length ? [a, b] : [b, a];
+    let score = 0;
+    for (const [term, weight] of Object.entries(smaller)) {
+        const other = larger[term];
+        if (other !== undefined) {
+            score += weight * other;
+        }
+    }
+    return score;
+}
+
+const compareStrings = (a: string | undefined, b: string | undefined): number =>
+    (a ?? '') < (b ?? '') ? -1 : (a ?? '') > (b ?? '') ? 1 : 0;
+
+// Orders by distance, breaking ties by product and then chunk ID so equal distances
+// always come back in the same order.
+export function compareByDistance(
+    a: { distance?: number; product?: string; chunk_id?: string },
+    b: { distance?: number; product?: string; chunk_id?: string }
+): number {
+    return ((a.distance ?? 0) - (b.distance ?? 0))
+        || compareStrings(a.product, b.product)
+        || compareStrings(a.chunk_id, b.chunk_id);
+}
+
+// Higher-is-better relevance of a result: the similarity of its distance, or its negated
+// BM25 score, since FTS5 scores better matches lower.
+export function relevanceScore(result: { distance?: number; score_type?: ScoreType }): number {
+    return result.score_type === 'bm25' ? -(result.distance ?? 0) : distanceToSimilarity(result.distance ?? 0);
+}
+
+// Where a result ranked in its own product's list: exact matches (with boostExactTitleMatch)
+// first, then by a higher-is-better score.
+export type MergeRank = { exact: boolean; score: number };
+
+// Merges per-product result lists in the order each product ranked by, breaking ties by
+// product and then chunk ID.
+export function compareByMergeRank<T extends { distance?: number; product?: string; chunk_id?: string }>(
+    ranks: WeakMap<T, MergeRank>
+): (a: T, b: T) => number {
+    return (a, b) => {
+        const rankA = ranks.get(a) ?? { exact: false, score: 0 };
+        const rankB = ranks.get(b) ?? { exact: false, score: 0 };
+        return (Number(rankB.exact) - Number(rankA.exact))
+            || (rankB.score - rankA.score)
+            || compareStrings(a.product, b.product)
+            || compareStrings(a.chunk_id, b.chunk_id);
+    };
+}
+
+// Highest composite score first; results without one fall back to distance order.
+export function compareByCompositeScore(a: DocumentationResult, b: DocumentationResult): number {
+    return ((b.composite_score ?? 0) - (a.composite_score ?? 0)) || compareByDistance(a, b);
+}
+
+// Rescales distances to [0, 1] across one result set, nearest 0 and farthest 1, so result
+// sets measured on different scales can be fused. A set of equal distances maps to 0.
+export function normalizeDistances(rows: QueryResult[]): QueryResult[] {
+    const distances = rows.map((row) => (typeof row.distance === 'number' ? row.distance : 0));
+    const min = Math.min(...distances);
+    const range = Math.max(...distances) - min;
+    return rows.map((row, index) => ({ ...row, distance: range > 0 ? (distances[index] - min) / range : 0 }));
+}
+
+export function fuseWeightedResults(
+    resultSets: { weight: number; rows: QueryResult[] }[],
+    topK: number
+): QueryResult[] {
+    const totalWeight = resultSets.reduce((sum, set) => sum + set.weight, 0) || 1;
+    // A chunk missing from one column's top-K is scored with that column's worst observed distance.
+    const worstDistances = resultSets.map((set) =>
+        set.rows.reduce((max, row) => Math.max(max, typeof row.distance === 'number' ? row.distance : 0), 0)
+    );
+
+    const fused = new Map<string, { row: QueryResult; distances: (number | undefined)[] }>();
+    resultSets.forEach((set, index) => {
+        for (const row of set.rows) {
+            let entry = fused.get(row.chunk_id);
+            if (!entry) {
+                entry = { row, distances: new Array(resultSets.length).fill(undefined) };
+                fused.set(row.chunk_id, entry);
+            }
+            entry.distances[index] = typeof row.distance === 'number' ? row.distance : 0;
+        }
+    });
+
+    return Array.from(fused.values())
+        .map(({ row, distances }) => ({
+            ...row,
+            distance: distances.reduce<number>(
+                (sum, distance, index) => sum + resultSets[index].weight * (distance ?? worstDistances[index]),
+                0
+            ) / totalWeight,
+        }))
+        .sort(compareByDistance)
+        .slice(0, topK);
+}
+
+// Per-call context the MCP SDK passes to tool handlers; `signal` aborts when the client
+// cancels the request.
+export type ToolCallExtra = { signal?: AbortSignal };
+
+export function createQueryHandlers(deps: {
+    createEmbeddings: (text: string, provider?: string, signal?: AbortSignal) => Promise<number[]>;
+    // Embeds several texts in one provider request; without it each text is embedded on its own.
+    createEmbeddingsBatch?: (texts: string[], provider?: string, signal?: AbortSignal) => Promise<number[][]>;
+    resolveDbPath: ResolveDbPath;
+    queryCollection: QueryCollection;
+    getChunksForDocument: GetChunksForDocument;
+    getChunksByIds?: GetChunksByIds;
+    listProducts?: () => string[];
+    getProductInfo?: GetProductInfo;
+    getLatestVersion?: GetLatestVersion;
+    testConnection?: TestConnection;
+    inspectDatabase?: InspectDatabase;
+    exportChunks?: ExportChunks;
+    getStoredDimension?: GetStoredDimension;
+    getColumns?: GetColumns;
+    describeEmbedding?: DescribeEmbedding;
+    getDistanceThreshold?: GetDistanceThreshold;
+    saveDistanceCalibration?: SaveDistanceCalibration;
+    keywordSearch?: KeywordSearch;
+    createSparseEmbedding?: (text: string, signal?: AbortSignal) => Promise<SparseVector>;
+    sparseSearch?: SparseSearch;
+    options?: QueryHandlerOptions;
+}) {
+    const { resolveDbPath, queryCollection, getChunksForDocument, getChunksByIds, listProducts, getProductInfo } = deps;
+    const { getDistanceThreshold, saveDistanceCalibration, keywordSearch, testConnection } = deps;
+    const { createSparseEmbedding, sparseSearch, getLatestVersion, inspectDatabase, exportChunks } = deps;
+    const maxQueryChars = deps.options?.maxQueryChars ?? DEFAULT_MAX_QUERY_CHARS;
+    const queryLengthMode = deps.options?.queryLengthMode ?? 'reject';
+    const queryTrimMode = deps.options?.queryTrimMode ?? 'edges';
+    const minQueryLength = deps.options?.minQueryLength ?? DEFAULT_MIN_QUERY_LENGTH;
+    const defaultDeadlineMs = deps.options?.deadlineMs ?? 0;
+    const maxChunkIds = deps.options?.maxChunkIds ?? DEFAULT_MAX_CHUNK_IDS;
+    const maxExcludeChunkIds = deps.options?.maxExcludeChunkIds ?? DEFAULT_MAX_EXCLUDE_CHUNK_IDS;
+    const maxVersions = deps.options?.maxVersions ?? DEFAULT_MAX_VERSIONS;
+    const routeMinSimilarity = deps.options?.routeMinSimilarity ?? 0;
+    const autoDetectProduct = deps.options?.autoDetectProduct ?? false;
+    const autoDetectMinSimilarity = deps.options?.autoDetectMinSimilarity ?? DEFAULT_AUTO_DETECT_MIN_SIMILARITY;
+    const autoDetectMaxProducts = deps.options?.autoDetectMaxProducts ?? DEFAULT_AUTO_DETECT_MAX_PRODUCTS;
+    const slowQueryThresholdMs = deps.options?.slowQueryThresholdMs ?? 0;
+    const defaultVersionStrategy = deps.options?.defaultVersionStrategy ?? 'all';
+    const queryProviders = deps.options?.queryProviders ?? [];
+    const listProductsLimit = deps.options?.listProductsLimit ?? DEFAULT_LIST_PRODUCTS_LIMIT;
+    const includeQueryEcho = deps.options?.includeQueryEcho ?? false;
+    const resultTemplate = deps.options?.resultTemplate;
+    const messages = deps.options?.messages ?? {};
+    const sparseWeight = deps.options?.sparseWeight ?? DEFAULT_SPARSE_WEIGHT;
+    const redactPatterns = deps.options?.redactPatterns ?? [];
+    const compositeWeights = deps.options?.compositeWeights ?? DEFAULT_COMPOSITE_WEIGHTS;
+    const recencyColumn = deps.options?.recencyColumn;
+    const recencyHalfLifeDays = deps.options?.recencyHalfLifeDays ?? DEFAULT_RECENCY_HALF_LIFE_DAYS;
+    const requestTimeoutMs = deps.options?.requestTimeoutMs ?? 0;
+
+    // Abort signal of the tool call in progress. Embedding requests hand it to the provider,
+    // so they are aborted when the client cancels the call or the request timeout passes.
+    const callSignal = new AsyncLocalStorage<AbortSignal | undefined>();
+    const createEmbeddings = (text: string, provider?: string): Promise<number[]> =>
+        deps.createEmbeddings(text, provider, callSignal.getStore());
+    const createEmbeddingsBatch = (texts: string[]): Promise<number[][]> =>
+        deps.createEmbeddingsBatch
+            ? deps.createEmbeddingsBatch(texts, undefined, callSignal.getStore())
+            : Promise.all(texts.map((text) => createEmbeddings(text)));
+    const withCallSignal = <A, R>(handler: (args: A) => Promise<R>) =>
+        (args: A, extra?: ToolCallExtra): Promise<R> => {
+            const signals = [extra?.signal, requestTimeoutMs > 0 ? AbortSignal.timeout(requestTimeoutMs) : undefined]
+                .filter((signal): signal is AbortSignal => signal !== undefined);
+            return callSignal.run(signals.length > 1 ? AbortSignal.any(signals) : signals[0], () => handler(args));
+        };
+
+    // Appends "did you mean" to errors for a product that does not exist, using the same
+    // listing as list_products.
+    const errorMessage = (error: any, productName: string | undefined): string => {
+        const message: string = error?.message ?? String(error);
+        if (!productName || !listProducts || !/Unknown product|Database file not found/.test(message)) {
+            return message;
+        }
+        let suggestion: string | undefined;
+        try {
+            suggestion = suggestProductName(productName, listProducts());
+        } catch (listError) {
+            console.error('Error listing products for a suggestion:', listError);
+        }
+        return suggestion ? `${message} Did you mean '${suggestion}'?` : message;
+    };
+
+    // Every tool that returns chunk content passes it through here, so redaction holds
+    // for all output formats and for structured content alike.
+    const redact = <T extends { content?: unknown }>(row: T): T =>
+        redactPatterns.length > 0 && typeof row.content === 'string'
+            ? { ...row, content: redactContent(row.content, redactPatterns) }
+            : row;
+
+    // The rank each result had in its own product's list, after boosts and re-ranking, so a
+    // query fanned out across products can merge on it rather than on the raw distance.
+    const mergeRanks = new WeakMap<DocumentationResult, MergeRank>();
+
+    // Without an explicit version, a product listed in the manifest is searched at its
+    // defaultVersion. dbName bypasses the product layer, so it gets no default.
+    const versionFor = (productName: string | undefined, dbName: string | undefined, version: string | undefined): string | undefined =>
+        version ?? (productName && !dbName ? getProductInfo?.(productName.trim())?.defaultVersion : undefined);
+
+    async function queryDocumentation(
+        queryText: string,
+        productName: string | undefined,
+        dbName: string | undefined,
+        version: string | undefined,
+        urlPathPrefix: string | undefined,
+        limit: number = 4,
+        options: QueryDocumentationOptions = {}
+    ): Promise<DocumentationResult[]> {
+        const keywordMode = options.mode === 'keyword';
+        if (keywordMode && !keywordSearch) {
+            throw invalidRequestError('Keyword search is not supported by the configured vector database.');
+        }
+        const sparseMode = options.mode === 'sparse';
+        if (sparseMode && (!createSparseEmbedding || !sparseSearch)) {
+            throw invalidRequestError('Sparse search is not configured. Set SPARSE_ENCODER_URL and use a SQLite database with a sparse column.');
+        }
+
+        version = versionFor(productName, dbName, version);
+        const { dbPath } = resolveDbPath(dbName, productName, version);
+        // Resolved per database, so a query fanned out across products searches each one's newest docs.
+        if (!version && defaultVersionStrategy === 'latest' && getLatestVersion) {
+            version = await getLatestVersion(dbPath);
+        }
+        const metadataBoosts = options.metadataBoosts && options.metadataBoosts.length > 0 ? options.metadataBoosts : undefined;
+        // Checked against the schema, so a column that exists is accepted even when no
+        // candidate has a value for it. Without a schema, only the returned rows can tell.
+        const unknownBoostColumns = (columns: string[]): void => {
+            const unknown = metadataBoosts!.filter(({ column }) => !columns.includes(column)).map(({ column }) => column);
+            if (unknown.length > 0) {
+                throw invalidRequestError(`Unknown boost column(s) ${unknown.map((column) => `"${column}"`).join(', ')}: not present in vec_items.`);
+            }
+        };
+        if (metadataBoosts && deps.getColumns) {
+            unknownBoostColumns(await deps.getColumns(dbPath));
+        }
+        // minDistance drops the nearest matches, so it needs the wider fetch like the other post-filters.
+        const minDistance = keywordMode ? undefined : options.minDistance;
+        const compositeRanking = options.ranking === 'composite';
+        const hasPostFilters = !!urlPathPrefix || !!options.uniqueUrls || !!options.boostExactTitleMatch || !!metadataBoosts || minDistance !== undefined || compositeRanking;
+        // candidateMultiplier only ever widens the fetch; post-filters keep their own 3x floor.
+        const candidateMultiplier = Math.min(Math.max(options.candidateMultiplier ?? 1, 1), MAX_CANDIDATE_MULTIPLIER);
+        // Counting candidates over-fetches as far as candidateMultiplier may, so the count
+        // says more than "limit or fewer".
+        const fetchLimit = Math.max(
+            hasPostFilters ? limit * 3 : limit,
+            Math.ceil(limit * (options.candidateCount ? MAX_CANDIDATE_MULTIPLIER : candidateMultiplier))
+        );
+        const excludeChunkIds = options.excludeChunkIds && options.excludeChunkIds.length > 0 ? options.excludeChunkIds : undefined;
+        const filter = { product_name: productName, version: version, urlPrefix: urlPathPrefix, excludeChunkIds };
+        // Keyword mode skips embedding entirely; BM25 scores are not comparable to
+        // distances, so distance thresholds do not apply to it.
+        const timings = options.timings;
+        let results: QueryResult[];
+        if (keywordMode && keywordSearch) {
+            const searchStart = Date.now();
+            results = await keywordSearch(queryText, dbPath, filter, fetchLimit);
+            if (timings) {
+                timings.queryMs = Date.now() - searchStart;
+            }
+        } else {
+            const embeddingStart = Date.now();
+            const [queryEmbedding, sparseQuery] = await Promise.all([
+                options.queryEmbedding ?? createEmbeddings(queryText, options.provider),
+                sparseMode ? createSparseEmbedding!(queryText, callSignal.getStore()) : undefined,
+            ]);
+            const searchStart = Date.now();
+            if (timings) {
+                timings.embeddingMs = searchStart - embeddingStart;
+            }
+            if (options.embeddingSource) {
+                Object.assign(options.embeddingSource, deps.describeEmbedding?.(queryEmbedding));
+            }
+            if (options.provider && deps.getStoredDimension) {
+                const storedDimension = await deps.getStoredDimension(dbPath);
+                if (storedDimension !== undefined && storedDimension !== queryEmbedding.length) {
+                    throw invalidRequestError(`Provider "${options.provider}" produces ${queryEmbedding.length}-dimensional embeddings, but ${productName ? `product "${productName}"` : `db "${dbName}"`} stores ${storedDimension} dimensions.`);
+                }
+            }
+            if (sparseQuery) {
+                // Dense distances (cosine or L2) and sparse distances are on different scales,
+                // so each side is min-max normalized before the weighted fusion.
+                const [denseRows, sparseRows] = await Promise.all([
+                    queryCollection(queryEmbedding, dbPath, filter, fetchLimit, timings),
+                    sparseSearch!(sparseQuery, dbPath, filter, fetchLimit),
+                ]);
+                results = fuseWeightedResults([
+                    { weight: 1 - sparseWeight, rows: normalizeDistances(denseRows) },
+                    { weight: sparseWeight, rows: normalizeDistances(sparseRows) },
+                ], fetchLimit);
+            } else {
+                results = await queryCollection(queryEmbedding, dbPath, filter, fetchLimit, timings);
+            }
+            if (timings && timings.queryMs === undefined) {
+                timings.queryMs = Date.now() - searchStart - (timings.dbOpenMs ?? 0);
+            }
+        }
+        let filteredResults = filterResultsWithContent(filterResultsByUrl(results, urlPathPrefix));
+        if (excludeChunkIds) {
+            const excluded = new Set(excludeChunkIds);
+            filteredResults = filteredResults.filter((row) => !excluded.has(row.chunk_id));
+        }
+        const maxDistance = keywordMode ? undefined : options.maxDistance ?? (sparseMode ? undefined : getDistanceThreshold?.(dbPath));
+        if (typeof maxDistance === 'number') {
+            filteredResults = filteredResults.filter((row) => typeof row.distance !== 'number' || row.distance <= maxDistance);
+        }
+        if (typeof minDistance === 'number') {
+            filteredResults = filteredResults.filter((row) => typeof row.distance !== 'number' || row.distance >= minDistance);
+        }
+        if (metadataBoosts && filteredResults.length > 0) {
+            if (!deps.getColumns) {
+                unknownBoostColumns([...new Set(filteredResults.flatMap((row) => Object.keys(row)))]);
+            }
+            filteredResults = applyMetadataBoosts(filteredResults, metadataBoosts);
+        }
+        if (options.boostExactTitleMatch) {
+            filteredResults = boostExactMatches(filteredResults, queryText);
+        }
+        if (compositeRanking) {
+            filteredResults = rankByCompositeScore(filteredResults, queryText, compositeWeights, { column: recencyColumn, halfLifeDays: recencyHalfLifeDays });
+        }
+        if (options.uniqueUrls) {
+            filteredResults = collapseByUrl(filteredResults);
+        }
+        if (options.candidateCount) {
+            options.candidateCount.total = filteredResults.length;
+            options.candidateCount.capped = results.length >= fetchLimit;
+        }
+        const ranks = filteredResults.slice(0, limit).map((result): MergeRank => ({
+            exact: !!options.boostExactTitleMatch && isExactMatch(result, queryText),
+            score: typeof result.composite_score === 'number'
+                ? result.composite_score
+                : metadataBoosts ? boostedScore(result, metadataBoosts) : relevanceScore(result),
+        }));
+        const ranked = (results: DocumentationResult[]): DocumentationResult[] => {
+            results.forEach((result, index) => mergeRanks.set(result, ranks[index]));
+            return results;
+        };
+        const mappedResults = filteredResults.slice(0, limit).map((result) => {
+            const rowid = options.includeRowid ? resultRowid(result) : undefined;
+            const documentationResult: DocumentationResult = typeof result.composite_score === 'number'
+                ? {
+                    ...toDocumentationResult(result),
+                    composite_score: result.composite_score,
+                    ...(options.explain && { composite: result.composite as CompositeComponents }),
+                }
+                : toDocumentationResult(result);
+            const mapped = rowid === undefined ? documentationResult : { ...documentationResult, rowid };
+            // Redacting after the transform also catches matches that markup had split up.
+            return redact(options.contentFormat
+                ? { ...mapped, content: transformContent(mapped.content, options.contentFormat) }
+                : mapped);
+        });
+        const snippetSentences = options.snippetSentences;
+        const renderedResults = snippetSentences && snippetSentences > 0
+            ? mappedResults.map((result) => ({
+                ...result,
+                content: extractSnippet(result.content, queryText, snippetSentences),
+            }))
+            : mappedResults;
+        if (!options.includeMatchOffset) {
+            return ranked(renderedResults);
+        }
+        // Offsets are taken last, so they point into the content exactly as returned.
+        return ranked(renderedResults.map((result) => {
+            const matchOffset = findMatchOffset(result.content, queryText);
+            return matchOffset === undefined ? result : { ...result, match_offset: matchOffset };
+        }));
+    }
+
+    async function queryCode(
+        queryText: string,
+        productName: string | undefined,
+        repo: string | undefined,
+        dbName: string | undefined,
+        branch: string | undefined,
+        filePathPrefix: string | undefined,
+        extensions: string[] | undefined,
+        limit: number = 4
+    ): Promise<{
+        results: DocumentationResult[];
+        rawCount: number;
+        emptyContentCount: number;
+    }> {
+        const queryEmbedding = await createEmbeddings(queryText);
+        const { dbPath } = resolveDbPath(dbName, productName, undefined, repo);
+        const hasPostFilters = !!filePathPrefix || (extensions && extensions.length > 0);
+        const fetchLimit = hasPostFilters ? limit * 3 : limit;
+        const results = await queryCollection(
+            queryEmbedding,
+            dbPath,
+            { product_name: productName, repo, branch, urlPrefix: filePathPrefix, extensions },
+            fetchLimit
+        );
+        const filteredResults = filterResultsWithContent(filterResultsByUrl(results, filePathPrefix, extensions));
+        const mappedResults = filteredResults.slice(0, limit).map((row) => redact(toDocumentationResult(row)));
+        const emptyContentCount = results.filter((row) => typeof row.content !== 'string' || row.content.trim().length === 0).length;
+        return { results: mappedResults, rawCount: results.length, emptyContentCount };
+    }
+
+    async function queryAllProducts(
+        queryText: string,
+        version: string | undefined,
+        limit: number = 4,
+        deadlineMs: number = defaultDeadlineMs
+    ): Promise<{
+        results: DocumentationResult[];
+        timedOutProducts: string[];
+        failedProducts: string[];
+    }> {
+        if (!listProducts) {
+            throw new Error('Listing products is not supported by the configured vector database.');
+        }
+
+        const products = listProducts();
+        const queryEmbedding = await createEmbeddings(queryText);
+        const timedOutProducts: string[] = [];
+        const failedProducts: string[] = [];
+
+        // All products share one deadline. Synchronous backends (SQLite) cannot be
+        // interrupted mid-query, so products that have not started by the deadline are skipped.
+        const deadlineAt = deadlineMs > 0 ? Date.now() + deadlineMs : Infinity;
+        const TIMED_OUT = Symbol('timed out');
+        let timer: ReturnType<typeof setTimeout> | undefined;
+        const deadline = deadlineMs > 0
+            ? new Promise<typeof TIMED_OUT>((resolve) => {
+                timer = setTimeout(() => resolve(TIMED_OUT), deadlineMs);
+            })
+            : null;
+
+        try {
+            const perProduct = await Promise.all(products.map(async (product) => {
+                if (Date.now() >= deadlineAt) {
+                    timedOutProducts.push(product);
+                    return [];
+                }
+
+                try {
+                    const productVersion = versionFor(product, undefined, version);
+                    const { dbPath } = resolveDbPath(undefined, product, productVersion);
+                    const query = queryCollection(queryEmbedding, dbPath, { version: productVersion }, limit);
+                    const outcome = deadline ? await Promise.race([query, deadline]) : await query;
+                    if (outcome === TIMED_OUT) {
+                        timedOutProducts.push(product);
+                        return [];
+                    }
+                    return filterResultsWithContent(outcome).map((row) => redact({ ...toDocumentationResult(row), product }));
+                } catch (error) {
+                    console.error(`Error querying product "${product}":`, error);
+                    failedProducts.push(product);
+                    return [];
+                }
+            }));
+
+            const results = perProduct.flat().sort(compareByDistance).slice(0, limit);
+            return { results, timedOutProducts, failedProducts };
+        } finally {
+            if (timer) {
+                clearTimeout(timer);
+            }
+        }
+    }
+
+    // One top-1 search per product with a shared embedding: only the best distance matters for routing.
+    const bestMatchPerProduct = async (queryEmbedding: number[], products: string[], version: string | undefined, toolName: string) => {
+        const failedProducts: string[] = [];
+        const unmatchedProducts: string[] = [];
+        const perProduct = await Promise.all(products.map(async (product) => {
+            try {
+                const productVersion = versionFor(product, undefined, version);
+                const { dbPath } = resolveDbPath(undefined, product, productVersion);
+                const [best] = filterResultsWithContent(await queryCollection(queryEmbedding, dbPath, { product_name: product, version: productVersion }, 1));
+                if (!best) {
+                    unmatchedProducts.push(product);
+                    return [];
+                }
+                return [{ product, best: redact(toDocumentationResult(best)) }];
+            } catch (error) {
+                console.error(`Error querying product "${product}" for ${toolName}:`, error);
+                failedProducts.push(product);
+                return [];
+            }
+        }));
+        return { matched: perProduct.flat(), unmatchedProducts, failedProducts };
+    };
+
+    // Picks the one product whose best match is closest to the query, bounded by
+    // autoDetectMaxProducts searches, or explains why no product was confident enough.
+    const detectProduct = async (
+        queryText: string,
+        version: string | undefined,
+        provider: string | undefined
+    ): Promise<{ product: string; similarity: number; queryEmbedding: number[] } | { error: string }> => {
+        const products = listProducts!();
+        if (products.length > autoDetectMaxProducts) {
+            return { error: `Automatic product detection is limited to ${autoDetectMaxProducts} products (${products.length} available). Provide productName or dbName.` };
+        }
+        const queryEmbedding = await createEmbeddings(queryText, provider);
+        const { matched } = await bestMatchPerProduct(queryEmbedding, products, version, 'query_documentation');
+        const [best] = matched.sort((a, b) => compareByDistance({ ...a.best, product: a.product }, { ...b.best, product: b.product }));
+        if (!best) {
+            return { error: `Could not detect a product for "${queryText}": no product has matching documentation. Provide productName or dbName.` };
+        }
+        const similarity = distanceToSimilarity(best.best.distance);
+        if (similarity < autoDetectMinSimilarity) {
+            return {
+                error: `Could not detect a product for "${queryText}" with enough confidence (best match "${best.product}" has similarity ${similarity.toFixed(4)}, below ${autoDetectMinSimilarity}). Provide productName or dbName.`,
+            };
+        }
+        return { product: best.product, similarity, queryEmbedding };
+    };
+
+    const queryDocumentationToolHandler = async ({
+        queryText,
+        productName,
+        dbName,
+        version,
+        versions,
+        urlPathPrefix,
+        limit,
+        uniqueUrls,
+        snippetSentences,
+        contentFormat = 'raw',
+        minDistance,
+        maxDistance,
+        mode = 'vector',
+        timing = false,
+        includeRowid = false,
+        excludeChunkIds,
+        boostExactTitleMatch = false,
+        candidateMultiplier,
+        includeMatchOffset = false,
+        includeTotalCandidates = false,
+        boosts,
+        contextTokenBudget,
+        provider,
+        ranking = 'distance',
+        explain = false,
+        format = 'plain',
+    }: {
+        queryText: string;
+        productName?: string;
+        dbName?: string;
+        version?: string;
+        versions?: string[];
+        urlPathPrefix?: string;
+        limit: number;
+        uniqueUrls?: boolean;
+        snippetSentences?: number;
+        contentFormat?: ContentFormat;
+        minDistance?: number;
+        maxDistance?: number;
+        mode?: SearchMode;
+        timing?: boolean;
+        includeRowid?: boolean;
+        excludeChunkIds?: string[];
+        boostExactTitleMatch?: boolean;
+        candidateMultiplier?: number;
+        includeMatchOffset?: boolean;
+        includeTotalCandidates?: boolean;
+        boosts?: Record<string, number>;
+        contextTokenBudget?: number;
+        provider?: string;
+        ranking?: RankingMode;
+        explain?: boolean;
+        format?: ResultFormat;
+    }) => {
+        if (!productName && !dbName && !(autoDetectProduct && listProducts)) {
+            return toolError('Provide either productName or dbName for query_documentation.', 'invalid_request');
+        }
+
+        // The composite score already blends keyword matches into the ranking, and BM25
+        // scores are not distances it could blend.
+        if (ranking === 'composite' && (mode === 'keyword' || boosts || boostExactTitleMatch)) {
+            return toolError("ranking 'composite' cannot be combined with mode 'keyword', boosts or boostExactTitleMatch.", 'invalid_request');
+        }
+
+        if (provider && !queryProviders.includes(provider)) {
+            return toolError(
+                queryProviders.length > 0
+                    ? `Provider "${provider}" is not enabled. Available providers: ${queryProviders.join(', ')}.`
+                    : 'Per-query provider selection is not enabled on this server.',
+                'invalid_request'
+            );
+        }
+
+        if (candidateMultiplier !== undefined && !(candidateMultiplier >= 1 && candidateMultiplier <= MAX_CANDIDATE_MULTIPLIER)) {
+            return toolError(`candidateMultiplier must be between 1 and ${MAX_CANDIDATE_MULTIPLIER}.`, 'invalid_request');
+        }
+
+        if (minDistance !== undefined && maxDistance !== undefined && minDistance > maxDistance) {
+            return toolError(`minDistance (${minDistance}) must not be greater than maxDistance (${maxDistance}).`, 'invalid_request');
+        }
+
+        let metadataBoosts: MetadataBoost[] | undefined;
+        try {
+            metadataBoosts = boosts ? parseMetadataBoosts(boosts) : undefined;
+        } catch (error: any) {
+            return toolError(error.message, 'invalid_request');
+        }
+
+        const productList = productName?.includes(',') ? parseProductNames(productName) : undefined;
+        if (productList?.error) {
+            return toolError(productList.error, 'invalid_request');
+        }
+        if (productList && dbName) {
+            return toolError('A comma-separated productName cannot be combined with dbName.', 'invalid_request');
+        }
+        const products = productList?.products ?? [];
+
+        const versionList = versions && versions.length > 0 ? Array.from(new Set(versions)) : undefined;
+        if (versionList && (version || productList)) {
+            return toolError('versions cannot be combined with version or a comma-separated productName.', 'invalid_request');
+        }
+        if (versionList && maxVersions > 0 && versionList.length > maxVersions) {
+            return toolError(`Too many versions (${versionList.length}, maximum is ${maxVersions}).`, 'invalid_request');
+        }
+
+        const excludedIds = excludeChunkIds ? Array.from(new Set(excludeChunkIds)) : undefined;
+        if (excludedIds && maxExcludeChunkIds > 0 && excludedIds.length > maxExcludeChunkIds) {
+            return toolError(`Too many excluded chunk IDs (${excludedIds.length}, maximum is ${maxExcludeChunkIds}).`, 'invalid_request');
+        }
+
+        const lengthCheck = enforceQueryLength(queryText, maxQueryChars, queryLengthMode, minQueryLength, queryTrimMode);
+        if (lengthCheck.error) {
+            return toolError(lengthCheck.error, 'invalid_request');
+        }
+        const queryTruncated = !!lengthCheck.truncated;
+        queryText = lengthCheck.queryText;
+
+        let autoSelected: { product: string; similarity: number } | undefined;
+        let detectedEmbedding: number[] | undefined;
+        if (!productName && !dbName) {
+            try {
+                const detection = await detectProduct(queryText, version, provider);
+                if ('error' in detection) {
+                    return toolError(detection.error, 'invalid_request');
+                }
+                autoSelected = { product: detection.product, similarity: detection.similarity };
+                detectedEmbedding = mode === 'keyword' ? undefined : detection.queryEmbedding;
+                productName = detection.product;
+            } catch (error: any) {
+                console.error("Error detecting the product for 'query_documentation':", error);
+                return toolError(`Error querying documentation: ${error.message}`, toolErrorKind(error));
+            }
+        }
+
+        console.error(`Received query: text="${queryText}", product="${productName || 'n/a'}", dbName="${dbName || 'n/a'}", version="${version || 'any'}", limit=${limit}`);
+
+        const echo = (text: string): string => {
+            if (!includeQueryEcho) {
+                return text;
+            }
+            const calibratedMaxDistance = maxDistance === undefined
+                ? getDistanceThreshold?.(resolveDbPath(dbName, productName, version).dbPath)
+                : undefined;
+            return withQueryEcho(text, {
+                queryText,
+                queryTruncated,
+                productName,
+                dbName,
+                version,
+                urlPathPrefix,
+                limit,
+                uniqueUrls: !!uniqueUrls,
+                snippetSentences,
+                contentFormat,
+                minDistance,
+                maxDistance: maxDistance ?? calibratedMaxDistance,
+                maxDistanceSource: maxDistance !== undefined ? 'request' : calibratedMaxDistance !== undefined ? 'calibration' : undefined,
+                mode,
+                ranking,
+                format,
+            }, format);
+        };
+
+        const handlerStart = Date.now();
+        // Timings are also collected, but not returned, when slow queries are logged.
+        const timings: QueryTimings | undefined = timing || slowQueryThresholdMs > 0 ? {} : undefined;
+        const target = products.length > 1
+            ? `products ${products.map((product) => `"${product}"`).join(', ')}`
+            : productName ? `product "${products[0] ?? productName}"` : `db "${dbName}"`;
+        // Failed queries are logged too, with the kind of error, since a timeout is often what made them slow.
+        const warnIfSlow = (errorKind?: ToolErrorKind) => {
+            const totalMs = Date.now() - handlerStart;
+            if (slowQueryThresholdMs > 0 && totalMs >= slowQueryThresholdMs) {
+                console.warn(formatSlowQueryLog(queryText, target, totalMs, slowQueryThresholdMs, timings ?? {}, errorKind));
+            }
+        };
+
+        try {
+            const queryOptions: QueryDocumentationOptions = { queryEmbedding: detectedEmbedding, uniqueUrls, snippetSentences, contentFormat, minDistance, maxDistance, mode, provider, timings, includeRowid, excludeChunkIds: excludedIds, boostExactTitleMatch, candidateMultiplier, includeMatchOffset, metadataBoosts, ranking, explain };
+            const candidateCounts: CandidateCount[] = [];
+            const countCandidates = (): CandidateCount | undefined => {
+                if (!includeTotalCandidates) {
+                    return undefined;
+                }
+                const count = { total: 0, capped: false };
+                candidateCounts.push(count);
+                return count;
+            };
+            const failedProducts: string[] = [];
+            const failedVersions: string[] = [];
+            let results: DocumentationResult[];
+            let versionGroups: { version: string; results: DocumentationResult[] }[] | undefined;
+            let embeddingSource: Partial<EmbeddingSource> = {};
+            if (versionList) {
+                // Search each version with one shared embedding; results stay grouped by version.
+                const queryEmbedding = mode === 'keyword' ? undefined : detectedEmbedding ?? await createEmbeddings(queryText, provider);
+                embeddingSource = (queryEmbedding && deps.describeEmbedding?.(queryEmbedding)) || {};
+                versionGroups = await Promise.all(versionList.map(async (searchVersion) => {
+                    try {
+                        const versionResults = await queryDocumentation(queryText, productName, dbName, searchVersion, urlPathPrefix, limit, { ...queryOptions, timings: undefined, queryEmbedding, candidateCount: countCandidates() });
+                        return { version: searchVersion, results: versionResults.map((result) => ({ ...result, version: searchVersion })) };
+                    } catch (error) {
+                        console.error(`Error querying version "${searchVersion}":`, error);
+                        failedVersions.push(searchVersion);
+                        return { version: searchVersion, results: [] };
+                    }
+                }));
+                results = versionGroups.flatMap((group) => group.results);
+            } else if (products.length > 1) {
+                // Fan out to each named product with one shared embedding, and merge in the order
+                // each product ranked its results, so boosts and BM25 scores carry across.
+                const queryEmbedding = mode === 'keyword' ? undefined : await createEmbeddings(queryText, provider);
+                embeddingSource = (queryEmbedding && deps.describeEmbedding?.(queryEmbedding)) || {};
+                const perProduct = await Promise.all(products.map(async (product) => {
+                    try {
+                        const productResults = await queryDocumentation(queryText, product, undefined, version, urlPathPrefix, limit, { ...queryOptions, timings: undefined, queryEmbedding, candidateCount: countCandidates() });
+                        return productResults.map((result) => {
+                            const tagged = { ...result, product };
+                            const rank = mergeRanks.get(result);
+                            if (rank) {
+                                mergeRanks.set(tagged, rank);
+                            }
+                            return tagged;
+                        });
+                    } catch (error) {
+                        console.error(`Error querying product "${product}":`, error);
+                        failedProducts.push(product);
+                        return [];
+                    }
+                }));
+                results = perProduct.flat().sort(compareByMergeRank(mergeRanks)).slice(0, limit);
+            } else {
+                results = await queryDocumentation(queryText, products[0] ?? productName, dbName, version, urlPathPrefix, limit, { ...queryOptions, candidateCount: countCandidates(), embeddingSource });
+            }
+            const embedding = embeddingSource.provider && embeddingSource.model
+                ? { provider: embeddingSource.provider, model: embeddingSource.model }
+                : undefined;
+            const totalCandidates = includeTotalCandidates
+                ? { total: candidateCounts.reduce((sum, count) => sum + count.total, 0), capped: candidateCounts.some((count) => count.capped) }
+                : undefined;
+            const candidatesNote = totalCandidates
+                ? `\n\nTotal candidates: ${totalCandidates.capped ? 'at least ' : ''}${totalCandidates.total}`
+                : '';
+            const failed = [...failedProducts, ...failedVersions];
+            const failedNote = failed.length > 0 ? `\n\nFailed: ${failed.join(', ')}` : '';
+            const autoSelectedNote = autoSelected
+                ? `\n\nProduct "${autoSelected.product}" was selected automatically (similarity ${autoSelected.similarity.toFixed(4)}); pass productName to search another product.`
+                : '';
+            const versionLabel = versionList ? ` (versions ${versionList.join(', ')})` : version ? ` (version ${version})` : '';
+            const messageValues = {
+                query: queryText,
+                product: products.length > 1 ? products.join(', ') : products[0] ?? productName ?? dbName ?? '',
+                version: versionList ? versionList.join(', ') : version ?? '',
+                count: results.length,
+            };
+            if (results.length === 0) {
+                warnIfSlow();
+                const noResultsMessage = messages.noResults
+                    ? formatMessage(messages.noResults, messageValues)
+                    : `No relevant documentation found for "${queryText}" in ${target}${versionLabel}.`;
+                // JSON clients get the same document shape as a hit, so they never branch on content type.
+                const noResultsText = format === 'json'
+                    ? JSON.stringify({
+                        results: [],
+                        message: noResultsMessage,
+                        ...(failed.length > 0 && { failed }),
+                        ...(autoSelected && { autoSelectedProduct: autoSelected }),
+                        ...(totalCandidates && { totalCandidates: 0 }),
+                        ...(embedding && { embedding }),
+                    }, null, 2)
+                    : `${noResultsMessage}${autoSelectedNote}${failedNote}`;
+                return {
+                    content: [{
+                        type: 'text' as const,
+                        text: echo(noResultsText),
+                    }],
+                    structuredContent: {
+                        results: [] as StructuredResult[],
+                        ...(autoSelected && { autoSelectedProduct: autoSelected }),
+                        ...(totalCandidates && { totalCandidates: 0 }),
+                        ...(embedding && { embedding }),
+                    },
+                };
+            }
+
+            const formatStart = Date.now();
+            const formattedResults = versionGroups && format !== 'json'
+                ? versionGroups
+                    .map((group) => `Version ${group.version}:\n\n${group.results.length > 0 ? formatQueryResults(group.results, format, resultTemplate, messages) : 'No matches.'}`)
+                    .join('\n\n')
+                : formatQueryResults(results, format, resultTemplate, messages);
+            if (timings) {
+                timings.formatMs = Date.now() - formatStart;
+            }
+
+            const fuzzyVersions = Array.from(new Set(
+                results.map((r) => r.matched_version).filter((v): v is string => typeof v === 'string')
+            ));
+            const versionNote = fuzzyVersions.length > 0
+                ? `\n\nNote: no documentation matched version "${version}" exactly; showing results for fuzzy-matched version(s) ${fuzzyVersions.join(', ')}.`
+                : '';
+
+            // With a context budget, text responses carry the packed block instead of the
+            // result list; JSON keeps the results and adds the block.
+            const contextBlock = contextTokenBudget ? buildContextBlock(results, contextTokenBudget) : undefined;
+            let resultsText: string;
+            if (format === 'json') {
+                resultsText = contextBlock || totalCandidates || embedding || autoSelected
+                    ? JSON.stringify({
+                        ...JSON.parse(formattedResults),
+                        ...(autoSelected && { autoSelectedProduct: autoSelected }),
+                        ...(contextBlock && { context: contextBlock.context }),
+                        ...(totalCandidates && { totalCandidates: totalCandidates.total, totalCandidatesCapped: totalCandidates.capped }),
+                        ...(embedding && { embedding }),
+                    }, null, 2)
+                    : formattedResults;
+            } else if (contextBlock) {
+                const header = messages.contextHeader
+                    ? formatMessage(messages.contextHeader, { ...messageValues, included: contextBlock.included, budget: contextTokenBudget! })
+                    : `Context for "${queryText}" from ${target}${versionLabel} (${contextBlock.included} of ${results.length} snippets within ${contextTokenBudget} tokens):`;
+                resultsText = `${header}\n\n${contextBlock.context}${versionNote}${autoSelectedNote}${failedNote}${candidatesNote}`;
+            } else {
+                const header = messages.resultsHeader
+                    ? formatMessage(messages.resultsHeader, messageValues)
+                    : `Found ${results.length} relevant documentation snippets for "${queryText}" in ${target}${versionLabel}:`;
+                resultsText = `${header}\n\n${formattedResults}${versionNote}${autoSelectedNote}${failedNote}${candidatesNote}`;
+            }
+            const responseText = echo(timing && timings ? withTimings(resultsText, timings, format) : resultsText);
+            console.error(`Handler finished processing. Payload size (approx): ${responseText.length} chars. Returning response object...`);
+            warnIfSlow();
+
+            return {
+                content: [{ type: 'text' as const, text: responseText }],
+                structuredContent: {
+                    results: toStructuredResults(results, products.length > 1 ? undefined : productName, version),
+                    ...(autoSelected && { autoSelectedProduct: autoSelected }),
+                    ...(contextBlock && { context: contextBlock.context }),
+                    ...(totalCandidates && { totalCandidates: totalCandidates.total, totalCandidatesCapped: totalCandidates.capped }),
+                    ...(embedding && { embedding }),
+                },
+            };
+        } catch (error: any) {
+            console.error("Error processing 'query_documentation' tool:", error);
+            warnIfSlow(toolErrorKind(error));
+            return toolError(`Error querying documentation: ${errorMessage(error, productName)}`, toolErrorKind(error));
+        }
+    };
+
+    const queryCodeToolHandler = async ({
+        queryText,
+        productName,
+        repo,
+        dbName,
+        branch,
+        filePathPrefix,
+        extensions,
+        limit,
+    }: {
+        queryText: string;
+        productName?: string;
+        repo?: string;
+        dbName?: string;
+        branch?: string;
+        filePathPrefix?: string;
+        extensions?: string[];
+        limit: number;
+    }) => {
+        if (!dbName) {
+            return toolError('Provide dbName for query_code.', 'invalid_request');
+        }
+
+        const lengthCheck = enforceQueryLength(queryText, maxQueryChars, queryLengthMode, minQueryLength, queryTrimMode);
+        if (lengthCheck.error) {
+            return toolError(lengthCheck.error, 'invalid_request');
+        }
+        queryText = lengthCheck.queryText;
+
+        console.error(`Received code query: text="${queryText}", product="${productName || 'n/a'}", repo="${repo || 'n/a'}", dbName="${dbName}", branch="${branch || 'any'}", limit=${limit}`);
+
+        try {
+            const { results, rawCount, emptyContentCount } = await queryCode(
+                queryText,
+                productName,
+                repo,
+                dbName,
+                branch,
+                filePathPrefix,
+                extensions,
+                limit
+            );
+
+            const target = repo
                 ? `repo "${repo}"`
                 : productName
                     ? `product "${productName}"`
                     : `db "${dbName}"`;
 
-            if (results.length === 0) {
-                if (rawCount > 0 && emptyContentCount === rawCount) {
-                    return {
-                        content: [{ type: 'text' as const, text: `Found ${rawCount} vector matches in ${target}, but all matching chunks have empty content. Re-ingest this database to populate content fields.` }],
-                    };
+            if (results.length === 0) {
+                if (rawCount > 0 && emptyContentCount === rawCount) {
+                    return {
+                        content: [{ type: 'text' as const, text: `Found ${rawCount} vector matches in ${target}, but all matching chunks have empty content. Re-ingest this database to populate content fields.` }],
+                    };
+                }
+
+                return {
+                    content: [{ type: 'text' as const, text: `No relevant code found for "${queryText}" in ${target}${branch ? ` (branch ${branch})` : ''}.` }],
+                };
+            }
+
+            const formattedResults = formatQueryResults(results, 'plain', resultTemplate, messages);
+
+            const responseText = `Found ${results.length} relevant code snippets for "${queryText}" in ${target}${branch ? ` (branch ${branch})` : ''}:\n\n${formattedResults}`;
+            console.error(`Handler finished processing. Payload size (approx): ${responseText.length} chars. Returning response object...`);
+
+            return {
+                content: [{ type: 'text' as const, text: responseText }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'query_code' tool:", error);
+            return toolError(`Error querying code: ${errorMessage(error, productName)}`, toolErrorKind(error));
+        }
+    };
+
+    const getChunksToolHandler = async ({
+        productName,
+        dbName,
+        filePath,
+        startIndex,
+        endIndex,
+        version,
+    }: {
+        productName?: string;
+        dbName?: string;
+        filePath: string;
+        startIndex?: number;
+        endIndex?: number;
+        version?: string;
+    }) => {
+        if (!productName && !dbName) {
+            return toolError('Provide either productName or dbName for get_chunks.', 'invalid_request');
+        }
+        version = versionFor(productName, dbName, version);
+
+        console.error(`Received get_chunks: filePath="${filePath}", product="${productName || 'n/a'}", dbName="${dbName || 'n/a'}", version="${version || 'any'}", startIndex=${startIndex}, endIndex=${endIndex}`);
+
+        try {
+            const results = (await getChunksForDocument(productName, dbName, filePath, startIndex, endIndex, version)).map(redact);
+
+            if (results.length === 0) {
+                return {
+                    content: [{
+                        type: 'text' as const,
+                        text: `No chunks found for "${filePath}" in ${productName ? `product "${productName}"` : `db "${dbName}"`}${version ? ` (version ${version})` : ''}.`,
+                    }],
+                };
+            }
+
+            const formattedResults = results.map((r) =>
+                [
+                    `Chunk ${typeof r.chunk_index === 'number' && typeof r.total_chunks === 'number' ? `${r.chunk_index + 1} of ${r.total_chunks}` : ''}`.trim(),
+                    `  Content: ${r.content}`,
+                    r.section ? `  Section: ${r.section}` : null,
+                    r.url ? `  URL: ${r.url}` : null,
+                    '---',
+                ].filter((line) => line !== null).join('\n')
+            ).join('\n');
+
+            return {
+                content: [{ type: 'text' as const, text: `Retrieved ${results.length} chunk(s) for "${filePath}":\n\n${formattedResults}` }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'get_chunks' tool:", error);
+            return toolError(`Error retrieving chunks: ${errorMessage(error, productName)}`, toolErrorKind(error));
+        }
+    };
+
+    const getChunksByIdsToolHandler = async ({
+        productName,
+        dbName,
+        chunkIds,
+        version,
+    }: {
+        productName?: string;
+        dbName?: string;
+        chunkIds: string[];
+        version?: string;
+    }) => {
+        if (!productName && !dbName) {
+            return toolError('Provide either productName or dbName for get_chunks_by_ids.', 'invalid_request');
+        }
+        version = versionFor(productName, dbName, version);
+
+        if (!getChunksByIds) {
+            return toolError('get_chunks_by_ids is not supported by the configured vector database.', 'invalid_request');
+        }
+
+        const uniqueIds = Array.from(new Set(chunkIds));
+        if (maxChunkIds > 0 && uniqueIds.length > maxChunkIds) {
+            return toolError(`Too many chunk IDs (${uniqueIds.length}, maximum is ${maxChunkIds}). Split the request into smaller batches.`, 'invalid_request');
+        }
+
+        console.error(`Received get_chunks_by_ids: ${uniqueIds.length} id(s), product="${productName || 'n/a'}", dbName="${dbName || 'n/a'}", version="${version || 'any'}"`);
+
+        try {
+            const rows = await getChunksByIds(productName, dbName, uniqueIds, version);
+            const rowsById = new Map(rows.map((row) => [row.chunk_id, row]));
+            const results = uniqueIds
+                .map((chunkId) => rowsById.get(chunkId))
+                .filter((row): row is QueryResult => row !== undefined)
+                .map(redact);
+            const missingIds = uniqueIds.filter((chunkId) => !rowsById.has(chunkId));
+
+            if (results.length === 0) {
+                return {
+                    content: [{
+                        type: 'text' as const,
+                        text: `No chunks found for the requested IDs in ${productName ? `product "${productName}"` : `db "${dbName}"`}${version ? ` (version ${version})` : ''}.`,
+                    }],
+                };
+            }
+
+            const formattedResults = results.map((r) =>
+                [
+                    `Chunk ${r.chunk_id}`,
+                    `  Content: ${r.content}`,
+                    r.section ? `  Section: ${r.section}` : null,
+                    r.url ? `  URL: ${r.url}` : null,
+                    typeof r.chunk_index === 'number' && typeof r.total_chunks === 'number' && r.total_chunks > 0
+                        ? `  Chunk: ${r.chunk_index + 1} of ${r.total_chunks}`
+                        : null,
+                    '---',
+                ].filter((line) => line !== null).join('\n')
+            ).join('\n');
+            const missingNote = missingIds.length > 0 ? `\n\nNot found: ${missingIds.join(', ')}` : '';
+
+            return {
+                content: [{ type: 'text' as const, text: `Retrieved ${results.length} chunk(s):\n\n${formattedResults}${missingNote}` }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'get_chunks_by_ids' tool:", error);
+            return toolError(`Error retrieving chunks: ${errorMessage(error, productName)}`, toolErrorKind(error));
+        }
+    };
+
+    const queryAllProductsToolHandler = async ({
+        queryText,
+        version,
+        limit,
+        deadlineMs,
+    }: {
+        queryText: string;
+        version?: string;
+        limit: number;
+        deadlineMs?: number;
+    }) => {
+        const lengthCheck = enforceQueryLength(queryText, maxQueryChars, queryLengthMode, minQueryLength, queryTrimMode);
+        if (lengthCheck.error) {
+            return toolError(lengthCheck.error, 'invalid_request');
+        }
+        queryText = lengthCheck.queryText;
+
+        console.error(`Received query across all products: text="${queryText}", version="${version || 'any'}", limit=${limit}, deadlineMs=${deadlineMs ?? defaultDeadlineMs}`);
+
+        try {
+            const { results, timedOutProducts, failedProducts } = await queryAllProducts(queryText, version, limit, deadlineMs);
+
+            const notes = [
+                timedOutProducts.length > 0 ? `Timed out (no results within the deadline): ${timedOutProducts.join(', ')}` : null,
+                failedProducts.length > 0 ? `Failed: ${failedProducts.join(', ')}` : null,
+            ].filter((line) => line !== null).join('\n');
+
+            if (results.length === 0) {
+                return {
+                    content: [{
+                        type: 'text' as const,
+                        text: `No relevant documentation found for "${queryText}" in any product${version ? ` (version ${version})` : ''}.${notes ? `\n\n${notes}` : ''}`,
+                    }],
+                };
+            }
+
+            const responseText = `Found ${results.length} relevant documentation snippets for "${queryText}" across all products${version ? ` (version ${version})` : ''}:\n\n${formatQueryResults(results, 'plain', resultTemplate, messages)}${notes ? `\n\n${notes}` : ''}`;
+            return {
+                content: [{ type: 'text' as const, text: responseText }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'query_all_products' tool:", error);
+            return toolError(`Error querying all products: ${error.message}`, toolErrorKind(error));
+        }
+    };
+
+    const compareProductsToolHandler = async ({
+        queryText,
+        productA,
+        productB,
+        version,
+    }: {
+        queryText: string;
+        productA: string;
+        productB: string;
+        version?: string;
+    }) => {
+        const lengthCheck = enforceQueryLength(queryText, maxQueryChars, queryLengthMode, minQueryLength, queryTrimMode);
+        if (lengthCheck.error) {
+            return toolError(lengthCheck.error, 'invalid_request');
+        }
+        queryText = lengthCheck.queryText;
+
+        console.error(`Received compare_products: text="${queryText}", productA="${productA}", productB="${productB}", version="${version || 'any'}"`);
+
+        const topResult = async (product: string): Promise<{ product: string; best?: DocumentationResult; error?: string }> => {
+            try {
+                const [best] = await queryDocumentation(queryText, product, undefined, version, undefined, 1);
+                return { product, best };
+            } catch (error: any) {
+                console.error(`Error querying product "${product}" for compare_products:`, error);
+                return { product, error: error.message };
+            }
+        };
+
+        const comparisons = await Promise.all([topResult(productA), topResult(productB)]);
+        const lines = comparisons.map(({ product, best, error }) => {
+            if (error) {
+                return `  ${product}: error (${error})`;
+            }
+            if (!best) {
+                return `  ${product}: no matching documentation`;
+            }
+            return `  ${product}: best distance ${best.distance.toFixed(4)}${best.url ? ` (${best.url})` : ''}`;
+        });
+
+        const [a, b] = comparisons;
+        let verdict: string;
+        if (a.best && b.best) {
+            verdict = a.best.distance === b.best.distance
+                ? 'Both products cover this query equally well.'
+                : `Better coverage: ${a.best.distance < b.best.distance ? a.product : b.product}`;
+        } else if (a.best || b.best) {
+            verdict = `Only ${a.best ? a.product : b.product} has documentation for this query.`;
+        } else {
+            verdict = 'Neither product has documentation for this query.';
+        }
+
+        return {
+            content: [{
+                type: 'text' as const,
+                text: `Coverage comparison for "${queryText}"${version ? ` (version ${version})` : ''}:\n${lines.join('\n')}\n${verdict}`,
+            }],
+        };
+    };
+
+    const listProductsToolHandler = async ({
+        validate = false,
+        limit,
+    }: {
+        validate?: boolean;
+        limit?: number;
+    }) => {
+        if (!listProducts) {
+            return toolError('list_products is not supported by the configured vector database.', 'invalid_request');
+        }
+
+        try {
+            const products = listProducts();
+            const cap = Math.min(limit ?? listProductsLimit, listProductsLimit > 0 ? listProductsLimit : Infinity);
+            const listed = cap > 0 ? products.slice(0, cap) : products;
+
+            console.error(`Received list_products: validate=${validate}, listing ${listed.length} of ${products.length}`);
+
+            if (listed.length === 0) {
+                return {
+                    content: [{ type: 'text' as const, text: 'No products found.' }],
+                };
+            }
+
+            // Validation opens every listed database, so it is opt-in and bounded by the cap.
+            const lines = await Promise.all(listed.map(async (product) => {
+                const info = getProductInfo?.(product);
+                const label = `- ${product}${info?.displayName ? `: ${info.displayName}` : ''}${info?.defaultVersion ? ` [default version ${info.defaultVersion}]` : ''}`;
+                if (!validate || !testConnection) {
+                    return label;
+                }
+                try {
+                    await testConnection(resolveDbPath(undefined, product).dbPath);
+                    return `${label} (ok)`;
+                } catch (error) {
+                    return `${label} (unavailable: ${error instanceof Error ? error.message : String(error)})`;
+                }
+            }));
+            const truncatedNote = listed.length < products.length
+                ? `\n\nShowing the first ${listed.length} of ${products.length} products.`
+                : '';
+
+            return {
+                content: [{ type: 'text' as const, text: `Available products:\n${lines.join('\n')}${truncatedNote}` }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'list_products' tool:", error);
+            return toolError(`Error listing products: ${error.message}`, toolErrorKind(error));
+        }
+    };
+
+    const routeQueryToolHandler = async ({
+        queryText,
+        version,
+        limit,
+        products: candidateProducts,
+        minSimilarity = routeMinSimilarity,
+    }: {
+        queryText: string;
+        version?: string;
+        limit: number;
+        products?: string[];
+        minSimilarity?: number;
+    }) => {
+        const lengthCheck = enforceQueryLength(queryText, maxQueryChars, queryLengthMode, minQueryLength, queryTrimMode);
+        if (lengthCheck.error) {
+            return toolError(lengthCheck.error, 'invalid_request');
+        }
+        queryText = lengthCheck.queryText;
+
+        if (!candidateProducts?.length && !listProducts) {
+            return toolError('route_query needs a products list: listing products is not supported by the configured vector database.', 'invalid_request');
+        }
+        // Candidates are checked like a comma-separated productName, since each names a database file.
+        const parsed = candidateProducts?.length ? parseProductNames(candidateProducts.join(',')) : undefined;
+        if (parsed?.error) {
+            return toolError(parsed.error, 'invalid_request');
+        }
+        const products = parsed ? parsed.products : listProducts!();
+
+        console.error(`Received route_query: text="${queryText}", version="${version || 'any'}", candidates=${products.length}, limit=${limit}`);
+
+        try {
+            const queryEmbedding = await createEmbeddings(queryText);
+            const { matched, unmatchedProducts, failedProducts } = await bestMatchPerProduct(queryEmbedding, products, version, 'route_query');
+
+            // Products whose best match is below the similarity floor are not offered at all.
+            const belowFloor = matched.filter(({ best }) => distanceToSimilarity(best.distance) < minSimilarity);
+            const ranked = matched
+                .filter(({ best }) => distanceToSimilarity(best.distance) >= minSimilarity)
+                .sort((a, b) => compareByDistance({ ...a.best, product: a.product }, { ...b.best, product: b.product }))
+                .slice(0, limit);
+            const notes = [
+                belowFloor.length > 0 ? `Below similarity floor ${minSimilarity}: ${belowFloor.map(({ product }) => product).join(', ')}` : null,
+                unmatchedProducts.length > 0 ? `No matches: ${unmatchedProducts.join(', ')}` : null,
+                failedProducts.length > 0 ? `Failed: ${failedProducts.join(', ')}` : null,
+            ].filter((line) => line !== null).join('\n');
+
+            if (ranked.length === 0 && belowFloor.length > 0) {
+                return {
+                    content: [{
+                        type: 'text' as const,
+                        text: `No suitable product for "${queryText}"${version ? ` (version ${version})` : ''}: every product's best match is below the similarity floor.${notes ? `\n\n${notes}` : ''}`,
+                    }],
+                };
+            }
+
+            if (ranked.length === 0) {
+                return {
+                    content: [{
+                        type: 'text' as const,
+                        text: `No product has documentation matching "${queryText}"${version ? ` (version ${version})` : ''}.${notes ? `\n\n${notes}` : ''}`,
+                    }],
+                };
+            }
+
+            const lines = ranked.map(({ product, best }, index) =>
+                `${index + 1}. ${product}: best distance ${best.distance.toFixed(4)}${best.url ? ` (${best.url})` : ''}`
+            );
+            return {
+                content: [{
+                    type: 'text' as const,
+                    text: `Most likely products for "${queryText}"${version ? ` (version ${version})` : ''}:\n${lines.join('\n')}${notes ? `\n\n${notes}` : ''}`,
+                }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'route_query' tool:", error);
+            return toolError(`Error routing query: ${error.message}`, toolErrorKind(error));
+        }
+    };
+
+    const embedTextToolHandler = async ({ text }: { text: string }) => {
+        const lengthCheck = enforceQueryLength(text, maxQueryChars, queryLengthMode, minQueryLength, queryTrimMode);
+        if (lengthCheck.error) {
+            return toolError(lengthCheck.error, 'invalid_request');
+        }
+
+        console.error(`Received embed_text: ${lengthCheck.queryText.length} chars`);
+
+        try {
+            const embedding = await createEmbeddings(lengthCheck.queryText);
+            return {
+                content: [{ type: 'text' as const, text: JSON.stringify({ dimension: embedding.length, embedding }) }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'embed_text' tool:", error);
+            return toolError(`Error creating embedding: ${error.message}`, toolErrorKind(error));
+        }
+    };
+
+    const textSimilarityToolHandler = async ({ textA, textB }: { textA: string; textB: string }) => {
+        const checks = [textA, textB].map((text) => enforceQueryLength(text, maxQueryChars, queryLengthMode, minQueryLength, queryTrimMode));
+        const failed = checks.find((check) => check.error);
+        if (failed?.error) {
+            return toolError(failed.error, 'invalid_request');
+        }
+
+        console.error(`Received text_similarity: ${checks[0].queryText.length} and ${checks[1].queryText.length} chars`);
+
+        try {
+            // Both texts are embedded in one batch; the cache and fallback apply to each.
+            const [embeddingA, embeddingB] = await createEmbeddingsBatch(checks.map((check) => check.queryText));
+            const sources = [embeddingA, embeddingB].map((embedding) => deps.describeEmbedding?.(embedding));
+            // A fallback may have served only one of the texts; vectors from two models are not comparable.
+            if (sources[0] && sources[1] && (sources[0].provider !== sources[1].provider || sources[0].model !== sources[1].model)) {
+                throw new Error(`The texts were embedded by different models (${sources[0].provider}/${sources[0].model} and ${sources[1].provider}/${sources[1].model}). Try again.`);
+            }
+            const similarity = cosineSimilarity(embeddingA, embeddingB);
+            return {
+                content: [{
+                    type: 'text' as const,
+                    text: JSON.stringify({ similarity, dimension: embeddingA.length, ...(sources[0] && { embedding: sources[0] }) }),
+                }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'text_similarity' tool:", error);
+            return toolError(`Error computing similarity: ${error.message}`, toolErrorKind(error));
+        }
+    };
+
+    const refineQueryToolHandler = async ({
+        previousQuery,
+        feedback,
+        productName,
+        dbName,
+        version,
+        limit,
+        previousChunkIds = [],
+    }: {
+        previousQuery: string;
+        feedback: string;
+        productName?: string;
+        dbName?: string;
+        version?: string;
+        limit: number;
+        previousChunkIds?: string[];
+    }) => {
+        if (!productName && !dbName) {
+            return toolError('Provide either productName or dbName for refine_query.', 'invalid_request');
+        }
+
+        const lengthCheck = enforceQueryLength(buildRefinedQuery(previousQuery, feedback), maxQueryChars, queryLengthMode, minQueryLength, queryTrimMode);
+        if (lengthCheck.error) {
+            return toolError(lengthCheck.error, 'invalid_request');
+        }
+        const refinedQuery = lengthCheck.queryText;
+
+        console.error(`Received refine_query: refined="${refinedQuery}", product="${productName || 'n/a'}", dbName="${dbName || 'n/a'}", version="${version || 'any'}", limit=${limit}, excluded=${previousChunkIds.length}`);
+
+        try {
+            // Over-fetch by the number of excluded chunks so already-seen results can be dropped.
+            const seen = new Set(previousChunkIds);
+            const results = (await queryDocumentation(refinedQuery, productName, dbName, version, undefined, limit + seen.size))
+                .filter((result) => !result.chunk_id || !seen.has(result.chunk_id))
+                .slice(0, limit);
+
+            if (results.length === 0) {
+                return {
+                    content: [{
+                        type: 'text' as const,
+                        text: `Refined query: "${refinedQuery}"\n\nNo new documentation found in ${productName ? `product "${productName}"` : `db "${dbName}"`}${version ? ` (version ${version})` : ''}.`,
+                    }],
+                };
+            }
+
+            return {
+                content: [{
+                    type: 'text' as const,
+                    text: `Refined query: "${refinedQuery}"\n\nFound ${results.length} relevant documentation snippets in ${productName ? `product "${productName}"` : `db "${dbName}"`}${version ? ` (version ${version})` : ''}:\n\n${formatQueryResults(results, 'plain', resultTemplate, messages)}`,
+                }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'refine_query' tool:", error);
+            return toolError(`Error refining query: ${error.message}`, toolErrorKind(error));
+        }
+    };
+
+    const calibrateThresholdToolHandler = async ({
+        productName,
+        dbName,
+        probeQueries,
+        topK = 3,
+        percentile = 0.9,
+    }: {
+        productName?: string;
+        dbName?: string;
+        probeQueries: string[];
+        topK?: number;
+        percentile?: number;
+    }) => {
+        if (!productName && !dbName) {
+            return toolError('Provide either productName or dbName for calibrate_threshold.', 'invalid_request');
+        }
+
+        // The calibration sidecar is written next to the database, so dbName must stay inside the database directory.
+        if (dbName && (dbName === '.' || dbName === '..' || /[\\/]/.test(dbName))) {
+            return toolError(`Invalid dbName "${dbName}": use a database file name from the database directory, not a path.`, 'invalid_request');
+        }
+
+        if (!saveDistanceCalibration) {
+            return toolError('calibrate_threshold is not supported by the configured vector database.', 'invalid_request');
+        }
+
+        const probes = probeQueries.map((probe) => probe.trim()).filter((probe) => probe.length > 0);
+        if (probes.length === 0) {
+            return toolError('Provide at least one non-empty probe query.', 'invalid_request');
+        }
+
+        console.error(`Received calibrate_threshold: ${probes.length} probe(s), product="${productName || 'n/a'}", dbName="${dbName || 'n/a'}", topK=${topK}, percentile=${percentile}`);
+
+        try {
+            const { dbPath, dbLabel } = resolveDbPath(dbName, productName);
+            const distances: number[] = [];
+            for (const probe of probes) {
+                const queryEmbedding = await createEmbeddings(probe);
+                const rows = await queryCollection(queryEmbedding, dbPath, { product_name: productName }, topK);
+                for (const row of filterResultsWithContent(rows)) {
+                    if (typeof row.distance === 'number') {
+                        distances.push(row.distance);
+                    }
+                }
+            }
+
+            const threshold = computeDistanceThreshold(distances, percentile);
+            if (threshold === undefined) {
+                return {
+                    content: [{ type: 'text' as const, text: `No results were returned for the probe queries in ${dbLabel}; threshold not changed.` }],
+                };
+            }
+
+            saveDistanceCalibration(dbPath, {
+                threshold,
+                percentile,
+                probeCount: probes.length,
+                calibratedAt: new Date().toISOString(),
+            });
+
+            return {
+                content: [{
+                    type: 'text' as const,
+                    text: `Calibrated ${dbLabel}: default maxDistance is now ${threshold.toFixed(4)} (p${Math.round(percentile * 100)} of ${distances.length} distances from ${probes.length} probe(s)).`,
+                }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'calibrate_threshold' tool:", error);
+            return toolError(`Error calibrating threshold: ${error.message}`, toolErrorKind(error));
+        }
+    };
+
+    // Runs each check in order; a check whose prerequisite failed is reported as skipped
+    // rather than failing with a misleading error.
+    const validateDatabaseToolHandler = async ({
+        productName,
+        dbName,
+        sampleQuery = DEFAULT_VALIDATION_QUERY,
+        format = 'plain',
+    }: {
+        productName?: string;
+        dbName?: string;
+        sampleQuery?: string;
+        format?: 'plain' | 'json';
+    }) => {
+        if (!productName && !dbName) {
+            return toolError('Provide either productName or dbName for validate_database.', 'invalid_request');
+        }
+
+        if (!inspectDatabase) {
+            return toolError('validate_database is not supported by the configured vector database.', 'invalid_request');
+        }
+
+        console.error(`Received validate_database: product="${productName || 'n/a'}", dbName="${dbName || 'n/a'}"`);
+
+        try {
+            const { dbPath, dbLabel } = resolveDbPath(dbName, productName);
+            const inspection = await inspectDatabase(dbPath);
+            const checks: DatabaseCheck[] = [];
+            const check = (name: string, status: DatabaseCheckStatus, detail: string) => {
+                checks.push({ name, status, detail });
+                return status === 'pass';
+            };
+            const skip = (name: string, reason: string) => check(name, 'skip', reason);
+
+            const exists = check('file_exists', inspection.exists ? 'pass' : 'fail', inspection.exists ? dbPath : `Database file not found at ${dbPath}`);
+            const opens = exists
+                ? check('opens', inspection.openError ? 'fail' : 'pass', inspection.openError ?? 'Opened read-only.')
+                : skip('opens', 'file does not exist');
+            const vecLoaded = opens
+                ? check('vec_extension', inspection.vecError ? 'fail' : 'pass', inspection.vecError ?? `sqlite-vec ${inspection.vecVersion}`)
+                : skip('vec_extension', 'database did not open');
+
+            let queryEmbedding: number[] | undefined;
+            let dimensionMatches = false;
+            const knownDimension = deps.options?.embeddingDimension;
+            if (!opens) {
+                skip('dimension', 'database did not open');
+            } else if (inspection.dimension === undefined) {
+                check('dimension', 'fail', 'Could not read the vector dimension from the vec_items declaration.');
+            } else if (knownDimension !== undefined) {
+                dimensionMatches = check(
+                    'dimension',
+                    knownDimension === inspection.dimension ? 'pass' : 'fail',
+                    `Database stores ${inspection.dimension} dimensions; the configured model produces ${knownDimension}.`
+                );
+            } else {
+                try {
+                    queryEmbedding = await createEmbeddings(sampleQuery);
+                    dimensionMatches = check(
+                        'dimension',
+                        queryEmbedding.length === inspection.dimension ? 'pass' : 'fail',
+                        `Database stores ${inspection.dimension} dimensions; the configured model produces ${queryEmbedding.length}.`
+                    );
+                } catch (error: any) {
+                    check('dimension', 'fail', `Could not embed the sample query: ${error.message}`);
+                }
+            }
+
+            if (!vecLoaded) {
+                skip('row_count', 'sqlite-vec is not loaded');
+            } else if (inspection.rowCount === undefined) {
+                check('row_count', 'fail', 'Could not count vec_items rows.');
+            } else {
+                check('row_count', inspection.rowCount > 0 ? 'pass' : 'fail', `${inspection.rowCount} rows in vec_items.`);
+            }
+
+            const missingColumns = REQUIRED_VEC_ITEMS_COLUMNS.filter((column) => !inspection.columns.includes(column));
+            if (!opens) {
+                skip('required_columns', 'database did not open');
+            } else {
+                check(
+                    'required_columns',
+                    missingColumns.length === 0 ? 'pass' : 'fail',
+                    missingColumns.length === 0 ? `vec_items has ${REQUIRED_VEC_ITEMS_COLUMNS.join(', ')}.` : `vec_items is missing ${missingColumns.join(', ')}.`
+                );
+            }
+
+            if (!vecLoaded || !dimensionMatches) {
+                skip('sample_query', 'an earlier check failed');
+            } else {
+                try {
+                    queryEmbedding ??= await createEmbeddings(sampleQuery);
+                    const rows = await queryCollection(queryEmbedding, dbPath, {}, 1);
+                    check(
+                        'sample_query',
+                        rows.length > 0 ? 'pass' : 'fail',
+                        rows.length > 0 ? `"${sampleQuery}" returned chunk ${rows[0].chunk_id}.` : `"${sampleQuery}" returned no results.`
+                    );
+                } catch (error: any) {
+                    check('sample_query', 'fail', error.message);
+                }
+            }
+
+            const ok = checks.every((entry) => entry.status === 'pass');
+            if (format === 'json') {
+                return {
+                    content: [{ type: 'text' as const, text: JSON.stringify({ database: dbLabel, ok, checks }, null, 2) }],
+                };
+            }
+            const lines = checks.map((entry) => `- [${entry.status}] ${entry.name}: ${entry.detail}`);
+            return {
+                content: [{ type: 'text' as const, text: `Validation of ${dbLabel}: ${ok ? 'PASS' : 'FAIL'}\n${lines.join('\n')}` }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'validate_database' tool:", error);
+            return toolError(`Error validating database: ${error.message}`, toolErrorKind(error));
+        }
+    };
+
+    // Pages through every chunk of a database in rowid order, for re-indexing with another
+    // model or backups. Vectors are left out; re-embedding is the point of an export.
+    const exportDocumentsToolHandler = async ({
+        productName,
+        dbName,
+        cursor = 0,
+        limit = DEFAULT_EXPORT_PAGE_SIZE,
+    }: {
+        productName?: string;
+        dbName?: string;
+        cursor?: number;
+        limit?: number;
+    }) => {
+        if (!productName && !dbName) {
+            return toolError('Provide either productName or dbName for export_documents.', 'invalid_request');
+        }
+
+        if (!exportChunks) {
+            return toolError('export_documents is not supported by the configured vector database.', 'invalid_request');
+        }
+
+        if (limit > MAX_EXPORT_PAGE_SIZE) {
+            return toolError(`Too many chunks per page (${limit}, maximum is ${MAX_EXPORT_PAGE_SIZE}).`, 'invalid_request');
+        }
+
+        console.error(`Received export_documents: product="${productName || 'n/a'}", dbName="${dbName || 'n/a'}", cursor=${cursor}, limit=${limit}`);
+
+        try {
+            const { dbPath, dbLabel } = resolveDbPath(dbName, productName);
+            const { rows, total, hasMore } = await exportChunks(dbPath, cursor, limit);
+            const chunks = rows.map((row) => {
+                const rowid = resultRowid(row);
+                const { rowid: _rowid, ...columns } = redact(row);
+                return rowid === undefined ? columns : { rowid, ...columns };
+            });
+            const lastRowid = rows.length > 0 ? resultRowid(rows[rows.length - 1]) : undefined;
+            const nextCursor = hasMore ? lastRowid : undefined;
+            return {
+                content: [{
+                    type: 'text' as const,
+                    text: JSON.stringify({ database: dbLabel, cursor, total, ...(nextCursor !== undefined && { nextCursor }), chunks }, null, 2),
+                }],
+            };
+        } catch (error: any) {
+            console.error("Error processing 'export_documents' tool:", error);
+            return toolError(`Error exporting documents: ${error.message}`, toolErrorKind(error));
+        }
+    };
+
+    return {
+        queryDocumentation,
+        queryCode,
+        queryAllProducts,
+        compareProductsToolHandler: withCallSignal(compareProductsToolHandler),
+        listProductsToolHandler: withCallSignal(listProductsToolHandler),
+        routeQueryToolHandler: withCallSignal(routeQueryToolHandler),
+        embedTextToolHandler: withCallSignal(embedTextToolHandler),
+        textSimilarityToolHandler: withCallSignal(textSimilarityToolHandler),
+        refineQueryToolHandler: withCallSignal(refineQueryToolHandler),
+        calibrateThresholdToolHandler: withCallSignal(calibrateThresholdToolHandler),
+        validateDatabaseToolHandler: withCallSignal(validateDatabaseToolHandler),
+        exportDocumentsToolHandler: withCallSignal(exportDocumentsToolHandler),
+        queryDocumentationToolHandler: withCallSignal(queryDocumentationToolHandler),
+        queryCodeToolHandler: withCallSignal(queryCodeToolHandler),
+        queryAllProductsToolHandler: withCallSignal(queryAllProductsToolHandler),
+        getChunksToolHandler: withCallSignal(getChunksToolHandler),
+        getChunksByIdsToolHandler: withCallSignal(getChunksByIdsToolHandler),
+    };
+}
+
+export function createSqliteDbProvider(deps: {
+    dbDir: string;
+    sqliteVec: SqliteVecModule;
+    Database: SqliteDatabaseCtor;
+    fs: FsModule;
+    path: PathModule;
+    vecColumns?: VecColumn[];
+    fuzzyVersionFallback?: boolean;
+    busyTimeoutMs?: number;
+    busyRetries?: number;
+    openRetries?: number;
+    ftsTable?: string;
+    maxEmbeddingDimension?: number;
+    sparseColumn?: string;
+    // Rows sparse search scores per query, 0 for no cap.
+    sparseMaxScanRows?: number;
+    productsManifest?: ProductManifestEntry[];
+    // Where the manifest was loaded from, for error messages.
+    productsManifestPath?: string;
+    vectorByteOrder?: ByteOrder;
+    vectorQuantization?: VectorQuantization;
+    caseInsensitiveFilters?: boolean;
+    // Product name -> SQLite file: URI, consulted before the manifest and directory.
+    databaseUris?: Record<string, string>;
+    logger?: ServerLogger;
+    // testConnection also runs PRAGMA quick_check, which reads every page.
+    integrityCheck?: boolean;
+    // Corrupt files are renamed with CORRUPT_DB_SUFFIX so rescans stop listing them.
+    quarantineCorrupt?: boolean;
+}) {
+    const { dbDir, sqliteVec, Database, path, productsManifest } = deps;
+    const databaseUris = deps.databaseUris ?? {};
+    const logger = deps.logger ?? createLogger();
+    // Databases may be SQLite URIs, so existence checks look at the file they name.
+    const fs: FsModule = { ...deps.fs, existsSync: (dbPath: string) => deps.fs.existsSync(sqliteFilePath(dbPath)) };
+    const manifestEntries = new Map((productsManifest ?? []).map((entry) => [entry.name, entry]));
+    const manifestLabel = deps.productsManifestPath ?? PRODUCTS_MANIFEST_FILE;
+    const sparseColumn = deps.sparseColumn ?? DEFAULT_SPARSE_COLUMN;
+    const sparseMaxScanRows = deps.sparseMaxScanRows ?? DEFAULT_SPARSE_MAX_SCAN_ROWS;
+    const maxEmbeddingDimension = deps.maxEmbeddingDimension ?? DEFAULT_MAX_EMBEDDING_DIMENSION;
+    const ftsTable = deps.ftsTable ?? DEFAULT_FTS_TABLE;
+    const busyTimeoutMs = deps.busyTimeoutMs ?? DEFAULT_DB_BUSY_TIMEOUT_MS;
+    const busyRetries = deps.busyRetries ?? DEFAULT_DB_BUSY_RETRIES;
+    const openRetries = deps.openRetries ?? DEFAULT_DB_OPEN_RETRIES;
+    const configuredByteOrder = deps.vectorByteOrder ?? 'little';
+    const configuredQuantization = deps.vectorQuantization ?? 'none';
+    const integrityCheck = deps.integrityCheck ?? false;
+    const quarantineCorrupt = deps.quarantineCorrupt ?? false;
+
+    // Databases found corrupt are left out of listDatabaseNames until the next rescan, so
+    // one bad file fails only the requests that name it, not every cross-product search.
+    const corruptDatabases = new Set<string>();
+
+    // Whether PRAGMA quick_check on a fresh connection agrees the file is corrupt. Moving a
+    // file aside is only safe once the corruption is confirmed, not on one failed query.
+    const confirmCorrupt = (dbPath: string): boolean => {
+        let db: SqliteDatabase | null = null;
+        try {
+            db = openDatabase(dbPath);
+            const [result] = db.prepare('PRAGMA quick_check(1)').all() as unknown as { quick_check?: unknown }[];
+            return result?.quick_check !== 'ok';
+        } catch (error) {
+            return isSqliteCorruptError(error);
+        } finally {
+            if (db) {
+                db.close();
+            }
+        }
+    };
+
+    // `confirmed` is set when the error already came from quick_check.
+    const corruptDatabaseError = (dbPath: string, error: unknown, confirmed = false): Error => {
+        const reason = error instanceof Error ? error.message : String(error);
+        const file = sqliteFilePath(dbPath);
+        if (!corruptDatabases.has(dbPath)) {
+            corruptDatabases.add(dbPath);
+            logger.error(`[DB ${dbPath}] Database is corrupt (${reason}); leaving it out of product listings.`);
+            if (quarantineCorrupt && deps.fs.renameSync) {
+                if (!confirmed && !confirmCorrupt(dbPath)) {
+                    logger.warn(`Warning: quick_check found ${file} intact; not quarantining it.`);
+                } else {
+                    try {
+                        deps.fs.renameSync(file, `${file}${CORRUPT_DB_SUFFIX}`);
+                        logger.error(`[DB ${dbPath}] Moved the corrupt database to ${file}${CORRUPT_DB_SUFFIX}.`);
+                    } catch (renameError) {
+                        logger.warn(`Warning: unable to quarantine ${file}:`, renameError);
+                    }
                 }
+            }
+        }
+        return new Error(`${DB_CORRUPT}: ${path.basename(file)} is corrupt (${reason}). Re-index or restore it.`);
+    };
 
-                return {
-                    content: [{ type: 'text' as const, text: `No relevant code found for "${queryText}" in ${target} ${branch ? `(branch ${branch})` : ''}.` }],
-                };
+    // Databases are opened read-only so the indexer can keep writing (WAL readers do not
+    // block writers); `timeout` sets SQLite's busy_timeout for the connection.
+    const openDatabase = (dbPath: string): SqliteDatabase =>
+        new Database(dbPath, { readonly: true, fileMustExist: true, timeout: busyTimeoutMs });
+
+    const openDatabaseWithRetry = async (dbPath: string): Promise<SqliteDatabase> => {
+        for (let attempt = 0; ; attempt++) {
+            try {
+                return openDatabase(dbPath);
+            } catch (error) {
+                if (!fs.existsSync(dbPath)) {
+                    throw new Error(`Database file not found at ${dbPath}`);
+                }
+                if (!isTransientOpenError(error) || attempt >= openRetries) {
+                    throw error;
+                }
+                const delayMs = RETRY_BASE_DELAY_MS * 2 ** attempt;
+                logger.warn(`[DB ${dbPath}] Open failed (${(error as { code?: string }).code}), retrying in ${delayMs}ms (attempt ${attempt + 1} of ${openRetries}).`);
+                await new Promise((resolve) => setTimeout(resolve, delayMs));
             }
+        }
+    };
+    const fuzzyVersionFallback = deps.fuzzyVersionFallback ?? false;
+    const caseInsensitiveFilters = deps.caseInsensitiveFilters ?? false;
+    const vecColumns = deps.vecColumns && deps.vecColumns.length > 0
+        ? deps.vecColumns
+        : [{ column: 'embedding', weight: 1 }];
 
-            const formattedResults = results.map((r, index) =>
-                [
-                    `Result ${index + 1}:`,
-                    `  Content: ${r.content}`,
-                    `  Distance: ${r.distance.toFixed(4)}`,
-                    r.url ? `  URL: ${r.url}` : null,
-                    typeof r.chunk_index === 'number' && typeof r.total_chunks === 'number' && r.total_chunks > 0
-                        ? `  Chunk: ${r.chunk_index + 1} of ${r.total_chunks}`
-                        : null,
-                    '---',
-                ].filter((line) => line !== null).join('\n')
-            ).join('\n');
+    const stripVectorColumns = (row: QueryResult): QueryResult => {
+        delete row.embedding;
+        for (const { column } of vecColumns) {
+            delete row[column];
+        }
+        return dropBlobColumns(row);
+    };
 
-            const responseText = `Found ${results.length} relevant code snippets for "${queryText}" in ${target} ${branch ? `(branch ${branch})` : ''}:\n\n${formattedResults}`;
-            console.error(`Handler finished processing. Payload size (approx): ${responseText.length} chars. Returning response object...`);
+    // The KNN search itself must be ordered by distance alone, so ties are broken by
+    // `tiebreaker` in an outer query to keep equal-distance results in a stable order.
+    // sqlite-vec reads a bare blob as float32, so an int8 query is wrapped in vec_int8().
+    const buildVectorQuery = (column: string, filter: QueryFilter, int8: boolean, tiebreaker: string): string => {
+        let query = `
+            SELECT * FROM (
+              SELECT
+                  rowid,
+                  *,
+                  distance
+              FROM vec_items
+              WHERE ${column} MATCH ${int8 ? 'vec_int8(@query_embedding)' : '@query_embedding'}`;
 
-            return {
-                content: [{ type: 'text' as const, text: responseText }],
-            };
-        } catch (error: any) {
-            console.error("Error processing 'query_code' tool:", error);
-            return {
-                content: [{ type: 'text' as const, text: `Error querying code: ${error.message}` }],
-            };
+        if (filter.product_name) query += ` AND product_name = @product_name`;
+        if (filter.version) query += ` AND version = @version`;
+        if (filter.branch) query += ` AND branch = @branch`;
+        if (filter.repo) query += ` AND repo = @repo`;
+        if (filter.excludeChunkIds?.length) {
+            query += ` AND chunk_id NOT IN (${filter.excludeChunkIds.map((_, index) => `@exclude_${index}`).join(', ')})`;
         }
+
+        query += `
+              ORDER BY distance
+              LIMIT @top_k
+            )
+            ORDER BY distance, ${tiebreaker};`;
+        return query;
     };
 
-    const getChunksToolHandler = async ({
-        productName,
-        dbName,
-        filePath,
-        startIndex,
-        endIndex,
-        version,
-    }: {
-        productName?: string;
-        dbName?: string;
-        filePath: string;
-        startIndex?: number;
-        endIndex?: number;
-        version?: string;
-    }) => {
-        if (!productName && !dbName) {
-            return {
-                content: [{ type: 'text' as const, text: 'Provide either productName or dbName for get_chunks.' }],
-            };
+    const runVectorSearch = (
+        db: SqliteDatabase,
+        dbPath: string,
+        filter: QueryFilter,
+        params: Record<string, SqliteBindValue>,
+        topK: number
+    ): QueryResult[] => {
+        const int8 = params.query_embedding instanceof Int8Array;
+        const tiebreaker = vectorTiebreaker(db, dbPath);
+        if (vecColumns.length === 1) {
+            return db.prepare(buildVectorQuery(vecColumns[0].column, filter, int8, tiebreaker)).all(params);
+        }
+        return fuseWeightedResults(
+            vecColumns.map(({ column, weight }) => ({
+                weight,
+                rows: db.prepare(buildVectorQuery(column, filter, int8, tiebreaker)).all(params),
+            })),
+            topK
+        );
+    };
+
+    // Retries a version-filtered search against every stored version that fuzzily
+    // matches the requested one, tagging rows with the version they matched.
+    const runFuzzyVersionSearch = (
+        db: SqliteDatabase,
+        dbPath: string,
+        filter: QueryFilter & { version: string },
+        params: Record<string, SqliteBindValue>,
+        topK: number
+    ): QueryResult[] => {
+        const storedVersions = db.prepare(`SELECT DISTINCT version FROM vec_items`).all() as unknown as { version?: unknown }[];
+        const candidates = storedVersions
+            .map((row) => row.version)
+            .filter((version): version is string =>
+                typeof version === 'string' && version !== filter.version && fuzzyVersionMatches(filter.version, version)
+            );
+        if (candidates.length === 0) {
+            return [];
+        }
+
+        logger.debug(`[DB ${dbPath}] No rows for version "${filter.version}". Retrying with fuzzy matches: ${candidates.join(', ')}`);
+        return candidates
+            .flatMap((version) =>
+                runVectorSearch(db, dbPath, { ...filter, version }, { ...params, version }, topK)
+                    .map((row) => ({ ...row, matched_version: version }))
+            )
+            .sort(compareByDistance)
+            .slice(0, topK);
+    };
+
+    // Per-file state read from a database is kept with the file's identity (inode, size and
+    // mtime). A file replaced or re-indexed in place no longer matches, so its state is read
+    // afresh instead of being applied to the new contents.
+    type FileState = {
+        signature: string | undefined;
+        // Distinct product_name and version values, for case-insensitive filters. Cached
+        // briefly like the latest version, since appends through the WAL leave the mtime alone.
+        filterValues: Map<string, { values: unknown[]; expiresAt: number }>;
+        latestVersion?: { version: string | undefined; expiresAt: number };
+        quantization?: VectorQuantization;
+        byteOrder?: ByteOrder;
+        // null when the vec_items declaration names no dimension.
+        storedDimension?: number | null;
+        // vec_items columns from PRAGMA table_info.
+        columns?: string[];
+    };
+    const fileStates = new Map<string, FileState>();
+
+    const fileSignature = (dbPath: string): string | undefined => {
+        if (!deps.fs.statSync) {
+            return undefined;
+        }
+        try {
+            const { ino, size, mtimeMs } = deps.fs.statSync(sqliteFilePath(dbPath));
+            return `${ino}:${size}:${mtimeMs}`;
+        } catch {
+            return undefined;
+        }
+    };
+
+    const fileState = (dbPath: string): FileState => {
+        const signature = fileSignature(dbPath);
+        let state = fileStates.get(dbPath);
+        if (state && state.signature !== signature) {
+            logger.info(`[DB ${dbPath}] File changed on disk; re-reading its metadata.`);
+            state = undefined;
+        }
+        if (!state) {
+            state = { signature, filterValues: new Map() };
+            fileStates.set(dbPath, state);
+        }
+        return state;
+    };
+
+    // The periodic health check: drops the state of files that were deleted, replaced or
+    // modified since it was read, and returns their paths.
+    const checkDatabaseFiles = (): string[] => {
+        const changed: string[] = [];
+        for (const [dbPath, state] of fileStates) {
+            if (!fs.existsSync(dbPath) || fileSignature(dbPath) !== state.signature) {
+                fileStates.delete(dbPath);
+                changed.push(dbPath);
+            }
+        }
+        return changed;
+    };
+
+    // Filter values are compared exactly by sqlite-vec, so stray whitespace is trimmed and,
+    // with caseInsensitiveFilters, a value is swapped for the stored value it matches ignoring
+    // case. The search itself stays an exact (pushed-down) comparison.
+    const canonicalizeFilter = (db: SqliteDatabase, dbPath: string, filter: QueryFilter): QueryFilter => {
+        const canonical = { ...filter };
+        for (const column of ['product_name', 'version'] as const) {
+            const value = canonical[column]?.trim();
+            if (!value) {
+                continue;
+            }
+            canonical[column] = value;
+            if (!caseInsensitiveFilters) {
+                continue;
+            }
+            const { filterValues } = fileState(dbPath);
+            let cached = filterValues.get(column);
+            if (!cached || cached.expiresAt <= Date.now()) {
+                const rows = db.prepare(`SELECT DISTINCT ${column} AS value FROM vec_items`).all() as unknown as { value?: unknown }[];
+                cached = { values: rows.map((row) => row.value), expiresAt: Date.now() + LATEST_VERSION_CACHE_MS };
+                filterValues.set(column, cached);
+            }
+            const match = matchStoredValue(value, cached.values);
+            if (match && match !== value) {
+                logger.debug(`[DB ${dbPath}] ${column} filter "${value}" matched stored value "${match}".`);
+                canonical[column] = match;
+            }
+        }
+        return canonical;
+    };
+
+    // Connections are opened per query, so statistics are tracked per database file.
+    const databaseStats = new Map<string, DatabaseStats>();
+
+    const readVecTableSql = (db: SqliteDatabase): string | undefined => {
+        const rows = db.prepare(`SELECT sql FROM sqlite_master WHERE name = 'vec_items'`).all() as unknown as { sql?: string }[];
+        return rows[0]?.sql;
+    };
+
+    // Read once per file version, so queries do not run PRAGMA table_info every time.
+    const readVecItemsColumns = (db: SqliteDatabase, dbPath: string): string[] => {
+        const state = fileState(dbPath);
+        if (!state.columns) {
+            const rows = db.prepare(`PRAGMA table_info(vec_items)`).all() as unknown as { name?: unknown }[];
+            state.columns = rows.map((row) => row.name).filter((name): name is string => typeof name === 'string');
+        }
+        return state.columns;
+    };
+
+    // Minimal schemas may have no chunk_id column, so ties fall back to rowid, which every table has.
+    const vectorTiebreaker = (db: SqliteDatabase, dbPath: string): string => {
+        try {
+            return readVecItemsColumns(db, dbPath).includes('chunk_id') ? 'chunk_id' : 'rowid';
+        } catch {
+            return 'rowid';
+        }
+    };
+
+    // Minimal databases may lack some metadata columns; filters on them are skipped with a warning.
+    const filterForSchema = (db: SqliteDatabase, dbPath: string, filter: QueryFilter): QueryFilter => {
+        if (!FILTER_COLUMNS.some((column) => filter[column]) && !filter.excludeChunkIds?.length) {
+            return filter;
+        }
+        let columns: string[] = [];
+        try {
+            columns = readVecItemsColumns(db, dbPath);
+        } catch (error) {
+            console.error(`[DB ${dbPath}] Unable to read vec_items columns:`, error);
+        }
+        const { filter: applicable, dropped } = applicableFilter(filter, columns);
+        for (const column of dropped) {
+            console.warn(`[DB ${dbPath}] vec_items has no "${column}" column; ignoring the ${column} filter.`);
+        }
+        return applicable;
+    };
+
+    const recordDatabaseUse = (dbPath: string, db: SqliteDatabase) => {
+        const now = new Date().toISOString();
+        const stats = databaseStats.get(dbPath);
+        if (stats) {
+            stats.queryCount += 1;
+            stats.lastUsedAt = now;
+            return;
+        }
+
+        let tableSql: string | undefined;
+        try {
+            tableSql = readVecTableSql(db);
+        } catch (error) {
+            console.error(`[DB ${dbPath}] Unable to read vec_items declaration:`, error);
+        }
+        databaseStats.set(dbPath, {
+            dbPath,
+            firstOpenedAt: now,
+            lastUsedAt: now,
+            queryCount: 1,
+            dimension: parseVectorDimension(tableSql, vecColumns[0].column),
+            distanceMetric: parseDistanceMetric(tableSql),
+        });
+    };
+
+    // A pipeline may record the byte order it wrote vectors in under the 'byte_order' key
+    // of vec_items_info; that wins over VECTOR_BYTE_ORDER. Looked up once per version of a file.
+    // sqlite-vec decodes stored float32 vectors in host order, so swapping only the query
+    // would still compare against garbage; see assertHostByteOrder.
+    const vectorByteOrder = (db: SqliteDatabase, dbPath: string): ByteOrder => {
+        const state = fileState(dbPath);
+        if (state.byteOrder) {
+            return state.byteOrder;
+        }
+        let recorded: unknown;
+        try {
+            const rows = db.prepare(`SELECT value FROM vec_items_info WHERE key = 'byte_order'`).all() as unknown as { value?: unknown }[];
+            recorded = rows[0]?.value;
+        } catch {
+            // Databases from older sqlite-vec versions have no vec_items_info table.
+        }
+        let byteOrder = configuredByteOrder;
+        if (recorded === 'little' || recorded === 'big') {
+            if (recorded !== configuredByteOrder) {
+                console.warn(`[DB ${dbPath}] vec_items_info records ${recorded}-endian vectors; using that instead of VECTOR_BYTE_ORDER=${configuredByteOrder}.`);
+            }
+            byteOrder = recorded;
+        }
+        state.byteOrder = byteOrder;
+        return byteOrder;
+    };
+
+    const assertHostByteOrder = (db: SqliteDatabase, dbPath: string, quantization: VectorQuantization): void => {
+        const byteOrder = vectorByteOrder(db, dbPath);
+        if (quantization !== 'int8' && byteOrder !== HOST_BYTE_ORDER) {
+            throw new Error(
+                `${path.basename(dbPath)} stores ${byteOrder}-endian vectors, but sqlite-vec reads vectors in this host's ${HOST_BYTE_ORDER}-endian order. Re-index it on a ${HOST_BYTE_ORDER}-endian host.`
+            );
+        }
+    };
+
+    // Likewise a 'quantization' key in vec_items_info, or else an int8[N] vector column in
+    // the vec0 declaration, wins over VECTOR_QUANTIZATION. Looked up once per version of a file.
+    const vectorQuantization = (db: SqliteDatabase, dbPath: string): VectorQuantization => {
+        const state = fileState(dbPath);
+        if (state.quantization) {
+            return state.quantization;
+        }
+        let recorded: unknown;
+        try {
+            const rows = db.prepare(`SELECT value FROM vec_items_info WHERE key = 'quantization'`).all() as unknown as { value?: unknown }[];
+            recorded = rows[0]?.value;
+        } catch {
+            // Databases from older sqlite-vec versions have no vec_items_info table.
+        }
+        if (recorded === undefined && new RegExp(`\\b${vecColumns[0].column}\\s+int8\\[`, 'i').test(readVecTableSql(db) ?? '')) {
+            recorded = 'int8';
+        }
+        let quantization = configuredQuantization;
+        if (recorded === 'none' || recorded === 'int8') {
+            if (recorded !== configuredQuantization) {
+                console.warn(`[DB ${dbPath}] Stored vectors use quantization '${recorded}'; using that instead of VECTOR_QUANTIZATION=${configuredQuantization}.`);
+            }
+            quantization = recorded;
+        }
+        state.quantization = quantization;
+        return quantization;
+    };
+
+    const getDatabaseStats = (): DatabaseStats[] =>
+        Array.from(databaseStats.values()).map((stats) => ({ ...stats }));
+
+    const resolveDbPath: ResolveDbPath = (dbName?: string, productName?: string) => {
+        if (dbName) {
+            const normalizedName = dbName.endsWith('.db') ? dbName : `${dbName}.db`;
+            // With a manifest, dbName may only name one of the listed database files.
+            if (productsManifest) {
+                const entry = productsManifest.find((candidate) => candidate.db === normalizedName);
+                if (!entry) {
+                    throw new Error(`Unknown product database "${normalizedName}": it is not listed in ${manifestLabel}.`);
+                }
+                return productDbPath(entry.name);
+            }
+            const dbPath = path.isAbsolute(normalizedName) ? normalizedName : path.join(dbDir, normalizedName);
+            return { dbPath, dbLabel: normalizedName };
+        }
+
+        if (!productName) {
+            throw new Error('Either productName/repo or dbName must be provided.');
+        }
+        productName = productName.trim();
+        if (caseInsensitiveFilters && !databaseUris[productName] && (productsManifest ? !manifestEntries.has(productName) : !fs.existsSync(path.join(dbDir, `${productName}.db`)))) {
+            productName = matchStoredValue(productName, listDatabaseNames()) ?? productName;
+        }
+        return productDbPath(productName);
+    };
+
+    const productDbPath = (productName: string): { dbPath: string; dbLabel: string } => {
+        const uri = databaseUris[productName];
+        if (uri) {
+            return { dbPath: uri, dbLabel: path.basename(sqliteFilePath(uri)) };
+        }
+
+        // With a manifest only the listed products are exposed, each at its configured file.
+        if (productsManifest) {
+            const entry = manifestEntries.get(productName);
+            if (!entry) {
+                throw new Error(`Unknown product "${productName}": it is not listed in ${manifestLabel}.`);
+            }
+            const dbPath = path.isAbsolute(entry.db) ? entry.db : path.join(dbDir, entry.db);
+            return { dbPath, dbLabel: entry.db };
+        }
+
+        const dbPath = path.join(dbDir, `${productName}.db`);
+        return { dbPath, dbLabel: `${productName}.db` };
+    };
+
+    const getProductInfo: GetProductInfo = (product: string) => manifestEntries.get(product);
+
+    const queryCollectionOnce = async (
+        queryEmbedding: number[],
+        dbPath: string,
+        filter: QueryFilter,
+        topK: number,
+        timings?: QueryTimings
+    ): Promise<QueryResult[]> => {
+        let db: SqliteDatabase | null = null;
+        try {
+            const openStart = Date.now();
+            db = await openDatabaseWithRetry(dbPath);
+            logger.debug(`[DB ${dbPath}] Opened connection.`);
+            sqliteVec.load(db);
+            logger.debug(`[DB ${dbPath}] sqliteVec loaded.`);
+            if (timings) {
+                timings.dbOpenMs = Date.now() - openStart;
+            }
+            filter = canonicalizeFilter(db, dbPath, filterForSchema(db, dbPath, filter));
+            // sqlite-vec may apply NOT IN after picking the k nearest rows, so k is padded
+            // by the number of excluded chunks and the result trimmed back to topK below.
+            const excludeChunkIds = filter.excludeChunkIds ?? [];
+            const quantization = vectorQuantization(db, dbPath);
+            assertHostByteOrder(db, dbPath, quantization);
+            const params = normalizeBindParams({
+                query_embedding: toEmbeddingVector(queryEmbedding, maxEmbeddingDimension, quantization),
+                product_name: filter.product_name,
+                version: filter.version,
+                branch: filter.branch,
+                repo: filter.repo,
+                top_k: Math.max(1, Math.floor(topK)) + excludeChunkIds.length,
+                ...Object.fromEntries(excludeChunkIds.map((chunkId, index) => [`exclude_${index}`, chunkId])),
+            });
+
+            logger.debug(`[DB ${dbPath}] Query prepared. Executing...`);
+            const startTime = Date.now();
+            let rows = runVectorSearch(db, dbPath, filter, params, topK);
+            if (rows.length === 0 && filter.version && fuzzyVersionFallback) {
+                rows = runFuzzyVersionSearch(db, dbPath, { ...filter, version: filter.version }, params, topK);
+            }
+            rows = rows.slice(0, topK);
+            const duration = Date.now() - startTime;
+            if (timings) {
+                timings.queryMs = duration;
+            }
+            logger.info(`[DB ${dbPath}] Query executed in ${duration}ms. Found ${rows.length} rows.`);
+            recordDatabaseUse(dbPath, db);
+
+            rows.forEach((row: any) => {
+                stripVectorColumns(row);
+                withProvenanceHash(row, filter.product_name ?? dbPath);
+            });
+
+            return rows as QueryResult[];
+        } finally {
+            if (db) {
+                db.close();
+            }
+        }
+    };
+
+    // The indexer may hold a write lock while appending; busy errors that outlast
+    // busy_timeout are retried with exponential backoff before giving up. Contention that
+    // survives the retries is reported as busy (HTTP 429), so clients know to retry rather
+    // than treat the database as broken.
+    const queryCollection: QueryCollection = async (
+        queryEmbedding: number[],
+        dbPath: string,
+        filter: QueryFilter,
+        topK: number = 10,
+        timings?: QueryTimings
+    ): Promise<QueryResult[]> => {
+        if (!fs.existsSync(dbPath)) {
+            throw new Error(`Database file not found at ${dbPath}`);
+        }
+
+        for (let attempt = 0; ; attempt++) {
+            try {
+                return await queryCollectionOnce(queryEmbedding, dbPath, filter, topK, timings);
+            } catch (error) {
+                if (isSqliteBusyError(error) && attempt < busyRetries) {
+                    const delayMs = RETRY_BASE_DELAY_MS * 2 ** attempt;
+                    logger.warn(`[DB ${dbPath}] Database is busy, retrying in ${delayMs}ms (attempt ${attempt + 1} of ${busyRetries}).`);
+                    await new Promise((resolve) => setTimeout(resolve, delayMs));
+                    continue;
+                }
+                if (isSqliteBusyError(error)) {
+                    const reason = error instanceof Error ? error.message : String(error);
+                    console.error(`[DB ${dbPath}] Database still busy after ${busyRetries} retries (busy_timeout ${busyTimeoutMs}ms); giving up. This is transient lock contention, not a broken database.`);
+                    throw busyError(`Database query failed: ${path.basename(dbPath)} is busy (${reason} after ${busyRetries} retries with a ${busyTimeoutMs}ms busy_timeout). Try again shortly.`);
+                }
+                if (isSqliteCorruptError(error)) {
+                    throw new Error(`Database query failed: ${corruptDatabaseError(dbPath, error).message}`);
+                }
+                console.error(`Error querying collection in ${dbPath}:`, error);
+                throw new Error(`Database query failed: ${error instanceof Error ? error.message : String(error)}`);
+            }
+        }
+    };
+
+    const scanDatabaseNames = (): string[] => {
+        const uriNames = Object.keys(databaseUris);
+        if (productsManifest) {
+            return Array.from(new Set([...productsManifest.map((entry) => entry.name), ...uriNames]));
+        }
+        const fileNames = fs.readdirSync
+            ? fs.readdirSync(dbDir).filter((file) => file.endsWith('.db')).map((file) => file.slice(0, -'.db'.length))
+            : [];
+        return Array.from(new Set([...fileNames, ...uriNames])).sort();
+    };
+
+    // Product names from the last rescan. Until rescanDatabases runs, the directory is
+    // read on every call.
+    let knownDatabaseNames: string[] | undefined;
+
+    const listDatabaseNames = (): string[] => {
+        const names = knownDatabaseNames ?? scanDatabaseNames();
+        if (corruptDatabases.size === 0) {
+            return names;
+        }
+        return names.filter((name) => {
+            try {
+                return !corruptDatabases.has(productDbPath(name).dbPath);
+            } catch {
+                return true;
+            }
+        });
+    };
+
+    // Refreshes the known products and forgets per-file state for databases that were
+    // deleted, reporting what changed since the previous scan.
+    const rescanDatabases = (): { added: string[]; removed: string[] } => {
+        const previous = new Set(knownDatabaseNames ?? []);
+        const names = scanDatabaseNames();
+        const current = new Set(names);
+        knownDatabaseNames = names;
+        // A re-indexed or restored file gets another chance; a still-corrupt one is caught again.
+        corruptDatabases.clear();
+        for (const dbPath of new Set([...databaseStats.keys(), ...fileStates.keys()])) {
+            if (!fs.existsSync(dbPath)) {
+                databaseStats.delete(dbPath);
+                fileStates.delete(dbPath);
+            }
+        }
+        return {
+            added: names.filter((name) => !previous.has(name)),
+            removed: Array.from(previous).filter((name) => !current.has(name)),
+        };
+    };
+
+    // Opens the database and checks that it has a vec_items table and, with
+    // integrityCheck, that every page reads back intact.
+    const testConnection: TestConnection = async (dbPath: string): Promise<void> => {
+        if (!fs.existsSync(dbPath)) {
+            throw new Error(`Database file not found at ${dbPath}`);
+        }
+
+        let db: SqliteDatabase | null = null;
+        let checked = false;
+        try {
+            db = await openDatabaseWithRetry(dbPath);
+            if (!readVecTableSql(db)) {
+                throw new Error('no vec_items table');
+            }
+            if (integrityCheck) {
+                const [result] = db.prepare('PRAGMA quick_check(1)').all() as unknown as { quick_check?: unknown }[];
+                if (result?.quick_check !== 'ok') {
+                    checked = true;
+                    throw Object.assign(new Error(`integrity check failed: ${String(result?.quick_check)}`), { code: 'SQLITE_CORRUPT' });
+                }
+            }
+        } catch (error) {
+            if (isSqliteCorruptError(error)) {
+                throw corruptDatabaseError(dbPath, error, checked);
+            }
+            throw error;
+        } finally {
+            if (db) {
+                db.close();
+            }
         }
+    };
 
-        console.error(`Received get_chunks: filePath="${filePath}", product="${productName || 'n/a'}", dbName="${dbName || 'n/a'}", version="${version || 'any'}", startIndex=${startIndex}, endIndex=${endIndex}`);
+    // sqlite-vec has no sparse index, so sparse search scans the filtered rows and scores
+    // each stored vector (a JSON term -> weight map in `sparseColumn`) by dot product.
+    // Every scanned row is JSON-parsed, so at most sparseMaxScanRows rows are scored.
+    const sparseSearch: SparseSearch = async (
+        sparseQuery: SparseVector,
+        dbPath: string,
+        filter: QueryFilter,
+        topK: number = 10
+    ): Promise<QueryResult[]> => {
+        if (!fs.existsSync(dbPath)) {
+            throw new Error(`Database file not found at ${dbPath}`);
+        }
 
+        let db: SqliteDatabase | null = null;
         try {
-            const results = await getChunksForDocument(productName, dbName, filePath, startIndex, endIndex, version);
+            db = await openDatabaseWithRetry(dbPath);
+            sqliteVec.load(db);
+            const columns = readVecItemsColumns(db, dbPath);
+            if (!columns.includes(sparseColumn)) {
+                throw new Error(`vec_items has no "${sparseColumn}" column; re-index with sparse vectors or use mode "vector".`);
+            }
+            filter = canonicalizeFilter(db, dbPath, filterForSchema(db, dbPath, filter));
 
-            if (results.length === 0) {
-                return {
-                    content: [{
-                        type: 'text' as const,
-                        text: `No chunks found for "${filePath}" in ${productName ? `product "${productName}"` : `db "${dbName}"`} ${version ? `(version ${version})` : ''}.`,
-                    }],
-                };
+            // Vector columns are skipped to avoid reading every embedding BLOB.
+            const vectorColumns = new Set(['embedding', ...vecColumns.map(({ column }) => column)]);
+            const selected = columns.filter((column) => !vectorColumns.has(column));
+            let query = `SELECT rowid, ${selected.join(', ')} FROM vec_items WHERE ${sparseColumn} IS NOT NULL`;
+            const params: Array<string | number> = [];
+            for (const column of FILTER_COLUMNS) {
+                const value = filter[column];
+                if (value) {
+                    query += ` AND ${column} = ?`;
+                    params.push(value);
+                }
+            }
+            if (sparseMaxScanRows > 0) {
+                // One extra row tells a capped scan from a table that fits.
+                query += ` LIMIT ?`;
+                params.push(sparseMaxScanRows + 1);
             }
 
-            const formattedResults = results.map((r) =>
-                [
-                    `Chunk ${typeof r.chunk_index === 'number' && typeof r.total_chunks === 'number' ? `${r.chunk_index + 1} of ${r.total_chunks}` : ''}`.trim(),
-                    `  Content: ${r.content}`,
-                    r.section ? `  Section: ${r.section}` : null,
-                    r.url ? `  URL: ${r.url}` : null,
-                    '---',
-                ].filter((line) => line !== null).join('\n')
-            ).join('\n');
+            const scored: Array<{ row: QueryResult; score: number }> = [];
+            const excluded = new Set(filter.excludeChunkIds ?? []);
+            let rows = db.prepare(query).all(...params) as QueryResult[];
+            if (sparseMaxScanRows > 0 && rows.length > sparseMaxScanRows) {
+                logger.warn(`[DB ${dbPath}] Sparse search scored only the first ${sparseMaxScanRows} matching rows; narrow the filters or raise SPARSE_MAX_SCAN_ROWS.`);
+                rows = rows.slice(0, sparseMaxScanRows);
+            }
+            for (const row of rows) {
+                const stored = parseSparseVector(row[sparseColumn]);
+                if (!stored || excluded.has(row.chunk_id)) {
+                    continue;
+                }
+                const score = sparseDotProduct(sparseQuery, stored);
+                if (score > 0) {
+                    delete row[sparseColumn];
+                    scored.push({ row: dropBlobColumns(row), score });
+                }
+            }
+            recordDatabaseUse(dbPath, db);
 
-            return {
-                content: [{ type: 'text' as const, text: `Retrieved ${results.length} chunk(s) for "${filePath}":\n\n${formattedResults}` }],
-            };
-        } catch (error: any) {
-            console.error("Error processing 'get_chunks' tool:", error);
-            return {
-                content: [{ type: 'text' as const, text: `Error retrieving chunks: ${error.message}` }],
-            };
+            scored.sort((a, b) => b.score - a.score || compareByDistance(a.row, b.row));
+            const bestScore = scored[0]?.score ?? 1;
+            return scored.slice(0, topK).map(({ row, score }) =>
+                withProvenanceHash({ ...row, distance: 1 - score / bestScore }, filter.product_name ?? dbPath)
+            );
+        } catch (error) {
+            if (isSqliteCorruptError(error)) {
+                throw new Error(`Sparse search failed: ${corruptDatabaseError(dbPath, error).message}`);
+            }
+            console.error(`Error running sparse search in ${dbPath}:`, error);
+            throw new Error(`Sparse search failed: ${error instanceof Error ? error.message : String(error)}`);
+        } finally {
+            if (db) {
+                db.close();
+            }
         }
     };
 
-    return {
-        queryDocumentation,
-        queryCode,
-        queryDocumentationToolHandler,
-        queryCodeToolHandler,
-        getChunksToolHandler,
-    };
-}
-
-export function createSqliteDbProvider(deps: {
-    dbDir: string;
-    sqliteVec: SqliteVecModule;
-    Database: SqliteDatabaseCtor;
-    fs: FsModule;
-    path: PathModule;
-}) {
-    const { dbDir, sqliteVec, Database, fs, path } = deps;
+    // sqlite-vec does not record the vector size in vec_items_info, so it is read
+    // from the vec0 table declaration instead. Provider-selected queries check it every
+    // time, so it is kept in the per-file state.
+    const getStoredDimension = async (dbPath: string): Promise<number | undefined> => {
+        if (!fs.existsSync(dbPath)) {
+            throw new Error(`Database file not found at ${dbPath}`);
+        }
 
-    const resolveDbPath: ResolveDbPath = (dbName?: string, productName?: string) => {
-        if (dbName) {
-            const normalizedName = dbName.endsWith('.db') ? dbName : `${dbName}.db`;
-            const dbPath = path.isAbsolute(normalizedName) ? normalizedName : path.join(dbDir, normalizedName);
-            return { dbPath, dbLabel: normalizedName };
+        const state = fileState(dbPath);
+        if (state.storedDimension !== undefined) {
+            return state.storedDimension ?? undefined;
+        }
+        let db: SqliteDatabase | null = null;
+        try {
+            db = await openDatabaseWithRetry(dbPath);
+            const dimension = parseVectorDimension(readVecTableSql(db), vecColumns[0].column);
+            state.storedDimension = dimension ?? null;
+            return dimension;
+        } finally {
+            if (db) {
+                db.close();
+            }
         }
+    };
 
-        if (!productName) {
-            throw new Error('Either productName/repo or dbName must be provided.');
+    const getColumns: GetColumns = async (dbPath: string) => {
+        if (!fs.existsSync(dbPath)) {
+            throw new Error(`Database file not found at ${dbPath}`);
         }
 
-        const dbPath = path.join(dbDir, `${productName}.db`);
-        return { dbPath, dbLabel: `${productName}.db` };
+        const cached = fileState(dbPath).columns;
+        if (cached) {
+            return cached;
+        }
+        let db: SqliteDatabase | null = null;
+        try {
+            db = await openDatabaseWithRetry(dbPath);
+            return readVecItemsColumns(db, dbPath);
+        } finally {
+            if (db) {
+                db.close();
+            }
+        }
     };
 
-    const queryCollection: QueryCollection = async (
-        queryEmbedding: number[],
+    // Keyword search expects an FTS5 table with a `chunk_id` column alongside the indexed
+    // `content`; matching chunk IDs are then looked up in vec_items for metadata and filters.
+    // The filters only apply after that lookup, so BM25 hits are read in growing pages until
+    // topK of them pass the filters or the FTS matches run out.
+    const keywordSearch: KeywordSearch = async (
+        queryText: string,
         dbPath: string,
         filter: QueryFilter,
         topK: number = 10
@@ -439,50 +4527,163 @@ export function createSqliteDbProvider(deps: {
             throw new Error(`Database file not found at ${dbPath}`);
         }
 
+        const matchExpression = buildFtsMatchExpression(queryText);
+        if (!matchExpression) {
+            return [];
+        }
+
         let db: SqliteDatabase | null = null;
         try {
-            db = new Database(dbPath);
-            console.error(`[DB ${dbPath}] Opened connection.`);
+            db = await openDatabaseWithRetry(dbPath);
             sqliteVec.load(db);
-            console.error(`[DB ${dbPath}] sqliteVec loaded.`);
-            let query = `
-              SELECT
-                  *,
-                  distance
-              FROM vec_items
-              WHERE embedding MATCH @query_embedding`;
+            filter = canonicalizeFilter(db, dbPath, filterForSchema(db, dbPath, filter));
 
-            if (filter.product_name) query += ` AND product_name = @product_name`;
-            if (filter.version) query += ` AND version = @version`;
-            if (filter.branch) query += ` AND branch = @branch`;
-            if (filter.repo) query += ` AND repo = @repo`;
+            const hasMetadataFilter = !!(filter.product_name || filter.version || filter.branch || filter.repo);
+            const excluded = new Set(filter.excludeChunkIds ?? []);
+            const hitsStatement = db.prepare(`
+              SELECT chunk_id, bm25(${ftsTable}) AS score
+              FROM ${ftsTable}
+              WHERE ${ftsTable} MATCH ?
+              ORDER BY score
+              LIMIT ? OFFSET ?`
+            );
+            const filterClauses: string[] = [];
+            const filterParams: string[] = [];
+            for (const column of ['product_name', 'version', 'branch', 'repo'] as const) {
+                const value = filter[column];
+                if (value) {
+                    filterClauses.push(` AND ${column} = ?`);
+                    filterParams.push(value);
+                }
+            }
 
-            query += `
-              ORDER BY distance
-              LIMIT @top_k;`;
+            const matched: QueryResult[] = [];
+            let pageSize = (hasMetadataFilter ? topK * 3 : topK) + excluded.size;
+            for (let offset = 0; matched.length < topK; offset += pageSize, pageSize *= 2) {
+                const page = hitsStatement.all(matchExpression, pageSize, offset) as unknown as { chunk_id: string; score: number }[];
+                const hits = page.filter((hit) => !excluded.has(hit.chunk_id));
+                if (hits.length > 0) {
+                    const query = `SELECT rowid, * FROM vec_items WHERE chunk_id IN (${hits.map(() => '?').join(', ')})${filterClauses.join('')}`;
+                    const rowsById = new Map(
+                        (db.prepare(query).all(...hits.map((hit) => hit.chunk_id), ...filterParams) as QueryResult[]).map((row) => [row.chunk_id, row])
+                    );
+                    for (const hit of hits) {
+                        const row = rowsById.get(hit.chunk_id);
+                        if (row) {
+                            matched.push({ ...row, distance: hit.score, score_type: 'bm25' });
+                        }
+                    }
+                }
+                if (page.length < pageSize) {
+                    break;
+                }
+            }
+            recordDatabaseUse(dbPath, db);
 
-            const stmt = db.prepare(query);
-            console.error(`[DB ${dbPath}] Query prepared. Executing...`);
-            const startTime = Date.now();
-            const rows = stmt.all({
-                query_embedding: new Float32Array(queryEmbedding),
-                product_name: filter.product_name,
-                version: filter.version,
-                branch: filter.branch,
-                repo: filter.repo,
-                top_k: topK,
-            });
-            const duration = Date.now() - startTime;
-            console.error(`[DB ${dbPath}] Query executed in ${duration}ms. Found ${rows.length} rows.`);
+            return matched
+                .slice(0, topK)
+                .map((row) => withProvenanceHash(stripVectorColumns(row), filter.product_name ?? dbPath));
+        } catch (error) {
+            const message = error instanceof Error ? error.message : String(error);
+            if (message.includes(`no such table: ${ftsTable}`)) {
+                throw new Error(`Keyword search requires an FTS5 table named '${ftsTable}' in ${dbPath}.`);
+            }
+            if (isSqliteCorruptError(error)) {
+                throw new Error(`Keyword search failed: ${corruptDatabaseError(dbPath, error).message}`);
+            }
+            console.error(`Error running keyword search in ${dbPath}:`, error);
+            throw new Error(`Keyword search failed: ${message}`);
+        } finally {
+            if (db) {
+                db.close();
+            }
+        }
+    };
 
-            rows.forEach((row: any) => {
-                delete row.embedding;
-            });
+    // Calibrated thresholds live in a JSON sidecar next to the database file, so they
+    // can be produced offline and picked up without a restart.
+    const getDistanceThreshold: GetDistanceThreshold = (dbPath: string) => {
+        const sidecarPath = calibrationSidecarPath(dbPath);
+        if (!fs.readFileSync || !fs.existsSync(sidecarPath)) {
+            return undefined;
+        }
 
-            return rows as QueryResult[];
+        try {
+            const { threshold } = JSON.parse(fs.readFileSync(sidecarPath, 'utf8'));
+            return typeof threshold === 'number' && Number.isFinite(threshold) ? threshold : undefined;
         } catch (error) {
-            console.error(`Error querying collection in ${dbPath}:`, error);
-            throw new Error(`Database query failed: ${error instanceof Error ? error.message : String(error)}`);
+            console.warn(`Warning: ignoring unreadable calibration file ${sidecarPath}:`, error);
+            return undefined;
+        }
+    };
+
+    // Gathers what validate_database checks. Each step records its failure and carries on,
+    // so one broken step does not hide the state of the others.
+    const inspectDatabase: InspectDatabase = async (dbPath: string) => {
+        const inspection: DatabaseInspection = { exists: fs.existsSync(dbPath), columns: [] };
+        if (!inspection.exists) {
+            return inspection;
+        }
+
+        let db: SqliteDatabase | null = null;
+        try {
+            try {
+                db = await openDatabaseWithRetry(dbPath);
+            } catch (error) {
+                inspection.openError = error instanceof Error ? error.message : String(error);
+                return inspection;
+            }
+            try {
+                sqliteVec.load(db);
+                const [row] = db.prepare('SELECT vec_version() AS version').all() as unknown as { version?: unknown }[];
+                inspection.vecVersion = String(row?.version ?? 'unknown');
+            } catch (error) {
+                inspection.vecError = error instanceof Error ? error.message : String(error);
+            }
+            try {
+                inspection.dimension = parseVectorDimension(readVecTableSql(db), vecColumns[0].column);
+                inspection.columns = readVecItemsColumns(db, dbPath);
+            } catch (error) {
+                console.error(`[DB ${dbPath}] Unable to read the vec_items schema:`, error);
+            }
+            if (!inspection.vecError) {
+                try {
+                    const [row] = db.prepare('SELECT COUNT(*) AS count FROM vec_items').all() as unknown as { count?: unknown }[];
+                    inspection.rowCount = typeof row?.count === 'number' ? row.count : undefined;
+                } catch (error) {
+                    console.error(`[DB ${dbPath}] Unable to count vec_items rows:`, error);
+                }
+            }
+            return inspection;
+        } finally {
+            if (db) {
+                db.close();
+            }
+        }
+    };
+
+    // SQL text ordering would put "1.9" above "1.30", so distinct versions are read and
+    // compared in code. The answer is cached briefly, since it changes only on re-index.
+    const getLatestVersion: GetLatestVersion = async (dbPath: string) => {
+        const cached = fileState(dbPath).latestVersion;
+        if (cached && cached.expiresAt > Date.now()) {
+            return cached.version;
+        }
+        if (!fs.existsSync(dbPath)) {
+            throw new Error(`Database file not found at ${dbPath}`);
+        }
+
+        let db: SqliteDatabase | null = null;
+        try {
+            db = await openDatabaseWithRetry(dbPath);
+            sqliteVec.load(db);
+            let version: string | undefined;
+            if (readVecItemsColumns(db, dbPath).includes('version')) {
+                const rows = db.prepare(`SELECT DISTINCT version FROM vec_items WHERE version IS NOT NULL`).all() as unknown as { version?: unknown }[];
+                version = pickLatestVersion(rows.map((row) => row.version));
+            }
+            fileState(dbPath).latestVersion = { version, expiresAt: Date.now() + LATEST_VERSION_CACHE_MS };
+            return version;
         } finally {
             if (db) {
                 db.close();
@@ -490,6 +4691,13 @@ export function createSqliteDbProvider(deps: {
         }
     };
 
+    const saveDistanceCalibration: SaveDistanceCalibration = (dbPath: string, calibration: DistanceCalibration) => {
+        if (!fs.writeFileSync) {
+            throw new Error('Writing calibration files is not supported.');
+        }
+        fs.writeFileSync(calibrationSidecarPath(dbPath), `${JSON.stringify(calibration, null, 2)}\n`);
+    };
+
     const getChunksForDocument: GetChunksForDocument = async (
         productName: string | undefined,
         dbName: string | undefined,
@@ -506,7 +4714,7 @@ export function createSqliteDbProvider(deps: {
 
         let db: SqliteDatabase | null = null;
         try {
-            db = new Database(dbPath);
+            db = await openDatabaseWithRetry(dbPath);
             sqliteVec.load(db);
 
             const hasRange = typeof startIndex === 'number' && typeof endIndex === 'number';
@@ -548,7 +4756,7 @@ export function createSqliteDbProvider(deps: {
             try {
                 stmt = db.prepare(query);
                 const rows = stmt.all(...params) as QueryResult[];
-                return rows;
+                return rows.map(dropBlobColumns);
             } catch (error: any) {
                 const errorMessage = error?.message || String(error);
                 const errorStr = String(error);
@@ -587,7 +4795,7 @@ export function createSqliteDbProvider(deps: {
                     try {
                         stmt = db.prepare(query);
                         const rows = stmt.all(...params) as QueryResult[];
-                        return rows;
+                        return rows.map(dropBlobColumns);
                     } catch (retryError: any) {
                         throw error;
                     }
@@ -596,6 +4804,9 @@ export function createSqliteDbProvider(deps: {
                 }
             }
         } catch (error) {
+            if (isSqliteCorruptError(error)) {
+                throw new Error(`Chunk retrieval failed: ${corruptDatabaseError(dbPath, error).message}`);
+            }
             console.error(`Error retrieving chunks in ${dbPath}:`, error);
             throw new Error(`Chunk retrieval failed: ${error instanceof Error ? error.message : String(error)}`);
         } finally {
@@ -605,10 +4816,100 @@ export function createSqliteDbProvider(deps: {
         }
     };
 
+    const getChunksByIds: GetChunksByIds = async (
+        productName: string | undefined,
+        dbName: string | undefined,
+        chunkIds: string[],
+        version?: string
+    ): Promise<QueryResult[]> => {
+        if (chunkIds.length === 0) {
+            return [];
+        }
+
+        const { dbPath } = resolveDbPath(dbName, productName);
+
+        if (!fs.existsSync(dbPath)) {
+            throw new Error(`Database file not found at ${dbPath}`);
+        }
+
+        let db: SqliteDatabase | null = null;
+        try {
+            db = await openDatabaseWithRetry(dbPath);
+            sqliteVec.load(db);
+
+            let query = `SELECT rowid, * FROM vec_items WHERE chunk_id IN (${chunkIds.map(() => '?').join(', ')})`;
+            const params: Array<string | number> = [...chunkIds];
+            if (productName) {
+                query += ` AND product_name = ?`;
+                params.push(productName);
+            }
+            if (version) {
+                query += ` AND version = ?`;
+                params.push(version);
+            }
+
+            const rows = db.prepare(query).all(...params) as QueryResult[];
+            return rows.map(stripVectorColumns);
+        } catch (error) {
+            if (isSqliteCorruptError(error)) {
+                throw new Error(`Chunk retrieval failed: ${corruptDatabaseError(dbPath, error).message}`);
+            }
+            console.error(`Error retrieving chunks by ID in ${dbPath}:`, error);
+            throw new Error(`Chunk retrieval failed: ${error instanceof Error ? error.message : String(error)}`);
+        } finally {
+            if (db) {
+                db.close();
+            }
+        }
+    };
+
+    // Keyset paging on rowid: each page seeks past the previous page's last rowid, so pages
+    // stay cheap deep into a large table and deleted rows never shift later pages.
+    const exportChunks: ExportChunks = async (dbPath: string, afterRowid: number, limit: number) => {
+        if (!fs.existsSync(dbPath)) {
+            throw new Error(`Database file not found at ${dbPath}`);
+        }
+
+        let db: SqliteDatabase | null = null;
+        try {
+            db = await openDatabaseWithRetry(dbPath);
+            sqliteVec.load(db);
+            const [countRow] = db.prepare('SELECT COUNT(*) AS count FROM vec_items').all() as unknown as { count?: unknown }[];
+            const rows = db.prepare('SELECT rowid, * FROM vec_items WHERE rowid > ? ORDER BY rowid LIMIT ?').all(afterRowid, limit + 1) as QueryResult[];
+            return { rows: rows.slice(0, limit).map(stripVectorColumns), total: Number(countRow?.count ?? 0), hasMore: rows.length > limit };
+        } catch (error) {
+            if (isSqliteCorruptError(error)) {
+                throw new Error(`Chunk export failed: ${corruptDatabaseError(dbPath, error).message}`);
+            }
+            console.error(`Error exporting chunks from ${dbPath}:`, error);
+            throw new Error(`Chunk export failed: ${error instanceof Error ? error.message : String(error)}`);
+        } finally {
+            if (db) {
+                db.close();
+            }
+        }
+    };
+
     return {
         resolveDbPath,
         queryCollection,
         getChunksForDocument,
+        getChunksByIds,
+        keywordSearch,
+        getDistanceThreshold,
+        saveDistanceCalibration,
+        getLatestVersion,
+        listDatabaseNames,
+        rescanDatabases,
+        checkDatabaseFiles,
+        getProductInfo,
+        testConnection,
+        inspectDatabase,
+        exportChunks,
+        sparseSearch,
+        getStoredDimension,
+        getColumns,
+        getDatabaseStats,
     };
 }
 
@@ -689,15 +4990,41 @@ export function createQdrantProvider(deps: { client: QdrantClientLike }) {
         topK: number = 10
     ): Promise<QueryResult[]> => {
         const must = buildFilterMust(filter);
+        const mustNot = filter.excludeChunkIds?.length
+            ? [{ key: 'chunk_id', match: { any: filter.excludeChunkIds } }]
+            : [];
         const response = await client.search(dbPath, {
             vector: queryEmbedding,
             limit: topK,
-            filter: must.length > 0 ? { must } : undefined,
+            filter: must.length > 0 || mustNot.length > 0
+                ? { ...(must.length > 0 && { must }), ...(mustNot.length > 0 && { must_not: mustNot }) }
+                : undefined,
             with_payload: true,
             with_vector: false,
         });
         const points = extractPoints(response);
-        return points.map(mapPointToResult);
+        return points.map((point) => withProvenanceHash(mapPointToResult(point), filter.product_name ?? dbPath));
+    };
+
+    // Scrolls `limit` points at a time, following next_page_offset until the filter is exhausted.
+    const scrollAll = async (collection: string, must: Array<Record<string, unknown>>, limit: number): Promise<any[]> => {
+        const points: any[] = [];
+        let nextOffset: any = undefined;
+
+        do {
+            const response = await client.scroll(collection, {
+                filter: { must },
+                with_payload: true,
+                with_vector: false,
+                limit,
+                offset: nextOffset,
+            });
+            const batch = extractPoints(response);
+            points.push(...batch);
+            nextOffset = response?.next_page_offset;
+        } while (nextOffset !== undefined && nextOffset !== null);
+
+        return points;
     };
 
     const getChunksForDocument: GetChunksForDocument = async (
@@ -723,23 +5050,7 @@ export function createQdrantProvider(deps: { client: QdrantClientLike }) {
             must.push({ key: 'chunk_index', range });
         }
 
-        const points: any[] = [];
-        let nextOffset: any = undefined;
-
-        do {
-            const response = await client.scroll(dbPath, {
-                filter: { must },
-                with_payload: true,
-                with_vector: false,
-                limit: 1000,
-                offset: nextOffset,
-            });
-            const batch = extractPoints(response);
-            points.push(...batch);
-            nextOffset = response?.next_page_offset;
-        } while (nextOffset !== undefined && nextOffset !== null);
-
-        const results = points.map(mapPointToResult);
+        const results = (await scrollAll(dbPath, must, 1000)).map(mapPointToResult);
         const hasChunkIndex = results.some((row) => typeof row.chunk_index === 'number');
         if (hasChunkIndex) {
             results.sort((a, b) => (a.chunk_index ?? 0) - (b.chunk_index ?? 0));
@@ -747,9 +5058,34 @@ export function createQdrantProvider(deps: { client: QdrantClientLike }) {
         return results;
     };
 
+    const getChunksByIds: GetChunksByIds = async (
+        productName: string | undefined,
+        dbName: string | undefined,
+        chunkIds: string[],
+        version?: string
+    ): Promise<QueryResult[]> => {
+        if (chunkIds.length === 0) {
+            return [];
+        }
+
+        const { dbPath } = resolveDbPath(dbName, productName, version);
+        const must: Array<Record<string, unknown>> = [{ key: 'chunk_id', match: { any: chunkIds } }];
+        if (productName) {
+            must.push({ key: 'product_name', match: { value: productName } });
+        }
+        if (version) {
+            must.push({ key: 'version', match: { value: version } });
+        }
+
+        // One chunk_id can be stored in several points (one per version, say), so a single
+        // page of chunkIds.length points may not hold every match.
+        return (await scrollAll(dbPath, must, Math.min(chunkIds.length, 1000))).map(mapPointToResult);
+    };
+
     return {
         resolveDbPath,
         queryCollection,
         getChunksForDocument,
+        getChunksByIds,
     };
 }
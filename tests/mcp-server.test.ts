@@ -1,3 +1,4 @@
+import { createHash } from 'crypto';
 import http from 'http';
 import os from 'os';
 import path from 'path';
@@ -6,13 +7,83 @@ import BetterSqlite3 from 'better-sqlite3';
 import * as sqliteVec from 'sqlite-vec';
 import { describe, expect, it, vi } from 'vitest';
 import {
+    checkProductHealth,
+    createCachedLoader,
+    createConnectionLimiter,
     createQueryHandlers,
     createQdrantProvider,
     createSqliteDbProvider,
+    createLogger,
+    isSqliteCorruptError,
+    quantizeInt8,
+    createTokenLedger,
+    createEmbeddingClients,
+    isTransientEmbeddingError,
+    retryWithBackoff,
+    applicableFilter,
+    buildFtsMatchExpression,
+    compareByDistance,
+    dropBlobColumns,
+    computeDistanceThreshold,
+    computeProvenanceHash,
+    isTransientOpenError,
     filterResultsByUrl,
+    extractSnippet,
     filterResultsWithContent,
+    formatQueryResults,
+    fuseWeightedResults,
+    fuzzyVersionMatches,
+    normalizeAzureEndpoint,
+    normalizeBindParams,
     normalizeExtensions,
+    parseQueryPreprocess,
+    parseProductManifest,
+    findMatchOffset,
+    formatMessage,
+    parseQueryMessages,
+    resultBreadcrumb,
+    matchStoredValue,
+    parseDatabaseUris,
+    parseRedactPatterns,
+    suggestProductName,
+    parseCompositeWeights,
+    recencyScore,
+    cosineSimilarity,
+    calibrationSidecarPath,
+    sqliteFilePath,
+    toDocumentationResult,
+    parseModelDimensions,
+    buildContextBlock,
+    truncateForEmbedding,
+    distanceToSimilarity,
+    applyMetadataBoosts,
+    compareVersions,
+    formatSlowQueryLog,
+    formatStartupBanner,
+    httpStatusForResponse,
+    invalidRequestError,
+    busyError,
+    toolError,
+    toolErrorKind,
+    maskApiKey,
+    parseResultTemplate,
+    parseSparseVector,
+    sparseDotProduct,
+    normalizeDistances,
+    parseVecColumns,
+    parseMetadataBoosts,
+    parseVectorDimension,
+    pickLatestVersion,
+    preprocessQuery,
+    resolveConfigValue,
+    toEmbeddingVector,
+    HOST_BYTE_ORDER,
+    transformContent,
+    withConcurrencyLimit,
 } from '../mcp/src/server';
+import type { DatabaseInspection } from '../mcp/src/server';
+import { MetricsRegistry } from '../mcp/src/metrics';
+import { embeddingCacheConfig, embeddingCacheKey, LruEmbeddingCache, SqliteEmbeddingCache } from '../mcp/src/embedding-cache';
 import { ContentProcessor } from '../content-processor';
 import { DatabaseManager } from '../database';
 import { Logger, LogLevel } from '../logger';
@@ -48,6 +119,648 @@ describe('MCP server helpers', () => {
         const filtered = filterResultsWithContent(results);
         expect(filtered.map((row) => row.chunk_id)).toEqual(['1']);
     });
+
+    it('resolves config values with flag > env > file > default precedence', () => {
+        const env = { PORT: '4000', TRANSPORT_TYPE: 'sse' };
+        const shellEnvNames = new Set(['PORT']);
+        expect(resolveConfigValue('5000', 'PORT', env, shellEnvNames, '3001')).toEqual({ value: '5000', source: 'flag' });
+        expect(resolveConfigValue(undefined, 'PORT', env, shellEnvNames, '3001')).toEqual({ value: '4000', source: 'env' });
+        expect(resolveConfigValue(undefined, 'TRANSPORT_TYPE', env, shellEnvNames, 'http')).toEqual({ value: 'sse', source: 'file' });
+        expect(resolveConfigValue(undefined, 'SQLITE_DB_DIR', env, shellEnvNames)).toEqual({ value: undefined, source: 'default' });
+    });
+
+    it('normalizes Azure endpoints and rejects malformed values', () => {
+        expect(normalizeAzureEndpoint('https://res.openai.azure.com/')).toBe('https://res.openai.azure.com');
+        expect(normalizeAzureEndpoint(' res.openai.azure.com// ')).toBe('https://res.openai.azure.com');
+        expect(normalizeAzureEndpoint('http://localhost:8080/proxy/')).toBe('http://localhost:8080/proxy');
+        expect(() => normalizeAzureEndpoint('ftp://res.openai.azure.com')).toThrow('expected an http(s) URL');
+        expect(() => normalizeAzureEndpoint('https://')).toThrow('Invalid AZURE_OPENAI_ENDPOINT');
+        expect(() => normalizeAzureEndpoint('https://res.openai.azure.com/?api-version=1')).toThrow('Invalid AZURE_OPENAI_ENDPOINT');
+    });
+
+    it('parses weighted vector columns and rejects invalid entries', () => {
+        expect(parseVecColumns('embedding:0.7, title_embedding:0.3')).toEqual([
+            { column: 'embedding', weight: 0.7 },
+            { column: 'title_embedding', weight: 0.3 },
+        ]);
+        expect(parseVecColumns('embedding')).toEqual([{ column: 'embedding', weight: 1 }]);
+        expect(parseVecColumns(undefined)).toEqual([]);
+        expect(() => parseVecColumns('bad-name:1')).toThrow('Invalid vector column name');
+        expect(() => parseVecColumns('embedding:abc')).toThrow('Invalid weight');
+        expect(() => parseVecColumns('content:0.7,embedding:0.3')).toThrow("'content' in VEC_COLUMNS is a text column, not a vector column.");
+    });
+
+    it('formats results as markdown blockquotes with citations', () => {
+        const markdown = formatQueryResults([
+            { distance: 0.1, content: 'line one\nline two', url: 'https://docs.example.com/a' },
+            { distance: 0.2, content: 'no link' },
+        ], 'markdown');
+
+        expect(markdown).toContain('**[1]**');
+        expect(markdown).toContain('> line one\n> line two');
+        expect(markdown).toContain('[1]: https://docs.example.com/a');
+        expect(markdown).not.toContain('[2]:');
+        expect(JSON.parse(formatQueryResults([{ distance: 0.1, content: 'x' }], 'json'))).toEqual({
+            results: [{ distance: 0.1, content: 'x' }],
+        });
+    });
+
+    it('truncates embedding input by strategy once it exceeds the estimated token limit', () => {
+        const text = 'abcdefghijklmnopqrstuvwxyz';
+        expect(truncateForEmbedding(text, 4, 'error')).toEqual({ text, truncated: false });
+        expect(truncateForEmbedding(text, 10, 'head')).toEqual({ text, truncated: false });
+        expect(truncateForEmbedding(text, 4, 'head')).toEqual({ text: 'abcdefghijkl', truncated: true });
+        expect(truncateForEmbedding(text, 4, 'tail')).toEqual({ text: 'opqrstuvwxyz', truncated: true });
+        expect(truncateForEmbedding(text, 4, 'middle')).toEqual({ text: 'abcdef\nvwxyz', truncated: true });
+    });
+
+    it('parses MODEL_DIMENSIONS overrides', () => {
+        expect(parseModelDimensions(undefined)).toEqual({});
+        expect(parseModelDimensions('my-deployment:3072, org/model:v2:768')).toEqual({ 'my-deployment': 3072, 'org/model:v2': 768 });
+        expect(() => parseModelDimensions('text-embedding-3-large')).toThrow('Invalid MODEL_DIMENSIONS entry');
+        expect(() => parseModelDimensions('model:0')).toThrow('Invalid MODEL_DIMENSIONS entry');
+    });
+
+    it('packs cited snippets into a context block within the token budget', () => {
+        const results = [
+            { distance: 0.1, content: 'a'.repeat(30), url: 'https://docs/a', section: 'Install' },
+            { distance: 0.2, content: 'b'.repeat(300) },
+            { distance: 0.3, content: 'c'.repeat(12), product: 'istio' },
+        ];
+        const { context, included } = buildContextBlock(results, 40);
+        expect(included).toBe(2);
+        expect(context).toBe(`[1] Install\n${'a'.repeat(30)}\n\n[2] istio\n${'c'.repeat(12)}\n\nSources:\n[1]: https://docs/a`);
+        expect(buildContextBlock(results, 1)).toEqual({ context: '', included: 0 });
+    });
+
+    it('finds the offset of the first whole-word query term', () => {
+        expect(findMatchOffset('Configure the Ingress controller first.', 'ingress setup')).toBe(14);
+        expect(findMatchOffset('Subnetting basics', 'net')).toBeUndefined();
+        expect(findMatchOffset('Nothing here', '')).toBeUndefined();
+    });
+
+    it('masks API keys and formats the startup banner as text or JSON', () => {
+        expect(maskApiKey('sk-proj-abcdef123456')).toBe('****3456');
+        expect(maskApiKey('short')).toBe('****');
+        expect(maskApiKey(undefined)).toBeUndefined();
+
+        const config = { transport: 'http', port: 3001, dbDir: '/data/my docs', fallbackProvider: undefined, strictMode: false };
+        expect(formatStartupBanner(config, 'text')).toBe('Startup config: transport=http port=3001 dbDir="/data/my docs" strictMode=false');
+        expect(JSON.parse(formatStartupBanner(config, 'json'))).toEqual({
+            event: 'startup',
+            transport: 'http',
+            port: 3001,
+            dbDir: '/data/my docs',
+            strictMode: false,
+        });
+    });
+
+    it('maps JSON-RPC errors and tool error results to HTTP status codes', () => {
+        const toolResult = (text: string, isError?: boolean) => ({ jsonrpc: '2.0', id: 1, result: { content: [{ type: 'text', text }], isError } });
+        const failure = (text: string, error: unknown) => ({ jsonrpc: '2.0', id: 1, result: toolError(text, toolErrorKind(error)) });
+
+        expect(httpStatusForResponse(toolResult('Found 2 relevant documentation snippets'))).toBeUndefined();
+        expect(httpStatusForResponse(toolResult('No relevant documentation found for "x"'))).toBeUndefined();
+        expect(httpStatusForResponse(toolResult('Release notes: the replica count must be between 1 and 5.'))).toBeUndefined();
+        expect(httpStatusForResponse(toolResult('Error handling: Invalid input is rejected with a 429 status.'))).toBeUndefined();
+        expect(httpStatusForResponse({ jsonrpc: '2.0', id: 1, result: toolError('Provide either productName or dbName for query_documentation.', 'invalid_request') })).toBe(400);
+        expect(httpStatusForResponse(failure('Error querying documentation: Unknown boost column(s) "audience"', invalidRequestError('Unknown boost column(s) "audience"')))).toBe(400);
+        expect(httpStatusForResponse(failure('Error querying documentation: Unknown product "x"', new Error('Unknown product "x": it is not listed in products.json.')))).toBe(404);
+        expect(httpStatusForResponse(failure('Error retrieving chunks: Database file not found', new Error('Database file not found at /data/x.db')))).toBe(404);
+        expect(httpStatusForResponse(failure('Error querying documentation: rate limited', new Error('Failed to create embeddings with openai: 429 Rate limit reached')))).toBe(429);
+        expect(httpStatusForResponse(failure('Error querying code: busy', busyError('/data/x.db is busy (2 concurrent queries). Try again shortly.')))).toBe(429);
+        expect(httpStatusForResponse(failure('Error querying code: locked', Object.assign(new Error('locked'), { code: 'SQLITE_BUSY' })))).toBe(429);
+        expect(httpStatusForResponse(failure('Error querying code: busy', new Error('The build is busy (3 jobs).')))).toBe(500);
+        expect(httpStatusForResponse(failure('Error routing query: unreachable', new Error('Failed to create embeddings with openai: fetch failed')))).toBe(503);
+        expect(httpStatusForResponse(failure('Error listing products: disk I/O error', new Error('disk I/O error')))).toBe(500);
+        expect(httpStatusForResponse(toolResult('Input validation error: Invalid arguments for tool query_documentation', true))).toBe(400);
+        expect(httpStatusForResponse(toolResult('Something went wrong', true))).toBe(500);
+        expect(httpStatusForResponse({ jsonrpc: '2.0', id: 2, error: { code: -32602, message: 'Invalid params' } })).toBe(400);
+        expect(httpStatusForResponse({ jsonrpc: '2.0', id: 3, error: { code: -32601, message: 'Method not found' } })).toBe(404);
+        expect(httpStatusForResponse({ jsonrpc: '2.0', id: 4, error: { code: -32603, message: 'Internal error' } })).toBe(500);
+        expect(httpStatusForResponse({ jsonrpc: '2.0', method: 'notifications/progress' })).toBeUndefined();
+    });
+
+    it('rejects new streams at MAX_CONNECTIONS but lets messages on known sessions through', () => {
+        const fakeResponse = () => {
+            const listeners: Array<() => void> = [];
+            return {
+                statusCode: 200,
+                headers: {} as Record<string, string>,
+                body: undefined as unknown,
+                status(code: number) {
+                    this.statusCode = code;
+                    return this;
+                },
+                set(field: string, value: string) {
+                    this.headers[field] = value;
+                    return this;
+                },
+                json(body: unknown) {
+                    this.body = body;
+                    return this;
+                },
+                once(_event: 'close', listener: () => void) {
+                    listeners.push(listener);
+                    return this;
+                },
+                close: () => listeners.forEach((listener) => listener()),
+            };
+        };
+        const onChange = vi.fn();
+        const onReject = vi.fn();
+        const limitConnections = createConnectionLimiter({ maxConnections: 2, onChange, onReject });
+        const limit = limitConnections((req) => req.headers['mcp-session-id'] === 'known');
+        const next = vi.fn();
+
+        const streams = [fakeResponse(), fakeResponse()];
+        streams.forEach((res) => limit({ headers: {} }, res, next));
+        expect(next).toHaveBeenCalledTimes(2);
+        expect(onChange).toHaveBeenLastCalledWith(2);
+
+        const rejected = fakeResponse();
+        limit({ headers: {} }, rejected, next);
+        expect(rejected.statusCode).toBe(503);
+        expect(rejected.headers['Retry-After']).toBe('1');
+        expect(rejected.body).toEqual({ error: 'Server is at capacity (2 open connections). Try again shortly.' });
+        expect(onReject).toHaveBeenCalledTimes(1);
+        expect(next).toHaveBeenCalledTimes(2);
+
+        limit({ headers: { 'mcp-session-id': 'known' } }, fakeResponse(), next);
+        expect(next).toHaveBeenCalledTimes(3);
+
+        streams[0].close();
+        expect(onChange).toHaveBeenLastCalledWith(1);
+        limit({ headers: {} }, fakeResponse(), next);
+        expect(next).toHaveBeenCalledTimes(4);
+    });
+
+    it('checks product health without absolute paths and caches the result', async () => {
+        const testConnection = vi.fn(async (dbPath: string) => {
+            if (dbPath === '/srv/data/broken.db') {
+                throw new Error(`Database file not found at ${dbPath}`);
+            }
+        });
+        const check = () => checkProductHealth(['istio', 'broken'], (product) => `/srv/data/${product}.db`, testConnection, path.basename);
+        expect(await check()).toEqual([
+            { product: 'istio', status: 'ok' },
+            { product: 'broken', status: 'unavailable', error: 'Database file not found at broken.db' },
+        ]);
+
+        let now = 0;
+        const load = vi.fn(check);
+        const cached = createCachedLoader(load, 30_000, () => now);
+        const [first, second] = await Promise.all([cached(), cached()]);
+        expect(second).toBe(first);
+        now = 29_999;
+        await cached();
+        expect(load).toHaveBeenCalledTimes(1);
+        now = 30_000;
+        await cached();
+        expect(load).toHaveBeenCalledTimes(2);
+    });
+
+    it('tracks embedding tokens per session and enforces the budget', () => {
+        const ledger = createTokenLedger(100);
+        ledger.charge('a', 60);
+        ledger.assertWithinBudget('a');
+        ledger.charge('a', 40);
+        ledger.charge('b', 5);
+        expect(ledger.used('a')).toBe(100);
+        expect(ledger.used('b')).toBe(5);
+        expect(() => ledger.assertWithinBudget('a')).toThrow('Embedding token budget exceeded for this session (100 of 100 tokens used)');
+        expect(() => ledger.assertWithinBudget('b')).not.toThrow();
+
+        const budgetError = new Error('Embedding token budget exceeded for this session (100 of 100 tokens used).');
+        expect(toolErrorKind(budgetError)).toBe('rate_limited');
+
+        ledger.forget('a');
+        expect(ledger.used('a')).toBe(0);
+        expect(() => createTokenLedger(0).assertWithinBudget('a')).not.toThrow();
+    });
+
+    it('closes embedding clients once, aborting requests still in flight', async () => {
+        const pool = createEmbeddingClients<{ openai: { name: string }; gemini: { name: string } }>();
+        pool.clients.openai = { name: 'openai' };
+        pool.clients.gemini = { name: 'gemini' };
+        const inFlight = (signal: AbortSignal) => new Promise((_resolve, reject) => {
+            signal.addEventListener('abort', () => reject(signal.reason));
+        });
+
+        // A request its own tool call already cancelled does not stop the clients closing.
+        const call = new AbortController();
+        const cancelled = inFlight(AbortSignal.any([pool.signal, call.signal]));
+        call.abort(new Error('Tool call cancelled.'));
+        await expect(cancelled).rejects.toThrow('Tool call cancelled.');
+
+        const pending = inFlight(pool.signal);
+        pool.close();
+        await expect(pending).rejects.toThrow('Embedding clients closed during shutdown.');
+        expect(pool.signal.aborted).toBe(true);
+        expect(pool.clients).toEqual({});
+
+        const reason = pool.signal.reason;
+        expect(() => pool.close()).not.toThrow();
+        expect(pool.signal.reason).toBe(reason);
+        expect(pool.clients).toEqual({});
+    });
+
+    it('retries transient embedding failures with jittered exponential backoff', async () => {
+        const rateLimited = Object.assign(new Error('Rate limit reached'), { status: 429 });
+        let failures = 2;
+        const task = vi.fn(async () => {
+            if (failures-- > 0) {
+                throw rateLimited;
+            }
+            return [0.1];
+        });
+        const retries: Array<[number, number]> = [];
+        await expect(retryWithBackoff(task, {
+            maxRetries: 3,
+            baseDelayMs: 4,
+            isRetryable: isTransientEmbeddingError,
+            onRetry: (_error, attempt, delayMs) => retries.push([attempt, delayMs]),
+            random: () => 0,
+        })).resolves.toEqual([0.1]);
+        expect(task).toHaveBeenCalledTimes(3);
+        expect(retries).toEqual([[1, 2], [2, 4]]);
+
+        const unauthorized = vi.fn(async () => {
+            throw Object.assign(new Error('Incorrect API key provided'), { status: 401 });
+        });
+        await expect(retryWithBackoff(unauthorized, { maxRetries: 3, baseDelayMs: 1, isRetryable: isTransientEmbeddingError })).rejects.toThrow('Incorrect API key');
+        expect(unauthorized).toHaveBeenCalledTimes(1);
+
+        const controller = new AbortController();
+        const cancelled = retryWithBackoff(async () => {
+            throw rateLimited;
+        }, { maxRetries: 3, baseDelayMs: 60_000, isRetryable: isTransientEmbeddingError, signal: controller.signal });
+        await new Promise((resolve) => setTimeout(resolve, 0));
+        controller.abort(new Error('Request cancelled by the client.'));
+        await expect(cancelled).rejects.toThrow('Request cancelled by the client.');
+
+        expect(isTransientEmbeddingError(Object.assign(new Error('Bad gateway'), { status: 502 }))).toBe(true);
+        expect(isTransientEmbeddingError(new Error('Voyage API returned 503: overloaded'))).toBe(true);
+        expect(isTransientEmbeddingError(new Error('Voyage API returned 400: bad input'))).toBe(false);
+        expect(isTransientEmbeddingError(Object.assign(new Error('Request timed out.'), { name: 'APIConnectionTimeoutError' }))).toBe(true);
+        expect(isTransientEmbeddingError(Object.assign(new TypeError('fetch failed'), { cause: { code: 'ECONNRESET' } }))).toBe(true);
+        expect(isTransientEmbeddingError(Object.assign(new Error('aborted'), { name: 'AbortError' }))).toBe(false);
+    });
+
+    it('parses metadata boosts and re-ranks results by boosted score', () => {
+        expect(parseMetadataBoosts({ 'doc_type=reference': 1.5, 'version = 1.30': 0.5 })).toEqual([
+            { column: 'doc_type', value: 'reference', multiplier: 1.5 },
+            { column: 'version', value: '1.30', multiplier: 0.5 },
+        ]);
+        expect(() => parseMetadataBoosts({ doc_type: 2 })).toThrow('Invalid boost "doc_type": expected column=value.');
+        expect(() => parseMetadataBoosts({ 'doc_type; DROP=x': 2 })).toThrow('expected column=value');
+        expect(() => parseMetadataBoosts({ 'doc_type=reference': 50 })).toThrow('must be between 0.1 and 10');
+
+        const results = [
+            { chunk_id: 'guide', distance: 0.2, content: 'a', doc_type: 'guide' },
+            { chunk_id: 'reference', distance: 0.4, content: 'b', doc_type: 'reference' },
+            { chunk_id: 'blog', distance: 0.3, content: 'c', doc_type: 'blog' },
+        ];
+        const boosted = applyMetadataBoosts(results, parseMetadataBoosts({ 'doc_type=reference': 1.5 }));
+        expect(boosted.map((result) => result.chunk_id)).toEqual(['reference', 'guide', 'blog']);
+        expect(boosted[0].distance).toBe(0.4);
+        expect(applyMetadataBoosts(results, parseMetadataBoosts({ 'doc_type=guide': 0.5 })).map((result) => result.chunk_id)).toEqual(['blog', 'reference', 'guide']);
+
+        // BM25 scores are lower for better matches, so a boost must push a score further down.
+        const bm25 = [
+            { chunk_id: 'strong', distance: -6, score_type: 'bm25' as const, content: 'a', doc_type: 'guide' },
+            { chunk_id: 'weak', distance: -4, score_type: 'bm25' as const, content: 'b', doc_type: 'reference' },
+        ];
+        expect(applyMetadataBoosts(bm25, parseMetadataBoosts({ 'doc_type=reference': 2 })).map((result) => result.chunk_id)).toEqual(['weak', 'strong']);
+    });
+
+    it('orders versions as semver and picks the latest', () => {
+        expect(compareVersions('1.30', '1.9')).toBe(1);
+        expect(compareVersions('v1.29.0', '1.29')).toBe(0);
+        expect(compareVersions('1.30.0-rc.1', '1.30.0')).toBe(-1);
+        expect(compareVersions('1.30.0-rc.2', '1.30.0-rc.1')).toBe(1);
+        expect(pickLatestVersion(['1.9', '1.30', null, '', '1.30.0-rc.1', 'v1.10'])).toBe('1.30');
+        expect(pickLatestVersion([])).toBeUndefined();
+    });
+
+    it('parses products manifests and rejects malformed entries', () => {
+        expect(parseProductManifest(JSON.stringify({
+            products: [
+                { name: 'kubernetes', db: 'k8s-docs', defaultVersion: '1.30', displayName: 'Kubernetes' },
+                { name: 'istio' },
+            ],
+        }))).toEqual([
+            { name: 'kubernetes', db: 'k8s-docs.db', defaultVersion: '1.30', displayName: 'Kubernetes' },
+            { name: 'istio', db: 'istio.db' },
+        ]);
+        expect(() => parseProductManifest('{')).toThrow('not valid JSON');
+        expect(() => parseProductManifest('[]')).toThrow('"products" array');
+        expect(() => parseProductManifest('{"products":[{"name":"../etc"}]}')).toThrow('invalid "name"');
+        expect(() => parseProductManifest('{"products":[{"name":"a"},{"name":"a"}]}')).toThrow('more than once');
+        expect(() => parseProductManifest('{"products":[{"name":"a","defaultVersion":3}]}')).toThrow('invalid "defaultVersion"');
+    });
+
+    it('parses sparse vectors and scores them by dot product', () => {
+        expect(parseSparseVector({ indices: [3, 7], values: [0.5, 1.5] })).toEqual({ 3: 0.5, 7: 1.5 });
+        expect(parseSparseVector('{"pod":1.2,"scaling":0.4}')).toEqual({ pod: 1.2, scaling: 0.4 });
+        expect(parseSparseVector('not json')).toBeUndefined();
+        expect(parseSparseVector({ indices: [1], values: [] })).toBeUndefined();
+        expect(parseSparseVector({ pod: 'high' })).toBeUndefined();
+        expect(sparseDotProduct({ pod: 2, scaling: 1 }, { pod: 0.5, network: 3 })).toBe(1);
+    });
+
+    it('breaks distance ties by product and chunk ID', () => {
+        const rows = [
+            { distance: 0.2, chunk_id: 'b', product: 'istio' },
+            { distance: 0.2, chunk_id: 'a', product: 'kubernetes' },
+            { distance: 0.2, chunk_id: 'a', product: 'istio' },
+            { distance: 0.1, chunk_id: 'z' },
+        ];
+        expect([...rows].sort(compareByDistance)).toEqual([rows[3], rows[2], rows[0], rows[1]]);
+        expect([...rows].reverse().sort(compareByDistance)).toEqual([rows[3], rows[2], rows[0], rows[1]]);
+    });
+
+    it('renders plain results through a custom result template', () => {
+        const results = [
+            { distance: 0.1, content: 'first', section: 'Install', url: 'https://docs.example.com/a', chunk_index: 0, total_chunks: 2 },
+            { distance: 0.25, content: 'second' },
+        ];
+        expect(formatQueryResults(results)).toBe(
+            'Result 1:\n  Content: first\n  Distance: 0.1000\n  URL: https://docs.example.com/a\n  Chunk: 1 of 2\n---\n'
+            + 'Result 2:\n  Content: second\n  Distance: 0.2500\n---'
+        );
+
+        const template = parseResultTemplate('[{{index}}]{{#section}} {{section}}{{/section}}: {{content}}', '\n\n');
+        expect(formatQueryResults(results, 'plain', template)).toBe('[1] Install: first\n\n[2]: second');
+
+        expect(() => parseResultTemplate('{{title}}')).toThrow('unknown field "title"');
+        expect(() => parseResultTemplate('{{#url}}{{url}}')).toThrow('is not closed');
+        expect(() => parseResultTemplate('{{content}')).toThrow('malformed tag');
+    });
+
+    it('builds breadcrumbs from heading columns when the database stores them', () => {
+        expect(resultBreadcrumb({ chunk_id: '1', content: 'x', heading_hierarchy: '["Networking", "Services", "ClusterIP"]' })).toBe('Networking > Services > ClusterIP');
+        expect(resultBreadcrumb({ chunk_id: '1', content: 'x', heading_hierarchy: ['Install', '', 'Helm'] })).toBe('Install > Helm');
+        expect(resultBreadcrumb({ chunk_id: '1', content: 'x', heading_hierarchy: 'Guide > Setup' })).toBe('Guide > Setup');
+        expect(resultBreadcrumb({ chunk_id: '1', content: 'x', h1: 'Guide', h2: 'Setup', h3: null })).toBe('Guide > Setup');
+        expect(resultBreadcrumb({ chunk_id: '1', content: 'x', heading_hierarchy: '[]' })).toBeUndefined();
+        expect(resultBreadcrumb({ chunk_id: '1', content: 'x' })).toBeUndefined();
+
+        const result = toDocumentationResult({ chunk_id: '1', distance: 0.1, content: 'ClusterIP exposes', heading_hierarchy: '["Networking", "Services"]' });
+        expect(result.breadcrumb).toBe('Networking > Services');
+        expect(formatQueryResults([result])).toBe('Result 1:\n  Breadcrumb: Networking > Services\n  Content: ClusterIP exposes\n  Distance: 0.1000\n---');
+        expect(formatQueryResults([result], 'markdown')).toContain('**[1]** — Networking > Services (distance 0.1000)');
+    });
+
+    it('parses message overrides and fills their placeholders', () => {
+        expect(parseQueryMessages('{"noResults": "Aucun résultat pour {query}", "distanceLabel": "Écart"}')).toEqual({
+            noResults: 'Aucun résultat pour {query}',
+            distanceLabel: 'Écart',
+        });
+        expect(() => parseQueryMessages('{')).toThrow('messages file is not valid JSON');
+        expect(() => parseQueryMessages('[]')).toThrow('must be a JSON object');
+        expect(() => parseQueryMessages('{"noResult": "x"}')).toThrow('unknown key "noResult"');
+        expect(() => parseQueryMessages('{"noResults": 3}')).toThrow('key "noResults" must be a string');
+
+        expect(formatMessage('{count} hits for "{query}" in {product} {unknown}', { query: 'install', product: 'kagent', count: 2 }))
+            .toBe('2 hits for "install" in kagent {unknown}');
+        expect(formatQueryResults([{ distance: 0.1, content: 'x' }], 'plain', undefined, { distanceLabel: 'Écart' }))
+            .toBe('Result 1:\n  Content: x\n  Écart: 0.1000\n---');
+    });
+
+    it('normalizes SQLite bind parameters and rejects unsupported types', () => {
+        const params = normalizeBindParams({
+            text: 'a',
+            count: 3,
+            big: BigInt(4),
+            flag: true,
+            missing: undefined,
+            vector: [0.5, 0.25],
+        });
+
+        expect(params.text).toBe('a');
+        expect(params.count).toBe(3);
+        expect(params.big).toBe(BigInt(4));
+        expect(params.flag).toBe(1);
+        expect(params.missing).toBeNull();
+        expect(params.vector).toBeInstanceOf(Float32Array);
+        expect(() => normalizeBindParams({ filter: { nested: true } })).toThrow('Unsupported parameter type for "filter"');
+        expect(() => normalizeBindParams({ limit: Number.NaN })).toThrow('non-finite');
+    });
+
+    it('extracts a sentence window centered on the best-matching sentence', () => {
+        const content = 'Intro sentence. Pods run containers. Services expose pods to traffic! Unrelated closing note.';
+        expect(extractSnippet(content, 'how do services expose pods', 1)).toBe('Services expose pods to traffic!');
+        expect(extractSnippet(content, 'how do services expose pods', 3)).toBe('Pods run containers. Services expose pods to traffic! Unrelated closing note.');
+        expect(extractSnippet('Short.', 'anything', 2)).toBe('Short.');
+    });
+
+    it('transforms content according to contentFormat', () => {
+        const content = '<p>## Install</p>\n\nRun **helm** with the [chart](https://example.com) &amp; `values.yaml`.<br>';
+        expect(transformContent(content, 'raw')).toBe(content);
+        expect(transformContent(content, 'markdown')).toBe('## Install\n\nRun **helm** with the [chart](https://example.com) & `values.yaml`.');
+        expect(transformContent(content, 'text')).toBe('Install\n\nRun helm with the chart & values.yaml.');
+    });
+
+    it('parses and applies query preprocessing steps', () => {
+        expect(parseQueryPreprocess(undefined)).toEqual([]);
+        expect(parseQueryPreprocess('Lowercase, strip_code_fences')).toEqual(['lowercase', 'strip_code_fences']);
+        expect(() => parseQueryPreprocess('stem')).toThrow("Invalid step 'stem'");
+
+        const query = 'How do I set   Replicas?\n```yaml\nreplicas: 3\n```';
+        expect(preprocessQuery(query, [])).toBe(query);
+        expect(preprocessQuery(query, ['collapse_whitespace', 'lowercase', 'strip_code_fences'])).toBe('how do i set replicas? replicas: 3');
+    });
+
+    it('bounds concurrent queries per database', async () => {
+        let releaseFirst: () => void = () => undefined;
+        const queryCollection = vi.fn((_embedding: number[], dbPath: string) =>
+            dbPath === '/data/slow.db'
+                ? new Promise<any[]>((resolve) => { releaseFirst = () => resolve([]); })
+                : Promise.resolve([])
+        );
+
+        const rejecting = withConcurrencyLimit(queryCollection, 1, 0);
+        const first = rejecting([0.1], '/data/slow.db', {});
+        await expect(rejecting([0.1], '/data/slow.db', {})).rejects.toThrow('is busy');
+        await expect(rejecting([0.1], '/data/other.db', {})).resolves.toEqual([]);
+        releaseFirst();
+        await first;
+
+        const waiting = withConcurrencyLimit(queryCollection, 1, 1000);
+        const held = waiting([0.1], '/data/slow.db', {});
+        const queued = waiting([0.1], '/data/slow.db', {});
+        releaseFirst();
+        await held;
+        await vi.waitFor(() => expect(queryCollection).toHaveBeenCalledTimes(4));
+        releaseFirst();
+        await expect(queued).resolves.toEqual([]);
+    });
+
+    it('computes stable provenance hashes from product and chunk ID', () => {
+        const hash = computeProvenanceHash('istio', 'chunk-1', 'a');
+        expect(hash).toMatch(/^[0-9a-f]{16}$/);
+        expect(computeProvenanceHash('istio', 'chunk-1', 'changed content')).toBe(hash);
+        expect(computeProvenanceHash('kagent', 'chunk-1', 'a')).not.toBe(hash);
+        expect(computeProvenanceHash('istio', undefined as unknown as string, 'a')).not.toBe(computeProvenanceHash('istio', undefined as unknown as string, 'b'));
+    });
+
+    it('rejects empty and oversized query embeddings', () => {
+        expect(Array.from(toEmbeddingVector([0.5, 1], 2))).toEqual([0.5, 1]);
+        expect(() => toEmbeddingVector([0.5, 1, 2], 2)).toThrow('above MAX_EMBEDDING_DIMENSION (2)');
+        expect(() => toEmbeddingVector([])).toThrow('Query embedding is empty');
+        expect(toEmbeddingVector([0.5, 1, 2], 0)).toHaveLength(3);
+    });
+
+    it('encodes query embeddings in host byte order', () => {
+        const vector = toEmbeddingVector([1.5], 0);
+        const bytes = Array.from(new Uint8Array(vector.buffer, vector.byteOffset, vector.byteLength));
+        expect(bytes).toEqual(HOST_BYTE_ORDER === 'little' ? [0x00, 0x00, 0xc0, 0x3f] : [0x3f, 0xc0, 0x00, 0x00]);
+    });
+
+    it('fuses weighted distances across vector columns', () => {
+        const fused = fuseWeightedResults([
+            {
+                weight: 0.7,
+                rows: [
+                    { chunk_id: 'a', distance: 0.2, content: 'a' },
+                    { chunk_id: 'b', distance: 0.4, content: 'b' },
+                ],
+            },
+            {
+                weight: 0.3,
+                rows: [
+                    { chunk_id: 'b', distance: 0.1, content: 'b' },
+                ],
+            },
+        ], 2);
+
+        expect(fused.map((row) => row.chunk_id)).toEqual(['a', 'b']);
+        expect(fused[0].distance).toBeCloseTo(0.7 * 0.2 + 0.3 * 0.1);
+        expect(fused[1].distance).toBeCloseTo(0.7 * 0.4 + 0.3 * 0.1);
+    });
+});
+
+describe('MCP metrics registry', () => {
+    it('renders counters, gauges, and histograms with labels', () => {
+        const registry = new MetricsRegistry([100, 1000]);
+        const labels = { provider: 'openai', model: 'text-embedding-3-large' };
+        registry.incCounter('errors_total', 'Errors', labels);
+        registry.incCounter('errors_total', 'Errors', labels);
+        registry.setGauge('dimension', 'Dimension', labels, 3072);
+        registry.observe('latency_ms', 'Latency', labels, 250);
+
+        const output = registry.render();
+        expect(output).toContain('# TYPE errors_total counter');
+        expect(output).toContain('errors_total{provider="openai",model="text-embedding-3-large"} 2');
+        expect(output).toContain('dimension{provider="openai",model="text-embedding-3-large"} 3072');
+        expect(output).toContain('latency_ms_bucket{provider="openai",model="text-embedding-3-large",le="100"} 0');
+        expect(output).toContain('latency_ms_bucket{provider="openai",model="text-embedding-3-large",le="1000"} 1');
+        expect(output).toContain('latency_ms_count{provider="openai",model="text-embedding-3-large"} 1');
+    });
+});
+
+describe('MCP embedding cache', () => {
+    it('evicts the least recently used embedding', () => {
+        const cache = new LruEmbeddingCache(2);
+        cache.set('a', [1]);
+        cache.set('b', [2]);
+        cache.get('a');
+        cache.set('c', [3]);
+        expect(cache.get('a')).toEqual([1]);
+        expect(cache.get('b')).toBeUndefined();
+        expect(cache.get('c')).toEqual([3]);
+    });
+
+    it('persists embeddings on disk across cache instances', () => {
+        const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'embedding-cache-'));
+        const cachePath = path.join(dir, 'cache.db');
+        const key = embeddingCacheKey('openai', 'text-embedding-3-large', 'how do I install');
+        try {
+            const first = new SqliteEmbeddingCache(BetterSqlite3 as any, cachePath);
+            first.set(key, [0.5, -1.25]);
+            first.close();
+
+            const second = new SqliteEmbeddingCache(BetterSqlite3 as any, cachePath);
+            expect(second.get(key)).toEqual([0.5, -1.25]);
+            expect(second.get(embeddingCacheKey('openai', 'text-embedding-3-small', 'how do I install'))).toBeUndefined();
+            second.close();
+        } finally {
+            fs.rmSync(dir, { recursive: true, force: true });
+        }
+    });
+
+    it('clears the disk cache when the embedding configuration changes', () => {
+        const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'embedding-cache-'));
+        const cachePath = path.join(dir, 'cache.db');
+        const key = embeddingCacheKey('openai', 'text-embedding-3-large', 'how do I install', 1024);
+        expect(key).not.toBe(embeddingCacheKey('openai', 'text-embedding-3-large', 'how do I install', 3072));
+        try {
+            const first = new SqliteEmbeddingCache(BetterSqlite3 as any, cachePath, embeddingCacheConfig('openai', 'text-embedding-3-large', 1024));
+            expect(first.invalidated).toBe(false);
+            first.set(key, [0.5]);
+            first.close();
+
+            const same = new SqliteEmbeddingCache(BetterSqlite3 as any, cachePath, embeddingCacheConfig('openai', 'text-embedding-3-large', 1024));
+            expect(same.invalidated).toBe(false);
+            expect(same.get(key)).toEqual([0.5]);
+            same.close();
+
+            const changed = new SqliteEmbeddingCache(BetterSqlite3 as any, cachePath, embeddingCacheConfig('openai', 'text-embedding-3-small', 1024));
+            expect(changed.invalidated).toBe(true);
+            expect(changed.get(key)).toBeUndefined();
+            changed.close();
+        } finally {
+            fs.rmSync(dir, { recursive: true, force: true });
+        }
+    });
+
+    it('prunes the disk cache by entry count and age', () => {
+        const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'embedding-cache-'));
+        const cachePath = path.join(dir, 'cache.db');
+        let now = 1_000;
+        try {
+            const cache = new SqliteEmbeddingCache(BetterSqlite3 as any, cachePath, undefined, { maxEntries: 2, maxAgeMs: 500, now: () => now });
+            cache.set('a', [1]);
+            now += 100;
+            cache.set('b', [2]);
+            now += 100;
+            cache.set('c', [3]);
+            expect(cache.get('a')).toBeUndefined();
+            expect(cache.get('b')).toEqual([2]);
+            expect(cache.get('c')).toEqual([3]);
+
+            now += 450;
+            expect(cache.get('b')).toBeUndefined();
+            expect(cache.get('c')).toEqual([3]);
+            cache.close();
+
+            const reopened = new SqliteEmbeddingCache(BetterSqlite3 as any, cachePath, undefined, { maxAgeMs: 500, now: () => now });
+            reopened.close();
+            const db = new BetterSqlite3(cachePath);
+            expect(db.prepare('SELECT cache_key FROM embeddings').all()).toEqual([{ cache_key: 'c' }]);
+            db.close();
+        } finally {
+            fs.rmSync(dir, { recursive: true, force: true });
+        }
+    });
+
+    it('treats disk cache failures as misses with a warning', () => {
+        const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'embedding-cache-'));
+        const warn = vi.spyOn(console, 'warn').mockImplementation(() => undefined);
+        try {
+            const cache = new SqliteEmbeddingCache(BetterSqlite3 as any, path.join(dir, 'cache.db'));
+            cache.set('a', [1]);
+            cache.close();
+            expect(cache.get('a')).toBeUndefined();
+            expect(() => cache.set('b', [2])).not.toThrow();
+            expect(warn).toHaveBeenCalledWith(expect.stringContaining('embedding cache read failed'));
+            expect(warn).toHaveBeenCalledWith(expect.stringContaining('embedding cache write failed'));
+        } finally {
+            warn.mockRestore();
+            fs.rmSync(dir, { recursive: true, force: true });
+        }
+    });
 });
 
 describe('MCP query handlers', () => {
@@ -56,130 +769,2219 @@ describe('MCP query handlers', () => {
     const queryCollection = vi.fn(async () => []);
     const getChunksForDocument = vi.fn(async () => []);
 
-    it('returns validation message when query_documentation params are missing', async () => {
-        const { queryDocumentationToolHandler } = createQueryHandlers({
-            createEmbeddings,
-            resolveDbPath,
-            queryCollection,
-            getChunksForDocument,
+    it('returns validation message when query_documentation params are missing', async () => {
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument,
+        });
+
+        const response = await queryDocumentationToolHandler({
+            queryText: 'test',
+            limit: 2,
+        });
+
+        expect(response.content[0].text).toContain('Provide either productName or dbName');
+    });
+
+    it('rejects or truncates query text longer than maxQueryChars', async () => {
+        const embed = vi.fn(async () => [0.1, 0.2]);
+        const rejecting = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument,
+            options: { maxQueryChars: 5 },
+        });
+
+        const rejected = await rejecting.queryDocumentationToolHandler({
+            queryText: 'far too long',
+            productName: 'product',
+            limit: 2,
+        });
+        expect(rejected.content[0].text).toContain('Query text is too long');
+        expect(embed).not.toHaveBeenCalled();
+
+        const truncating = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument,
+            options: { maxQueryChars: 5, queryLengthMode: 'truncate' },
+        });
+
+        await truncating.queryDocumentationToolHandler({
+            queryText: 'far too long',
+            productName: 'product',
+            limit: 2,
+        });
+        expect(embed).toHaveBeenCalledWith('far t');
+    });
+
+    it('rejects whitespace-only and too-short queries before embedding', async () => {
+        const embed = vi.fn(async () => [0.1, 0.2]);
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument,
+            options: { minQueryLength: 3 },
+        });
+
+        const whitespace = await queryDocumentationToolHandler({ queryText: '     ', productName: 'product', limit: 2 });
+        expect(whitespace.content[0].text).toContain('Query text is too short');
+
+        const short = await queryDocumentationToolHandler({ queryText: ' ab ', productName: 'product', limit: 2 });
+        expect(short.content[0].text).toContain('minimum is 3');
+        expect(embed).not.toHaveBeenCalled();
+    });
+
+    it('trims query whitespace before embedding and optionally collapses internal runs', async () => {
+        const embed = vi.fn(async () => [0.1, 0.2]);
+        const trimming = createQueryHandlers({ createEmbeddings: embed, resolveDbPath, queryCollection, getChunksForDocument });
+        await trimming.queryDocumentationToolHandler({ queryText: '  how to   scale \n', productName: 'product', limit: 2 });
+        expect(embed).toHaveBeenLastCalledWith('how to   scale');
+
+        const collapsing = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument,
+            options: { queryTrimMode: 'collapse' },
+        });
+        await collapsing.queryDocumentationToolHandler({ queryText: '  how to   scale \n', productName: 'product', limit: 2 });
+        expect(embed).toHaveBeenLastCalledWith('how to scale');
+    });
+
+    it('filters empty content and url prefix in queryDocumentation', async () => {
+        const collectionResults = [
+            { chunk_id: '1', distance: 0.1, content: 'ok', url: 'https://docs.example.com/a' },
+            { chunk_id: '2', distance: 0.2, content: '', url: 'https://docs.example.com/a' },
+            { chunk_id: '3', distance: 0.3, content: 'ok', url: 'https://other.example.com/b' },
+        ];
+
+        const { queryDocumentation } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => collectionResults),
+            getChunksForDocument,
+        });
+
+        const results = await queryDocumentation('test', 'product', undefined, undefined, 'https://docs.example.com/', 4);
+        expect(results).toHaveLength(1);
+        expect(results[0].content).toBe('ok');
+    });
+
+    it('collapses results to one chunk per URL when uniqueUrls is set', async () => {
+        const collectionResults = [
+            { chunk_id: '1', distance: 0.1, content: 'a1', url: 'https://docs.example.com/a' },
+            { chunk_id: '2', distance: 0.2, content: 'a2', url: 'https://docs.example.com/a' },
+            { chunk_id: '3', distance: 0.3, content: 'b1', url: 'https://docs.example.com/b' },
+            { chunk_id: '4', distance: 0.4, content: 'no url' },
+        ];
+
+        const { queryDocumentation } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => collectionResults),
+            getChunksForDocument,
+        });
+
+        const results = await queryDocumentation('test', 'product', undefined, undefined, undefined, 4, { uniqueUrls: true });
+        expect(results.map((r) => r.content)).toEqual(['a1', 'b1', 'no url']);
+    });
+
+    it('returns chunks by ID in request order and enforces maxChunkIds', async () => {
+        const getChunksByIds = vi.fn(async () => [
+            { chunk_id: 'b', content: 'second' },
+            { chunk_id: 'a', content: 'first' },
+        ]);
+        const { getChunksByIdsToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => []),
+            getChunksForDocument,
+            getChunksByIds,
+            options: { maxChunkIds: 3 },
+        });
+
+        const response = await getChunksByIdsToolHandler({ productName: 'product', chunkIds: ['a', 'missing', 'b', 'a'] });
+        const text = response.content[0].text;
+        expect(getChunksByIds).toHaveBeenCalledWith('product', undefined, ['a', 'missing', 'b'], undefined);
+        expect(text.indexOf('first')).toBeLessThan(text.indexOf('second'));
+        expect(text).toContain('Not found: missing');
+
+        const tooMany = await getChunksByIdsToolHandler({ productName: 'product', chunkIds: ['1', '2', '3', '4'] });
+        expect(tooMany.content[0].text).toContain('Too many chunk IDs');
+    });
+
+    it('echoes effective query parameters when includeQueryEcho is set', async () => {
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [{ chunk_id: '1', distance: 0.1, content: 'a' }]),
+            getChunksForDocument,
+            getDistanceThreshold: () => 0.5,
+            options: { includeQueryEcho: true, maxQueryChars: 4, queryLengthMode: 'truncate' },
+        });
+
+        const plain = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 2 });
+        expect(plain.content[0].text).toMatch(/^Effective query: /);
+        expect(plain.content[0].text).toContain('"queryText":"inst","queryTruncated":true');
+        expect(plain.content[0].text).toContain('"maxDistance":0.5,"maxDistanceSource":"calibration"');
+
+        const json = await queryDocumentationToolHandler({ queryText: 'inst', productName: 'product', limit: 2, maxDistance: 0.2, format: 'json' });
+        const parsed = JSON.parse(json.content[0].text);
+        expect(parsed.query).toMatchObject({ productName: 'product', limit: 2, maxDistance: 0.2, maxDistanceSource: 'request' });
+        expect(parsed.results).toHaveLength(1);
+    });
+
+    it('returns an empty results document for no matches in JSON mode', async () => {
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => []),
+            getChunksForDocument,
+        });
+
+        const json = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', version: '1.0', format: 'json' });
+        expect(JSON.parse(json.content[0].text)).toEqual({
+            results: [],
+            message: 'No relevant documentation found for "install" in product "product" (version 1.0).',
+        });
+
+        const plain = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', version: '1.0' });
+        expect(plain.content[0].text).toBe('No relevant documentation found for "install" in product "product" (version 1.0).');
+
+        const unversioned = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product' });
+        expect(unversioned.content[0].text).toBe('No relevant documentation found for "install" in product "product".');
+    });
+
+    it('calibrates a distance threshold and applies it as the default maxDistance', async () => {
+        let savedThreshold: number | undefined;
+        const saveDistanceCalibration = vi.fn((_dbPath: string, calibration: { threshold: number }) => {
+            savedThreshold = calibration.threshold;
+        });
+        const { calibrateThresholdToolHandler, queryDocumentation } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [
+                { chunk_id: '1', distance: 0.1, content: 'a' },
+                { chunk_id: '2', distance: 0.3, content: 'b' },
+                { chunk_id: '3', distance: 0.9, content: 'c' },
+            ]),
+            getChunksForDocument,
+            getDistanceThreshold: () => savedThreshold,
+            saveDistanceCalibration,
+        });
+
+        const response = await calibrateThresholdToolHandler({ productName: 'product', probeQueries: ['install', 'upgrade'], topK: 3, percentile: 0.5 });
+        expect(response.content[0].text).toContain('default maxDistance is now 0.3000');
+        expect(saveDistanceCalibration).toHaveBeenCalledTimes(1);
+
+        const outside = await calibrateThresholdToolHandler({ dbName: '/etc/outside.db', probeQueries: ['install'] });
+        expect(outside.content[0].text).toContain('Invalid dbName');
+        const traversal = await calibrateThresholdToolHandler({ dbName: '../outside', probeQueries: ['install'] });
+        expect(traversal.content[0].text).toContain('Invalid dbName');
+        expect(saveDistanceCalibration).toHaveBeenCalledTimes(1);
+
+        expect((await queryDocumentation('test', 'product', undefined, undefined, undefined, 4)).map((r) => r.content)).toEqual(['a', 'b']);
+        expect((await queryDocumentation('test', 'product', undefined, undefined, undefined, 4, { maxDistance: 1 }))).toHaveLength(3);
+        expect(computeDistanceThreshold([], 0.9)).toBeUndefined();
+    });
+
+    it('appends a timing breakdown when timing is requested', async () => {
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async (_embedding: number[], _dbPath: string, _filter: unknown, _topK?: number, timings?: { dbOpenMs?: number; queryMs?: number }) => {
+                if (timings) {
+                    timings.dbOpenMs = 3;
+                    timings.queryMs = 7;
+                }
+                return [{ chunk_id: '1', distance: 0.1, content: 'a' }];
+            }),
+            getChunksForDocument,
+        });
+
+        const plain = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, timing: true });
+        expect(plain.content[0].text).toMatch(/Timing: embedding \d+ms, db open 3ms, query 7ms, format \d+ms$/);
+
+        const json = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, timing: true, format: 'json' });
+        expect(JSON.parse(json.content[0].text).timing).toMatchObject({ dbOpenMs: 3, queryMs: 7 });
+
+        const untimed = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1 });
+        expect(untimed.content[0].text).not.toContain('Timing:');
+    });
+
+    it('searches only the latest version when the default version strategy is latest', async () => {
+        const queryCollection = vi.fn(async () => [{ chunk_id: '1', distance: 0.1, content: 'a' }]);
+        const getLatestVersion = vi.fn(async () => '1.30');
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument,
+            getLatestVersion,
+            options: { defaultVersionStrategy: 'latest' },
+        });
+
+        await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1 });
+        expect(getLatestVersion).toHaveBeenCalledWith('/tmp/db.db');
+        expect(queryCollection).toHaveBeenLastCalledWith(expect.any(Array), '/tmp/db.db', expect.objectContaining({ version: '1.30' }), 1, undefined);
+
+        await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', version: '1.29', limit: 1 });
+        expect(getLatestVersion).toHaveBeenCalledTimes(1);
+        expect(queryCollection).toHaveBeenLastCalledWith(expect.any(Array), '/tmp/db.db', expect.objectContaining({ version: '1.29' }), 1, undefined);
+
+        const { queryDocumentationToolHandler: allVersions } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument,
+            getLatestVersion,
+        });
+        await allVersions({ queryText: 'install', productName: 'product', limit: 1 });
+        expect(getLatestVersion).toHaveBeenCalledTimes(1);
+        expect(queryCollection).toHaveBeenLastCalledWith(expect.any(Array), '/tmp/db.db', expect.objectContaining({ version: undefined }), 1, undefined);
+    });
+
+    it('validates a database end to end and skips checks whose prerequisites failed', async () => {
+        const inspectDatabase = vi.fn(async (): Promise<DatabaseInspection> => ({
+            exists: true,
+            vecVersion: 'v0.1.6',
+            dimension: 2,
+            rowCount: 12,
+            columns: ['chunk_id', 'content', 'url', 'embedding'],
+        }));
+        const { validateDatabaseToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [{ chunk_id: 'c1', distance: 0.2, content: 'a' }]),
+            getChunksForDocument,
+            inspectDatabase,
+        });
+
+        const passing = await validateDatabaseToolHandler({ productName: 'product' });
+        expect(passing.content[0].text).toBe([
+            'Validation of db.db: PASS',
+            '- [pass] file_exists: /tmp/db.db',
+            '- [pass] opens: Opened read-only.',
+            '- [pass] vec_extension: sqlite-vec v0.1.6',
+            '- [pass] dimension: Database stores 2 dimensions; the configured model produces 2.',
+            '- [pass] row_count: 12 rows in vec_items.',
+            '- [pass] required_columns: vec_items has chunk_id, content, url.',
+            '- [pass] sample_query: "getting started" returned chunk c1.',
+        ].join('\n'));
+
+        inspectDatabase.mockResolvedValueOnce({ exists: true, vecVersion: 'v0.1.6', dimension: 3, rowCount: 0, columns: ['chunk_id', 'content'] });
+        const failing = await validateDatabaseToolHandler({ productName: 'product', format: 'json' });
+        const report = JSON.parse(failing.content[0].text);
+        expect(report.ok).toBe(false);
+        expect(report.checks.map((check: { name: string; status: string }) => `${check.name}:${check.status}`)).toEqual([
+            'file_exists:pass',
+            'opens:pass',
+            'vec_extension:pass',
+            'dimension:fail',
+            'row_count:fail',
+            'required_columns:fail',
+            'sample_query:skip',
+        ]);
+        expect(report.checks[5].detail).toBe('vec_items is missing url.');
+
+        inspectDatabase.mockResolvedValueOnce({ exists: false, columns: [] });
+        const missing = await validateDatabaseToolHandler({ dbName: 'missing.db' });
+        expect(missing.content[0].text).toContain('- [fail] file_exists: Database file not found at /tmp/db.db');
+        expect(missing.content[0].text).toContain('- [skip] sample_query: an earlier check failed');
+
+        const { validateDatabaseToolHandler: unsupported } = createQueryHandlers({ createEmbeddings, resolveDbPath, queryCollection, getChunksForDocument });
+        expect((await unsupported({ productName: 'product' })).content[0].text).toContain('not supported');
+
+        // A configured dimension is checked without calling the provider, which then only
+        // embeds for the sample query.
+        const embed = vi.fn(async () => [0.1, 0.2]);
+        const withDimension = (embeddingDimension: number) => createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [{ chunk_id: 'c1', distance: 0.2, content: 'a' }]),
+            getChunksForDocument,
+            inspectDatabase,
+            options: { embeddingDimension },
+        }).validateDatabaseToolHandler;
+        const mismatched = await withDimension(3)({ productName: 'product' });
+        expect(mismatched.content[0].text).toContain('- [fail] dimension: Database stores 2 dimensions; the configured model produces 3.');
+        expect(mismatched.content[0].text).toContain('- [skip] sample_query: an earlier check failed');
+        expect(embed).not.toHaveBeenCalled();
+        const matched = await withDimension(2)({ productName: 'product' });
+        expect(matched.content[0].text).toContain('Validation of db.db: PASS');
+        expect(embed).toHaveBeenCalledTimes(1);
+    });
+
+    it('exports chunks page by page in rowid order', async () => {
+        const rows = [1, 2, 5].map((rowid) => ({ rowid, chunk_id: `c${rowid}`, content: `chunk ${rowid}`, url: 'https://docs.example.com/a', version: '1.0' }));
+        const exportChunks = vi.fn(async (_dbPath: string, afterRowid: number, limit: number) => {
+            const after = rows.filter((row) => row.rowid > afterRowid);
+            return { rows: after.slice(0, limit), total: rows.length, hasMore: after.length > limit };
+        });
+        const { exportDocumentsToolHandler } = createQueryHandlers({ createEmbeddings, resolveDbPath, queryCollection, getChunksForDocument, exportChunks });
+
+        const first = JSON.parse((await exportDocumentsToolHandler({ productName: 'product', limit: 2 })).content[0].text);
+        expect(first).toEqual({
+            database: 'db.db',
+            cursor: 0,
+            total: 3,
+            nextCursor: 2,
+            chunks: [
+                { rowid: 1, chunk_id: 'c1', content: 'chunk 1', url: 'https://docs.example.com/a', version: '1.0' },
+                { rowid: 2, chunk_id: 'c2', content: 'chunk 2', url: 'https://docs.example.com/a', version: '1.0' },
+            ],
+        });
+
+        const last = JSON.parse((await exportDocumentsToolHandler({ productName: 'product', cursor: first.nextCursor, limit: 2 })).content[0].text);
+        expect(last.chunks.map((chunk: { chunk_id: string }) => chunk.chunk_id)).toEqual(['c5']);
+        expect(last).not.toHaveProperty('nextCursor');
+        expect(exportChunks).toHaveBeenLastCalledWith('/tmp/db.db', 2, 2);
+
+        expect((await exportDocumentsToolHandler({ productName: 'product', limit: 5000 })).content[0].text).toBe('Too many chunks per page (5000, maximum is 1000).');
+    });
+
+        const last = JSON.parse((await exportDocumentsToolHandler({ productName: 'product', offset: first.nextOffset, limit: 2 })).content[0].text);
+        expect(last.chunks.map((chunk: { chunk_id: string }) => chunk.chunk_id)).toEqual(['c3']);
+        expect(last).not.toHaveProperty('nextOffset');
+        expect(exportChunks).toHaveBeenLastCalledWith('/tmp/db.db', 2, 2);
+
+        expect((await exportDocumentsToolHandler({ productName: 'product', limit: 5000 })).content[0].text).toBe('Too many chunks per page (5000, maximum is 1000).');
+    });
+
+    it('logs slow queries with a hashed query and the timing breakdown', async () => {
+        const warn = vi.spyOn(console, 'warn').mockImplementation(() => undefined);
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async (_embedding: number[], _dbPath: string, _filter: unknown, _topK?: number, timings?: { queryMs?: number }) => {
+                await new Promise((resolve) => setTimeout(resolve, 5));
+                if (timings) {
+                    timings.queryMs = 5;
+                }
+                return [{ chunk_id: '1', distance: 0.1, content: 'a' }];
+            }),
+            getChunksForDocument,
+            options: { slowQueryThresholdMs: 1 },
+        });
+
+        const response = await queryDocumentationToolHandler({ queryText: 'secret install question', productName: 'product', limit: 1 });
+        expect(response.content[0].text).not.toContain('Timing:');
+        expect(warn).toHaveBeenCalledTimes(1);
+        const line = warn.mock.calls[0][0] as string;
+        expect(line).toMatch(/^Warning: slow query \(\d+ms, threshold 1ms\): query_hash=[0-9a-f]{12} target=product "product" embedding=\d+ms query=5ms format=\d+ms$/);
+        expect(line).not.toContain('secret');
+
+        const failing = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => {
+                await new Promise((resolve) => setTimeout(resolve, 5));
+                throw Object.assign(new Error('database is locked'), { code: 'SQLITE_BUSY' });
+            }),
+            getChunksForDocument,
+            options: { slowQueryThresholdMs: 1 },
+        });
+        const failed = await failing.queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1 });
+        expect(failed.content[0].text).toContain('Error querying documentation');
+        expect(warn).toHaveBeenCalledTimes(2);
+        expect(warn.mock.calls[1][0]).toMatch(/^Warning: slow query \(\d+ms, threshold 1ms\): query_hash=[0-9a-f]{12} target=product "product" .*error=rate_limited$/);
+        warn.mockRestore();
+
+        expect(formatSlowQueryLog('q', 'db "a.db"', 1500, 1000, {})).toBe(
+            `Warning: slow query (1500ms, threshold 1000ms): query_hash=${createHash('sha256').update('q').digest('hex').slice(0, 12)} target=db "a.db"`
+        );
+    });
+
+    it('fuses dense and sparse results in sparse mode', async () => {
+        const sparseSearch = vi.fn(async () => [
+            { chunk_id: 'sparse-only', distance: 0, content: 'exact term hit' },
+            { chunk_id: 'both', distance: 0.25, content: 'shared' },
+            { chunk_id: 'sparse-tail', distance: 0.5, content: 'weak term hit' },
+        ]);
+        const createSparseEmbedding = vi.fn(async (_text: string, _signal?: AbortSignal) => ({ kubelet: 1.3 }));
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [
+                { chunk_id: 'both', distance: 0.2, content: 'shared' },
+                { chunk_id: 'dense-only', distance: 0.4, content: 'semantic neighbour' },
+            ]),
+            getChunksForDocument,
+            createSparseEmbedding,
+            sparseSearch,
+            options: { sparseWeight: 0.5 },
+        });
+
+        const controller = new AbortController();
+        const response = await queryDocumentationToolHandler({ queryText: 'kubelet', productName: 'product', limit: 3, mode: 'sparse', format: 'json' }, { signal: controller.signal });
+        const results = JSON.parse(response.content[0].text).results;
+        // Both sides are normalized to [0, 1] first: both = 0.5 * 0 + 0.5 * 0.5.
+        expect(results.map((r: { chunk_id: string }) => r.chunk_id)).toEqual(['both', 'sparse-only', 'dense-only']);
+        expect(results[0].distance).toBeCloseTo(0.25);
+        expect(sparseSearch).toHaveBeenCalledWith({ kubelet: 1.3 }, '/tmp/db.db', expect.any(Object), 3);
+        expect(createSparseEmbedding.mock.calls[0][1]).toBeInstanceOf(AbortSignal);
+        expect(normalizeDistances([
+            { chunk_id: 'a', distance: 2, content: 'a' },
+            { chunk_id: 'b', distance: 6, content: 'b' },
+            { chunk_id: 'c', distance: 3, content: 'c' },
+        ]).map((row) => row.distance)).toEqual([0, 1, 0.25]);
+
+        const { queryDocumentationToolHandler: unconfigured } = createQueryHandlers({ createEmbeddings, resolveDbPath, queryCollection, getChunksForDocument });
+        const error = await unconfigured({ queryText: 'kubelet', productName: 'product', limit: 3, mode: 'sparse' });
+        expect(error.content[0].text).toContain('Sparse search is not configured');
+    });
+
+    it('returns structured results with score, product and version', async () => {
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [{ chunk_id: '1', distance: 0.25, content: 'Install it.', url: 'https://docs/install' }]),
+            getChunksForDocument,
+        });
+
+        const response = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', version: '1.2', limit: 1 });
+        expect(response.content[0].text).toContain('Result 1:');
+        expect((response as any).structuredContent).toEqual({
+            results: [{
+                chunk_id: '1',
+                distance: 0.25,
+                score: 0.8,
+                content: 'Install it.',
+                url: 'https://docs/install',
+                product: 'product',
+                version: '1.2',
+            }],
+        });
+
+        const invalid = await queryDocumentationToolHandler({ queryText: 'install', limit: 1 });
+        expect(invalid).not.toHaveProperty('structuredContent');
+    });
+
+    it('returns a packed context block when contextTokenBudget is set', async () => {
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [
+                { chunk_id: '1', distance: 0.1, content: 'Run the installer.', url: 'https://docs/install' },
+                { chunk_id: '2', distance: 0.2, content: 'x'.repeat(600) },
+            ]),
+            getChunksForDocument,
+        });
+
+        const response = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 2, contextTokenBudget: 50 });
+        const text = response.content[0].text;
+        expect(text).toContain('(1 of 2 snippets within 50 tokens)');
+        expect(text).toContain('[1]\nRun the installer.\n\nSources:\n[1]: https://docs/install');
+        expect(text).not.toContain('Result 1:');
+        expect((response as any).structuredContent.context).toContain('Run the installer.');
+
+        const json = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 2, contextTokenBudget: 50, format: 'json' });
+        const body = JSON.parse(json.content[0].text);
+        expect(body.results).toHaveLength(2);
+        expect(body.context).toContain('[1]: https://docs/install');
+    });
+
+    it('adds match offsets into the returned content when includeMatchOffset is set', async () => {
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [
+                { chunk_id: '1', distance: 0.1, content: '<p>Enable the <b>ingress</b> addon.</p>' },
+                { chunk_id: '2', distance: 0.2, content: 'Semantic neighbour without the term.' },
+            ]),
+            getChunksForDocument,
+        });
+
+        const response = await queryDocumentationToolHandler({ queryText: 'ingress', productName: 'product', limit: 2, contentFormat: 'markdown', includeMatchOffset: true, format: 'json' });
+        const [first, second] = JSON.parse(response.content[0].text).results;
+        expect(first.content).toBe('Enable the ingress addon.');
+        expect(first.match_offset).toBe(11);
+        expect(second).not.toHaveProperty('match_offset');
+
+        const plain = await queryDocumentationToolHandler({ queryText: 'ingress', productName: 'product', limit: 2, format: 'json' });
+        expect(JSON.parse(plain.content[0].text).results[0]).not.toHaveProperty('match_offset');
+    });
+
+    it('searches each requested version and groups the results by version', async () => {
+        const embed = vi.fn(async () => [0.1, 0.2]);
+        const search = vi.fn(async (_embedding: number[], _dbPath: string, filter: { version?: string }) => {
+            if (filter.version === '1.28') {
+                throw new Error('boom');
+            }
+            return filter.version === '1.30' ? [] : [{ chunk_id: `c-${filter.version}`, distance: 0.2, content: `docs for ${filter.version}` }];
+        });
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection: search,
+            getChunksForDocument,
+            options: { maxVersions: 3 },
+        });
+
+        const response = await queryDocumentationToolHandler({ queryText: 'pod security', productName: 'product', versions: ['1.29', '1.30', '1.28', '1.29'], limit: 2 });
+        const text = response.content[0].text;
+        expect(text).toContain('in product "product" (versions 1.29, 1.30, 1.28):');
+        expect(text).toContain('Version 1.29:\n\nResult 1:');
+        expect(text).toContain('Version 1.30:\n\nNo matches.');
+        expect(text).toContain('Failed: 1.28');
+        expect(embed).toHaveBeenCalledTimes(1);
+
+        const json = await queryDocumentationToolHandler({ queryText: 'pod security', productName: 'product', versions: ['1.29'], limit: 2, format: 'json' });
+        expect(JSON.parse(json.content[0].text).results[0]).toMatchObject({ chunk_id: 'c-1.29', version: '1.29' });
+
+        const tooMany = await queryDocumentationToolHandler({ queryText: 'pod security', productName: 'product', versions: ['1', '2', '3', '4'], limit: 2 });
+        expect(tooMany.content[0].text).toBe('Too many versions (4, maximum is 3).');
+        const mixed = await queryDocumentationToolHandler({ queryText: 'pod security', productName: 'product', version: '1.29', versions: ['1.30'], limit: 2 });
+        expect(mixed.content[0].text).toContain('versions cannot be combined with version');
+    });
+
+    it('widens the candidate fetch by candidateMultiplier within bounds', async () => {
+        const search = vi.fn(async () => []);
+        const { queryDocumentationToolHandler } = createQueryHandlers({ createEmbeddings, resolveDbPath, queryCollection: search, getChunksForDocument });
+
+        await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 4 });
+        await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 4, candidateMultiplier: 5 });
+        await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 4, uniqueUrls: true, candidateMultiplier: 2 });
+        expect(search.mock.calls.map((call) => call[3])).toEqual([4, 20, 12]);
+
+        const rejected = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 4, candidateMultiplier: 50 });
+        expect(rejected.content[0].text).toBe('candidateMultiplier must be between 1 and 10.');
+        expect(search).toHaveBeenCalledTimes(3);
+    });
+
+    it('applies metadata boosts after retrieval and rejects unknown boost columns', async () => {
+        const search = vi.fn(async () => [
+            { chunk_id: 'guide', distance: 0.2, content: 'a', doc_type: 'guide' },
+            { chunk_id: 'reference', distance: 0.4, content: 'b', doc_type: 'reference' },
+        ]);
+        const { queryDocumentationToolHandler } = createQueryHandlers({ createEmbeddings, resolveDbPath, queryCollection: search, getChunksForDocument });
+
+        const boosted = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, boosts: { 'doc_type=reference': 2 }, format: 'json' });
+        expect(search.mock.calls[0][3]).toBe(3);
+        expect(JSON.parse(boosted.content[0].text).results.map((result: { chunk_id: string }) => result.chunk_id)).toEqual(['reference']);
+
+        const unknown = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, boosts: { 'audience=admin': 2 } });
+        expect(unknown.content[0].text).toBe('Error querying documentation: Unknown boost column(s) "audience": not present in vec_items.');
+        expect((unknown as any)._meta).toEqual({ errorKind: 'invalid_request' });
+
+        const invalid = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, boosts: { 'doc_type=reference': 0 } });
+        expect(invalid.content[0].text).toBe('Boost multiplier for "doc_type=reference" must be between 0.1 and 10.');
+        expect(search).toHaveBeenCalledTimes(2);
+
+        // With the schema available, a column is known even when no candidate carries it.
+        const getColumns = vi.fn(async () => ['chunk_id', 'content', 'doc_type', 'audience']);
+        const withSchema = createQueryHandlers({ createEmbeddings, resolveDbPath, queryCollection: search, getChunksForDocument, getColumns });
+        const known = await withSchema.queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, boosts: { 'audience=admin': 2 }, format: 'json' });
+        expect(JSON.parse(known.content[0].text).results.map((result: { chunk_id: string }) => result.chunk_id)).toEqual(['guide']);
+        expect(getColumns).toHaveBeenCalledWith('/tmp/db.db');
+        const missing = await withSchema.queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, boosts: { 'tier=gold': 2 } });
+        expect(missing.content[0].text).toBe('Error querying documentation: Unknown boost column(s) "tier": not present in vec_items.');
+        expect(search).toHaveBeenCalledTimes(3);
+    });
+
+    it('returns only results inside a minDistance/maxDistance band', async () => {
+        const search = vi.fn(async () => [0.05, 0.2, 0.35, 0.6].map((distance, index) => ({ chunk_id: String(index), distance, content: `chunk ${index}` })));
+        const { queryDocumentationToolHandler } = createQueryHandlers({ createEmbeddings, resolveDbPath, queryCollection: search, getChunksForDocument });
+
+        const band = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 4, minDistance: 0.1, maxDistance: 0.5, format: 'json' });
+        expect(JSON.parse(band.content[0].text).results.map((result: { distance: number }) => result.distance)).toEqual([0.2, 0.35]);
+        expect(search.mock.calls[0][3]).toBe(12);
+
+        const invalid = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 4, minDistance: 0.5, maxDistance: 0.1 });
+        expect(invalid.content[0].text).toBe('minDistance (0.5) must not be greater than maxDistance (0.1).');
+        expect(search).toHaveBeenCalledTimes(1);
+    });
+
+    it('embeds with a per-query provider and checks its dimension against the product', async () => {
+        const embed = vi.fn(async (_text: string, provider?: string) => (provider === 'gemini' ? [0.1, 0.2, 0.3] : [0.1, 0.2]));
+        const search = vi.fn(async () => [{ distance: 0.1, content: 'Install guide' }]);
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection: search,
+            getChunksForDocument,
+            getStoredDimension: async () => 3,
+            options: { queryProviders: ['openai', 'gemini'] },
+        });
+
+        const selected = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, provider: 'gemini' });
+        expect(selected.content[0].text).toContain('Install guide');
+        expect(embed).toHaveBeenCalledWith('install', 'gemini');
+        expect(search.mock.calls[0][0]).toEqual([0.1, 0.2, 0.3]);
+
+        const mismatch = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, provider: 'openai' });
+        expect(mismatch.content[0].text).toBe('Error querying documentation: Provider "openai" produces 2-dimensional embeddings, but product "product" stores 3 dimensions.');
+
+        const disabled = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, provider: 'voyage' });
+        expect(disabled.content[0].text).toBe('Provider "voyage" is not enabled. Available providers: openai, gemini.');
+        expect(search).toHaveBeenCalledTimes(1);
+    });
+
+    it('reports the provider and model that embedded the query', async () => {
+        const vectors = new WeakMap<number[], { provider: string; model: string }>();
+        const embed = vi.fn(async () => {
+            const embedding = [0.1, 0.2];
+            vectors.set(embedding, { provider: 'openai', model: 'text-embedding-3-large' });
+            return embedding;
+        });
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [{ distance: 0.1, content: 'Install guide' }]),
+            getChunksForDocument,
+            describeEmbedding: (embedding) => vectors.get(embedding),
+        });
+        const source = { provider: 'openai', model: 'text-embedding-3-large' };
+
+        const json = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, format: 'json' });
+        expect(JSON.parse(json.content[0].text).embedding).toEqual(source);
+        expect(json.structuredContent).toMatchObject({ embedding: source });
+
+        const fanOut = await queryDocumentationToolHandler({ queryText: 'install', productName: 'a,b', limit: 1 });
+        expect(fanOut.structuredContent).toMatchObject({ embedding: source });
+        expect(fanOut.content[0].text).not.toContain('text-embedding-3-large');
+    });
+
+    it('uses configured messages in place of the built-in strings', async () => {
+        const search = vi.fn(async () => [{ distance: 0.2, content: 'Installez kagent' }]);
+        const messages = {
+            noResults: 'Aucun résultat pour "{query}" ({product} {version}).',
+            resultsHeader: '{count} résultat(s) pour "{query}" :',
+            distanceLabel: 'Écart',
+        };
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: search,
+            getChunksForDocument,
+            options: { messages },
+        });
+
+        const found = await queryDocumentationToolHandler({ queryText: 'installer', productName: 'kagent', limit: 1 });
+        expect(found.content[0].text).toBe('1 résultat(s) pour "installer" :\n\nResult 1:\n  Content: Installez kagent\n  Écart: 0.2000\n---');
+
+        search.mockResolvedValueOnce([]);
+        const empty = await queryDocumentationToolHandler({ queryText: 'installer', productName: 'kagent', version: '0.5', limit: 1 });
+        expect(empty.content[0].text).toBe('Aucun résultat pour "installer" (kagent 0.5).');
+    });
+
+    it('reports the total candidates left after filtering when requested', async () => {
+        const rows = (count: number) => Array.from({ length: count }, (_, index) => ({
+            chunk_id: String(index),
+            distance: index / 10,
+            content: `chunk ${index}`,
+            url: index % 2 === 0 ? 'https://docs.example.com/guide/a' : 'https://docs.example.com/blog/b',
+        }));
+        const search = vi.fn(async (_embedding: number[], _dbPath: string, _filter: unknown, topK?: number) => rows(Math.min(topK ?? 0, 7)));
+        const { queryDocumentationToolHandler } = createQueryHandlers({ createEmbeddings, resolveDbPath, queryCollection: search, getChunksForDocument });
+
+        const plain = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 2, urlPathPrefix: 'https://docs.example.com/guide/', includeTotalCandidates: true });
+        expect(search.mock.calls[0][3]).toBe(20);
+        expect(plain.content[0].text).toMatch(/Total candidates: 4$/);
+        expect(plain.structuredContent).toMatchObject({ totalCandidates: 4, totalCandidatesCapped: false });
+
+        const json = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, includeTotalCandidates: true, format: 'json' });
+        expect(JSON.parse(json.content[0].text)).toMatchObject({ totalCandidates: 7, totalCandidatesCapped: false });
+
+        search.mockImplementationOnce(async (_embedding, _dbPath, _filter, topK) => rows(topK ?? 0));
+        const capped = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 1, includeTotalCandidates: true });
+        expect(capped.content[0].text).toMatch(/Total candidates: at least 10$/);
+
+        const untouched = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 2 });
+        expect(untouched.content[0].text).not.toContain('Total candidates');
+        expect(search.mock.calls[search.mock.calls.length - 1][3]).toBe(2);
+    });
+
+    it('moves exact query matches to the top when boostExactTitleMatch is set', async () => {
+        const search = vi.fn(async () => [
+            { chunk_id: '1', distance: 0.1, content: 'fuzzy neighbour' },
+            { chunk_id: '2', distance: 0.2, content: 'unrelated', section: 'Pod Disruption Budget' },
+            { chunk_id: '3', distance: 0.3, content: 'Configure a pod disruption budget first' },
+        ]);
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: search,
+            getChunksForDocument,
+        });
+
+        const boosted = await queryDocumentationToolHandler({ queryText: 'pod disruption budget', productName: 'product', limit: 3, boostExactTitleMatch: true, format: 'json' });
+        expect(JSON.parse(boosted.content[0].text).results.map((r: { chunk_id: string }) => r.chunk_id)).toEqual(['2', '3', '1']);
+        expect(search.mock.calls[0][3]).toBe(9);
+
+        const plain = await queryDocumentationToolHandler({ queryText: 'pod disruption budget', productName: 'product', limit: 3, format: 'json' });
+        expect(JSON.parse(plain.content[0].text).results.map((r: { chunk_id: string }) => r.chunk_id)).toEqual(['1', '2', '3']);
+    });
+
+    it('passes excludeChunkIds to the search and caps the exclusion list', async () => {
+        const search = vi.fn(async () => [
+            { chunk_id: '1', distance: 0.1, content: 'seen' },
+            { chunk_id: '2', distance: 0.2, content: 'new' },
+        ]);
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: search,
+            getChunksForDocument,
+            options: { maxExcludeChunkIds: 2 },
+        });
+
+        const response = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 2, excludeChunkIds: ['1'], format: 'json' });
+        expect(search.mock.calls[0][2]).toMatchObject({ excludeChunkIds: ['1'] });
+        expect(JSON.parse(response.content[0].text).results.map((r: { chunk_id: string }) => r.chunk_id)).toEqual(['2']);
+
+        const tooMany = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 2, excludeChunkIds: ['1', '2', '3'] });
+        expect(tooMany.content[0].text).toContain('Too many excluded chunk IDs (3, maximum is 2)');
+    });
+
+    it('includes the SQLite rowid in JSON results only when includeRowid is set', async () => {
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [
+                { chunk_id: '1', rowid: 42, distance: 0.1, content: 'a' },
+                { chunk_id: '2', id: BigInt(7), distance: 0.2, content: 'b' },
+                { chunk_id: '3', distance: 0.3, content: 'c' },
+            ]),
+            getChunksForDocument,
+        });
+
+        const withRowid = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 3, includeRowid: true, format: 'json' });
+        expect(JSON.parse(withRowid.content[0].text).results.map((r: { rowid?: number }) => r.rowid)).toEqual([42, 7, undefined]);
+
+        const withoutRowid = await queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 3, format: 'json' });
+        expect(withoutRowid.content[0].text).not.toContain('rowid');
+    });
+
+    it('answers keyword mode with BM25 results without embedding the query', async () => {
+        const embed = vi.fn(async () => [0.1]);
+        const keywordSearch = vi.fn(async () => [
+            { chunk_id: '1', distance: -4.2, score_type: 'bm25', content: 'helm install', url: 'https://docs.example.com/a' },
+        ]);
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => []),
+            getChunksForDocument,
+            keywordSearch,
+            getDistanceThreshold: () => 0.5,
+        });
+
+        const response = await queryDocumentationToolHandler({ queryText: 'helm install', productName: 'product', limit: 4, mode: 'keyword' });
+        expect(embed).not.toHaveBeenCalled();
+        expect(keywordSearch).toHaveBeenCalledWith('helm install', '/tmp/db.db', expect.objectContaining({ product_name: 'product' }), 4);
+        expect(response.content[0].text).toContain('BM25 score: -4.2000');
+        expect(buildFtsMatchExpression('helm "install" -- helm')).toBe('"helm" OR "install"');
+    });
+
+    it('refines a previous query with feedback and skips previously seen chunks', async () => {
+        const embed = vi.fn(async () => [0.1]);
+        const { refineQueryToolHandler } = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [
+                { chunk_id: 'seen', distance: 0.1, content: 'already shown' },
+                { chunk_id: 'new', distance: 0.2, content: 'service mesh networking' },
+            ]),
+            getChunksForDocument,
+        });
+
+        const response = await refineQueryToolHandler({
+            previousQuery: 'install istio',
+            feedback: 'more about networking',
+            productName: 'istio',
+            limit: 1,
+            previousChunkIds: ['seen'],
+        });
+        expect(embed).toHaveBeenCalledWith('more about networking. install istio');
+        expect(response.content[0].text).toContain('Refined query: "more about networking. install istio"');
+        expect(response.content[0].text).toContain('service mesh networking');
+        expect(response.content[0].text).not.toContain('already shown');
+    });
+
+    it('fans out a comma-separated productName and merges results by distance', async () => {
+        const embed = vi.fn(async () => [0.1]);
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath: vi.fn((_dbName?: string, productName?: string) => ({ dbPath: `/tmp/${productName}.db`, dbLabel: `${productName}.db` })),
+            queryCollection: vi.fn(async (_embedding: number[], dbPath: string) => {
+                if (dbPath === '/tmp/broken.db') {
+                    throw new Error('boom');
+                }
+                return dbPath === '/tmp/istio.db'
+                    ? [{ chunk_id: 'i1', distance: 0.1, content: 'istio result' }]
+                    : [{ chunk_id: 'k1', distance: 0.3, content: 'kubernetes result' }];
+            }),
+            getChunksForDocument,
+        });
+
+        const response = await queryDocumentationToolHandler({ queryText: 'sidecar', productName: 'kubernetes, istio,broken', limit: 2 });
+        const text = response.content[0].text;
+        expect(embed).toHaveBeenCalledTimes(1);
+        expect(text).toContain('in products "kubernetes", "istio", "broken"');
+        expect(text.indexOf('istio result')).toBeLessThan(text.indexOf('kubernetes result'));
+        expect(text).toContain('Product: istio');
+        expect(text).toContain('Failed: broken');
+
+        const invalid = await queryDocumentationToolHandler({ queryText: 'sidecar', productName: 'kubernetes,../etc', limit: 2 });
+        expect(invalid.content[0].text).toContain('Invalid product name(s)');
+    });
+
+    it('merges a multi-product query in the order each product ranked its results', async () => {
+        const search = (rows: Record<string, Record<string, unknown>[]>) => vi.fn(async (...args: unknown[]) => {
+            const dbPath = args.find((arg) => typeof arg === 'string' && arg.startsWith('/tmp/')) as string;
+            return rows[dbPath];
+        });
+        const resolveByProduct = vi.fn((_dbName?: string, productName?: string) => ({ dbPath: `/tmp/${productName}.db`, dbLabel: `${productName}.db` }));
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath: resolveByProduct,
+            queryCollection: search({
+                '/tmp/istio.db': [{ chunk_id: 'i1', distance: 0.1, content: 'mesh traffic', doc_type: 'guide' }],
+                '/tmp/kubernetes.db': [{ chunk_id: 'k1', distance: 0.3, content: 'configure sidecar injection', doc_type: 'reference' }],
+            }),
+            keywordSearch: search({
+                '/tmp/istio.db': [{ chunk_id: 'i1', distance: -2, score_type: 'bm25', content: 'sidecar' }],
+                '/tmp/kubernetes.db': [{ chunk_id: 'k1', distance: -8, score_type: 'bm25', content: 'sidecar injection' }],
+            }),
+            getChunksForDocument,
+        });
+
+        const chunkIds = (response: { content: { text: string }[] }) =>
+            JSON.parse(response.content[0].text).results.map((r: { chunk_id: string }) => r.chunk_id);
+        const exact = await queryDocumentationToolHandler({ queryText: 'sidecar injection', productName: 'istio,kubernetes', limit: 2, boostExactTitleMatch: true, format: 'json' });
+        expect(chunkIds(exact)).toEqual(['k1', 'i1']);
+        const keyword = await queryDocumentationToolHandler({ queryText: 'sidecar', productName: 'istio,kubernetes', limit: 2, mode: 'keyword', format: 'json' });
+        expect(chunkIds(keyword)).toEqual(['k1', 'i1']);
+        const boosted = await queryDocumentationToolHandler({ queryText: 'mesh', productName: 'istio,kubernetes', limit: 2, boosts: { 'doc_type=reference': 3 }, format: 'json' });
+        expect(chunkIds(boosted)).toEqual(['k1', 'i1']);
+    });
+
+    it('merges results across products and reports products past the deadline', async () => {
+        const { queryAllProducts } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath: vi.fn((_dbName?: string, productName?: string) => ({ dbPath: `/tmp/${productName}.db`, dbLabel: `${productName}.db` })),
+            queryCollection: vi.fn(async (_embedding: number[], dbPath: string) => {
+                if (dbPath === '/tmp/slow.db') {
+                    await new Promise((resolve) => setTimeout(resolve, 200));
+                }
+                return [{ chunk_id: dbPath, distance: dbPath === '/tmp/b.db' ? 0.1 : 0.3, content: dbPath }];
+            }),
+            getChunksForDocument,
+            listProducts: () => ['a', 'b', 'slow'],
+        });
+
+        const { results, timedOutProducts, failedProducts } = await queryAllProducts('test', undefined, 4, 50);
+        expect(results.map((r) => r.product)).toEqual(['b', 'a']);
+        expect(timedOutProducts).toEqual(['slow']);
+        expect(failedProducts).toEqual([]);
+    });
+
+    it('compares the best distance of two products', async () => {
+        const { compareProductsToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath: vi.fn((_dbName?: string, productName?: string) => ({ dbPath: `/tmp/${productName}.db`, dbLabel: `${productName}.db` })),
+            queryCollection: vi.fn(async (_embedding: number[], dbPath: string) =>
+                dbPath === '/tmp/istio.db' ? [] : [{ chunk_id: '1', distance: 0.25, content: 'ok', url: 'https://k8s.example.com' }]
+            ),
+            getChunksForDocument,
+        });
+
+        const response = await compareProductsToolHandler({ queryText: 'pods', productA: 'kubernetes', productB: 'istio' });
+        const text = response.content[0].text;
+        expect(text).toContain('kubernetes: best distance 0.2500');
+        expect(text).toContain('istio: no matching documentation');
+        expect(text).toContain('Only kubernetes has documentation');
+    });
+
+    it('lists products up to the cap and validates them on request', async () => {
+        const testConnection = vi.fn(async (dbPath: string) => {
+            if (dbPath === '/tmp/broken.db') {
+                throw new Error('no vec_items table');
+            }
+        });
+        const { listProductsToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath: vi.fn((_dbName?: string, productName?: string) => ({ dbPath: `/tmp/${productName}.db`, dbLabel: `${productName}.db` })),
+            queryCollection,
+            getChunksForDocument,
+            listProducts: () => ['broken', 'istio', 'kubernetes'],
+            testConnection,
+            options: { listProductsLimit: 2 },
+        });
+
+        const fast = await listProductsToolHandler({});
+        expect(fast.content[0].text).toBe('Available products:\n- broken\n- istio\n\nShowing the first 2 of 3 products.');
+        expect(testConnection).not.toHaveBeenCalled();
+
+        const validated = await listProductsToolHandler({ validate: true, limit: 5 });
+        expect(validated.content[0].text).toContain('- broken (unavailable: no vec_items table)');
+        expect(validated.content[0].text).toContain('- istio (ok)');
+        expect(validated.content[0].text).not.toContain('kubernetes');
+    });
+
+    it('returns the embedding and its dimension from embed_text', async () => {
+        const embed = vi.fn(async () => [0.5, -0.25, 1]);
+        const { embedTextToolHandler } = createQueryHandlers({ createEmbeddings: embed, resolveDbPath, queryCollection, getChunksForDocument });
+
+        const response = await embedTextToolHandler({ text: '  pod autoscaling ' });
+        expect(JSON.parse(response.content[0].text)).toEqual({ dimension: 3, embedding: [0.5, -0.25, 1] });
+        expect(embed).toHaveBeenCalledWith('pod autoscaling');
+
+        const empty = await embedTextToolHandler({ text: '   ' });
+        expect(empty.content[0].text).toContain('Query text is too short');
+    });
+
+    it('ranks products by their best distance for route_query', async () => {
+        const queryCollection = vi.fn(async (_embedding: number[], dbPath: string) => {
+            if (dbPath === '/tmp/broken.db') {
+                throw new Error('boom');
+            }
+            if (dbPath === '/tmp/empty.db') {
+                return [];
+            }
+            return [{ chunk_id: '1', distance: dbPath === '/tmp/istio.db' ? 0.1 : 0.4, content: 'ok' }];
+        });
+        const embed = vi.fn(async () => [0.1, 0.2]);
+        const { routeQueryToolHandler } = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath: vi.fn((_dbName?: string, productName?: string) => ({ dbPath: `/tmp/${productName}.db`, dbLabel: `${productName}.db` })),
+            queryCollection,
+            getChunksForDocument,
+            listProducts: () => ['kubernetes', 'istio', 'empty', 'broken'],
+        });
+
+        const response = await routeQueryToolHandler({ queryText: 'sidecar injection', limit: 3 });
+        const text = response.content[0].text;
+        expect(text).toContain('1. istio: best distance 0.1000');
+        expect(text).toContain('2. kubernetes: best distance 0.4000');
+        expect(text).toContain('No matches: empty');
+        expect(text).toContain('Failed: broken');
+        expect(embed).toHaveBeenCalledTimes(1);
+        expect(queryCollection.mock.calls.every((call) => call[3] === 1)).toBe(true);
+
+        const subset = await routeQueryToolHandler({ queryText: 'sidecar injection', limit: 1, products: ['kubernetes'] });
+        expect(subset.content[0].text).toContain('1. kubernetes');
+        expect(subset.content[0].text).not.toContain('istio');
+
+        queryCollection.mockClear();
+        const invalid = await routeQueryToolHandler({ queryText: 'sidecar injection', limit: 1, products: ['kubernetes', '../etc'] });
+        expect(invalid.content[0].text).toContain('Invalid product name(s)');
+        expect((invalid as any)._meta).toEqual({ errorKind: 'invalid_request' });
+        expect(queryCollection).not.toHaveBeenCalled();
+    });
+
+    it('leaves products below the similarity floor out of route_query', async () => {
+        const { routeQueryToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath: vi.fn((_dbName?: string, productName?: string) => ({ dbPath: `/tmp/${productName}.db`, dbLabel: `${productName}.db` })),
+            queryCollection: vi.fn(async (_embedding: number[], dbPath: string) => [
+                { chunk_id: '1', distance: dbPath === '/tmp/istio.db' ? 0.1 : 0.4, content: 'ok' },
+            ]),
+            getChunksForDocument,
+            listProducts: () => ['kubernetes', 'istio'],
+            options: { routeMinSimilarity: 0.8 },
+        });
+
+        const floored = await routeQueryToolHandler({ queryText: 'sidecar injection', limit: 3 });
+        expect(floored.content[0].text).toContain('1. istio');
+        expect(floored.content[0].text).not.toContain('2. kubernetes');
+        expect(floored.content[0].text).toContain('Below similarity floor 0.8: kubernetes');
+
+        const none = await routeQueryToolHandler({ queryText: 'sidecar injection', limit: 3, minSimilarity: 0.95 });
+        expect(none.content[0].text).toContain('No suitable product for "sidecar injection"');
+        expect(none.content[0].text).toContain('Below similarity floor 0.95: kubernetes, istio');
+
+        expect(distanceToSimilarity(0)).toBe(1);
+        expect(distanceToSimilarity(1)).toBe(0.5);
+    });
+
+    it('detects the product for query_documentation when none is named', async () => {
+        const embed = vi.fn(async () => [0.1, 0.2]);
+        const queryCollection = vi.fn(async (_embedding: number[], dbPath: string) => [
+            { chunk_id: '1', distance: dbPath === '/tmp/istio.db' ? 0.1 : 0.4, content: 'ok' },
+        ]);
+        const handlers = (options: Record<string, unknown>) => createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath: vi.fn((_dbName?: string, productName?: string) => ({ dbPath: `/tmp/${productName}.db`, dbLabel: `${productName}.db` })),
+            queryCollection,
+            getChunksForDocument,
+            listProducts: () => ['kubernetes', 'istio'],
+            options,
+        }).queryDocumentationToolHandler;
+
+        const detected = await handlers({ autoDetectProduct: true })({ queryText: 'sidecar injection', limit: 2 });
+        expect(detected.content[0].text).toContain('in product "istio"');
+        expect(detected.content[0].text).toContain('Product "istio" was selected automatically (similarity 0.9091)');
+        expect((detected as any).structuredContent.autoSelectedProduct).toEqual({ product: 'istio', similarity: 1 / 1.1 });
+        expect(embed).toHaveBeenCalledTimes(1);
+        expect(queryCollection.mock.calls.at(-1)?.[1]).toBe('/tmp/istio.db');
+
+        const json = await handlers({ autoDetectProduct: true })({ queryText: 'sidecar injection', limit: 2, format: 'json' });
+        expect(JSON.parse(json.content[0].text).autoSelectedProduct.product).toBe('istio');
+
+        const unsure = await handlers({ autoDetectProduct: true, autoDetectMinSimilarity: 0.95 })({ queryText: 'sidecar injection', limit: 2 });
+        expect(unsure.content[0].text).toBe('Could not detect a product for "sidecar injection" with enough confidence (best match "istio" has similarity 0.9091, below 0.95). Provide productName or dbName.');
+
+        const tooMany = await handlers({ autoDetectProduct: true, autoDetectMaxProducts: 1 })({ queryText: 'sidecar injection', limit: 2 });
+        expect(tooMany.content[0].text).toBe('Automatic product detection is limited to 1 products (2 available). Provide productName or dbName.');
+
+        const disabled = await handlers({})({ queryText: 'sidecar injection', limit: 2 });
+        expect(disabled.content[0].text).toBe('Provide either productName or dbName for query_documentation.');
+    });
+
+    it('labels products and applies manifest default versions in every handler', async () => {
+        const manifest: Record<string, { name: string; db: string; defaultVersion?: string; displayName?: string }> = {
+            kubernetes: { name: 'kubernetes', db: 'k8s.db', defaultVersion: '1.30', displayName: 'Kubernetes' },
+            istio: { name: 'istio', db: 'istio.db' },
+        };
+        const queryCollection = vi.fn(async () => [{ chunk_id: '1', distance: 0.2, content: 'ok' }]);
+        const getChunksForDocument = vi.fn(async () => []);
+        const getChunksByIds = vi.fn(async () => []);
+        const { listProductsToolHandler, routeQueryToolHandler, queryDocumentationToolHandler, queryAllProductsToolHandler, getChunksToolHandler, getChunksByIdsToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath: vi.fn((_dbName?: string, productName?: string) => ({ dbPath: `/tmp/${productName}.db`, dbLabel: `${productName}.db` })),
+            queryCollection,
+            getChunksForDocument,
+            getChunksByIds,
+            listProducts: () => ['kubernetes', 'istio'],
+            getProductInfo: (product) => manifest[product],
+        });
+
+        const listing = await listProductsToolHandler({});
+        expect(listing.content[0].text).toBe('Available products:\n- kubernetes: Kubernetes [default version 1.30]\n- istio');
+
+        await routeQueryToolHandler({ queryText: 'pod scheduling', limit: 2 });
+        expect(queryCollection).toHaveBeenCalledWith(expect.any(Array), '/tmp/kubernetes.db', { product_name: 'kubernetes', version: '1.30' }, 1);
+        expect(queryCollection).toHaveBeenCalledWith(expect.any(Array), '/tmp/istio.db', { product_name: 'istio', version: undefined }, 1);
+
+        queryCollection.mockClear();
+        await routeQueryToolHandler({ queryText: 'pod scheduling', version: '1.29', limit: 2, products: ['kubernetes'] });
+        expect(queryCollection).toHaveBeenCalledWith(expect.any(Array), '/tmp/kubernetes.db', { product_name: 'kubernetes', version: '1.29' }, 1);
+
+        queryCollection.mockClear();
+        await queryDocumentationToolHandler({ queryText: 'pod scheduling', productName: 'kubernetes', limit: 4 });
+        expect((queryCollection.mock.calls[0] as unknown[])[2]).toMatchObject({ version: '1.30' });
+        await queryDocumentationToolHandler({ queryText: 'pod scheduling', productName: 'kubernetes', version: '1.29', limit: 4 });
+        expect((queryCollection.mock.calls[1] as unknown[])[2]).toMatchObject({ version: '1.29' });
+
+        queryCollection.mockClear();
+        await queryAllProductsToolHandler({ queryText: 'pod scheduling', limit: 4 });
+        expect(queryCollection).toHaveBeenCalledWith(expect.any(Array), '/tmp/kubernetes.db', { version: '1.30' }, 4);
+        expect(queryCollection).toHaveBeenCalledWith(expect.any(Array), '/tmp/istio.db', { version: undefined }, 4);
+
+        await getChunksToolHandler({ productName: 'kubernetes', filePath: 'https://kubernetes.io/docs/a' });
+        expect((getChunksForDocument.mock.calls[0] as unknown[])[5]).toBe('1.30');
+        await getChunksToolHandler({ dbName: 'k8s', filePath: 'https://kubernetes.io/docs/a' });
+        expect((getChunksForDocument.mock.calls[1] as unknown[])[5]).toBeUndefined();
+        await getChunksByIdsToolHandler({ productName: 'kubernetes', chunkIds: ['1'] });
+        expect((getChunksByIds.mock.calls[0] as unknown[])[3]).toBe('1.30');
+    });
+
+    it('returns empty-content warning for query_code when all matches are empty', async () => {
+        const { queryCodeToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [
+                { chunk_id: '1', distance: 0.1, content: '' },
+                { chunk_id: '2', distance: 0.2, content: '  ' },
+            ]),
+            getChunksForDocument,
+        });
+
+        const response = await queryCodeToolHandler({
+            queryText: 'test',
+            dbName: 'repo',
+            limit: 3,
+        });
+
+        expect(response.content[0].text).toContain('all matching chunks have empty content');
+    });
+
+    it('formats get_chunks results with chunk index', async () => {
+        const { getChunksToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument: vi.fn(async () => [
+                {
+                    chunk_id: '1',
+                    distance: 0,
+                    content: 'chunk content',
+                    url: 'file://doc',
+                    chunk_index: 0,
+                    total_chunks: 2,
+                },
+            ]),
+        });
+
+        const response = await getChunksToolHandler({
+            productName: 'product',
+            filePath: 'file://doc',
+        });
+
+        expect(response.content[0].text).toContain('Chunk 1 of 2');
+    });
+
+    it('redacts configured patterns from returned content', async () => {
+        const content = 'Call 555-12-3456 and use Secret-Token abc.';
+        const { queryDocumentationToolHandler, getChunksToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => [{ chunk_id: '1', distance: 0.1, content, url: 'https://docs/a' }]),
+            getChunksForDocument: vi.fn(async () => [{ chunk_id: '1', distance: 0, content, chunk_index: 0, total_chunks: 1 }]),
+            options: { redactPatterns: parseRedactPatterns(JSON.stringify(['\\b\\d{3}-\\d{2}-\\d{4}\\b', '/secret-token/i'])) },
+        });
+
+        const response = await queryDocumentationToolHandler({ queryText: 'phone', productName: 'product', limit: 1, format: 'json' });
+        expect(JSON.parse(response.content[0].text).results[0].content).toBe('Call [REDACTED] and use [REDACTED] abc.');
+        expect(JSON.stringify((response as any).structuredContent)).not.toContain('555-12-3456');
+
+        const chunks = await getChunksToolHandler({ productName: 'product', filePath: 'https://docs/a' });
+        expect(chunks.content[0].text).toContain('Content: Call [REDACTED] and use [REDACTED] abc.');
+
+        expect(parseRedactPatterns(undefined)).toEqual([]);
+        expect(() => parseRedactPatterns('"secret"')).toThrow('must be a JSON array');
+        expect(() => parseRedactPatterns('["(unclosed"]')).toThrow("Invalid pattern '(unclosed'");
+        expect(() => parseRedactPatterns('["a*"]')).toThrow('matches the empty string');
+    });
+
+    it('returns the cosine similarity of two texts', async () => {
+        const vectors: Record<string, number[]> = { cat: [1, 0], kitten: [3, 4], dog: [0, 2] };
+        const { textSimilarityToolHandler } = createQueryHandlers({
+            createEmbeddings: vi.fn(async (text: string) => vectors[text]),
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument,
+            describeEmbedding: () => ({ provider: 'openai', model: 'text-embedding-3-small' }),
+        });
+
+        const similar = await textSimilarityToolHandler({ textA: 'cat', textB: 'kitten' });
+        expect(JSON.parse(similar.content[0].text)).toEqual({
+            similarity: 0.6,
+            dimension: 2,
+            embedding: { provider: 'openai', model: 'text-embedding-3-small' },
+        });
+        const unrelated = await textSimilarityToolHandler({ textA: 'cat', textB: 'dog' });
+        expect(JSON.parse(unrelated.content[0].text).similarity).toBe(0);
+
+        const tooShort = await textSimilarityToolHandler({ textA: 'cat', textB: ' ' });
+        expect(tooShort.content[0].text).not.toContain('similarity');
+        expect(() => cosineSimilarity([1, 0], [1, 0, 0])).toThrow('Cannot compare a 2-dimensional embedding with a 3-dimensional one.');
+    });
+
+    it('embeds both text_similarity texts in one batch when the provider supports it', async () => {
+        const vectors: Record<string, number[]> = { cat: [1, 0], kitten: [3, 4] };
+        const createEmbeddingsMock = vi.fn(async (text: string) => vectors[text]);
+        const createEmbeddingsBatch = vi.fn(async (texts: string[]) => texts.map((text) => vectors[text]));
+        const { textSimilarityToolHandler } = createQueryHandlers({
+            createEmbeddings: createEmbeddingsMock,
+            createEmbeddingsBatch,
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument,
+        });
+
+        const result = await textSimilarityToolHandler({ textA: 'cat', textB: 'kitten' });
+        expect(JSON.parse(result.content[0].text).similarity).toBe(0.6);
+        expect(createEmbeddingsBatch).toHaveBeenCalledTimes(1);
+        expect(createEmbeddingsBatch.mock.calls[0][0]).toEqual(['cat', 'kitten']);
+        expect(createEmbeddingsMock).not.toHaveBeenCalled();
+    });
+
+    it('aborts the in-flight embedding request when the call is cancelled or times out', async () => {
+        const signals: Array<AbortSignal | undefined> = [];
+        const embed = vi.fn((_text: string, _provider?: string, signal?: AbortSignal) => {
+            signals.push(signal);
+            return new Promise<number[]>((_resolve, reject) => {
+                signal?.addEventListener('abort', () => reject(new Error('Request was aborted.')));
+            });
+        });
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument,
+        });
+
+        const controller = new AbortController();
+        const pending = queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 2 }, { signal: controller.signal });
+        await vi.waitFor(() => expect(embed).toHaveBeenCalledTimes(1));
+        expect(signals[0]?.aborted).toBe(false);
+        controller.abort();
+        const cancelled = await pending;
+        expect(signals[0]?.aborted).toBe(true);
+        expect(cancelled.content[0].text).toBe('Error querying documentation: Request was aborted.');
+
+        const timed = createQueryHandlers({
+            createEmbeddings: embed,
+            resolveDbPath,
+            queryCollection,
+            getChunksForDocument,
+            options: { requestTimeoutMs: 20 },
+        });
+        const timedOut = await timed.queryDocumentationToolHandler({ queryText: 'install', productName: 'product', limit: 2 });
+        expect(signals[1]?.aborted).toBe(true);
+        expect(timedOut.content[0].text).toBe('Error querying documentation: Request was aborted.');
+    });
+
+    it('re-ranks candidates by a composite score and explains its signals', async () => {
+        const now = Date.now();
+        const collection = vi.fn(async () => [
+            { chunk_id: 'old', distance: 0.2, content: 'Pod scheduling basics.', updated_at: new Date(now - 720 * 86_400_000).toISOString() },
+            { chunk_id: 'new', distance: 0.3, content: 'Pod scheduling with taints.', updated_at: Math.floor(now / 1000) },
+            { chunk_id: 'far', distance: 0.9, content: 'Unrelated text.' },
+        ]);
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: collection,
+            getChunksForDocument,
+            options: { compositeWeights: parseCompositeWeights('vector:0.5,keyword:0.2,recency:0.3'), recencyColumn: 'updated_at', recencyHalfLifeDays: 180 },
+        });
+
+        const response = await queryDocumentationToolHandler({ queryText: 'pod taints', productName: 'product', limit: 2, ranking: 'composite', explain: true, format: 'json' });
+        const { results } = JSON.parse(response.content[0].text);
+        expect(collection.mock.calls[0][3]).toBe(6);
+        expect(results.map((result: { chunk_id: string }) => result.chunk_id)).toEqual(['new', 'old']);
+        expect(results[0].composite.keyword).toBe(1);
+        expect(results[0].composite.recency).toBeCloseTo(1, 3);
+        expect(results[1].composite.keyword).toBe(0.5);
+        expect(results[0].composite_score).toBeCloseTo(0.5 / 1.3 + 0.2 + 0.3, 3);
+
+        const plain = await queryDocumentationToolHandler({ queryText: 'pod taints', productName: 'product', limit: 1, ranking: 'composite', explain: true });
+        expect(plain.content[0].text).toMatch(/Composite: 0\.\d{4} \(vector 0\.7692, keyword 1\.0000, recency 1\.0000\)/);
+
+        const rejected = await queryDocumentationToolHandler({ queryText: 'pod', productName: 'product', limit: 2, ranking: 'composite', mode: 'keyword' });
+        expect(rejected.content[0].text).toContain("ranking 'composite' cannot be combined");
+
+        expect(parseCompositeWeights(undefined)).toEqual({ vector: 0.8, keyword: 0.2, recency: 0 });
+        expect(parseCompositeWeights('keyword:1')).toEqual({ vector: 0, keyword: 1, recency: 0 });
+        expect(() => parseCompositeWeights('freshness:1')).toThrow("Invalid signal 'freshness'");
+        expect(() => parseCompositeWeights('vector:0')).toThrow('at least one signal');
+        expect(recencyScore('2024-01-01T00:00:00Z', 30, Date.parse('2024-01-31T00:00:00Z'))).toBeCloseTo(0.5, 5);
+        expect(recencyScore(undefined, 30)).toBe(0);
+    });
+
+    it('suggests the closest product when a database is not found', async () => {
+        const { queryDocumentationToolHandler } = createQueryHandlers({
+            createEmbeddings,
+            resolveDbPath,
+            queryCollection: vi.fn(async () => {
+                throw new Error('Database file not found at /tmp/kubernets.db');
+            }),
+            getChunksForDocument,
+            listProducts: () => ['istio', 'kubernetes'],
+        });
+
+        const response = await queryDocumentationToolHandler({ queryText: 'pods', productName: 'kubernets', limit: 1 });
+        expect(response.content[0].text).toBe("Error querying documentation: Database file not found at /tmp/kubernets.db Did you mean 'kubernetes'?");
+
+        expect(suggestProductName('Istoi', ['istio', 'kubernetes'])).toBe('istio');
+        expect(suggestProductName('helm', ['istio', 'kubernetes'])).toBeUndefined();
+        expect(suggestProductName('ab', ['istio', 'xy'])).toBeUndefined();
+        expect(suggestProductName('istio', ['istio', 'istic'])).toBeUndefined();
+    });
+});
+
+describe('SQLite provider compatibility', () => {
+    it('falls back when chunk_index column is missing', async () => {
+        const sqliteVec = { load: vi.fn() };
+        const fs = { existsSync: vi.fn(() => true) };
+
+        class FakeDb {
+            prepare(query: string) {
+                if (query.includes('chunk_index')) {
+                    return {
+                        all: () => {
+                            throw new Error('no such column: chunk_index');
+                        },
+                    };
+                }
+                return {
+                    all: () => [
+                        {
+                            chunk_id: '1',
+                            content: 'ok',
+                            url: 'file://doc',
+                            section: 's',
+                            heading_hierarchy: 'h',
+                        },
+                    ],
+                };
+            }
+
+            close() {
+                return undefined;
+            }
+        }
+
+        const { getChunksForDocument } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec,
+            Database: FakeDb,
+            fs,
+            path,
+        });
+
+        const results = await getChunksForDocument('product', undefined, 'file://doc', 0, 1, '1.0');
+        expect(results).toHaveLength(1);
+        expect(results[0].content).toBe('ok');
+    });
+
+    it('tests connectivity by opening the database and checking for vec_items', async () => {
+        const sqliteVec = { load: vi.fn() };
+        const fs = { existsSync: vi.fn((file: string) => file !== '/data/missing.db') };
+        class FakeDb {
+            constructor(private dbPath: string) {}
+            prepare() {
+                return {
+                    all: () => (this.dbPath === '/data/empty.db' ? [] : [{ sql: 'CREATE VIRTUAL TABLE vec_items USING vec0(embedding FLOAT[3])' }]),
+                };
+            }
+            close() {
+                return undefined;
+            }
+        }
+
+        const { testConnection } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec,
+            Database: FakeDb as any,
+            fs,
+            path,
+        });
+
+        await expect(testConnection('/data/a.db')).resolves.toBeUndefined();
+        await expect(testConnection('/data/empty.db')).rejects.toThrow('no vec_items table');
+        await expect(testConnection('/data/missing.db')).rejects.toThrow('Database file not found');
+    });
+
+    it('reports corrupt databases as DB_CORRUPT and leaves them out of listings', async () => {
+        const error = vi.spyOn(console, 'error').mockImplementation(() => undefined);
+        const renameSync = vi.fn();
+        class FakeDb {
+            constructor(private dbPath: string) {}
+            prepare(sql: string) {
+                return {
+                    all: () => {
+                        if (this.dbPath === '/data/bad.db') {
+                            throw Object.assign(new Error('file is not a database'), { code: 'SQLITE_NOTADB' });
+                        }
+                        if (sql.startsWith('PRAGMA quick_check')) {
+                            return [{ quick_check: this.dbPath === '/data/torn.db' ? '*** in database main ***\nPage 7: btreeInitPage() returns error code 11' : 'ok' }];
+                        }
+                        if (this.dbPath === '/data/flaky.db') {
+                            throw Object.assign(new Error('database disk image is malformed'), { code: 'SQLITE_CORRUPT' });
+                        }
+                        return sql.includes('sqlite_master')
+                            ? [{ sql: 'CREATE VIRTUAL TABLE vec_items USING vec0(embedding FLOAT[3])' }]
+                            : [{ chunk_id: '1', distance: 0.1, content: 'ok' }];
+                    },
+                };
+            }
+            close() {
+                return undefined;
+            }
+        }
+
+        const { queryCollection, testConnection, exportChunks, listDatabaseNames, rescanDatabases } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec: { load: vi.fn() },
+            Database: FakeDb as any,
+            fs: { existsSync: vi.fn(() => true), readdirSync: vi.fn(() => ['good.db', 'bad.db', 'torn.db', 'flaky.db']), renameSync },
+            path,
+            integrityCheck: true,
+            quarantineCorrupt: true,
+        });
+
+        expect(listDatabaseNames()).toEqual(['bad', 'flaky', 'good', 'torn']);
+        await expect(queryCollection([0.1], '/data/bad.db', {}, 4)).rejects.toThrow('Database query failed: DB_CORRUPT: bad.db is corrupt (file is not a database). Re-index or restore it.');
+        await expect(testConnection('/data/torn.db')).rejects.toThrow('DB_CORRUPT: torn.db is corrupt (integrity check failed');
+        await expect(testConnection('/data/good.db')).resolves.toBeUndefined();
+        expect(listDatabaseNames()).toEqual(['good']);
+        expect(renameSync).toHaveBeenCalledWith('/data/bad.db', '/data/bad.db.corrupt');
+        expect(renameSync).toHaveBeenCalledTimes(2);
+
+        // A corrupt error that quick_check does not confirm is reported but the file stays put.
+        const warn = vi.spyOn(console, 'warn').mockImplementation(() => undefined);
+        await expect(exportChunks('/data/flaky.db', 0, 10)).rejects.toThrow('Chunk export failed: DB_CORRUPT: flaky.db is corrupt (database disk image is malformed).');
+        expect(renameSync).toHaveBeenCalledTimes(2);
+        expect(listDatabaseNames()).toEqual(['good']);
+        warn.mockRestore();
+
+        rescanDatabases();
+        expect(listDatabaseNames()).toEqual(['bad', 'flaky', 'good', 'torn']);
+        expect(isSqliteCorruptError(new Error('database disk image is malformed'))).toBe(true);
+        expect(isSqliteCorruptError(Object.assign(new Error('locked'), { code: 'SQLITE_BUSY' }))).toBe(false);
+        error.mockRestore();
+    });
+
+    it('reads the stored vector dimension and columns of vec_items', async () => {
+        const sqliteVec = { load: vi.fn() };
+        const fs = { existsSync: vi.fn(() => true), readdirSync: vi.fn(() => ['b.db', 'notes.txt', 'a.db']) };
+        let opens = 0;
+        class FakeDb {
+            constructor() {
+                opens++;
+            }
+            prepare(sql: string) {
+                return {
+                    all: () => sql.startsWith('PRAGMA table_info')
+                        ? [{ name: 'embedding' }, { name: 'content' }]
+                        : [{ sql: 'CREATE VIRTUAL TABLE vec_items USING vec0(embedding FLOAT[1536], content TEXT)' }],
+                };
+            }
+            close() {
+                return undefined;
+            }
+        }
+
+        const { getStoredDimension, getColumns, listDatabaseNames } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec,
+            Database: FakeDb as any,
+            fs,
+            path,
+        });
+
+        expect(listDatabaseNames()).toEqual(['a', 'b']);
+        expect(await getStoredDimension('/data/a.db')).toBe(1536);
+        expect(await getStoredDimension('/data/a.db')).toBe(1536);
+        expect(opens).toBe(1);
+        expect(await getColumns('/data/a.db')).toEqual(['embedding', 'content']);
+        expect(parseVectorDimension('CREATE VIRTUAL TABLE vec_items USING vec0(content TEXT)')).toBeUndefined();
+    });
+
+    it('uses the products manifest instead of scanning the directory', () => {
+        const fs = { existsSync: vi.fn(() => true), readdirSync: vi.fn(() => ['a.db', 'unlisted.db']) };
+        const { listDatabaseNames, resolveDbPath, getProductInfo } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec: { load: vi.fn() },
+            Database: class {} as any,
+            fs,
+            path,
+            productsManifest: [
+                { name: 'kubernetes', db: 'k8s-docs.db', displayName: 'Kubernetes' },
+                { name: 'istio', db: '/mnt/shared/istio.db' },
+            ],
+        });
+
+        expect(listDatabaseNames()).toEqual(['kubernetes', 'istio']);
+        expect(fs.readdirSync).not.toHaveBeenCalled();
+        expect(resolveDbPath(undefined, 'kubernetes')).toEqual({ dbPath: '/data/k8s-docs.db', dbLabel: 'k8s-docs.db' });
+        expect(resolveDbPath(undefined, 'istio').dbPath).toBe('/mnt/shared/istio.db');
+        expect(() => resolveDbPath(undefined, 'unlisted')).toThrow('not listed in products.json');
+        expect(() => resolveDbPath('unlisted')).toThrow('Unknown product database "unlisted.db": it is not listed in products.json.');
+        expect(() => resolveDbPath('/etc/unlisted.db')).toThrow('not listed in products.json');
+        expect(resolveDbPath('k8s-docs')).toEqual({ dbPath: '/data/k8s-docs.db', dbLabel: 'k8s-docs.db' });
+        expect(getProductInfo('kubernetes')?.displayName).toBe('Kubernetes');
+    });
+
+    it('refuses databases whose vec_items_info records a byte order other than the host\'s', async () => {
+        const bound: ArrayBufferView[] = [];
+        const otherOrder = HOST_BYTE_ORDER === 'little' ? 'big' : 'little';
+        let recordedOrder: string = otherOrder;
+        let stat = { ino: 1, size: 100, mtimeMs: 1000 };
+        class FakeDb {
+            prepare(query: string) {
+                if (query.includes('vec_items_info')) {
+                    return { all: () => [{ value: recordedOrder }] };
+                }
+                return {
+                    all: (params?: { query_embedding?: ArrayBufferView }) => {
+                        if (params?.query_embedding) {
+                            bound.push(params.query_embedding);
+                        }
+                        return [{ chunk_id: '1', distance: 0.1, content: 'ok' }];
+                    },
+                };
+            }
+            close() {
+                return undefined;
+            }
+        }
+        const warn = vi.spyOn(console, 'warn').mockImplementation(() => undefined);
+        const { queryCollection } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec: { load: vi.fn() },
+            Database: FakeDb as any,
+            fs: { existsSync: () => true, statSync: () => stat },
+            path,
+            vectorByteOrder: HOST_BYTE_ORDER,
+        });
+
+        await expect(queryCollection([1.5], '/data/a.db', {}, 1)).rejects.toThrow(`a.db stores ${otherOrder}-endian vectors, but sqlite-vec reads vectors in this host's ${HOST_BYTE_ORDER}-endian order`);
+        await expect(queryCollection([1.5], '/data/a.db', {}, 1)).rejects.toThrow('Re-index it');
+        expect(bound).toHaveLength(0);
+        expect(warn).toHaveBeenCalledTimes(1);
+        expect(warn).toHaveBeenCalledWith(expect.stringContaining(`records ${otherOrder}-endian vectors`));
+        warn.mockRestore();
+
+        // Replaced by a file written in host order: the cached byte order is not reused.
+        recordedOrder = HOST_BYTE_ORDER;
+        stat = { ino: 2, size: 100, mtimeMs: 1000 };
+        await expect(queryCollection([1.5], '/data/a.db', {}, 1)).resolves.toHaveLength(1);
+        expect(bound).toHaveLength(1);
+    });
+
+    it('quantizes query vectors for databases that store int8 vectors', async () => {
+        const bound: ArrayBufferView[] = [];
+        const queries: string[] = [];
+        let tableSql = 'CREATE VIRTUAL TABLE vec_items USING vec0(embedding int8[3], chunk_id TEXT)';
+        let stat = { ino: 1, size: 100, mtimeMs: 1000 };
+        class FakeDb {
+            prepare(query: string) {
+                queries.push(query);
+                if (query.includes('sqlite_master')) {
+                    return { all: () => [{ sql: tableSql }] };
+                }
+                return {
+                    all: (params?: { query_embedding?: ArrayBufferView }) => {
+                        if (params?.query_embedding) {
+                            bound.push(params.query_embedding);
+                        }
+                        return [{ chunk_id: '1', distance: 0.1, content: 'ok' }];
+                    },
+                };
+            }
+            close() {
+                return undefined;
+            }
+        }
+        const warn = vi.spyOn(console, 'warn').mockImplementation(() => undefined);
+        const { queryCollection } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec: { load: vi.fn() },
+            Database: FakeDb as any,
+            fs: { existsSync: () => true, statSync: () => stat },
+            path,
+        });
+
+        await queryCollection([-1, 0, 1], '/data/a.db', {}, 1);
+        expect(bound[0]).toBeInstanceOf(Int8Array);
+        expect(Array.from(bound[0] as Int8Array)).toEqual([-128, 0, 127]);
+        expect(queries.some((query) => query.includes('MATCH vec_int8(@query_embedding)'))).toBe(true);
+        expect(warn).toHaveBeenCalledWith(expect.stringContaining("quantization 'int8'; using that instead of VECTOR_QUANTIZATION=none"));
+        warn.mockRestore();
+
+        // Re-indexed in place as float32: the changed file is no longer queried as int8.
+        tableSql = 'CREATE VIRTUAL TABLE vec_items USING vec0(embedding float[3], chunk_id TEXT)';
+        stat = { ino: 1, size: 200, mtimeMs: 2000 };
+        await queryCollection([-1, 0, 1], '/data/a.db', {}, 1);
+        expect(bound[1]).toBeInstanceOf(Float32Array);
+
+        expect(Array.from(quantizeInt8([-2, -0.5, 0.5, 2]))).toEqual([-128, -64, 63, 127]);
+        expect(toEmbeddingVector([0.5], 0, 'int8')).toBeInstanceOf(Int8Array);
+    });
+
+    it('inspects a database for validate_database without throwing on failures', async () => {
+        class FakeDb {
+            prepare(query: string) {
+                if (query.includes('vec_version')) {
+                    return { all: () => [{ version: 'v0.1.6' }] };
+                }
+                if (query.includes('sqlite_master')) {
+                    return { all: () => [{ sql: 'CREATE VIRTUAL TABLE vec_items USING vec0(embedding FLOAT[768], chunk_id TEXT, content TEXT, url TEXT)' }] };
+                }
+                if (query.includes('table_info')) {
+                    return { all: () => [{ name: 'embedding' }, { name: 'chunk_id' }, { name: 'content' }, { name: 'url' }] };
+                }
+                return { all: () => [{ count: 42 }] };
+            }
+            close() {
+                return undefined;
+            }
+        }
+        const { inspectDatabase } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec: { load: vi.fn() },
+            Database: FakeDb as any,
+            fs: { existsSync: (file: string) => file === '/data/a.db' },
+            path,
+        });
+
+        expect(await inspectDatabase('/data/a.db')).toEqual({
+            exists: true,
+            vecVersion: 'v0.1.6',
+            dimension: 768,
+            rowCount: 42,
+            columns: ['embedding', 'chunk_id', 'content', 'url'],
+        });
+        expect(await inspectDatabase('/data/missing.db')).toEqual({ exists: false, columns: [] });
+
+        const { inspectDatabase: withoutVec } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec: { load: vi.fn(() => { throw new Error('extension not found'); }) },
+            Database: FakeDb as any,
+            fs: { existsSync: () => true },
+            path,
+        });
+        const inspection = await withoutVec('/data/a.db');
+        expect(inspection.vecError).toBe('extension not found');
+        expect(inspection.rowCount).toBeUndefined();
+        expect(inspection.dimension).toBe(768);
+    });
+
+    it('serves the product list from the last rescan and forgets deleted databases', async () => {
+        let files = ['a.db', 'b.db'];
+        const fs = {
+            existsSync: vi.fn((file: string) => files.includes(file.replace('/data/', ''))),
+            readdirSync: vi.fn(() => files),
+        };
+        class FakeDb {
+            prepare() {
+                return { all: () => [] };
+            }
+            close() {
+                return undefined;
+            }
+        }
+        const { listDatabaseNames, rescanDatabases, queryCollection, getDatabaseStats } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec: { load: vi.fn() },
+            Database: FakeDb as any,
+            fs,
+            path,
+        });
+
+        expect(rescanDatabases()).toEqual({ added: ['a', 'b'], removed: [] });
+        await queryCollection([0.1], '/data/b.db', {}, 1);
+        expect(getDatabaseStats().map((stats) => stats.dbPath)).toEqual(['/data/b.db']);
+
+        files = ['a.db', 'c.db'];
+        expect(listDatabaseNames()).toEqual(['a', 'b']);
+        expect(rescanDatabases()).toEqual({ added: ['c'], removed: ['b'] });
+        expect(listDatabaseNames()).toEqual(['a', 'c']);
+        expect(getDatabaseStats()).toEqual([]);
+    });
+
+    it('re-reads cached per-file metadata when the database file changes on disk', async () => {
+        let stat = { ino: 1, size: 100, mtimeMs: 1000 };
+        let versions = ['1.0'];
+        const fs = { existsSync: vi.fn(() => true), statSync: vi.fn(() => stat) };
+        class FakeDb {
+            prepare(query: string) {
+                if (query.startsWith('PRAGMA table_info')) {
+                    return { all: () => [{ name: 'version' }] };
+                }
+                return { all: () => versions.map((version) => ({ version })) };
+            }
+            close() {
+                return undefined;
+            }
+        }
+        const { getLatestVersion, checkDatabaseFiles } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec: { load: vi.fn() },
+            Database: FakeDb as any,
+            fs,
+            path,
+        });
+
+        expect(await getLatestVersion('/data/a.db')).toBe('1.0');
+        versions = ['1.0', '2.0'];
+        expect(await getLatestVersion('/data/a.db')).toBe('1.0');
+        expect(checkDatabaseFiles()).toEqual([]);
+
+        stat = { ino: 2, size: 100, mtimeMs: 1000 };
+        expect(checkDatabaseFiles()).toEqual(['/data/a.db']);
+        expect(await getLatestVersion('/data/a.db')).toBe('2.0');
+
+        versions = ['3.0'];
+        stat = { ino: 2, size: 120, mtimeMs: 2000 };
+        expect(await getLatestVersion('/data/a.db')).toBe('3.0');
+    });
+
+    it('tracks per-database query statistics', async () => {
+        const sqliteVec = { load: vi.fn() };
+        const fs = { existsSync: vi.fn(() => true) };
+        class FakeDb {
+            prepare(query: string) {
+                if (query.includes('sqlite_master')) {
+                    return {
+                        all: () => [{ sql: 'CREATE VIRTUAL TABLE vec_items USING vec0(embedding float[768] distance_metric=cosine)' }],
+                    };
+                }
+                return { all: () => [{ chunk_id: '1', distance: 0.1, content: 'ok' }] };
+            }
+            close() {
+                return undefined;
+            }
+        }
+
+        const { queryCollection, getDatabaseStats } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec,
+            Database: FakeDb,
+            fs,
+            path,
+        });
+
+        await queryCollection([0.1], '/data/a.db', {}, 1);
+        await queryCollection([0.1], '/data/a.db', {}, 1);
+
+        const [stats] = getDatabaseStats();
+        expect(stats.dbPath).toBe('/data/a.db');
+        expect(stats.queryCount).toBe(2);
+        expect(stats.dimension).toBe(768);
+        expect(stats.distanceMetric).toBe('cosine');
+    });
+
+    it('opens databases read-only and retries searches while the database is busy', async () => {
+        const sqliteVec = { load: vi.fn() };
+        const fs = { existsSync: vi.fn(() => true) };
+        const openOptions: unknown[] = [];
+        let busyAttempts = 2;
+        let busyOpens = 0;
+        class FakeDb {
+            constructor(_path: string, options?: unknown) {
+                openOptions.push(options);
+                if (busyOpens-- > 0) {
+                    throw Object.assign(new Error('database is locked'), { code: 'SQLITE_BUSY' });
+                }
+            }
+            prepare() {
+                return {
+                    all: () => {
+                        if (busyAttempts-- > 0) {
+                            throw Object.assign(new Error('database is locked'), { code: 'SQLITE_BUSY' });
+                        }
+                        return [{ chunk_id: '1', distance: 0.1, content: 'ok' }];
+                    },
+                };
+            }
+            close() {
+                return undefined;
+            }
+        }
+
+        const { queryCollection } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec,
+            Database: FakeDb as any,
+            fs,
+            path,
+            busyTimeoutMs: 250,
+            busyRetries: 2,
         });
 
-        const response = await queryDocumentationToolHandler({
-            queryText: 'test',
-            limit: 2,
+        await expect(queryCollection([0.1], '/data/a.db', {}, 4)).resolves.toHaveLength(1);
+        expect(openOptions).toHaveLength(3);
+        expect(openOptions[0]).toEqual({ readonly: true, fileMustExist: true, timeout: 250 });
+
+        busyAttempts = 5;
+        const busyFailure = await queryCollection([0.1], '/data/a.db', {}, 4).catch((error: Error) => error);
+        expect(busyFailure).toBeInstanceOf(Error);
+        expect((busyFailure as Error).message.startsWith('Database query failed: a.db is busy')).toBe(true);
+        expect((busyFailure as { code?: string }).code).toBe('BUSY');
+        expect(httpStatusForResponse({ jsonrpc: '2.0', id: 1, result: toolError(`Error querying documentation: ${(busyFailure as Error).message}`, toolErrorKind(busyFailure)) })).toBe(429);
+
+        // A busy open is retried by the busy loop alone, not by the open retries as well.
+        openOptions.length = 0;
+        busyAttempts = 0;
+        busyOpens = 10;
+        await expect(queryCollection([0.1], '/data/a.db', {}, 4)).rejects.toThrow('a.db is busy');
+        expect(openOptions).toHaveLength(3);
+        expect(isTransientOpenError({ code: 'SQLITE_BUSY' })).toBe(false);
+    });
+
+    it('logs per-query connection details only at debug level', async () => {
+        const error = vi.spyOn(console, 'error').mockImplementation(() => undefined);
+        class FakeDb {
+            prepare() {
+                return { all: () => [{ chunk_id: '1', distance: 0.1, content: 'ok' }] };
+            }
+            close() {
+                return undefined;
+            }
+        }
+        const provider = (level: 'debug' | 'info' | 'error') => createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec: { load: vi.fn() },
+            Database: FakeDb as any,
+            fs: { existsSync: vi.fn(() => true) },
+            path,
+            logger: createLogger(level),
         });
+        const lines = () => error.mock.calls.map((call) => String(call[0]));
 
-        expect(response.content[0].text).toContain('Provide either productName or dbName');
+        await provider('info').queryCollection([0.1], '/data/a.db', {}, 4);
+        expect(lines().some((line) => line.includes('Opened connection'))).toBe(false);
+        expect(lines().filter((line) => line.includes('Query executed'))).toHaveLength(1);
+
+        error.mockClear();
+        await provider('debug').queryCollection([0.1], '/data/a.db', {}, 4);
+        expect(lines().some((line) => line.includes('Opened connection'))).toBe(true);
+        expect(lines().some((line) => line.includes('Query prepared'))).toBe(true);
+
+        error.mockClear();
+        await provider('error').queryCollection([0.1], '/data/a.db', {}, 4);
+        expect(lines()).toEqual([]);
+        error.mockRestore();
     });
 
-    it('filters empty content and url prefix in queryDocumentation', async () => {
-        const collectionResults = [
-            { chunk_id: '1', distance: 0.1, content: 'ok', url: 'https://docs.example.com/a' },
-            { chunk_id: '2', distance: 0.2, content: '', url: 'https://docs.example.com/a' },
-            { chunk_id: '3', distance: 0.3, content: 'ok', url: 'https://other.example.com/b' },
-        ];
+    it('retries transient open failures but not missing files', async () => {
+        const sqliteVec = { load: vi.fn() };
+        const fs = { existsSync: vi.fn(() => true) };
+        let failedOpens = 1;
+        class FakeDb {
+            constructor() {
+                if (failedOpens-- > 0) {
+                    throw Object.assign(new Error('disk I/O error'), { code: 'SQLITE_IOERR_READ' });
+                }
+            }
+            prepare() {
+                return { all: () => [{ chunk_id: '1', distance: 0.1, content: 'ok' }] };
+            }
+            close() {
+                return undefined;
+            }
+        }
 
-        const { queryDocumentation } = createQueryHandlers({
-            createEmbeddings,
-            resolveDbPath,
-            queryCollection: vi.fn(async () => collectionResults),
-            getChunksForDocument,
+        const { queryCollection } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec,
+            Database: FakeDb as any,
+            fs,
+            path,
+            openRetries: 1,
         });
 
-        const results = await queryDocumentation('test', 'product', undefined, undefined, 'https://docs.example.com/', 4);
-        expect(results).toHaveLength(1);
-        expect(results[0].content).toBe('ok');
+        await expect(queryCollection([0.1], '/data/a.db', {}, 4)).resolves.toHaveLength(1);
+
+        failedOpens = 1;
+        fs.existsSync.mockImplementationOnce(() => true).mockImplementationOnce(() => false);
+        await expect(queryCollection([0.1], '/data/a.db', {}, 4)).rejects.toThrow('Database file not found');
+        expect(isTransientOpenError({ code: 'ENOENT' })).toBe(false);
     });
 
-    it('returns empty-content warning for query_code when all matches are empty', async () => {
-        const { queryCodeToolHandler } = createQueryHandlers({
-            createEmbeddings,
-            resolveDbPath,
-            queryCollection: vi.fn(async () => [
-                { chunk_id: '1', distance: 0.1, content: '' },
-                { chunk_id: '2', distance: 0.2, content: '  ' },
-            ]),
-            getChunksForDocument,
-        });
+    it('retries with fuzzy version matches when the exact version has no rows', async () => {
+        const sqliteVec = { load: vi.fn() };
+        const fs = { existsSync: vi.fn(() => true) };
+        class FakeDb {
+            prepare(query: string) {
+                if (query.includes('DISTINCT version')) {
+                    return { all: () => [{ version: '1.29.0' }, { version: 'v1.29' }, { version: '1.30.0' }] };
+                }
+                return {
+                    all: (params: { version?: string }) => (params.version === '1.29.0'
+                        ? [{ chunk_id: '1', distance: 0.2, content: 'exact-ish' }]
+                        : []),
+                };
+            }
+            close() {
+                return undefined;
+            }
+        }
 
-        const response = await queryCodeToolHandler({
-            queryText: 'test',
-            dbName: 'repo',
-            limit: 3,
+        const { queryCollection } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec,
+            Database: FakeDb as any,
+            fs,
+            path,
+            fuzzyVersionFallback: true,
         });
 
-        expect(response.content[0].text).toContain('all matching chunks have empty content');
+        const rows = await queryCollection([0.1], '/data/a.db', { version: '1.29' }, 4);
+        expect(rows).toHaveLength(1);
+        expect(rows[0].matched_version).toBe('1.29.0');
+
+        expect(fuzzyVersionMatches('1.29', 'v1.29')).toBe(true);
+        expect(fuzzyVersionMatches('v1.29.3', '1.29.0')).toBe(true);
+        expect(fuzzyVersionMatches('1.29', '1.290')).toBe(false);
     });
 
-    it('formats get_chunks results with chunk index', async () => {
-        const { getChunksToolHandler } = createQueryHandlers({
-            createEmbeddings,
-            resolveDbPath,
-            queryCollection,
-            getChunksForDocument: vi.fn(async () => [
-                {
-                    chunk_id: '1',
-                    distance: 0,
-                    content: 'chunk content',
-                    url: 'file://doc',
-                    chunk_index: 0,
-                    total_chunks: 2,
-                },
-            ]),
+    it('excludes chunk IDs in the vector query and pads k by the exclusion count', async () => {
+        const sqliteVec = { load: vi.fn() };
+        const fs = { existsSync: vi.fn(() => true) };
+        const queries: Array<{ query: string; params: Record<string, unknown> }> = [];
+        class FakeDb {
+            prepare(query: string) {
+                if (query.startsWith('PRAGMA table_info')) {
+                    return { all: () => ['embedding', 'chunk_id', 'content'].map((name) => ({ name })) };
+                }
+                return {
+                    all: (params: Record<string, unknown>) => {
+                        queries.push({ query, params });
+                        return [
+                            { chunk_id: '3', distance: 0.1, content: 'a' },
+                            { chunk_id: '4', distance: 0.2, content: 'b' },
+                            { chunk_id: '5', distance: 0.3, content: 'c' },
+                        ];
+                    },
+                };
+            }
+            close() {
+                return undefined;
+            }
+        }
+
+        const { queryCollection } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec,
+            Database: FakeDb as any,
+            fs,
+            path,
         });
 
-        const response = await getChunksToolHandler({
-            productName: 'product',
-            filePath: 'file://doc',
+        const rows = await queryCollection([0.1], '/data/a.db', { excludeChunkIds: ['1', '2'] }, 2);
+        expect(rows.map((row) => row.chunk_id)).toEqual(['3', '4']);
+        const vectorQuery = queries.find(({ query }) => query.includes('MATCH'));
+        expect(vectorQuery?.query).toContain('chunk_id NOT IN (@exclude_0, @exclude_1)');
+        expect(vectorQuery?.query).toContain('ORDER BY distance, chunk_id');
+        expect(vectorQuery?.params).toMatchObject({ top_k: 4, exclude_0: '1', exclude_1: '2' });
+    });
+
+    it('skips filters on columns missing from minimal schemas', async () => {
+        const sqliteVec = { load: vi.fn() };
+        const fs = { existsSync: vi.fn(() => true) };
+        const queries: string[] = [];
+        class FakeDb {
+            prepare(query: string) {
+                queries.push(query);
+                if (query.startsWith('PRAGMA table_info')) {
+                    return { all: () => [{ name: 'embedding' }, { name: 'chunk_id' }, { name: 'content' }, { name: 'url' }] };
+                }
+                return { all: () => [{ chunk_id: '1', distance: 0.1, content: 'ok' }] };
+            }
+            close() {
+                return undefined;
+            }
+        }
+        const warn = vi.spyOn(console, 'warn').mockImplementation(() => undefined);
+
+        const { queryCollection } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec,
+            Database: FakeDb as any,
+            fs,
+            path,
         });
 
-        expect(response.content[0].text).toContain('Chunk 1 of 2');
+        await expect(queryCollection([0.1], '/data/a.db', { product_name: 'p', version: '1.0' }, 2)).resolves.toHaveLength(1);
+        const vectorQuery = queries.find((query) => query.includes('MATCH')) ?? '';
+        expect(vectorQuery).not.toContain('product_name =');
+        expect(vectorQuery).not.toContain('version =');
+        expect(warn).toHaveBeenCalledWith(expect.stringContaining('no "version" column'));
+        warn.mockRestore();
+
+        expect(applicableFilter({ version: '1.0', excludeChunkIds: ['1'] }, ['version'])).toEqual({ filter: { version: '1.0' }, dropped: ['chunk_id'] });
+        expect(applicableFilter({ version: '1.0' }, [])).toEqual({ filter: { version: '1.0' }, dropped: [] });
     });
-});
 
-describe('SQLite provider compatibility', () => {
-    it('falls back when chunk_index column is missing', async () => {
+    it('breaks distance ties by chunk_id only when vec_items has that column', async () => {
         const sqliteVec = { load: vi.fn() };
         const fs = { existsSync: vi.fn(() => true) };
+        const vectorQueryFor = async (columns: string[]) => {
+            const queries: string[] = [];
+            class FakeDb {
+                prepare(query: string) {
+                    queries.push(query);
+                    if (query.startsWith('PRAGMA table_info')) {
+                        return { all: () => columns.map((name) => ({ name })) };
+                    }
+                    return { all: () => [{ rowid: 1, distance: 0.1, content: 'ok' }] };
+                }
+                close() {
+                    return undefined;
+                }
+            }
+            const { queryCollection } = createSqliteDbProvider({ dbDir: '/data', sqliteVec, Database: FakeDb as any, fs, path });
+            await expect(queryCollection([0.1], '/data/a.db', {}, 2)).resolves.toHaveLength(1);
+            return queries.find((query) => query.includes('MATCH')) ?? '';
+        };
+
+        expect(await vectorQueryFor(['embedding', 'chunk_id', 'content', 'url'])).toContain('ORDER BY distance, chunk_id;');
+        const minimal = await vectorQueryFor(['embedding', 'content', 'url']);
+        expect(minimal).toContain('ORDER BY distance, rowid;');
+        expect(minimal).not.toContain('chunk_id');
+    });
 
+    it('trims filter values and matches stored values ignoring case when enabled', async () => {
+        const sqliteVec = { load: vi.fn() };
+        const fs = { existsSync: vi.fn((file: string) => file !== '/data/kubernetes.db') };
+        const searches: Array<Record<string, unknown>> = [];
         class FakeDb {
             prepare(query: string) {
-                if (query.includes('chunk_index')) {
-                    return {
-                        all: () => {
-                            throw new Error('no such column: chunk_index');
-                        },
-                    };
+                if (query.startsWith('PRAGMA table_info')) {
+                    return { all: () => ['embedding', 'chunk_id', 'content', 'product_name', 'version'].map((name) => ({ name })) };
+                }
+                if (query.includes('DISTINCT product_name')) {
+                    return { all: () => [{ value: 'Kubernetes' }, { value: 'istio' }] };
+                }
+                if (query.includes('DISTINCT version')) {
+                    return { all: () => [{ value: 'v1.30' }, { value: null }] };
+                }
+                return {
+                    all: (params: Record<string, unknown>) => {
+                        if (query.includes('MATCH')) {
+                            searches.push(params);
+                        }
+                        return [{ chunk_id: '1', distance: 0.1, content: 'ok' }];
+                    },
+                };
+            }
+            close() {
+                return undefined;
+            }
+        }
+        const provider = (caseInsensitiveFilters: boolean) => createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec,
+            Database: FakeDb as any,
+            fs: { ...fs, readdirSync: () => ['Kubernetes.db', 'istio.db'] },
+            path,
+            caseInsensitiveFilters,
+        });
+
+        await provider(false).queryCollection([0.1], '/data/a.db', { product_name: ' kubernetes ', version: 'V1.30 ' }, 2);
+        expect(searches[0]).toMatchObject({ product_name: 'kubernetes', version: 'V1.30' });
+
+        const { queryCollection, resolveDbPath } = provider(true);
+        await queryCollection([0.1], '/data/a.db', { product_name: ' kubernetes ', version: 'V1.30 ' }, 2);
+        expect(searches[1]).toMatchObject({ product_name: 'Kubernetes', version: 'v1.30' });
+        expect(resolveDbPath(undefined, ' kubernetes').dbPath).toBe('/data/Kubernetes.db');
+
+        expect(matchStoredValue('Istio', ['istio', 'ISTIO'])).toBe('istio');
+        expect(matchStoredValue('ISTIO', ['istio', 'ISTIO'])).toBe('ISTIO');
+        expect(matchStoredValue('linkerd', ['istio'])).toBeUndefined();
+    });
+
+    it('opens products mapped to SQLite URIs and validates the URIs', async () => {
+        const opened: string[] = [];
+        const fs = { existsSync: vi.fn((file: string) => file === '/mnt/k8s.db'), readdirSync: () => ['istio.db'] };
+        class FakeDb {
+            constructor(dbPath: string) {
+                opened.push(dbPath);
+            }
+            prepare() {
+                return { all: () => [{ chunk_id: '1', distance: 0.1, content: 'ok' }] };
+            }
+            close() {
+                return undefined;
+            }
+        }
+        const uri = 'file:/mnt/k8s.db?vfs=unix-dotfile&cache=shared';
+        const { resolveDbPath, queryCollection, listDatabaseNames } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec: { load: vi.fn() },
+            Database: FakeDb as any,
+            fs,
+            path,
+            databaseUris: parseDatabaseUris(JSON.stringify({ kubernetes: uri })),
+        });
+
+        expect(resolveDbPath(undefined, 'kubernetes')).toEqual({ dbPath: uri, dbLabel: 'k8s.db' });
+        expect(resolveDbPath(undefined, 'istio').dbPath).toBe('/data/istio.db');
+        expect(listDatabaseNames()).toEqual(['istio', 'kubernetes']);
+        await expect(queryCollection([0.1], uri, {}, 1)).resolves.toHaveLength(1);
+        expect(opened).toEqual([uri]);
+        expect(fs.existsSync).toHaveBeenCalledWith('/mnt/k8s.db');
+
+        expect(sqliteFilePath('file:///mnt/a%20b.db?mode=ro')).toBe('/mnt/a b.db');
+        expect(sqliteFilePath('file://localhost/mnt/a.db')).toBe('/mnt/a.db');
+        expect(sqliteFilePath('/data/a.db')).toBe('/data/a.db');
+        expect(calibrationSidecarPath(uri)).toBe('/mnt/k8s.calibration.json');
+        expect(() => parseDatabaseUris('{"k8s": "/data/k8s.db"}')).toThrow('must be a SQLite file: URI');
+        expect(() => parseDatabaseUris('{"k8s": "file:/data/k8s.db?mode=rwc"}')).toThrow('only mode=ro is allowed');
+        expect(() => parseDatabaseUris('{"k8s": "file:/data/k8s.db?vsf=unix"}')).toThrow('unknown parameter "vsf"');
+        expect(() => parseDatabaseUris('[]')).toThrow('must be a JSON object');
+    });
+
+    it('scores stored sparse vectors and requires the sparse column', async () => {
+        const sqliteVec = { load: vi.fn() };
+        let mtimeMs = 1;
+        const fs = { existsSync: vi.fn(() => true), statSync: vi.fn(() => ({ ino: 1, size: 1, mtimeMs })) };
+        const queries: string[] = [];
+        let columns = ['embedding', 'chunk_id', 'content', 'product_name', 'sparse_embedding'];
+        class FakeDb {
+            prepare(query: string) {
+                queries.push(query);
+                if (query.startsWith('PRAGMA table_info')) {
+                    return { all: () => columns.map((name) => ({ name })) };
                 }
                 return {
                     all: () => [
-                        {
-                            chunk_id: '1',
-                            content: 'ok',
-                            url: 'file://doc',
-                            section: 's',
-                            heading_hierarchy: 'h',
-                        },
+                        { chunk_id: '1', content: 'a', sparse_embedding: '{"pod":1,"scaling":1}' },
+                        { chunk_id: '2', content: 'b', sparse_embedding: '{"pod":2}' },
+                        { chunk_id: '3', content: 'c', sparse_embedding: '{"network":5}' },
                     ],
                 };
             }
+            close() {
+                return undefined;
+            }
+        }
+
+        const { sparseSearch } = createSqliteDbProvider({
+            dbDir: '/data',
+            sqliteVec,
+            Database: FakeDb as any,
+            fs,
+            path,
+        });
+
+        const rows = await sparseSearch({ pod: 1, scaling: 3 }, '/data/a.db', { product_name: 'p' }, 5);
+        expect(rows.map((row) => [row.chunk_id, row.distance])).toEqual([['1', 0], ['2', 0.5]]);
+        expect(rows[0]).not.toHaveProperty('sparse_embedding');
+        const scan = queries.find((query) => query.includes('FROM vec_items WHERE')) ?? '';
+        expect(scan).not.toContain('embedding,');
+        expect(scan).toContain('product_name = ?');
+        expect(scan).toContain('LIMIT ?');
+        await sparseSearch({ pod: 1 }, '/data/a.db', { product_name: 'p' }, 5);
+        expect(queries.filter((query) => query.startsWith('PRAGMA table_info'))).toHaveLength(1);
 
+        const warn = vi.spyOn(console, 'warn').mockImplementation(() => undefined);
+        const capped = createSqliteDbProvider({ dbDir: '/data', sqliteVec, Database: FakeDb as any, fs, path, sparseMaxScanRows: 2 });
+        const cappedRows = await capped.sparseSearch({ network: 1 }, '/data/a.db', {}, 5);
+        expect(cappedRows).toEqual([]);
+        expect(warn).toHaveBeenCalledWith(expect.stringContaining('Sparse search scored only the first 2 matching rows'));
+        warn.mockRestore();
+
+        columns = ['embedding', 'chunk_id', 'content'];
+        mtimeMs = 2;
+        await expect(sparseSearch({ pod: 1 }, '/data/a.db', {}, 5)).rejects.toThrow('no "sparse_embedding" column');
+    });
+
+    it('drops BLOB columns so binary data never reaches text fields', async () => {
+        const sqliteVec = { load: vi.fn() };
+        const fs = { existsSync: vi.fn(() => true) };
+        class FakeDb {
+            prepare() {
+                return {
+                    all: () => [
+                        { chunk_id: '1', distance: 0.1, content: 'ok', title_vector: Buffer.from([1, 2, 3]) },
+                        { chunk_id: '2', distance: 0.2, content: Buffer.from('blob'), url: new Float32Array([0.5]) },
+                    ],
+                };
+            }
             close() {
                 return undefined;
             }
         }
 
-        const { getChunksForDocument } = createSqliteDbProvider({
+        const { queryCollection } = createSqliteDbProvider({
             dbDir: '/data',
             sqliteVec,
-            Database: FakeDb,
+            Database: FakeDb as any,
             fs,
             path,
         });
 
-        const results = await getChunksForDocument('product', undefined, 'file://doc', 0, 1, '1.0');
-        expect(results).toHaveLength(1);
-        expect(results[0].content).toBe('ok');
+        const rows = await queryCollection([0.1], '/data/a.db', {}, 2);
+        expect(rows[0]).not.toHaveProperty('title_vector');
+        expect(rows[1].content).toBe('');
+        expect(rows[1]).not.toHaveProperty('url');
+        expect(filterResultsWithContent(rows).map((row) => row.chunk_id)).toEqual(['1']);
+        expect(dropBlobColumns({ content: 'text', count: 3 })).toEqual({ content: 'text', count: 3 });
     });
 
     it('resolves db paths with normalized extension', () => {
@@ -206,6 +3008,55 @@ describe('SQLite provider compatibility', () => {
         expect(resolved.dbPath).toBe(path.join('/data', 'my-db.db'));
         expect(resolved.dbLabel).toBe('my-db.db');
     });
+
+    it('exports chunks by keyset paging on rowid', async () => {
+        const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'export-chunks-'));
+        const dbPath = path.join(dir, 'product.db');
+        const db = new BetterSqlite3(dbPath);
+        db.exec('CREATE TABLE vec_items (chunk_id TEXT, content TEXT, embedding BLOB)');
+        for (let rowid = 1; rowid <= 5; rowid++) {
+            db.prepare('INSERT INTO vec_items (rowid, chunk_id, content, embedding) VALUES (?, ?, ?, ?)').run(rowid, `c${rowid}`, `chunk ${rowid}`, Buffer.alloc(4));
+        }
+        db.exec('DELETE FROM vec_items WHERE rowid IN (2, 3)');
+        db.close();
+
+        const { exportChunks } = createSqliteDbProvider({ dbDir: dir, sqliteVec: { load: vi.fn() }, Database: BetterSqlite3 as any, fs, path });
+
+        const first = await exportChunks(dbPath, 0, 2);
+        expect(first.rows.map((row) => row.chunk_id)).toEqual(['c1', 'c4']);
+        expect(first.rows[0]).not.toHaveProperty('embedding');
+        expect(first).toMatchObject({ total: 3, hasMore: true });
+
+        const last = await exportChunks(dbPath, 4, 2);
+        expect(last.rows.map((row) => row.chunk_id)).toEqual(['c5']);
+        expect(last.hasMore).toBe(false);
+        fs.rmSync(dir, { recursive: true, force: true });
+    });
+
+    it('keeps reading keyword hits until enough pass the product filter', async () => {
+        const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'keyword-search-'));
+        const dbPath = path.join(dir, 'product.db');
+        const db = new BetterSqlite3(dbPath);
+        db.exec('CREATE TABLE vec_items (chunk_id TEXT, content TEXT, product_name TEXT, embedding BLOB)');
+        db.exec('CREATE VIRTUAL TABLE vec_items_fts USING fts5(chunk_id UNINDEXED, content)');
+        const insert = (chunkId: string, content: string, product: string) => {
+            db.prepare('INSERT INTO vec_items (chunk_id, content, product_name, embedding) VALUES (?, ?, ?, ?)').run(chunkId, content, product, Buffer.alloc(4));
+            db.prepare('INSERT INTO vec_items_fts (chunk_id, content) VALUES (?, ?)').run(chunkId, content);
+        };
+        for (let index = 0; index < 10; index++) {
+            insert(`a${index}`, 'helm helm helm', 'a');
+        }
+        insert('b0', 'helm chart install guide for the b product with more words', 'b');
+        db.close();
+
+        const { keywordSearch } = createSqliteDbProvider({ dbDir: dir, sqliteVec: { load: vi.fn() }, Database: BetterSqlite3 as any, fs, path });
+
+        const rows = await keywordSearch('helm', dbPath, { product_name: 'b' }, 1);
+        expect(rows.map((row) => row.chunk_id)).toEqual(['b0']);
+        expect(rows[0].score_type).toBe('bm25');
+        expect(await keywordSearch('helm', dbPath, { product_name: 'c' }, 1)).toEqual([]);
+        fs.rmSync(dir, { recursive: true, force: true });
+    });
 });
 
 describe('Qdrant provider', () => {
@@ -237,6 +3088,7 @@ describe('Qdrant provider', () => {
         expect(results).toHaveLength(1);
         expect(results[0].content).toBe('Hello Qdrant');
         expect(results[0].distance).toBe(0.42);
+        expect(results[0].provenance_hash).toBe(computeProvenanceHash('TestProduct', 'chunk-1', 'Hello Qdrant'));
         expect(client.search).toHaveBeenCalledWith('my-collection', expect.objectContaining({ limit: 5 }));
     });
 
@@ -276,6 +3128,25 @@ describe('Qdrant provider', () => {
         expect(results.map((r) => r.content)).toEqual(['First', 'Second']);
         expect(client.scroll).toHaveBeenCalledWith('collection', expect.objectContaining({ limit: 1000 }));
     });
+
+    it('follows next_page_offset when fetching chunks by ID', async () => {
+        const point = (id: string, chunkId: string) => ({ id, payload: { chunk_id: chunkId, content: id, url: 'file://doc' } });
+        const client = {
+            search: vi.fn(async () => ({ result: [] })),
+            scroll: vi.fn(async (_collection: string, options: { offset?: string }) =>
+                options.offset === 'page-2'
+                    ? { points: [point('p3', 'b')], next_page_offset: null }
+                    : { points: [point('p1', 'a'), point('p2', 'a')], next_page_offset: 'page-2' }
+            ),
+        };
+
+        const { getChunksByIds } = createQdrantProvider({ client });
+        const results = await getChunksByIds(undefined, 'collection', ['a', 'b']);
+
+        expect(results.map((r) => r.content)).toEqual(['p1', 'p2', 'p3']);
+        expect(client.scroll).toHaveBeenCalledTimes(2);
+        expect(client.scroll.mock.calls[1][1]).toEqual(expect.objectContaining({ limit: 2, offset: 'page-2' }));
+    });
 });
 
 describe('MCP server end-to-end', () => {